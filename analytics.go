@@ -0,0 +1,386 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxTimeseriesBuckets bounds the size of a single timeseries response.
+const maxTimeseriesBuckets = 2000
+
+type TimeseriesBucket struct {
+	Date        string `json:"date"`
+	Views       int    `json:"views"`
+	Clicks      int    `json:"clicks"`
+	Conversions int    `json:"conversions"`
+}
+
+// parseTimeParam accepts RFC3339 timestamps or plain YYYY-MM-DD dates.
+func parseTimeParam(v string) (t time.Time, dateOnly bool, err error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.UTC(), false, nil
+	}
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, true, nil
+	}
+	return time.Time{}, false, fmt.Errorf("invalid time %q, use RFC3339 or YYYY-MM-DD", v)
+}
+
+// parseRange reads the from/to query parameters as a half-open [from, to)
+// range. A date-only "to" includes that whole day. Missing bounds default to
+// the span ending now.
+func parseRange(r *http.Request, defaultSpan time.Duration) (from, to time.Time, err error) {
+	q := r.URL.Query()
+
+	to = time.Now().UTC()
+	if v := q.Get("to"); v != "" {
+		var dateOnly bool
+		if to, dateOnly, err = parseTimeParam(v); err != nil {
+			return from, to, err
+		}
+		if dateOnly {
+			to = to.AddDate(0, 0, 1)
+		}
+	}
+
+	from = to.Add(-defaultSpan)
+	if v := q.Get("from"); v != "" {
+		if from, _, err = parseTimeParam(v); err != nil {
+			return from, to, err
+		}
+	}
+
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+// handleAnalyticsAd dispatches /api/analytics/ad/{id}/{report}.
+func handleAnalyticsAd(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/analytics/ad/"), "/")
+	if len(parts) != 2 {
+		respondError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid ad ID")
+		return
+	}
+
+	switch parts[1] {
+	case "timeseries":
+		handleAdTimeseries(w, r, id)
+	default:
+		respondError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// timeseriesRange is the bucketing of an ad timeseries.
+type timeseriesRange struct {
+	from, to time.Time
+	step     time.Duration
+	goFormat string
+}
+
+// parseTimeseriesRange reads the interval, from and to parameters of a
+// timeseries request, defaulting to daily buckets over the last week.
+func parseTimeseriesRange(r *http.Request) (timeseriesRange, error) {
+	var tr timeseriesRange
+	switch r.URL.Query().Get("interval") {
+	case "", "day":
+		tr.step, tr.goFormat = 24*time.Hour, "2006-01-02"
+	case "hour":
+		tr.step, tr.goFormat = time.Hour, "2006-01-02T15:00:00Z"
+	default:
+		return tr, fmt.Errorf("interval must be day or hour")
+	}
+
+	var err error
+	if tr.from, tr.to, err = parseRange(r, 7*24*time.Hour); err != nil {
+		return tr, err
+	}
+	tr.from = tr.from.Truncate(tr.step)
+	if tr.to.Sub(tr.from)/tr.step > maxTimeseriesBuckets {
+		return tr, fmt.Errorf("range too large, at most %d buckets", maxTimeseriesBuckets)
+	}
+	return tr, nil
+}
+
+func handleAdTimeseries(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	tr, err := parseTimeseriesRange(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var exists int
+	if err := db.QueryRow(`SELECT 1 FROM ads WHERE id = ?`, id).Scan(&exists); err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "ad not found")
+		return
+	} else if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	series, err := adTimeseries(id, tr, trafficCondition(r))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	respondJSON(w, http.StatusOK, series)
+}
+
+// adTimeseries counts an ad's views, clicks and conversions in each bucket
+// of tr, including empty ones. traffic is a trafficCondition.
+func adTimeseries(id int, tr timeseriesRange, traffic string) ([]TimeseriesBucket, error) {
+	rows, err := db.Query(`
+		SELECT
+			`+db.FormatTime("viewed_at", tr.goFormat)+` AS bucket,
+			SUM(views), SUM(clicks), SUM(conversions)
+		FROM (`+impressionCountsSQL+`) i
+		WHERE ad_id = ? AND `+inRangeSQL("viewed_at")+`
+			AND `+traffic+`
+		GROUP BY bucket`,
+		id, tr.from.Format(sqlTimeLayout), tr.to.Format(sqlTimeLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]TimeseriesBucket{}
+	for rows.Next() {
+		var b TimeseriesBucket
+		if err := rows.Scan(&b.Date, &b.Views, &b.Clicks, &b.Conversions); err != nil {
+			continue
+		}
+		counts[b.Date] = b
+	}
+
+	series := []TimeseriesBucket{}
+	for t := tr.from; t.Before(tr.to); t = t.Add(tr.step) {
+		key := t.Format(tr.goFormat)
+		b, ok := counts[key]
+		if !ok {
+			b = TimeseriesBucket{Date: key}
+		}
+		series = append(series, b)
+	}
+	return series, nil
+}
+
+// defaultCTRMinViews is the view count an ad or campaign needs before it is
+// ranked by CTR, so a single lucky click doesn't top the board.
+const defaultCTRMinViews = 100
+
+// LeaderboardEntry is one ranked ad or campaign in /api/analytics/top.
+type LeaderboardEntry struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Views  int    `json:"views"`
+	Clicks int    `json:"clicks"`
+	CTR    string `json:"ctr"`
+}
+
+func formatCTR(clicks, views int) string {
+	if views == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%.2f%%", float64(clicks)/float64(views)*100)
+}
+
+// handleTopAds ranks ads, or campaigns when mounted at
+// /api/analytics/top/campaigns, by clicks, views or CTR over a date range.
+func handleTopAds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	q := r.URL.Query()
+	byCampaign := strings.TrimSuffix(r.URL.Path, "/") == "/api/analytics/top/campaigns"
+
+	var orderBy string
+	switch q.Get("metric") {
+	case "", "clicks":
+		orderBy = "clicks DESC, views DESC"
+	case "views":
+		orderBy = "views DESC, clicks DESC"
+	case "ctr":
+		orderBy = "CAST(clicks AS REAL) / views DESC, views DESC"
+	default:
+		respondError(w, http.StatusBadRequest, "metric must be clicks, views or ctr")
+		return
+	}
+
+	limit := 10
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			respondError(w, http.StatusBadRequest, "limit must be between 1 and 100")
+			return
+		}
+		limit = n
+	}
+
+	minViews := 0
+	if q.Get("metric") == "ctr" {
+		minViews = defaultCTRMinViews
+		if v := q.Get("min_views"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				respondError(w, http.StatusBadRequest, "invalid min_views")
+				return
+			}
+			minViews = n
+		}
+		if minViews < 1 {
+			minViews = 1
+		}
+	}
+
+	from, to, err := parseRange(r, 7*24*time.Hour)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var query string
+	if byCampaign {
+		query = `
+		SELECT c.id, c.name, SUM(i.views) AS views, SUM(i.clicks) AS clicks
+		FROM campaigns c
+		JOIN ads a ON a.campaign_id = c.id
+		JOIN (` + impressionTotalsSQL(r) + `) i ON i.ad_id = a.id
+		GROUP BY c.id`
+	} else {
+		query = `
+		SELECT a.id, CASE WHEN a.ad_type = 'image' THEN COALESCE(a.image_url, '') ELSE COALESCE(a.content, '') END,
+			i.views AS views, i.clicks AS clicks
+		FROM ads a
+		JOIN (` + impressionTotalsSQL(r) + `) i ON i.ad_id = a.id`
+	}
+	query = `SELECT * FROM (` + query + `) ranked WHERE views >= ? ORDER BY ` + orderBy + ` LIMIT ?`
+
+	rows, err := db.Query(query, from.Format(sqlTimeLayout), to.Format(sqlTimeLayout), minViews, limit)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer rows.Close()
+
+	entries := []LeaderboardEntry{}
+	for rows.Next() {
+		var e LeaderboardEntry
+		if err := rows.Scan(&e.ID, &e.Name, &e.Views, &e.Clicks); err != nil {
+			continue
+		}
+		e.CTR = formatCTR(e.Clicks, e.Views)
+		entries = append(entries, e)
+	}
+
+	respondJSON(w, http.StatusOK, entries)
+}
+
+// impressionTotalsSQL sums views and clicks per ad between two bound
+// timestamps.
+func impressionTotalsSQL(r *http.Request) string {
+	return `
+	SELECT ad_id, SUM(views) AS views, SUM(clicks) AS clicks
+	FROM (` + impressionCountsSQL + `) i
+	WHERE ` + inRangeSQL("viewed_at") + `
+		AND ` + trafficCondition(r) + `
+	GROUP BY ad_id`
+}
+
+// trafficCondition is the SQL predicate on the bot and internal columns of
+// impression rows. Bot and internal traffic are left out of reports unless
+// the request asks for include_bots=true or include_internal=true.
+func trafficCondition(r *http.Request) string {
+	q := r.URL.Query()
+	var conds []string
+	if q.Get("include_bots") != "true" {
+		conds = append(conds, "bot = 0")
+	}
+	if q.Get("include_internal") != "true" {
+		conds = append(conds, "internal = 0")
+	}
+	if len(conds) == 0 {
+		return "1 = 1"
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// Summary holds the dashboard header totals.
+type Summary struct {
+	TotalAds         int `json:"total_ads"`
+	ActiveAds        int `json:"active_ads"`
+	TotalCampaigns   int `json:"total_campaigns"`
+	ImpressionsToday int `json:"impressions_today"`
+}
+
+// handleSummary reports catalog totals and today's views (since local
+// midnight, excluding bots unless include_bots=true) in a single query.
+func handleSummary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	now := time.Now()
+	y, m, d := now.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+
+	var s Summary
+	err := db.QueryRow(`SELECT
+			(SELECT COUNT(*) FROM ads),
+			(SELECT COUNT(*) FROM ads WHERE paused = 0
+				AND (expires_at IS NULL OR `+db.Time("expires_at")+` > `+db.Time(db.Now())+`)),
+			(SELECT COUNT(*) FROM campaigns),
+			(SELECT COALESCE(SUM(weight), 0) FROM impressions
+				WHERE action_type = 'view' AND `+trafficCondition(r)+`
+					AND `+db.Time("viewed_at")+` >= `+db.Time("?")+`)`,
+		midnight.UTC().Format(sqlTimeLayout)).Scan(&s.TotalAds, &s.ActiveAds, &s.TotalCampaigns, &s.ImpressionsToday)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	respondJSON(w, http.StatusOK, s)
+}
+
+// ReconcileResult is the body of /api/analytics/reconcile.
+type ReconcileResult struct {
+	Fixed []CounterFix `json:"fixed"`
+}
+
+// handleReconcile recomputes the ads' view and click counters from the
+// impressions, for when they have drifted (after editing the database by
+// hand, say), and reports the ads it corrected.
+func handleReconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	fixes, err := reconcileCounts()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	if len(fixes) > 0 {
+		candidateCache.Invalidate()
+		recordAudit(r, auditReconcile, "analytics", 0)
+	}
+	respondJSON(w, http.StatusOK, ReconcileResult{Fixed: fixes})
+}
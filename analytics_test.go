@@ -0,0 +1,293 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// mustLogImpressions stores n impressions of ad with action at t.
+func mustLogImpressions(t *testing.T, adID int, action string, at time.Time, n int) {
+	t.Helper()
+	for range n {
+		if err := insertImpression(Impression{AdID: adID, ActionType: action, ViewedAt: at.UTC().Format(sqlTimeLayout)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTimeseriesBuckets(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "charted")
+	day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	mustLogImpressions(t, id, "view", day.Add(2*time.Hour), 3)
+	mustLogImpressions(t, id, "click", day.Add(2*time.Hour), 1)
+	mustLogImpressions(t, id, "view", day.Add(2*24*time.Hour+23*time.Hour), 2)
+	mustLogImpressions(t, id, "view", day.Add(5*24*time.Hour), 1) // after the range
+
+	var series []TimeseriesBucket
+	decodeBody(t, serve(handleAnalyticsAd, newRequest(http.MethodGet,
+		"/api/analytics/ad/"+itoa(id)+"/timeseries?from=2026-03-01&to=2026-03-04&interval=day", "")), http.StatusOK, &series)
+	want := []TimeseriesBucket{
+		{Date: "2026-03-01", Views: 3, Clicks: 1},
+		{Date: "2026-03-02"},
+		{Date: "2026-03-03", Views: 2},
+		{Date: "2026-03-04"},
+	}
+	if len(series) != len(want) {
+		t.Fatalf("got %d buckets, want %d: %+v", len(series), len(want), series)
+	}
+	for i := range want {
+		if series[i] != want[i] {
+			t.Errorf("bucket %d = %+v, want %+v", i, series[i], want[i])
+		}
+	}
+
+	decodeBody(t, serve(handleAnalyticsAd, newRequest(http.MethodGet,
+		"/api/analytics/ad/"+itoa(id)+"/timeseries?from=2026-03-01T00:00:00Z&to=2026-03-01T04:00:00Z&interval=hour", "")), http.StatusOK, &series)
+	if len(series) != 4 || series[2].Date != "2026-03-01T02:00:00Z" || series[2].Views != 3 || series[1].Views != 0 {
+		t.Errorf("hourly series = %+v", series)
+	}
+
+	for _, query := range []string{
+		"interval=week",
+		"from=2026-03-04&to=2026-03-01",
+		"from=yesterday",
+		"from=2020-01-01&to=2026-01-01&interval=hour",
+	} {
+		w := serve(handleAnalyticsAd, newRequest(http.MethodGet, "/api/analytics/ad/"+itoa(id)+"/timeseries?"+query, ""))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, w.Code)
+		}
+	}
+	if w := serve(handleAnalyticsAd, newRequest(http.MethodGet, "/api/analytics/ad/999/timeseries", "")); w.Code != http.StatusNotFound {
+		t.Errorf("missing ad: status %d, want 404", w.Code)
+	}
+}
+
+func TestTopAdsRanking(t *testing.T) {
+	newTestDB(t)
+	now := time.Now().Add(-time.Hour)
+	popular := mustInsertAd(t, "popular") // 200 views, 10 clicks: 5%
+	clicky := mustInsertAd(t, "clicky")   // 120 views, 12 clicks: 10%
+	lucky := mustInsertAd(t, "lucky")     // 2 views, 2 clicks: 100%, too few views
+	mustLogImpressions(t, popular, "view", now, 200)
+	mustLogImpressions(t, popular, "click", now, 10)
+	mustLogImpressions(t, clicky, "view", now, 120)
+	mustLogImpressions(t, clicky, "click", now, 12)
+	mustLogImpressions(t, lucky, "view", now, 2)
+	mustLogImpressions(t, lucky, "click", now, 2)
+
+	for _, tc := range []struct {
+		query string
+		want  []int
+	}{
+		{"metric=clicks", []int{clicky, popular, lucky}},
+		{"metric=views", []int{popular, clicky, lucky}},
+		{"metric=views&limit=1", []int{popular}},
+		{"metric=ctr", []int{clicky, popular}},
+		{"metric=ctr&min_views=1", []int{lucky, clicky, popular}},
+	} {
+		var entries []LeaderboardEntry
+		decodeBody(t, serve(handleTopAds, newRequest(http.MethodGet, "/api/analytics/top?"+tc.query, "")), http.StatusOK, &entries)
+		var got []int
+		for _, e := range entries {
+			got = append(got, e.ID)
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: ranked %v, want %v", tc.query, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%s: ranked %v, want %v", tc.query, got, tc.want)
+				break
+			}
+		}
+	}
+
+	for _, query := range []string{"metric=revenue", "limit=0", "limit=101", "metric=ctr&min_views=-1"} {
+		if w := serve(handleTopAds, newRequest(http.MethodGet, "/api/analytics/top?"+query, "")); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestTopCampaigns(t *testing.T) {
+	newTestDB(t)
+	now := time.Now().Add(-time.Hour)
+	var ids []int
+	for _, name := range []string{"small", "big"} {
+		c, err := insertCampaign(Campaign{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, int(c))
+		for _, content := range []string{"a", "b"} {
+			ad, err := insertAd(Ad{AdType: "text", Content: name + content, RedirectURL: "https://example.com", CampaignID: int(c)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			clicks := 1
+			if name == "big" {
+				clicks = 3
+			}
+			mustLogImpressions(t, int(ad), "click", now, clicks)
+		}
+	}
+
+	var entries []LeaderboardEntry
+	decodeBody(t, serve(handleTopAds, newRequest(http.MethodGet, "/api/analytics/top/campaigns?metric=clicks", "")), http.StatusOK, &entries)
+	if len(entries) != 2 || entries[0].ID != ids[1] || entries[0].Clicks != 6 || entries[1].Clicks != 2 {
+		t.Errorf("campaigns ranked %+v, want big (6 clicks) then small (2)", entries)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	newTestDB(t)
+	if _, err := insertCampaign(Campaign{Name: "only"}); err != nil {
+		t.Fatal(err)
+	}
+	id := mustInsertAd(t, "active")
+	mustInsertExpiringAd(t, "later", time.Now().Add(time.Hour))
+	mustInsertExpiringAd(t, "expired", time.Now().Add(-time.Hour))
+
+	now := time.Now()
+	y, m, d := now.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+	mustLogImpressions(t, id, "view", now, 3)
+	mustLogImpressions(t, id, "click", now, 1)
+	mustLogImpressions(t, id, "view", midnight.Add(-time.Minute), 5) // yesterday
+	if err := insertImpression(Impression{AdID: id, ActionType: "view", Bot: true, ViewedAt: now.UTC().Format(sqlTimeLayout)}); err != nil {
+		t.Fatal(err)
+	}
+
+	var s Summary
+	decodeBody(t, serve(handleSummary, newRequest(http.MethodGet, "/api/summary", "")), http.StatusOK, &s)
+	if want := (Summary{TotalAds: 3, ActiveAds: 2, TotalCampaigns: 1, ImpressionsToday: 3}); s != want {
+		t.Errorf("summary = %+v, want %+v", s, want)
+	}
+	decodeBody(t, serve(handleSummary, newRequest(http.MethodGet, "/api/summary?include_bots=true", "")), http.StatusOK, &s)
+	if s.ImpressionsToday != 4 {
+		t.Errorf("with bots, impressions_today = %d, want 4", s.ImpressionsToday)
+	}
+}
+
+func TestStatsFilteredByCampaignAndType(t *testing.T) {
+	newTestDB(t)
+	campaign, err := insertCampaign(Campaign{Name: "spring"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func(ad Ad) int {
+		t.Helper()
+		ad.RedirectURL = "https://example.com/" + ad.Content
+		id, err := insertAd(ad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(id)
+	}
+	image := add(Ad{AdType: "image", Content: "image", ImageURL: "/static/images/image1.jpg", CampaignID: int(campaign)})
+	text := add(Ad{AdType: "text", Content: "text", CampaignID: int(campaign)})
+	add(Ad{AdType: "image", Content: "other", ImageURL: "/static/images/image2.png"})
+
+	for _, tc := range []struct {
+		query string
+		want  []int
+	}{
+		{"campaign_id=" + itoa(int(campaign)) + "&ad_type=image", []int{image}},
+		{"campaign_id=" + itoa(int(campaign)), []int{image, text}},
+		{"ad_type=text", []int{text}},
+		{"campaign_id=999", nil},
+	} {
+		var stats []AnalyticsStats
+		decodeBody(t, serve(handleAnalyticsStats, newRequest(http.MethodGet, "/api/analytics/stats?"+tc.query, "")), http.StatusOK, &stats)
+		var got []int
+		for _, s := range stats {
+			got = append(got, s.AdID)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s: stats for %v, want %v", tc.query, got, tc.want)
+		}
+	}
+
+	for _, query := range []string{"campaign_id=spring", "ad_type=banner"} {
+		if w := serve(handleAnalyticsStats, newRequest(http.MethodGet, "/api/analytics/stats?"+query, "")); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestTimeToClick(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "clicked")
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	record := func(action, ip string, after time.Duration) {
+		t.Helper()
+		imp := Impression{AdID: id, ActionType: action, IP: ip, UserAgent: "ua", ViewedAt: start.Add(after).Format(sqlTimeLayout)}
+		if err := insertImpression(imp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record("view", "198.51.100.1", 0)
+	record("click", "198.51.100.1", 30*time.Second)
+	// Measured from the client's latest view.
+	record("view", "198.51.100.2", 0)
+	record("view", "198.51.100.2", time.Minute)
+	record("click", "198.51.100.2", 80*time.Second)
+	// A click without a view from the same client has no latency.
+	record("click", "198.51.100.3", time.Minute)
+
+	rows, err := db.Query(`SELECT ip, time_to_click FROM impressions WHERE action_type = 'click' ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := map[string]*int{}
+	for rows.Next() {
+		var ip string
+		var ttc *int
+		if err := rows.Scan(&ip, &ttc); err != nil {
+			t.Fatal(err)
+		}
+		got[ip] = ttc
+	}
+	if got["198.51.100.1"] == nil || *got["198.51.100.1"] != 30 || got["198.51.100.2"] == nil || *got["198.51.100.2"] != 20 || got["198.51.100.3"] != nil {
+		t.Errorf("time_to_click = %v, want 30, 20 and none", got)
+	}
+
+	var stats []AnalyticsStats
+	decodeBody(t, serve(handleAnalyticsStats, newRequest(http.MethodGet, "/api/analytics/stats", "")), http.StatusOK, &stats)
+	if len(stats) != 1 || stats[0].AvgTimeToClick == nil || *stats[0].AvgTimeToClick != 25 {
+		t.Errorf("stats = %+v, want an average time to click of 25s", stats)
+	}
+}
+
+func TestReconcileFixesCorruptedCounter(t *testing.T) {
+	newTestDB(t)
+	drifted, fine := mustInsertAd(t, "drifted"), mustInsertAd(t, "fine")
+	mustLogImpressions(t, drifted, "view", time.Now().Add(-time.Hour), 4)
+	mustLogImpressions(t, drifted, "click", time.Now().Add(-time.Hour), 1)
+	mustLogImpressions(t, fine, "view", time.Now().Add(-time.Hour), 2)
+	if _, err := db.Exec(`UPDATE ads SET view_count = 100, click_count = 0 WHERE id = ?`, drifted); err != nil {
+		t.Fatal(err)
+	}
+
+	var result ReconcileResult
+	decodeBody(t, serve(handleReconcile, newRequest(http.MethodPost, "/api/analytics/reconcile", "")), http.StatusOK, &result)
+	want := CounterFix{AdID: drifted, OldViewCount: 100, ViewCount: 4, OldClickCount: 0, ClickCount: 1}
+	if len(result.Fixed) != 1 || result.Fixed[0] != want {
+		t.Errorf("fixed %+v, want only %+v", result.Fixed, want)
+	}
+	if ad := mustGetAd(t, drifted); ad.ViewCount != 4 || ad.ClickCount != 1 {
+		t.Errorf("after reconcile: %d views, %d clicks; want 4 and 1", ad.ViewCount, ad.ClickCount)
+	}
+
+	decodeBody(t, serve(handleReconcile, newRequest(http.MethodPost, "/api/analytics/reconcile", "")), http.StatusOK, &result)
+	if len(result.Fixed) != 0 {
+		t.Errorf("second run fixed %+v, want nothing", result.Fixed)
+	}
+}
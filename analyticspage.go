@@ -0,0 +1,205 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxChartedAds bounds how many ads /admin/analytics draws at once.
+const maxChartedAds = 20
+
+// Chart geometry, in SVG user units.
+const (
+	chartWidth   = 640
+	chartHeight  = 180
+	chartPadding = 24
+)
+
+// adChart is one ad's views and clicks over time, as drawn on
+// /admin/analytics.
+type adChart struct {
+	ID          int
+	Content     string
+	Views       int
+	Clicks      int
+	Max         int
+	First, Last string
+	ViewPoints  string
+	ClickPoints string
+}
+
+var analyticsPage = template.Must(template.New("analytics").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Ad analytics</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+section { margin-bottom: 2em; }
+svg { border: 1px solid #ddd; background: #fafafa; }
+.views { stroke: #0066cc; color: #0066cc; }
+.clicks { stroke: #cc3300; color: #cc3300; }
+.legend span { margin-right: 1em; }
+.muted { color: #777; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>Views and clicks</h1>
+<p class="muted">{{.From}} to {{.To}}, by {{.Interval}}.
+<a href="?interval=day">Last 7 days</a> &middot; <a href="?interval=hour&amp;from={{.Yesterday}}">Last 24 hours</a> &middot; <a href="/admin">Dashboard</a></p>
+{{- range .Charts}}
+<section>
+<h2>Ad {{.ID}}</h2>
+{{- with .Content}}
+<p class="muted">{{.}}</p>
+{{- end}}
+<p class="legend"><span class="views">&#9632; {{.Views}} views</span> <span class="clicks">&#9632; {{.Clicks}} clicks</span></p>
+<svg width="{{$.Width}}" height="{{$.Height}}" viewBox="0 0 {{$.Width}} {{$.Height}}" role="img" aria-label="Views and clicks for ad {{.ID}}">
+<text x="4" y="14" font-size="11">{{.Max}}</text>
+<text x="{{$.Padding}}" y="{{$.Height}}" dy="-6" font-size="11">{{.First}}</text>
+<text x="{{$.Width}}" dx="-4" y="{{$.Height}}" dy="-6" font-size="11" text-anchor="end">{{.Last}}</text>
+<polyline class="views" fill="none" stroke-width="2" points="{{.ViewPoints}}"/>
+<polyline class="clicks" fill="none" stroke-width="2" points="{{.ClickPoints}}"/>
+</svg>
+</section>
+{{- else}}
+<p>No views or clicks in this range.</p>
+{{- end}}
+</body>
+</html>
+`))
+
+// handleAnalyticsPage draws each ad's views and clicks over time as inline
+// SVG, from the same buckets as /api/analytics/ad/{id}/timeseries. It shows
+// the ad_id ad, or else the most viewed ads in the range.
+func handleAnalyticsPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondErrorPage(w, r, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	tr, err := parseTimeseriesRange(r)
+	if err != nil {
+		respondErrorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	traffic := trafficCondition(r)
+
+	var ads []Ad
+	if v := r.URL.Query().Get("ad_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			respondErrorPage(w, r, http.StatusBadRequest, "invalid ad_id")
+			return
+		}
+		var ad Ad
+		err = db.QueryRow(`SELECT id, content FROM ads WHERE id = ?`, id).Scan(&ad.ID, &ad.Content)
+		if err == sql.ErrNoRows {
+			respondErrorPage(w, r, http.StatusNotFound, "ad not found")
+			return
+		} else if err != nil {
+			respondErrorPage(w, r, http.StatusInternalServerError, "database error")
+			return
+		}
+		ads = append(ads, ad)
+	} else if ads, err = chartedAds(tr, traffic); err != nil {
+		log.Printf("Analytics page: %v", err)
+		respondErrorPage(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	charts := make([]adChart, 0, len(ads))
+	for _, ad := range ads {
+		series, err := adTimeseries(ad.ID, tr, traffic)
+		if err != nil {
+			log.Printf("Analytics page: %v", err)
+			respondErrorPage(w, r, http.StatusInternalServerError, "database error")
+			return
+		}
+		charts = append(charts, drawChart(ad, series))
+	}
+
+	interval := "day"
+	if tr.step == time.Hour {
+		interval = "hour"
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	analyticsPage.Execute(w, map[string]interface{}{
+		"Charts":    charts,
+		"From":      tr.from.Format(tr.goFormat),
+		"To":        tr.to.Format(tr.goFormat),
+		"Interval":  interval,
+		"Yesterday": time.Now().UTC().Add(-24 * time.Hour).Format(time.RFC3339),
+		"Width":     chartWidth,
+		"Height":    chartHeight,
+		"Padding":   chartPadding,
+	})
+}
+
+// chartedAds lists the ads with the most views in tr, then the most clicks.
+func chartedAds(tr timeseriesRange, traffic string) ([]Ad, error) {
+	rows, err := db.Query(`
+		SELECT a.id, a.content
+		FROM (`+impressionCountsSQL+`) i
+		JOIN ads a ON a.id = i.ad_id
+		WHERE `+inRangeSQL("i.viewed_at")+`
+			AND `+traffic+`
+		GROUP BY a.id
+		HAVING SUM(i.views) + SUM(i.clicks) > 0
+		ORDER BY SUM(i.views) DESC, SUM(i.clicks) DESC, a.id
+		LIMIT ?`,
+		tr.from.Format(sqlTimeLayout), tr.to.Format(sqlTimeLayout), maxChartedAds)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ads []Ad
+	for rows.Next() {
+		var ad Ad
+		if err := rows.Scan(&ad.ID, &ad.Content); err != nil {
+			return nil, err
+		}
+		ads = append(ads, ad)
+	}
+	return ads, rows.Err()
+}
+
+// drawChart scales an ad's series to the chart area, with the busiest
+// bucket at the top.
+func drawChart(ad Ad, series []TimeseriesBucket) adChart {
+	c := adChart{ID: ad.ID, Content: ad.Content, Max: 1}
+	for _, b := range series {
+		c.Views += b.Views
+		c.Clicks += b.Clicks
+		c.Max = max(c.Max, b.Views, b.Clicks)
+	}
+	if len(series) > 0 {
+		c.First, c.Last = series[0].Date, series[len(series)-1].Date
+	}
+
+	plotWidth := float64(chartWidth - 2*chartPadding)
+	plotHeight := float64(chartHeight - 2*chartPadding)
+	var views, clicks []string
+	for i, b := range series {
+		x := float64(chartPadding) + plotWidth/2
+		if len(series) > 1 {
+			x = float64(chartPadding) + plotWidth*float64(i)/float64(len(series)-1)
+		}
+		y := func(n int) string {
+			return fmt.Sprintf("%.1f,%.1f", x, float64(chartHeight-chartPadding)-plotHeight*float64(n)/float64(c.Max))
+		}
+		views = append(views, y(b.Views))
+		clicks = append(clicks, y(b.Clicks))
+	}
+	c.ViewPoints = strings.Join(views, " ")
+	c.ClickPoints = strings.Join(clicks, " ")
+	return c
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnalyticsPageChartsSeededAd(t *testing.T) {
+	newTestDB(t)
+	seeded, quiet := mustInsertAd(t, "charted <b>ad</b>"), mustInsertAd(t, "quiet")
+	at := time.Now().Add(-48 * time.Hour)
+	mustLogImpressions(t, seeded, "view", at, 4)
+	mustLogImpressions(t, seeded, "click", at, 1)
+	apiToken = testToken
+	page := withAdminAuth(handleAnalyticsPage)
+
+	if w := serve(page, httptest.NewRequest(http.MethodGet, "/admin/analytics", nil)); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous: status %d, want 401", w.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/analytics", nil)
+	req.SetBasicAuth("admin", testToken)
+	w := serve(page, req)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("status %d, type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"<h2>Ad " + itoa(seeded) + "</h2>",
+		"charted &lt;b&gt;ad&lt;/b&gt;",
+		"4 views", "1 clicks",
+		`<polyline class="views"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page is missing %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "<h2>Ad "+itoa(quiet)+"</h2>") {
+		t.Errorf("ad %d has no traffic but was charted", quiet)
+	}
+	// The day with the views peaks at the top of the chart.
+	if line := chartLine(t, body, "views"); !strings.Contains(line, ","+itoa(chartPadding)+".0") {
+		t.Errorf("views line %q never reaches the top", line)
+	}
+}
+
+// chartLine returns the points of the first polyline of the given class.
+func chartLine(t *testing.T, body, class string) string {
+	t.Helper()
+	_, rest, ok := strings.Cut(body, `<polyline class="`+class+`"`)
+	if !ok {
+		t.Fatalf("no %s line", class)
+	}
+	_, rest, _ = strings.Cut(rest, `points="`)
+	points, _, _ := strings.Cut(rest, `"`)
+	return points
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Audit actions recorded by the admin handlers.
+const (
+	auditCreate = "create"
+	auditUpdate = "update"
+	auditDelete = "delete"
+	auditImport = "import"
+	auditPause  = "pause"
+	auditResume = "resume"
+	// Correcting ad counters; see handleReconcile.
+	auditReconcile = "reconcile"
+	// Switching read-only mode; see handleReadOnly.
+	auditReadOnly  = "read_only"
+	auditReadWrite = "read_write"
+)
+
+// AuditEntry is one row of /api/audit.
+type AuditEntry struct {
+	ID         int    `json:"id"`
+	Action     string `json:"action"`
+	TargetType string `json:"target_type"`
+	TargetID   int    `json:"target_id,omitempty"`
+	Actor      string `json:"actor"`
+	IP         string `json:"ip"`
+	CreatedAt  string `json:"created_at"`
+}
+
+// auditActor identifies who made a request without storing a usable
+// credential: the last four characters of a bearer token, or a short hash
+// of the session id.
+func auditActor(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && validToken(token) {
+		if len(token) <= 4 {
+			return "token:****"
+		}
+		return "token:****" + token[len(token)-4:]
+	}
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		sum := sha256.Sum256([]byte(c.Value))
+		return "session:" + hex.EncodeToString(sum[:4])
+	}
+	return "unknown"
+}
+
+// recordAudit logs an admin action. Failures are logged rather than failing
+// the request that already succeeded.
+func recordAudit(r *http.Request, action, targetType string, targetID int) {
+	_, err := db.Exec(`INSERT INTO audit_log (action, target_type, target_id, actor, ip) VALUES (?, ?, ?, ?, ?)`,
+		action, targetType, nullableID(targetID), auditActor(r), clientIP(r))
+	if err != nil {
+		log.Printf("Audit write failed for %s %s %d: %v", action, targetType, targetID, err)
+	}
+}
+
+// handleAudit lists audit entries newest first, paginated with limit and
+// offset.
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	q := r.URL.Query()
+	limit := 50
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			respondError(w, http.StatusBadRequest, "limit must be between 1 and 500")
+			return
+		}
+		limit = n
+	}
+	offset := 0
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			respondError(w, http.StatusBadRequest, "invalid offset")
+			return
+		}
+		offset = n
+	}
+
+	rows, err := db.Query(`SELECT id, action, target_type, COALESCE(target_id, 0), actor, COALESCE(ip, ''), created_at
+		FROM audit_log ORDER BY id DESC LIMIT ? OFFSET ?`, limit, offset)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.Action, &e.TargetType, &e.TargetID, &e.Actor, &e.IP, &e.CreatedAt); err != nil {
+			continue
+		}
+		e.CreatedAt = storedTime(e.CreatedAt)
+		entries = append(entries, e)
+	}
+
+	respondJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDeleteIsAudited(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "doomed")
+	mustInsertAd(t, "kept")
+
+	w := serve(handleDeleteAd, newRequest(http.MethodDelete, "/api/ad/delete/"+itoa(id), ""))
+	decodeBody(t, w, http.StatusOK, nil)
+
+	var entries []AuditEntry
+	decodeBody(t, serve(handleAudit, newRequest(http.MethodGet, "/api/audit", "")), http.StatusOK, &entries)
+	if len(entries) != 1 {
+		t.Fatalf("audit log = %+v, want one entry", entries)
+	}
+	e := entries[0]
+	if e.Action != auditDelete || e.TargetType != "ad" || e.TargetID != id {
+		t.Errorf("entry = %+v, want delete of ad %d", e, id)
+	}
+	if e.Actor != "token:****oken" {
+		t.Errorf("actor = %q, want the masked token", e.Actor)
+	}
+	if e.IP != "192.0.2.1" {
+		t.Errorf("ip = %q", e.IP)
+	}
+	if at, err := time.Parse(time.RFC3339, e.CreatedAt); err != nil || time.Since(at) > time.Minute {
+		t.Errorf("created_at = %q", e.CreatedAt)
+	}
+
+	// Entries page newest first.
+	w = serve(handleDeleteAd, newRequest(http.MethodDelete, "/api/ad/delete/"+itoa(id+1), ""))
+	decodeBody(t, w, http.StatusOK, nil)
+	decodeBody(t, serve(handleAudit, newRequest(http.MethodGet, "/api/audit?limit=1&offset=1", "")), http.StatusOK, &entries)
+	if len(entries) != 1 || entries[0].TargetID != id {
+		t.Errorf("second page = %+v, want the first delete", entries)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Beacons are the fire-and-forget way to report a served ad's view:
+// navigator.sendBeacon (a POST with no body the server needs) or an image
+// pixel (a GET). Unlike /api/impression they take no JSON and never fail
+// visibly, so a page can fire one while unloading. Each served ad's
+// beacon_url carries a view ID, and repeats of the same ID count once; a
+// beacon without an ID the server issued is refused, so a loop can't
+// inflate views.
+
+// beaconGIF is a transparent 1x1 GIF, the body of GET beacons.
+var beaconGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00,
+	0x00, 0x2c, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02,
+	0x44, 0x01, 0x00, 0x3b,
+}
+
+// maxBeaconViews bounds the view IDs remembered for deduplication. The set
+// starts over when full, so a very late repeat may count again.
+const maxBeaconViews = 100000
+
+// beaconViewTTL is how long a view ID is remembered when impression nonces
+// are off. With nonces on, the view ID is the nonce and its TTL applies.
+const beaconViewTTL = time.Hour
+
+// viewSet remembers recently seen view IDs.
+type viewSet struct {
+	mu   sync.Mutex
+	seen map[string]time.Time // key -> expiry
+}
+
+var beaconViews = &viewSet{seen: map[string]time.Time{}}
+
+// Add records key and reports whether it was new.
+func (s *viewSet) Add(key string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if expires, ok := s.seen[key]; ok && now.Before(expires) {
+		return false
+	}
+	if len(s.seen) >= maxBeaconViews {
+		for k, expires := range s.seen {
+			if !now.Before(expires) {
+				delete(s.seen, k)
+			}
+		}
+		if len(s.seen) >= maxBeaconViews {
+			s.seen = map[string]time.Time{}
+		}
+	}
+	s.seen[key] = now.Add(beaconViewTTL)
+	return true
+}
+
+// viewIDKey signs view IDs when impression nonces are off. Like the nonce
+// key it is per process, so a restart invalidates outstanding IDs.
+var viewIDKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// newViewID returns the ID a served ad's beacon reports: the impression
+// nonce when those are enabled, so the beacon and impression URL can't both
+// count, or else a random one signed for the ad, as "random.signature".
+func newViewID(adID int, now time.Time) (id string, nonce bool) {
+	if impressionNonces != nil {
+		return impressionNonces.Issue(adID, now), true
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	random := hex.EncodeToString(b)
+	return random + "." + signViewID(adID, random), false
+}
+
+func signViewID(adID int, random string) string {
+	mac := hmac.New(sha256.New, viewIDKey)
+	mac.Write([]byte(strconv.Itoa(adID) + "." + random))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validViewID reports whether view was issued by newViewID for ad adID.
+func validViewID(adID int, view string) bool {
+	random, sig, ok := strings.Cut(view, ".")
+	return ok && hmac.Equal([]byte(sig), []byte(signViewID(adID, random)))
+}
+
+func beaconURL(base string, id int, view string) string {
+	return base + "/api/beacon/" + strconv.Itoa(id) + "?view=" + view
+}
+
+// handleBeacon records a view from /api/beacon/{id}. The view ID must be
+// one the server issued for the ad; a repeated one gets the same response
+// but isn't counted again. GET answers with a transparent GIF, POST with
+// 204.
+func handleBeacon(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, "use GET or POST")
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/beacon/"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid ad ID")
+		return
+	}
+
+	now := time.Now()
+	view := r.URL.Query().Get("view")
+	fresh := true
+	if impressionNonces != nil {
+		err := impressionNonces.Redeem(view, id, "view", now)
+		if errors.Is(err, errNonceSpent) {
+			fresh = false
+		} else if err != nil {
+			respondError(w, http.StatusForbidden, err.Error())
+			return
+		}
+	} else {
+		if !validViewID(id, view) {
+			respondError(w, http.StatusForbidden, "missing or invalid view ID")
+			return
+		}
+		fresh = beaconViews.Add(strconv.Itoa(id)+"/"+view, now)
+	}
+
+	if fresh && !recordImpression(r, id, "view", viewableParam(r)) {
+		respondError(w, http.StatusServiceUnavailable, "impression queue full")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodPost {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "image/gif")
+	w.Write(beaconGIF)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postBeacon(id int, query string) int {
+	w := httptest.NewRecorder()
+	handleBeacon(w, httptest.NewRequest(http.MethodPost, "/api/beacon/"+itoa(id)+"?"+query, nil))
+	return w.Code
+}
+
+// viewableCounts returns an ad's stored views and how many are viewable.
+func viewableCounts(t *testing.T, adID int) (views, viewable int) {
+	t.Helper()
+	flushImpressions(t)
+	if err := db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(viewable), 0) FROM impressions WHERE ad_id = ? AND action_type = 'view'`, adID).Scan(&views, &viewable); err != nil {
+		t.Fatal(err)
+	}
+	return views, viewable
+}
+
+func TestViewableTrackedSeparately(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "viewable")
+	view, _ := newViewID(id, time.Now())
+	if code := postBeacon(id, "view="+view+"&viewable=1"); code != http.StatusNoContent {
+		t.Fatalf("status %d", code)
+	}
+	other, _ := newViewID(id, time.Now())
+	postBeacon(id, "view="+other)
+
+	if views, viewable := viewableCounts(t, id); views != 2 || viewable != 1 {
+		t.Errorf("%d views, %d viewable; want 2, 1", views, viewable)
+	}
+}
+
+func TestViewableNeedsIssuedViewID(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "viewable")
+
+	postImpression(id, "viewable=1")
+	view, _ := newViewID(id+1, time.Now())
+	for _, query := range []string{"viewable=1", "view=made-up&viewable=1", "view=" + view + "&viewable=1"} {
+		if code := postBeacon(id, query); code != http.StatusForbidden {
+			t.Errorf("beacon %s: status %d, want 403", query, code)
+		}
+	}
+
+	if views, viewable := viewableCounts(t, id); views != 1 || viewable != 0 {
+		t.Errorf("%d views, %d viewable; want 1, 0", views, viewable)
+	}
+}
+
+func TestViewableWithNonce(t *testing.T) {
+	newTestDB(t)
+	withNonces(t)
+	id := mustInsertAd(t, "viewable")
+	if code := postImpression(id, "viewable=1&nonce="+impressionNonces.Issue(id, time.Now())); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if views, viewable := viewableCounts(t, id); views != 1 || viewable != 1 {
+		t.Errorf("%d views, %d viewable; want 1, 1", views, viewable)
+	}
+}
+
+func TestGetBeaconLogsViewOnce(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "beacon")
+	view, _ := newViewID(id, time.Now())
+	for range 3 {
+		w := httptest.NewRecorder()
+		handleBeacon(w, httptest.NewRequest(http.MethodGet, "/api/beacon/"+itoa(id)+"?view="+view, nil))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/gif" || w.Body.Len() == 0 {
+			t.Fatalf("status %d, type %q, %d bytes; want a pixel", w.Code, w.Header().Get("Content-Type"), w.Body.Len())
+		}
+	}
+	// POST is the same endpoint, so it doesn't count the view again.
+	if code := postBeacon(id, "view="+view); code != http.StatusNoContent {
+		t.Fatalf("POST: status %d", code)
+	}
+	// Without an issued view ID there is nothing to deduplicate on, so a
+	// loop of them would count without end; they're refused instead.
+	for _, query := range []string{"", "?view=", "?view=made-up", "?view=abc.def"} {
+		w := httptest.NewRecorder()
+		handleBeacon(w, httptest.NewRequest(http.MethodGet, "/api/beacon/"+itoa(id)+query, nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("GET beacon%s: status %d, want 403", query, w.Code)
+		}
+	}
+	if views, _ := viewableCounts(t, id); views != 1 {
+		t.Errorf("%d views, want 1", views)
+	}
+	if ad := mustGetAd(t, id); ad.ViewCount != 1 {
+		t.Errorf("view_count = %d, want 1", ad.ViewCount)
+	}
+
+	w := serve(handleEmbedJS, newRequest(http.MethodGet, "/embed.js", ""))
+	if !strings.Contains(w.Body.String(), "navigator.sendBeacon") {
+		t.Error("embed.js doesn't use sendBeacon")
+	}
+}
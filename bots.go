@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trafficFilter decides whether a tracking request came from automated
+// traffic. It runs before an impression or click is queued.
+type trafficFilter interface {
+	IsBot(r *http.Request) bool
+}
+
+// defaultBotUAPatterns are matched case-insensitively as substrings of the
+// User-Agent. ADSERVER_BOT_UA_PATTERNS replaces the list.
+var defaultBotUAPatterns = []string{
+	"bot", "crawl", "spider", "slurp", "headless", "facebookexternalhit",
+	"python-requests", "go-http-client", "curl/", "wget/",
+}
+
+// botFilter flags requests with an empty User-Agent, a User-Agent matching
+// one of its patterns, or a client IP inside one of its networks (typically
+// datacenter ranges).
+type botFilter struct {
+	uaPatterns []string
+	networks   []*net.IPNet
+}
+
+func newBotFilter(patterns, cidrs []string) (*botFilter, error) {
+	f := &botFilter{}
+	for _, p := range patterns {
+		if p = strings.ToLower(strings.TrimSpace(p)); p != "" {
+			f.uaPatterns = append(f.uaPatterns, p)
+		}
+	}
+	networks, err := parseNetworks(cidrs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bot IP range %v", err)
+	}
+	f.networks = networks
+	return f, nil
+}
+
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, c := range cidrs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(c))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", c, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func inNetworks(networks []*net.IPNet, ip string) bool {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		for _, n := range networks {
+			if n.Contains(parsed) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *botFilter) IsBot(r *http.Request) bool {
+	ua := strings.ToLower(strings.TrimSpace(r.UserAgent()))
+	if ua == "" {
+		return true
+	}
+	for _, p := range f.uaPatterns {
+		if strings.Contains(ua, p) {
+			return true
+		}
+	}
+	return inNetworks(f.networks, clientIP(r))
+}
+
+// Bot traffic handling modes for ADSERVER_BOT_TRAFFIC.
+const (
+	botTrafficTag  = "tag"  // record with bot = 1, excluded from analytics
+	botTrafficDrop = "drop" // don't record at all
+)
+
+var (
+	impressionFilter trafficFilter
+	botTrafficMode   = botTrafficTag
+	// internalNetworks are our own (office, staging, monitoring) addresses.
+	// Their impressions are recorded with internal = 1 and left out of
+	// analytics like bot traffic.
+	internalNetworks []*net.IPNet
+)
+
+// newImpression builds the impression for a tracking request and reports
+// whether it should be recorded.
+func newImpression(r *http.Request, adID int, action string) (Impression, bool) {
+	imp := Impression{AdID: adID, ActionType: action, IP: clientIP(r), UserAgent: r.UserAgent(), Referrer: r.Referer()}
+	if impressionFilter != nil && impressionFilter.IsBot(r) {
+		if botTrafficMode == botTrafficDrop {
+			return imp, false
+		}
+		imp.Bot = true
+	}
+	imp.Internal = inNetworks(internalNetworks, imp.IP)
+	// Bot and internal checks need the full address; only storage doesn't.
+	if anonymizeIPs {
+		imp.IP = anonymizeIP(imp.IP)
+	}
+	return imp, applyOptOut(r, &imp)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBotImpressionsFlaggedAndExcluded(t *testing.T) {
+	newTestDB(t)
+	f, err := newBotFilter(defaultBotUAPatterns, []string{"203.0.113.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	impressionFilter = f
+	defer func() { impressionFilter = nil }()
+	id := mustInsertAd(t, "watched")
+
+	view := func(ua, ip string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/api/impression/"+itoa(id), nil)
+		req.Header.Set("User-Agent", ua)
+		req.RemoteAddr = ip + ":1234"
+		if w := serve(handleImpression, req); w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+	}
+	browser := "Mozilla/5.0 (X11; Linux x86_64) Firefox/125.0"
+	view(browser, "198.51.100.7")
+	view("Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "198.51.100.8")
+	view("", "198.51.100.9")
+	view(browser, "203.0.113.5") // datacenter range
+
+	flushImpressions(t)
+	var humans, bots int
+	if err := db.QueryRow(`SELECT COUNT(CASE WHEN bot = 0 THEN 1 END), COUNT(CASE WHEN bot = 1 THEN 1 END) FROM impressions`).Scan(&humans, &bots); err != nil {
+		t.Fatal(err)
+	}
+	if humans != 1 || bots != 3 {
+		t.Errorf("stored %d human and %d bot views, want 1 and 3", humans, bots)
+	}
+
+	var stats []AnalyticsStats
+	decodeBody(t, serve(handleAnalyticsStats, newRequest(http.MethodGet, "/api/analytics/stats", "")), http.StatusOK, &stats)
+	if len(stats) != 1 || stats[0].Views != 1 {
+		t.Errorf("stats = %+v, want 1 view", stats)
+	}
+	decodeBody(t, serve(handleAnalyticsStats, newRequest(http.MethodGet, "/api/analytics/stats?include_bots=true", "")), http.StatusOK, &stats)
+	if len(stats) != 1 || stats[0].Views != 4 {
+		t.Errorf("include_bots stats = %+v, want 4 views", stats)
+	}
+
+	botTrafficMode = botTrafficDrop
+	defer func() { botTrafficMode = botTrafficTag }()
+	view("", "198.51.100.10")
+	if n := countImpressions(t, id, "view"); n != 4 {
+		t.Errorf("drop mode stored a bot view: %d rows, want 4", n)
+	}
+}
+
+func TestInternalImpressionsExcludedByDefault(t *testing.T) {
+	newTestDB(t)
+	networks, err := parseNetworks([]string{"10.0.0.0/8", "127.0.0.1/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	internalNetworks = networks
+	defer func() { internalNetworks = nil }()
+	id := mustInsertAd(t, "watched")
+
+	for _, ip := range []string{"10.1.2.3", "127.0.0.1", "198.51.100.7"} {
+		req := httptest.NewRequest(http.MethodPost, "/api/impression/"+itoa(id), nil)
+		req.RemoteAddr = ip + ":1234"
+		if w := serve(handleImpression, req); w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+	}
+	flushImpressions(t)
+	var internal int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM impressions WHERE internal = 1`).Scan(&internal); err != nil || internal != 2 {
+		t.Errorf("%d views tagged internal (%v), want 2", internal, err)
+	}
+
+	var stats []AnalyticsStats
+	decodeBody(t, serve(handleAnalyticsStats, newRequest(http.MethodGet, "/api/analytics/stats", "")), http.StatusOK, &stats)
+	if len(stats) != 1 || stats[0].Views != 1 {
+		t.Errorf("stats = %+v, want the 1 external view", stats)
+	}
+	decodeBody(t, serve(handleAnalyticsStats, newRequest(http.MethodGet, "/api/analytics/stats?include_internal=true", "")), http.StatusOK, &stats)
+	if len(stats) != 1 || stats[0].Views != 3 {
+		t.Errorf("include_internal stats = %+v, want 3 views", stats)
+	}
+
+	if _, err := parseNetworks([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("invalid CIDR accepted")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCachedTagSets bounds how many distinct tag queries are memoized before
+// the cache is cleared, so arbitrary tag combinations can't grow it forever.
+const maxCachedTagSets = 1000
+
+// adCache keeps servable ads in memory so ad selection does not query the
+// database on every request. Entries are keyed by the normalized tag set
+// and reload after ttl or once invalidated.
+type adCache struct {
+	mu      sync.RWMutex
+	entries map[string]cacheEntry
+	ttl     time.Duration
+}
+
+type cacheEntry struct {
+	ads      []Ad
+	loadedAt time.Time
+}
+
+var candidateCache = &adCache{ttl: defaultAdCacheTTL}
+
+// Get returns the servable ads carrying at least one of tags (all servable
+// ads when tags is empty), reloading them from the database when stale.
+// The returned slice is shared and must not be modified.
+func (c *adCache) Get(tags []string) ([]Ad, error) {
+	norm := normalizeTags(tags)
+	key := strings.Join(norm, ",")
+
+	c.mu.RLock()
+	e, ok := c.entries[key]
+	c.mu.RUnlock()
+	if ok && time.Since(e.loadedAt) < c.ttl {
+		return e.ads, nil
+	}
+
+	ads, err := loadServableAds(norm)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.entries == nil || len(c.entries) >= maxCachedTagSets {
+		c.entries = map[string]cacheEntry{}
+	}
+	c.entries[key] = cacheEntry{ads: ads, loadedAt: time.Now()}
+	c.mu.Unlock()
+	return ads, nil
+}
+
+// Invalidate forces the next Get to reload from the database.
+func (c *adCache) Invalidate() {
+	c.mu.Lock()
+	c.entries = nil
+	c.mu.Unlock()
+}
+
+// maxCandidates caps how many matching ads are loaded per tag set. When more
+// ads match, a random subset is loaded and the rest become eligible only on
+// a later reload. Raise it rather than rely on that rotation.
+var maxCandidates = defaultMaxCandidates
+
+// loadServableAds fetches active, unpaused ads matching any of the
+// normalized tags, doing the tag match in SQL via ad_tags and campaign_tags.
+func loadServableAds(tags []string) ([]Ad, error) {
+	query := `SELECT ` + adColumns + ` FROM ads
+	          WHERE paused = 0 AND (expires_at IS NULL OR ` + db.Time("expires_at") + ` > ` + db.Time(db.Now()) + `)`
+	var args []interface{}
+	if len(tags) > 0 {
+		// An ad matches on its own tags unless its campaign overrides them,
+		// or on its campaign's default tags (see targetingTags).
+		in := `(?` + strings.Repeat(",?", len(tags)-1) + `)`
+		query += ` AND ((id IN (SELECT ad_id FROM ad_tags WHERE tag IN ` + in + `)
+		               AND COALESCE(campaign_id, 0) NOT IN (SELECT id FROM campaigns WHERE tag_mode = 'override'))
+		            OR campaign_id IN (SELECT campaign_id FROM campaign_tags WHERE tag IN ` + in + `))`
+		for range 2 {
+			for _, t := range tags {
+				args = append(args, t)
+			}
+		}
+	}
+	// The random subset is returned in id order so a seeded selection
+	// (ADSERVER_SELECTION_SEED) sees the same candidates in the same order.
+	query = `SELECT * FROM (` + query + ` ORDER BY ` + db.Random() + ` LIMIT ?) sample ORDER BY id`
+	args = append(args, maxCandidates)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ads []Ad
+	for rows.Next() {
+		a, err := scanAd(rows)
+		if err != nil {
+			continue
+		}
+		ads = append(ads, a)
+	}
+	if len(ads) == maxCandidates {
+		log.Printf("Ad candidate limit of %d reached; some ads are not eligible for selection", maxCandidates)
+	}
+	return ads, rows.Err()
+}
+
+// isExpired reports whether the ad expired since it was cached.
+func isExpired(a Ad, now time.Time) bool {
+	if a.ExpiresAt == nil {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339, *a.ExpiresAt)
+	if err != nil {
+		return false
+	}
+	return !t.After(now)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingRepository counts the queries run on a Repository.
+type countingRepository struct {
+	Repository
+	queries atomic.Int64
+}
+
+func (c *countingRepository) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	c.queries.Add(1)
+	return c.Repository.Query(query, args...)
+}
+
+func TestAdCacheInvalidatedOnAdd(t *testing.T) {
+	newTestDB(t)
+	candidateCache.ttl = time.Hour
+	t.Cleanup(func() { candidateCache.ttl = defaultAdCacheTTL })
+	mustInsertAd(t, "first", "go")
+
+	if ads, _ := candidateCache.Get([]string{"go"}); len(ads) != 1 {
+		t.Fatalf("got %d ads, want 1", len(ads))
+	}
+	w := serve(handleAddAd, newRequest(http.MethodPost, "/api/ad/add",
+		`{"ad_type":"text","content":"second","redirect_url":"https://example.com/2","tags":["go"]}`))
+	decodeBody(t, w, http.StatusCreated, nil)
+
+	if ads, _ := candidateCache.Get([]string{"go"}); len(ads) != 2 {
+		t.Errorf("after adding an ad got %d ads, want 2", len(ads))
+	}
+}
+
+// BenchmarkRandomAd serves ads with and without the candidate cache and
+// reports the database queries each request makes.
+func BenchmarkRandomAd(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		ttl  time.Duration
+	}{{"uncached", 0}, {"cached", time.Hour}} {
+		b.Run(bc.name, func(b *testing.B) {
+			repo, err := openSQLite(filepath.Join(b.TempDir(), "ads.db"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer repo.Close()
+			counter := &countingRepository{Repository: repo}
+			db = counter
+			createTables()
+			for _, content := range []string{"a", "b", "c"} {
+				if _, err := insertAd(Ad{AdType: "text", Content: content, RedirectURL: "https://example.com/" + content, Tags: []string{"go"}}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			candidateCache.ttl = bc.ttl
+			candidateCache.Invalidate()
+			defer func() { candidateCache.ttl = defaultAdCacheTTL }()
+
+			counter.queries.Store(0)
+			b.ResetTimer()
+			for range b.N {
+				w := serve(handleRandomAd, newRequest(http.MethodGet, "/api/ad/random?tags=go&track=none", ""))
+				if w.Code != http.StatusOK {
+					b.Fatalf("status %d: %s", w.Code, w.Body)
+				}
+			}
+			b.ReportMetric(float64(counter.queries.Load())/float64(b.N), "queries/op")
+		})
+	}
+}
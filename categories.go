@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// adCategories is the taxonomy an ad's category must come from. It defaults
+// to the IAB content categories (tier 1) and can be replaced with
+// ADSERVER_CATEGORIES.
+var adCategories = []string{
+	"arts-entertainment", "automotive", "business", "careers", "education",
+	"family-parenting", "health-fitness", "food-drink", "hobbies-interests",
+	"home-garden", "law-government-politics", "news", "personal-finance",
+	"society", "science", "pets", "sports", "style-fashion",
+	"technology-computing", "travel", "real-estate", "shopping",
+	"religion-spirituality", "uncategorized", "non-standard-content",
+	"illegal-content",
+}
+
+// normalizeCategory lowercases and trims a category name.
+func normalizeCategory(c string) string {
+	return strings.ToLower(strings.TrimSpace(c))
+}
+
+func knownCategory(c string) bool {
+	for _, known := range adCategories {
+		if normalizeCategory(known) == c {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCategories reads a comma-separated category list from a query
+// parameter, rejecting names outside the taxonomy so a typo can't silently
+// turn an exclusion into a no-op.
+func parseCategories(param, v string) ([]string, error) {
+	var out []string
+	for _, c := range strings.Split(v, ",") {
+		if c = normalizeCategory(c); c == "" {
+			continue
+		}
+		if !knownCategory(c) {
+			return nil, fmt.Errorf("%s: unknown category %q", param, c)
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// categoryAllowed reports whether an ad passes the query's category
+// filters. Requiring categories excludes uncategorized ads.
+func categoryAllowed(a Ad, q adQuery) bool {
+	for _, c := range q.ExcludeCategories {
+		if a.Category == c {
+			return false
+		}
+	}
+	if len(q.Categories) == 0 {
+		return true
+	}
+	for _, c := range q.Categories {
+		if a.Category == c {
+			return true
+		}
+	}
+	return false
+}
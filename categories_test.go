@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCategoryValidation(t *testing.T) {
+	newTestDB(t)
+	for _, tc := range []struct {
+		category string
+		want     int
+	}{
+		{"sports", http.StatusCreated},
+		{" Technology-Computing ", http.StatusCreated},
+		{"", http.StatusCreated},
+		{"gambling", http.StatusBadRequest},
+	} {
+		body := `{"ad_type":"text","content":"ad ` + tc.category + `","redirect_url":"https://example.com","category":"` + tc.category + `"}`
+		if w := serve(handleAddAd, newRequest(http.MethodPost, "/api/ad/add", body)); w.Code != tc.want {
+			t.Errorf("category %q: status %d, want %d: %s", tc.category, w.Code, tc.want, w.Body)
+		}
+	}
+
+	var ads []Ad
+	decodeBody(t, serve(handleListAds, newRequest(http.MethodGet, "/api/ads", "")), http.StatusOK, &ads)
+	stored := map[string]bool{}
+	for _, a := range ads {
+		stored[a.Category] = true
+	}
+	if !stored["sports"] || !stored["technology-computing"] {
+		t.Errorf("stored categories %v, want sports and technology-computing", stored)
+	}
+}
+
+func TestCategoryTargeting(t *testing.T) {
+	newTestDB(t)
+	add := func(content, category string) int {
+		t.Helper()
+		id, err := insertAd(Ad{AdType: "text", Content: content, RedirectURL: "https://example.com/" + content, Tags: []string{"go"}, Category: category})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(id)
+	}
+	sports := add("sports", "sports")
+	news := add("news", "news")
+	plain := add("plain", "")
+
+	served := func(query string) map[int]bool {
+		t.Helper()
+		seen := map[int]bool{}
+		for range 60 {
+			ad, code := randomAd(t, "tags=go&"+query)
+			if code != http.StatusOK {
+				break
+			}
+			seen[ad.ID] = true
+		}
+		return seen
+	}
+	if seen := served("exclude_categories=sports"); seen[sports] || !seen[news] || !seen[plain] {
+		t.Errorf("excluding sports served %v", seen)
+	}
+	if seen := served("exclude_categories=sports,news"); len(seen) != 1 || !seen[plain] {
+		t.Errorf("excluding sports and news served %v, want only ad %d", seen, plain)
+	}
+	if seen := served("categories=news"); len(seen) != 1 || !seen[news] {
+		t.Errorf("requiring news served %v, want only ad %d", seen, news)
+	}
+
+	if _, code := randomAd(t, "exclude_categories=sprots"); code != http.StatusBadRequest {
+		t.Errorf("unknown category: status %d, want 400", code)
+	}
+}
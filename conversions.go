@@ -0,0 +1,63 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// conversionRequest is the optional body of POST /api/conversion/{id}.
+type conversionRequest struct {
+	// Value is the conversion's worth to the advertiser, e.g. order total.
+	Value *float64 `json:"value"`
+}
+
+// handleConversion records a post-click conversion (purchase, signup, ...)
+// for an ad. It is public so advertisers can fire it from their own pages.
+func handleConversion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/conversion/"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid ad ID")
+		return
+	}
+
+	// The body is optional, so an empty one is not an error.
+	var req conversionRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBody)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		respondDecodeError(w, err)
+		return
+	}
+	if req.Value != nil && (*req.Value < 0 || math.IsNaN(*req.Value) || math.IsInf(*req.Value, 0)) {
+		respondError(w, http.StatusBadRequest, "value must be a non-negative number")
+		return
+	}
+
+	var exists int
+	if err := db.QueryRow(`SELECT 1 FROM ads WHERE id = ?`, id).Scan(&exists); err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "ad not found")
+		return
+	} else if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	imp, ok := newImpression(r, id, "conversion")
+	imp.Value = req.Value
+	if ok && !impressionLog.Enqueue(imp) {
+		respondError(w, http.StatusServiceUnavailable, "impression queue full")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"status": "logged"})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestConversionsCountedApartFromClicks(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "converting")
+	for range 4 {
+		postImpression(id, "")
+	}
+	for range 2 {
+		postImpression(id, "action=click")
+	}
+	for _, body := range []string{`{"value": 19.5}`, `{"value": 0.5}`, ""} {
+		w := serve(handleConversion, newRequest(http.MethodPost, "/api/conversion/"+itoa(id), body))
+		decodeBody(t, w, http.StatusOK, nil)
+	}
+	for _, tc := range []struct {
+		target, body string
+		want         int
+	}{
+		{"/api/conversion/" + itoa(id), `{"value": -1}`, http.StatusBadRequest},
+		{"/api/conversion/" + itoa(id), `{"value": "lots"}`, http.StatusBadRequest},
+		{"/api/conversion/999", "", http.StatusNotFound},
+	} {
+		if w := serve(handleConversion, newRequest(http.MethodPost, tc.target, tc.body)); w.Code != tc.want {
+			t.Errorf("POST %s %s: status %d, want %d", tc.target, tc.body, w.Code, tc.want)
+		}
+	}
+	flushImpressions(t)
+
+	var stats []AnalyticsStats
+	decodeBody(t, serve(handleAnalyticsStats, newRequest(http.MethodGet, "/api/analytics/stats", "")), http.StatusOK, &stats)
+	if len(stats) != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	s := stats[0]
+	if s.Views != 4 || s.Clicks != 2 || s.Conversions != 3 || s.ConversionValue != 20 || s.ConversionRate != "150.00%" {
+		t.Errorf("stats = %+v, want 4 views, 2 clicks and 3 conversions worth 20", s)
+	}
+}
@@ -1,28 +1,96 @@
 CREATE TABLE IF NOT EXISTS campaigns (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     name TEXT NOT NULL,
-    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    priority INTEGER NOT NULL DEFAULT 0,
+    tags TEXT,
+    tag_mode TEXT NOT NULL DEFAULT 'merge' CHECK(tag_mode IN ('merge', 'override'))
 );
 CREATE TABLE IF NOT EXISTS ads (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
-    ad_type TEXT NOT NULL CHECK(ad_type IN ('text', 'image')),
+    ad_type TEXT NOT NULL CHECK(ad_type IN ('text', 'image', 'video')),
     content TEXT,
     image_url TEXT,
+    video_url TEXT,
+    video_duration INTEGER,
     redirect_url TEXT NOT NULL,
     tags TEXT,
     campaign_id INTEGER,
     expires_at DATETIME,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    referrer_allow TEXT,
+    referrer_deny TEXT,
+    daily_cap INTEGER NOT NULL DEFAULT 0,
+    images TEXT,
+    content_hash TEXT,
+    paused INTEGER NOT NULL DEFAULT 0,
+    priority INTEGER NOT NULL DEFAULT 0,
+    category TEXT,
+    metadata TEXT,
+    localized_content TEXT,
+    companion_id INTEGER REFERENCES ads(id) ON DELETE SET NULL DEFERRABLE INITIALLY DEFERRED,
+    version INTEGER NOT NULL DEFAULT 1,
+    view_count INTEGER NOT NULL DEFAULT 0,
+    click_count INTEGER NOT NULL DEFAULT 0,
     FOREIGN KEY (campaign_id) REFERENCES campaigns(id) ON DELETE SET NULL
 );
 CREATE TABLE IF NOT EXISTS impressions (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     ad_id INTEGER NOT NULL,
-    action_type TEXT NOT NULL CHECK(action_type IN ('view', 'click')),
+    action_type TEXT NOT NULL CHECK(action_type IN ('view', 'click', 'conversion')),
     ip TEXT,
     user_agent TEXT,
     viewed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    bot INTEGER NOT NULL DEFAULT 0,
+    internal INTEGER NOT NULL DEFAULT 0,
+    referrer TEXT,
+    weight INTEGER NOT NULL DEFAULT 1,
+    value REAL,
+    time_to_click INTEGER,
+    viewable INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY (ad_id) REFERENCES ads(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS audit_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    action TEXT NOT NULL,
+    target_type TEXT NOT NULL,
+    target_id INTEGER,
+    actor TEXT NOT NULL,
+    ip TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS impression_daily (
+    ad_id INTEGER NOT NULL,
+    day TEXT NOT NULL,
+    bot INTEGER NOT NULL DEFAULT 0,
+    internal INTEGER NOT NULL DEFAULT 0,
+    views INTEGER NOT NULL DEFAULT 0,
+    clicks INTEGER NOT NULL DEFAULT 0,
+    conversions INTEGER NOT NULL DEFAULT 0,
+    conversion_value REAL NOT NULL DEFAULT 0,
+    viewable_views INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (ad_id, day, bot, internal),
+    FOREIGN KEY (ad_id) REFERENCES ads(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS uploads (
+    filename TEXT PRIMARY KEY,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS ad_tags (
+    ad_id INTEGER NOT NULL,
+    tag TEXT NOT NULL,
+    PRIMARY KEY (ad_id, tag),
     FOREIGN KEY (ad_id) REFERENCES ads(id) ON DELETE CASCADE
 );
+CREATE TABLE IF NOT EXISTS campaign_tags (
+    campaign_id INTEGER NOT NULL,
+    tag TEXT NOT NULL,
+    PRIMARY KEY (campaign_id, tag),
+    FOREIGN KEY (campaign_id) REFERENCES campaigns(id) ON DELETE CASCADE
+);
 CREATE INDEX IF NOT EXISTS idx_ads_expires ON ads(expires_at);
+CREATE INDEX IF NOT EXISTS idx_ads_content_hash ON ads(content_hash);
+CREATE INDEX IF NOT EXISTS idx_ad_tags_tag ON ad_tags(tag);
+CREATE INDEX IF NOT EXISTS idx_campaign_tags_tag ON campaign_tags(tag);
 CREATE INDEX IF NOT EXISTS idx_impressions_ad ON impressions(ad_id, action_type);
\ No newline at end of file
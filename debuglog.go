@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// debugBodyLimit is how much of each request body the debug log shows.
+const debugBodyLimit = 1024
+
+// redactedHeaders carry credentials and are never written to the debug log.
+var redactedHeaders = map[string]bool{
+	"Authorization": true,
+	"Cookie":        true,
+	csrfHeaderName:  true,
+}
+
+// redactedBodies are the paths whose request bodies are credentials and are
+// never written to the debug log.
+var redactedBodies = map[string]bool{
+	"/api/login": true,
+}
+
+// secretFields matches JSON string fields holding credentials, which are
+// masked in any other body that is logged.
+var secretFields = regexp.MustCompile(`("(?:token|password|secret)"\s*:\s*)"(?:[^"\\]|\\.)*"?`)
+
+// withDebugLog logs every request's method, path, headers and the start of
+// its body, then the response status and duration. It is only installed
+// when ADSERVER_DEBUG_REQUESTS is set, so it costs nothing otherwise.
+func withDebugLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		var body []byte
+		if r.Body != nil {
+			body, _ = io.ReadAll(io.LimitReader(r.Body, debugBodyLimit+1))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		}
+		truncated := ""
+		if len(body) > debugBodyLimit {
+			body, truncated = body[:debugBodyLimit], " (truncated)"
+		}
+		log.Printf("DEBUG --> %s %s headers=%s body=%s%s", r.Method, r.URL.RequestURI(), debugHeaders(r.Header), debugBody(r.URL.Path, body), truncated)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		log.Printf("DEBUG <-- %s %s %d in %s", r.Method, r.URL.Path, rec.status, time.Since(start))
+	})
+}
+
+// debugHeaders formats headers in a stable order with credentials redacted.
+func debugHeaders(h http.Header) string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		value := strings.Join(h[name], ", ")
+		if redactedHeaders[name] {
+			value = "[REDACTED]"
+		}
+		parts = append(parts, name+": "+value)
+	}
+	return "{" + strings.Join(parts, "; ") + "}"
+}
+
+// debugBody quotes a request body for the debug log with credentials masked.
+func debugBody(path string, body []byte) string {
+	if redactedBodies[path] && len(body) > 0 {
+		return "[REDACTED]"
+	}
+	return strconv.Quote(string(secretFields.ReplaceAll(body, []byte(`$1"[REDACTED]"`))))
+}
+
+// statusRecorder remembers the status code a handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, so
+// streaming handlers can still flush.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
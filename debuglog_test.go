@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// debugLogFor serves req through withDebugLog and returns what it logged
+// and the body the handler read.
+func debugLogFor(t *testing.T, req *http.Request) (logged, body string) {
+	t.Helper()
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	h := withDebugLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	return buf.String(), body
+}
+
+func TestDebugLogRedactsAuthorization(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/api/ads", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	req.Header.Set("Cookie", "session=abc123")
+	req.Header.Set("X-Trace", "visible")
+
+	logged, _ := debugLogFor(t, req)
+	for _, secret := range []string{"s3cret", "abc123"} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("log contains %q:\n%s", secret, logged)
+		}
+	}
+	if !strings.Contains(logged, "Authorization: [REDACTED]") || !strings.Contains(logged, "X-Trace: visible") {
+		t.Errorf("log = %s", logged)
+	}
+	if !strings.Contains(logged, "418") {
+		t.Errorf("response status not logged: %s", logged)
+	}
+}
+
+func TestDebugLogRedactsCredentialBodies(t *testing.T) {
+	logged, body := debugLogFor(t, httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(`{"token":"s3cret"}`)))
+	if strings.Contains(logged, "s3cret") || !strings.Contains(logged, "body=[REDACTED]") {
+		t.Errorf("login body logged: %s", logged)
+	}
+	if body != `{"token":"s3cret"}` {
+		t.Errorf("handler read %q", body)
+	}
+
+	logged, _ = debugLogFor(t, httptest.NewRequest(http.MethodPost, "/api/other", strings.NewReader(`{"name":"x","token": "s3cret","password":"hunter\"2"}`)))
+	if strings.Contains(logged, "s3cret") || strings.Contains(logged, "hunter") {
+		t.Errorf("token field logged: %s", logged)
+	}
+	if !strings.Contains(logged, `\"name\":\"x\"`) {
+		t.Errorf("other fields not logged: %s", logged)
+	}
+}
+
+func TestDebugLogTruncatesBody(t *testing.T) {
+	long := `{"token":"` + strings.Repeat("a", debugBodyLimit) + `"}`
+	logged, body := debugLogFor(t, httptest.NewRequest(http.MethodPost, "/api/other", strings.NewReader(long)))
+	if strings.Contains(logged, "aaaa") || !strings.Contains(logged, "(truncated)") {
+		t.Errorf("log = %.200s", logged)
+	}
+	if body != long {
+		t.Error("handler did not get the whole body")
+	}
+}
+
+func TestDebugLogOnlyWhenEnabled(t *testing.T) {
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+	mux := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	serverHandler(mux, false).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/ads", nil))
+	if buf.Len() != 0 {
+		t.Errorf("disabled debug mode logged: %s", buf.String())
+	}
+
+	serverHandler(mux, true).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/ads", nil))
+	if logged := buf.String(); !strings.Contains(logged, "GET /api/ads") || !strings.Contains(logged, "204") {
+		t.Errorf("enabled debug mode logged: %q", logged)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Catalog is the backup document served by /api/export and accepted by
+// /api/import. Its entries use the same shape as the preload JSON files.
+type Catalog struct {
+	Campaigns []Campaign `json:"campaigns"`
+	Ads       []Ad       `json:"ads"`
+}
+
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	catalog := Catalog{Campaigns: []Campaign{}, Ads: []Ad{}}
+
+	rows, err := db.Query(`SELECT ` + campaignColumns + ` FROM campaigns ORDER BY id`)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	for rows.Next() {
+		if c, err := scanCampaign(rows); err == nil {
+			catalog.Campaigns = append(catalog.Campaigns, c)
+		}
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT ` + adColumns + ` FROM ads ORDER BY id`)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	for rows.Next() {
+		if a, err := scanAd(rows); err == nil {
+			catalog.Ads = append(catalog.Ads, a)
+		}
+	}
+	rows.Close()
+
+	w.Header().Set("Content-Disposition", `attachment; filename="adserver-export.json"`)
+	respondJSON(w, http.StatusOK, catalog)
+}
+
+// handleImport upserts a Catalog by id in one transaction, so importing
+// the same document twice leaves the database unchanged.
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	var catalog Catalog
+	if !decodeJSONBody(w, r, &catalog, maxImportBody) {
+		return
+	}
+
+	for i, c := range catalog.Campaigns {
+		if err := validateCampaign(c); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("campaigns[%d]: %v", i, err))
+			return
+		}
+	}
+	for i, ad := range catalog.Ads {
+		if err := validateAd(ad); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("ads[%d]: %v", i, err))
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer tx.Rollback()
+
+	for i, c := range catalog.Campaigns {
+		if err := upsertCampaign(tx, c); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("campaigns[%d]: %v", i, err))
+			return
+		}
+	}
+	var created []int64
+	for i, ad := range catalog.Ads {
+		id, err := upsertAd(tx, ad)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("ads[%d]: %v", i, err))
+			return
+		}
+		if id != 0 {
+			created = append(created, id)
+		}
+	}
+	for _, table := range []string{"campaigns", "ads"} {
+		if err := db.SyncIDs(tx, table); err != nil {
+			respondError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	candidateCache.Invalidate()
+	recordAudit(r, auditImport, "catalog", 0)
+	for _, id := range created {
+		notifyAdCreated(id)
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "imported",
+		"campaigns": len(catalog.Campaigns),
+		"ads":       len(catalog.Ads),
+	})
+}
+
+// exportFlushRows is how many impressions are written between flushes of an
+// NDJSON export.
+const exportFlushRows = 1000
+
+// handleImpressionExport streams raw impressions in a time range as
+// newline-delimited JSON, one impression per line. Rows are written as they
+// are scanned, so memory use doesn't grow with the range.
+func handleImpressionExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	from, to, err := parseRange(r, 24*time.Hour)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	query := `SELECT id, ad_id, action_type, COALESCE(ip, ''), COALESCE(user_agent, ''), viewed_at,
+			COALESCE(referrer, ''), bot, internal, weight, value, viewable
+		FROM impressions
+		WHERE ` + inRangeSQL("viewed_at")
+	args := []interface{}{from.Format(sqlTimeLayout), to.Format(sqlTimeLayout)}
+	if v := r.URL.Query().Get("ad_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "invalid ad_id")
+			return
+		}
+		query += ` AND ad_id = ?`
+		args = append(args, id)
+	}
+	query += ` ORDER BY id`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="impressions.ndjson"`)
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	n := 0
+	for rows.Next() {
+		var imp Impression
+		var value sql.NullFloat64
+		if err := rows.Scan(&imp.ID, &imp.AdID, &imp.ActionType, &imp.IP, &imp.UserAgent, &imp.ViewedAt,
+			&imp.Referrer, &imp.Bot, &imp.Internal, &imp.Weight, &value, &imp.Viewable); err != nil {
+			log.Printf("Impression export: %v", err)
+			return
+		}
+		imp.ViewedAt = storedTime(imp.ViewedAt)
+		if value.Valid {
+			imp.Value = &value.Float64
+		}
+		if err := enc.Encode(imp); err != nil {
+			return // client went away
+		}
+		if n++; n%exportFlushRows == 0 {
+			rc.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		// The status is already sent; a truncated file is all we can signal.
+		log.Printf("Impression export: %v", err)
+	}
+}
+
+func upsertCampaign(tx *Tx, c Campaign) error {
+	var createdAt interface{}
+	if c.CreatedAt != "" {
+		createdAt = c.CreatedAt
+	}
+	cols, values := "", ""
+	var args []interface{}
+	if c.ID != 0 {
+		cols, values, args = "id, ", "?, ", []interface{}{c.ID}
+	}
+	tags := normalizeTags(c.Tags)
+	var campaignID int64
+	err := tx.QueryRow(`INSERT INTO campaigns (`+cols+`name, priority, tags, tag_mode, created_at) VALUES (`+values+`?, ?, ?, ?, COALESCE(?, `+db.Now()+`))
+	                   ON CONFLICT(id) DO UPDATE SET name = excluded.name, priority = excluded.priority, tags = excluded.tags,
+	                   tag_mode = excluded.tag_mode, created_at = excluded.created_at
+	                   RETURNING id`,
+		append(args, c.Name, c.Priority, strings.Join(tags, ","), tagModeValue(c.TagMode), createdAt)...).Scan(&campaignID)
+	if err != nil {
+		return err
+	}
+	return replaceCampaignTags(tx, campaignID, tags)
+}
+
+// upsertAd inserts or overwrites ad, returning its ID if it is a new ad.
+func upsertAd(tx *Tx, ad Ad) (int64, error) {
+	var existed bool
+	if ad.ID != 0 {
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM ads WHERE id = ?)`, ad.ID).Scan(&existed); err != nil {
+			return 0, err
+		}
+	}
+
+	// Keep the exported timestamps so a round trip is lossless.
+	createdAt, updatedAt := sqlTimeValue(ad.CreatedAt), sqlTimeValue(ad.UpdatedAt)
+
+	if existed {
+		// Unlike an update, an import restores the paused state too.
+		set := strings.Join(adWriteColumns, " = ?, ") + " = ?"
+		_, err := tx.Exec(`UPDATE ads SET `+set+`, paused = ?, created_at = COALESCE(?, `+db.Now()+`), updated_at = COALESCE(?, `+db.Now()+`)
+		                   WHERE id = ?`,
+			append(adValues(ad), ad.Paused, createdAt, updatedAt, ad.ID)...)
+		if err != nil {
+			return 0, err
+		}
+		return 0, replaceAdTags(tx, int64(ad.ID), ad.Tags)
+	}
+
+	cols, values := "", ""
+	var args []interface{}
+	if ad.ID != 0 {
+		cols, values, args = "id, ", "?, ", []interface{}{ad.ID}
+	}
+	// A new ad identical to one already stored is skipped, so importing the
+	// same catalog twice doesn't duplicate it.
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM ads WHERE content_hash = ?)`, adContentHash(ad)).Scan(&exists); err != nil || exists {
+		return 0, err
+	}
+	var adID int64
+	err := tx.QueryRow(`INSERT INTO ads (`+cols+strings.Join(adWriteColumns, ", ")+`, paused, created_at, updated_at)
+	                   VALUES (`+values+placeholders(len(adWriteColumns))+`, ?, COALESCE(?, `+db.Now()+`), COALESCE(?, `+db.Now()+`))
+	                   RETURNING id`,
+		append(append(args, adValues(ad)...), ad.Paused, createdAt, updatedAt)...).Scan(&adID)
+	if err != nil {
+		return 0, err
+	}
+	if err := replaceAdTags(tx, adID, ad.Tags); err != nil {
+		return 0, err
+	}
+	return adID, nil
+}
+
+// sqlTimeValue converts an RFC3339 timestamp to sqlTimeLayout, or NULL
+// when it is missing or malformed.
+func sqlTimeValue(ts string) interface{} {
+	if t, err := time.Parse(time.RFC3339, ts); err == nil {
+		return t.UTC().Format(sqlTimeLayout)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	newTestDB(t)
+	campaign, err := insertCampaign(Campaign{Name: "spring", Tags: []string{"sale"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := "2030-01-01T00:00:00Z"
+	if _, err := insertAd(Ad{AdType: "text", Content: "in campaign", RedirectURL: "https://example.com/a", Tags: []string{"go"}, CampaignID: int(campaign), ExpiresAt: &expires}); err != nil {
+		t.Fatal(err)
+	}
+	mustInsertAd(t, "loose", "rust", "web")
+
+	export := func() string {
+		t.Helper()
+		w := serve(handleExport, newRequest(http.MethodGet, "/api/export", ""))
+		decodeBody(t, w, http.StatusOK, nil)
+		return w.Body.String()
+	}
+	before := export()
+
+	newTestDB(t) // wipe
+	for range 2 {
+		w := serve(handleImport, newRequest(http.MethodPost, "/api/import", before))
+		decodeBody(t, w, http.StatusOK, nil)
+	}
+	if after := export(); after != before {
+		t.Errorf("round trip changed the catalog:\nbefore %s\nafter  %s", before, after)
+	}
+}
+
+func TestImpressionExportNDJSON(t *testing.T) {
+	newTestDB(t)
+	a, b := mustInsertAd(t, "a"), mustInsertAd(t, "b")
+	day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	mustLogImpressions(t, a, "view", day.Add(time.Hour), 3)
+	mustLogImpressions(t, a, "click", day.Add(2*time.Hour), 1)
+	mustLogImpressions(t, b, "view", day.Add(3*time.Hour), 2)
+	mustLogImpressions(t, a, "view", day.Add(-time.Hour), 4) // the day before
+
+	lines := func(query string) []Impression {
+		t.Helper()
+		w := serve(handleImpressionExport, newRequest(http.MethodGet, "/api/impressions/export?"+query, ""))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+			t.Fatalf("status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+		}
+		body := w.Body.String()
+		if body != "" && !strings.HasSuffix(body, "\n") {
+			t.Errorf("output doesn't end with a newline: %q", body)
+		}
+		var imps []Impression
+		for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+			if line == "" {
+				continue
+			}
+			var imp Impression
+			if err := json.Unmarshal([]byte(line), &imp); err != nil {
+				t.Fatalf("line %q: %v", line, err)
+			}
+			imps = append(imps, imp)
+		}
+		return imps
+	}
+
+	imps := lines("from=2026-03-01&to=2026-03-01")
+	if len(imps) != 6 {
+		t.Fatalf("exported %d impressions, want the 6 on March 1", len(imps))
+	}
+	if imps[3].ActionType != "click" || imps[3].ViewedAt != "2026-03-01T02:00:00Z" {
+		t.Errorf("fourth line = %+v, want the click at 02:00", imps[3])
+	}
+	if imps := lines("from=2026-03-01&to=2026-03-01&ad_id=" + itoa(b)); len(imps) != 2 || imps[0].AdID != b {
+		t.Errorf("ad %d exported %+v, want its 2 views", b, imps)
+	}
+	if imps := lines("from=2026-04-01&to=2026-04-02"); len(imps) != 0 {
+		t.Errorf("empty range exported %d impressions", len(imps))
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// geoResolver maps a client IP to an ISO country code, or "" when unknown.
+type geoResolver interface {
+	Country(ip string) string
+}
+
+// geoIP is nil when no GeoIP database is configured.
+var geoIP geoResolver
+
+// unknownCountry labels traffic whose IP didn't resolve to a country.
+const unknownCountry = "(unknown)"
+
+// cidrGeoResolver resolves IPs against a list of networks, preferring the
+// most specific one that contains the address.
+type cidrGeoResolver struct {
+	networks  []*net.IPNet
+	countries []string
+}
+
+// loadGeoCSV reads "network,country" rows such as "81.2.69.0/24,GB". A
+// header row and blank lines are ignored.
+func loadGeoCSV(filename string) (*cidrGeoResolver, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	g := &cidrGeoResolver{}
+	cr := csv.NewReader(f)
+	cr.FieldsPerRecord = -1
+	for line := 1; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) < 2 || (line == 1 && rec[0] == "network") {
+			continue
+		}
+		_, network, err := net.ParseCIDR(strings.TrimSpace(rec[0]))
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid network %q", filename, line, rec[0])
+		}
+		g.networks = append(g.networks, network)
+		g.countries = append(g.countries, strings.ToUpper(strings.TrimSpace(rec[1])))
+	}
+	return g, nil
+}
+
+func (g *cidrGeoResolver) Country(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+	country, best := "", -1
+	for i, n := range g.networks {
+		if ones, _ := n.Mask.Size(); ones > best && n.Contains(addr) {
+			country, best = g.countries[i], ones
+		}
+	}
+	return country
+}
+
+// GeoStats is one row of /api/analytics/geo.
+type GeoStats struct {
+	Country string `json:"country"`
+	Views   int    `json:"views"`
+	Clicks  int    `json:"clicks"`
+	CTR     string `json:"ctr"`
+}
+
+// handleGeoStats breaks views and clicks down by the country of the client
+// IP, optionally for a single ad.
+func handleGeoStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	from, to, err := parseRange(r, 7*24*time.Hour)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	query := `
+		SELECT COALESCE(ip, ''),
+			SUM(CASE WHEN action_type = 'view' THEN weight ELSE 0 END),
+			SUM(CASE WHEN action_type = 'click' THEN 1 ELSE 0 END)
+		FROM impressions
+		WHERE ` + inRangeSQL("viewed_at") + `
+			AND ` + trafficCondition(r)
+	args := []interface{}{from.Format(sqlTimeLayout), to.Format(sqlTimeLayout)}
+	if v := r.URL.Query().Get("ad_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "invalid ad_id")
+			return
+		}
+		query += ` AND ad_id = ?`
+		args = append(args, id)
+	}
+	query += ` GROUP BY ip`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer rows.Close()
+
+	// Countries aren't stored, so resolve each distinct IP and fold here.
+	byCountry := map[string]*GeoStats{}
+	for rows.Next() {
+		var ip string
+		var views, clicks int
+		if err := rows.Scan(&ip, &views, &clicks); err != nil {
+			continue
+		}
+		country := ""
+		if geoIP != nil {
+			country = geoIP.Country(ip)
+		}
+		if country == "" {
+			country = unknownCountry
+		}
+		s, ok := byCountry[country]
+		if !ok {
+			s = &GeoStats{Country: country}
+			byCountry[country] = s
+		}
+		s.Views += views
+		s.Clicks += clicks
+	}
+
+	stats := []GeoStats{}
+	for _, s := range byCountry {
+		s.CTR = formatCTR(s.Clicks, s.Views)
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Views != stats[j].Views {
+			return stats[i].Views > stats[j].Views
+		}
+		return stats[i].Country < stats[j].Country
+	})
+
+	respondJSON(w, http.StatusOK, stats)
+}
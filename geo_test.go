@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// fakeGeo resolves IPs from a fixed table.
+type fakeGeo map[string]string
+
+func (g fakeGeo) Country(ip string) string { return g[ip] }
+
+func TestGeoStats(t *testing.T) {
+	newTestDB(t)
+	geoIP = fakeGeo{"81.2.69.1": "GB", "81.2.69.2": "GB", "5.6.7.8": "DE"}
+	defer func() { geoIP = nil }()
+	a, b := mustInsertAd(t, "a"), mustInsertAd(t, "b")
+
+	at := time.Now().Add(-time.Hour).UTC().Format(sqlTimeLayout)
+	for _, imp := range []Impression{
+		{AdID: a, ActionType: "view", IP: "81.2.69.1"},
+		{AdID: a, ActionType: "view", IP: "81.2.69.2"},
+		{AdID: a, ActionType: "click", IP: "81.2.69.2"},
+		{AdID: a, ActionType: "view", IP: "5.6.7.8"},
+		{AdID: a, ActionType: "view", IP: "192.0.2.9"},
+		{AdID: b, ActionType: "view", IP: "5.6.7.8"},
+		{AdID: b, ActionType: "view", IP: "5.6.7.8"},
+	} {
+		imp.ViewedAt = at
+		if err := insertImpression(imp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(query string, want []GeoStats) {
+		t.Helper()
+		var stats []GeoStats
+		decodeBody(t, serve(handleGeoStats, newRequest(http.MethodGet, "/api/analytics/geo"+query, "")), http.StatusOK, &stats)
+		if len(stats) != len(want) {
+			t.Fatalf("%s: got %+v, want %+v", query, stats, want)
+		}
+		for i := range want {
+			if stats[i] != want[i] {
+				t.Errorf("%s: got %+v, want %+v", query, stats, want)
+				break
+			}
+		}
+	}
+	check("?ad_id="+itoa(a), []GeoStats{
+		{Country: "GB", Views: 2, Clicks: 1, CTR: "50.00%"},
+		{Country: unknownCountry, Views: 1, CTR: "0.00%"},
+		{Country: "DE", Views: 1, CTR: "0.00%"},
+	})
+	check("", []GeoStats{
+		{Country: "DE", Views: 3, CTR: "0.00%"},
+		{Country: "GB", Views: 2, Clicks: 1, CTR: "50.00%"},
+		{Country: unknownCountry, Views: 1, CTR: "0.00%"},
+	})
+	check("?from=2020-01-01&to=2020-01-02", nil)
+}
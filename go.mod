@@ -2,4 +2,7 @@ module taggy-adserver
 
 go 1.25.2
 
-require github.com/mattn/go-sqlite3 v1.14.32 // indirect
+require (
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.32
+)
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sqlTimeLayout is how timestamps are stored, in UTC: SQLite's
+// CURRENT_TIMESTAMP format, which Postgres databases use too.
+const sqlTimeLayout = "2006-01-02 15:04:05"
+
+// impressionWriter batches impression inserts off the request path. Handlers
+// enqueue records and return; a single goroutine flushes them in a
+// transaction whenever batchSize records are pending or interval elapses.
+type impressionWriter struct {
+	ch        chan Impression
+	batchSize int
+	interval  time.Duration
+	// block makes Enqueue wait for buffer space instead of dropping.
+	block bool
+
+	dropped atomic.Uint64
+	// failed counts impressions that reached the writer but could not be
+	// stored.
+	failed atomic.Uint64
+	// retry holds clicks from a batch whose transaction failed, to be
+	// written with the next flush. Only the run goroutine touches it.
+	retry []Impression
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+var impressionLog *impressionWriter
+
+// maxClickRetries bounds how many failed clicks are held for the next flush.
+const maxClickRetries = 10000
+
+// insertImpressionSQL also stores, for a click, the seconds since the same
+// client's (IP and user agent) latest view of the ad, when there is one.
+func insertImpressionSQL() string {
+	return `INSERT INTO impressions (ad_id, action_type, ip, user_agent, viewed_at, bot, internal, referrer, weight, value, viewable, time_to_click)
+	VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11,
+		CASE WHEN ?2 = 'click' AND (?3 != '' OR ?4 != '') THEN (
+			SELECT ` + db.Seconds("MAX(viewed_at)", "?5") + `
+			FROM impressions
+			WHERE ad_id = ?1 AND action_type = 'view' AND ip = ?3 AND user_agent = ?4 AND viewed_at <= ?5
+		) END)`
+}
+
+func impressionArgs(imp Impression) []interface{} {
+	return []interface{}{imp.AdID, imp.ActionType, imp.IP, imp.UserAgent, imp.ViewedAt, imp.Bot, imp.Internal, imp.Referrer, max(imp.Weight, 1), imp.Value, imp.Viewable}
+}
+
+// storeImpression inserts an impression and adds it to its ad's view or
+// click count in the same transaction, so the counters always match the
+// impressions table. Like the default analytics, the counters leave out bot
+// and internal traffic.
+func storeImpression(tx *Tx, imp Impression) error {
+	if _, err := tx.Exec(insertImpressionSQL(), impressionArgs(imp)...); err != nil {
+		return err
+	}
+	if imp.Bot || imp.Internal {
+		return nil
+	}
+	var err error
+	switch imp.ActionType {
+	case "view":
+		_, err = tx.Exec(`UPDATE ads SET view_count = view_count + ? WHERE id = ?`, max(imp.Weight, 1), imp.AdID)
+	case "click":
+		_, err = tx.Exec(`UPDATE ads SET click_count = click_count + 1 WHERE id = ?`, imp.AdID)
+	}
+	return err
+}
+
+// insertImpression stores a single impression outside the batch writer.
+func insertImpression(imp Impression) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := storeImpression(tx, imp); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	liveCounts.Record(imp, time.Now())
+	return nil
+}
+
+// CounterFix is an ad whose stored counters disagreed with its impressions,
+// as corrected by reconcileCounts.
+type CounterFix struct {
+	AdID          int `json:"ad_id"`
+	OldViewCount  int `json:"old_view_count"`
+	ViewCount     int `json:"view_count"`
+	OldClickCount int `json:"old_click_count"`
+	ClickCount    int `json:"click_count"`
+}
+
+// reconcileCounts recomputes every ad's view and click counts from the raw
+// and rolled-up impressions, correcting and returning those that drifted.
+func reconcileCounts() ([]CounterFix, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT ads.id, ads.view_count, COALESCE(t.views, 0), ads.click_count, COALESCE(t.clicks, 0)
+		FROM ads
+		LEFT JOIN (
+			SELECT ad_id, SUM(views) AS views, SUM(clicks) AS clicks
+			FROM (` + impressionCountsSQL + `) i
+			WHERE bot = 0 AND internal = 0
+			GROUP BY ad_id
+		) t ON t.ad_id = ads.id
+		WHERE ads.view_count != COALESCE(t.views, 0) OR ads.click_count != COALESCE(t.clicks, 0)
+		ORDER BY ads.id`)
+	if err != nil {
+		return nil, err
+	}
+	fixes := []CounterFix{}
+	for rows.Next() {
+		var f CounterFix
+		if err := rows.Scan(&f.AdID, &f.OldViewCount, &f.ViewCount, &f.OldClickCount, &f.ClickCount); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		fixes = append(fixes, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, f := range fixes {
+		if _, err := tx.Exec(`UPDATE ads SET view_count = ?, click_count = ? WHERE id = ?`, f.ViewCount, f.ClickCount, f.AdID); err != nil {
+			return nil, err
+		}
+	}
+	return fixes, tx.Commit()
+}
+
+// recordImpression logs a view or click for the request, applying the bot,
+// privacy and view sampling rules, and marks a view viewable as told. It
+// reports false only when the queue was full; dropped bots and unsampled
+// views count as handled.
+func recordImpression(r *http.Request, adID int, action string, viewable bool) bool {
+	imp, ok := newImpression(r, adID, action)
+	if ok && action == "view" {
+		imp.Weight, ok = sampleView()
+		imp.Viewable = viewable
+	}
+	return !ok || impressionLog.Enqueue(imp)
+}
+
+// viewableParam is the request's viewable flag. The client asserts it, so
+// callers only believe it on a view the server issued a nonce or view ID
+// for, which can be reported once.
+func viewableParam(r *http.Request) bool {
+	viewable, _ := strconv.ParseBool(r.URL.Query().Get("viewable"))
+	return viewable
+}
+
+// How a served ad's view gets recorded, chosen with the track parameter.
+const (
+	// trackBeacon leaves it to the client, which calls the ad's
+	// impression URL once the ad is actually shown. The default.
+	trackBeacon = "beacon"
+	// trackServer records the view as the ad is served, for clients that
+	// can't fire a beacon.
+	trackServer = "server"
+	// trackNone records nothing, for previews.
+	trackNone = "none"
+)
+
+func parseTracking(r *http.Request) (string, error) {
+	switch mode := r.URL.Query().Get("track"); mode {
+	case "":
+		return trackBeacon, nil
+	case trackBeacon, trackServer, trackNone:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("track must be beacon, server or none")
+	}
+}
+
+// trackServedAd handles the view of an ad served with the given tracking
+// mode, filling in the impression and beacon URLs the response should
+// carry: none unless the client is to beacon, so no view is counted twice.
+func trackServedAd(r *http.Request, base string, ad *Ad, mode string) {
+	switch mode {
+	case trackServer:
+		recordImpression(r, ad.ID, "view", false)
+		return
+	case trackNone:
+		return
+	}
+	view, nonce := newViewID(ad.ID, time.Now())
+	if nonce {
+		ad.ImpressionURL = impressionURL(base, ad.ID, view)
+	} else {
+		ad.ImpressionURL = impressionURL(base, ad.ID, "")
+	}
+	ad.BeaconURL = beaconURL(base, ad.ID, view)
+}
+
+// viewSampleRate logs one in every viewSampleRate views, each stored with
+// that weight so reported totals stay approximately correct. Clicks are
+// never sampled.
+var viewSampleRate = 1
+
+// sampleView decides whether to record a view and with what weight.
+func sampleView() (weight int, keep bool) {
+	if viewSampleRate <= 1 {
+		return 1, true
+	}
+	return viewSampleRate, rand.IntN(viewSampleRate) == 0
+}
+
+func newImpressionWriter(bufferSize, batchSize int, interval time.Duration, block bool) *impressionWriter {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return &impressionWriter{
+		ch:        make(chan Impression, bufferSize),
+		batchSize: batchSize,
+		interval:  interval,
+		block:     block,
+		done:      make(chan struct{}),
+	}
+}
+
+// Start launches the background flusher.
+func (iw *impressionWriter) Start() {
+	go iw.run()
+}
+
+// Enqueue queues an impression for writing. It reports false when the
+// buffer is full and the writer is configured to drop.
+func (iw *impressionWriter) Enqueue(imp Impression) bool {
+	if imp.ViewedAt == "" {
+		imp.ViewedAt = time.Now().UTC().Format(sqlTimeLayout)
+	}
+
+	if iw.block {
+		iw.ch <- imp
+		return true
+	}
+
+	select {
+	case iw.ch <- imp:
+		return true
+	default:
+		iw.dropped.Add(1)
+		return false
+	}
+}
+
+// EnqueueClick queues a click like Enqueue, but when the buffer is full it
+// writes the click synchronously instead of dropping it: clicks are rare
+// and worth more than the latency.
+func (iw *impressionWriter) EnqueueClick(imp Impression) {
+	if imp.ViewedAt == "" {
+		imp.ViewedAt = time.Now().UTC().Format(sqlTimeLayout)
+	}
+
+	select {
+	case iw.ch <- imp:
+		return
+	default:
+	}
+	if iw.block {
+		iw.ch <- imp
+		return
+	}
+	if err := insertImpression(imp); err != nil {
+		iw.failed.Add(1)
+		log.Printf("Failed to record click for ad %d: %v", imp.AdID, err)
+	}
+}
+
+// Close stops accepting impressions and waits for the pending ones to be
+// flushed. Enqueue must not be called after Close.
+func (iw *impressionWriter) Close() {
+	iw.closeOnce.Do(func() {
+		close(iw.ch)
+		<-iw.done
+		if n := iw.dropped.Load(); n > 0 {
+			log.Printf("Impression writer dropped %d impressions (buffer full)", n)
+		}
+		if n := iw.failed.Load(); n > 0 {
+			log.Printf("Impression writer failed to store %d impressions", n)
+		}
+	})
+}
+
+func (iw *impressionWriter) run() {
+	defer close(iw.done)
+
+	ticker := time.NewTicker(iw.interval)
+	defer ticker.Stop()
+
+	batch := make([]Impression, 0, iw.batchSize)
+	for {
+		select {
+		case imp, ok := <-iw.ch:
+			if !ok {
+				iw.flush(batch)
+				return
+			}
+			batch = append(batch, imp)
+			if len(batch) >= iw.batchSize {
+				iw.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 || len(iw.retry) > 0 {
+				iw.flush(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+func (iw *impressionWriter) flush(batch []Impression) {
+	if len(iw.retry) > 0 {
+		batch = append(iw.retry, batch...)
+		iw.retry = nil
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		iw.fail(batch, err)
+		return
+	}
+
+	// A savepoint per impression lets one that can't be stored (its ad was
+	// deleted, say) fail alone. Postgres would otherwise abort the whole
+	// transaction.
+	var stored []Impression
+	for _, imp := range batch {
+		if _, err := tx.Exec(`SAVEPOINT impression`); err != nil {
+			iw.fail(batch, err)
+			tx.Rollback()
+			return
+		}
+		if err := storeImpression(tx, imp); err != nil {
+			iw.failed.Add(1)
+			log.Printf("Failed to insert impression for ad %d: %v", imp.AdID, err)
+			tx.Exec(`ROLLBACK TO impression`)
+		} else {
+			stored = append(stored, imp)
+		}
+		tx.Exec(`RELEASE impression`)
+	}
+
+	if err := tx.Commit(); err != nil {
+		iw.fail(batch, err)
+		return
+	}
+	now := time.Now()
+	for _, imp := range stored {
+		liveCounts.Record(imp, now)
+	}
+}
+
+// fail handles a batch whose transaction could not be written. Views are
+// dropped; clicks are kept for the next flush, up to maxClickRetries.
+func (iw *impressionWriter) fail(batch []Impression, err error) {
+	dropped := 0
+	for _, imp := range batch {
+		if imp.ActionType == "click" && len(iw.retry) < maxClickRetries {
+			iw.retry = append(iw.retry, imp)
+			continue
+		}
+		dropped++
+	}
+	iw.failed.Add(uint64(dropped))
+	log.Printf("Impression flush failed, dropping %d and retrying %d clicks: %v", dropped, len(iw.retry), err)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBufferedImpressionsArePersisted(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "buffered")
+	iw := newImpressionWriter(100, 50, 20*time.Millisecond, false)
+	iw.Start()
+	defer iw.Close()
+
+	for range 3 {
+		if !iw.Enqueue(Impression{AdID: id, ActionType: "view"}) {
+			t.Fatal("Enqueue dropped an impression")
+		}
+	}
+	// The batch is never full, so the interval flushes it.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var n int
+		db.QueryRow(`SELECT COUNT(*) FROM impressions WHERE ad_id = ?`, id).Scan(&n)
+		if n == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of 3 impressions stored after 2s", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestImpressionsFlushedOnShutdown(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "shutdown")
+	iw := newImpressionWriter(100, 50, time.Hour, false)
+	iw.Start()
+
+	for range 5 {
+		iw.Enqueue(Impression{AdID: id, ActionType: "view"})
+	}
+	iw.EnqueueClick(Impression{AdID: id, ActionType: "click"})
+	iw.Close()
+
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM impressions WHERE ad_id = ?`, id).Scan(&n); err != nil || n != 6 {
+		t.Errorf("stored %d impressions after Close, want 6", n)
+	}
+}
+
+func TestFullBufferDropsViewsButNotClicks(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "full")
+	// Not started, so the one-slot buffer stays full.
+	iw := newImpressionWriter(1, 10, time.Hour, false)
+	if !iw.Enqueue(Impression{AdID: id, ActionType: "view"}) {
+		t.Fatal("first view dropped")
+	}
+	if iw.Enqueue(Impression{AdID: id, ActionType: "view"}) {
+		t.Error("view accepted into a full buffer")
+	}
+	if iw.dropped.Load() != 1 {
+		t.Errorf("dropped = %d, want 1", iw.dropped.Load())
+	}
+
+	iw.EnqueueClick(Impression{AdID: id, ActionType: "click"})
+	if n := countImpressions(t, id, "click"); n != 1 {
+		t.Errorf("click written %d times, want directly once", n)
+	}
+}
+
+func TestFailedImpressionDoesNotSinkBatch(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "batch")
+	impressionLog.Enqueue(Impression{AdID: id, ActionType: "view"})
+	impressionLog.Enqueue(Impression{AdID: id + 100, ActionType: "view"}) // no such ad
+	impressionLog.Enqueue(Impression{AdID: id, ActionType: "view"})
+
+	if n := countImpressions(t, id, "view"); n != 2 {
+		t.Errorf("stored %d views of the existing ad, want 2", n)
+	}
+}
+
+func TestFailedClickStillRedirectsAndIsCounted(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "clicked")
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	// Not started, so the one-slot buffer stays full and the click is
+	// written directly, into a table that is gone.
+	saved := impressionLog
+	defer func() { impressionLog = saved }()
+	impressionLog = newImpressionWriter(1, 10, time.Hour, false)
+	impressionLog.Enqueue(Impression{AdID: id, ActionType: "view"})
+	if _, err := db.Exec(`DROP TABLE impressions`); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(handleRedirect, newRequest(http.MethodGet, "/api/redirect/"+itoa(id), ""))
+	if w.Code != redirectStatus || w.Header().Get("Location") != "https://example.com/clicked" {
+		t.Errorf("status %d to %q, want a redirect to the ad", w.Code, w.Header().Get("Location"))
+	}
+	if n := impressionLog.failed.Load(); n != 1 {
+		t.Errorf("failed = %d, want 1", n)
+	}
+	if !strings.Contains(logged.String(), "Failed to record click for ad "+itoa(id)) {
+		t.Errorf("log = %q, want the failed click", logged.String())
+	}
+}
+
+func TestFailedFlushRetriesClicks(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "retried")
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	iw := newImpressionWriter(10, 10, time.Hour, false)
+	iw.fail([]Impression{
+		{AdID: id, ActionType: "click", ViewedAt: time.Now().UTC().Format(sqlTimeLayout)},
+		{AdID: id, ActionType: "view"},
+	}, errors.New("database is locked"))
+	if len(iw.retry) != 1 || iw.failed.Load() != 1 {
+		t.Fatalf("kept %d for retry and failed %d, want the click kept and the view failed", len(iw.retry), iw.failed.Load())
+	}
+
+	iw.flush(nil)
+	if len(iw.retry) != 0 {
+		t.Errorf("%d clicks still waiting after a good flush", len(iw.retry))
+	}
+	if n := countImpressions(t, id, "click"); n != 1 {
+		t.Errorf("stored %d clicks, want the retried one", n)
+	}
+}
+
+func TestServedAdCarriesTrackingURLs(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "tracked")
+
+	req := newRequest(http.MethodGet, "/api/ad/random", "")
+	req.Host = "ads.example.org"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	var ad Ad
+	decodeBody(t, serve(handleRandomAd, req), http.StatusOK, &ad)
+	if want := "https://ads.example.org/api/impression/" + itoa(id); ad.ImpressionURL != want {
+		t.Errorf("impression_url = %q, want %q", ad.ImpressionURL, want)
+	}
+	if want := "https://ads.example.org/api/redirect/" + itoa(id); ad.ClickURL != want {
+		t.Errorf("click_url = %q, want %q", ad.ClickURL, want)
+	}
+
+	withNonces(t)
+	decodeBody(t, serve(handleRandomAd, newRequest(http.MethodGet, "/api/ad/random", "")), http.StatusOK, &ad)
+	u, err := url.Parse(ad.ImpressionURL)
+	if err != nil || u.Path != "/api/impression/"+itoa(id) {
+		t.Fatalf("signed impression_url = %q", ad.ImpressionURL)
+	}
+	nonce := u.Query().Get("nonce")
+	if code := postImpression(id, "nonce="+nonce+"x"); code != http.StatusForbidden {
+		t.Errorf("tampered nonce: status %d, want 403", code)
+	}
+	if code := postImpression(id, "nonce="+nonce); code != http.StatusOK {
+		t.Errorf("issued nonce: status %d, want 200", code)
+	}
+}
+
+func TestViewSampling(t *testing.T) {
+	newTestDB(t)
+	impressionLog.Close()
+	impressionLog = newImpressionWriter(5000, 100, 10*time.Millisecond, false)
+	impressionLog.Start()
+	viewSampleRate = 10
+	defer func() { viewSampleRate = 1 }()
+	id := mustInsertAd(t, "sampled")
+
+	const views, clicks = 2000, 30
+	for range views {
+		if code := postImpression(id, ""); code != http.StatusOK {
+			t.Fatalf("view: status %d", code)
+		}
+	}
+	for range clicks {
+		if code := postImpression(id, "action=click"); code != http.StatusOK {
+			t.Fatalf("click: status %d", code)
+		}
+	}
+
+	// About one view in ten is stored, each weighted ten.
+	if n := countImpressions(t, id, "view"); n < 140 || n > 260 {
+		t.Errorf("stored %d of %d views, want about %d", n, views, views/10)
+	}
+	if n := countImpressions(t, id, "click"); n != clicks {
+		t.Errorf("stored %d of %d clicks; clicks aren't sampled", n, clicks)
+	}
+
+	var stored int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM impressions WHERE action_type = 'view'`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	var stats []AnalyticsStats
+	decodeBody(t, serve(handleAnalyticsStats, newRequest(http.MethodGet, "/api/analytics/stats", "")), http.StatusOK, &stats)
+	if len(stats) != 1 || stats[0].Views != stored*10 || stats[0].Clicks != clicks {
+		t.Errorf("stats = %+v, want %d views (scaled up) and %d clicks", stats, stored*10, clicks)
+	}
+}
+
+func TestStoredIPsAnonymized(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "private")
+	track := func(h http.HandlerFunc, target, ip string) {
+		t.Helper()
+		req := newRequest(http.MethodPost, target, "")
+		req.RemoteAddr = ip
+		if w := serve(h, req); w.Code >= 400 {
+			t.Fatalf("%s: status %d", target, w.Code)
+		}
+	}
+	storedIPs := func() []string {
+		t.Helper()
+		flushImpressions(t)
+		rows, err := db.Query(`SELECT ip FROM impressions ORDER BY id`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var ips []string
+		for rows.Next() {
+			var ip string
+			rows.Scan(&ip)
+			ips = append(ips, ip)
+		}
+		return ips
+	}
+
+	track(handleImpression, "/api/impression/"+itoa(id), "198.51.100.77:1234")
+	if ips := storedIPs(); len(ips) != 1 || ips[0] != "198.51.100.77" {
+		t.Errorf("stored %v, want the full address by default", ips)
+	}
+
+	anonymizeIPs = true
+	defer func() { anonymizeIPs = false }()
+	track(handleImpression, "/api/impression/"+itoa(id), "198.51.100.78:1234")
+	track(handleRedirect, "/api/redirect/"+itoa(id), "[2001:db8:aaaa:bbbb:cccc::1]:1234")
+	ips := storedIPs()
+	if want := []string{"198.51.100.77", "198.51.100.0", "2001:db8:aaaa::"}; !slices.Equal(ips, want) {
+		t.Errorf("stored %v, want %v", ips, want)
+	}
+}
+
+func TestServingPathsTrackViewsAlike(t *testing.T) {
+	newTestDB(t)
+	// Video ads, so VAST has something to serve too.
+	for _, c := range []string{"a", "b"} {
+		if _, err := insertAd(Ad{AdType: "video", Content: c, VideoURL: "https://example.com/" + c + ".mp4", RedirectURL: "https://example.com/" + c, Tags: []string{"go"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	countViews := func() int {
+		t.Helper()
+		flushImpressions(t)
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM impressions WHERE action_type = 'view'`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(`DELETE FROM impressions`); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	for _, tc := range []struct {
+		name   string
+		h      http.HandlerFunc
+		target string
+		served int
+	}{
+		{"random", handleRandomAd, "/api/ad/random?tags=go", 1},
+		{"random xml", handleRandomAd, "/api/ad/random?tags=go&format=xml", 1},
+		{"vast", handleRandomAd, "/api/ad/random?tags=go&format=vast", 1},
+		{"multiple", handleRandomAds, "/api/ads/random?tags=go&count=2", 2},
+		{"render", handleRenderAd, "/api/ad/render?tags=go", 1},
+	} {
+		for _, mode := range []struct {
+			track string
+			views int
+			urls  bool
+		}{
+			{"", 0, true}, // the client beacons
+			{"&track=beacon", 0, true},
+			{"&track=server", tc.served, false},
+			{"&track=none", 0, false},
+		} {
+			w := serve(tc.h, newRequest(http.MethodGet, tc.target+mode.track, ""))
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s%s: status %d", tc.name, mode.track, w.Code)
+			}
+			if n := countViews(); n != mode.views {
+				t.Errorf("%s%s: logged %d views, want %d", tc.name, mode.track, n, mode.views)
+			}
+			body := w.Body.String()
+			if has := strings.Contains(body, "/api/impression/") || strings.Contains(body, "/api/beacon/"); has != mode.urls {
+				t.Errorf("%s%s: tracking URL in response = %v, want %v", tc.name, mode.track, has, mode.urls)
+			}
+		}
+		if w := serve(tc.h, newRequest(http.MethodGet, tc.target+"&track=always", "")); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: unknown track mode: status %d, want 400", tc.name, w.Code)
+		}
+	}
+}
+
+func TestCountersMatchImpressions(t *testing.T) {
+	newTestDB(t)
+	popular, quiet := mustInsertAd(t, "popular"), mustInsertAd(t, "quiet")
+	networks, err := parseNetworks([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	internalNetworks = networks
+	defer func() { internalNetworks = nil }()
+
+	hit := func(h http.HandlerFunc, target, ip string) {
+		t.Helper()
+		req := newRequest(http.MethodPost, target, "")
+		req.RemoteAddr = ip + ":1234"
+		if w := serve(h, req); w.Code >= 400 {
+			t.Fatalf("%s: status %d", target, w.Code)
+		}
+	}
+	for range 5 {
+		hit(handleImpression, "/api/impression/"+itoa(popular), "198.51.100.1")
+	}
+	hit(handleImpression, "/api/impression/"+itoa(popular), "10.0.0.1") // internal
+	hit(handleImpression, "/api/impression/"+itoa(quiet), "198.51.100.2")
+	hit(handleRedirect, "/api/redirect/"+itoa(popular), "198.51.100.1")
+	hit(handleRedirect, "/api/redirect/"+itoa(popular), "198.51.100.3")
+	hit(handleImpression, "/api/impression/"+itoa(quiet)+"?action=click", "198.51.100.2")
+	flushImpressions(t)
+
+	for _, id := range []int{popular, quiet} {
+		var views, clicks int
+		if err := db.QueryRow(`SELECT COUNT(CASE WHEN action_type = 'view' THEN 1 END), COUNT(CASE WHEN action_type = 'click' THEN 1 END)
+			FROM impressions WHERE ad_id = ? AND bot = 0 AND internal = 0`, id).Scan(&views, &clicks); err != nil {
+			t.Fatal(err)
+		}
+		if ad := mustGetAd(t, id); ad.ViewCount != views || ad.ClickCount != clicks {
+			t.Errorf("ad %d counters = %d views, %d clicks; impressions table has %d and %d", id, ad.ViewCount, ad.ClickCount, views, clicks)
+		}
+	}
+	if ad := mustGetAd(t, popular); ad.ViewCount != 5 || ad.ClickCount != 2 {
+		t.Errorf("popular = %d views, %d clicks; want 5 and 2", ad.ViewCount, ad.ClickCount)
+	}
+	if fixes, err := reconcileCounts(); err != nil || len(fixes) != 0 {
+		t.Errorf("reconcileCounts = %+v, %v; want nothing to fix", fixes, err)
+	}
+
+	var ads []Ad
+	decodeBody(t, serve(handleListAds, newRequest(http.MethodGet, "/api/ads?sort=views", "")), http.StatusOK, &ads)
+	if got := adIDs(ads); !slices.Equal(got, []int{popular, quiet}) {
+		t.Errorf("sorted by views: %v, want %v", got, []int{popular, quiet})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// liveWindow is the span /api/analytics/live reports on, kept as one bucket
+// per second.
+const liveWindow = 60
+
+// liveCounter counts recent views and clicks per ad in memory, so the live
+// report never touches the database. Only impressions that were stored are
+// counted, so they trail live traffic by up to one impression flush. Bot and
+// internal traffic is left out, as in the default analytics.
+type liveCounter struct {
+	mu     sync.Mutex
+	ads    map[int]*liveAd
+	pruned time.Time
+}
+
+// liveAd is a ring of per-second buckets; a bucket whose second has passed
+// out of the window is reset before it is reused.
+type liveAd struct {
+	seconds [liveWindow]int64
+	views   [liveWindow]int
+	clicks  [liveWindow]int
+}
+
+var liveCounts = &liveCounter{ads: map[int]*liveAd{}}
+
+// Record counts a stored impression in the second it was viewed, unless
+// that has already left the window. Views count with their sampling weight.
+func (c *liveCounter) Record(imp Impression, now time.Time) {
+	if imp.Bot || imp.Internal {
+		return
+	}
+	viewed, err := time.Parse(sqlTimeLayout, imp.ViewedAt)
+	sec := viewed.Unix()
+	if err != nil || sec <= now.Unix()-liveWindow || sec > now.Unix() {
+		return
+	}
+	i := sec % liveWindow
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prune(now)
+	a, ok := c.ads[imp.AdID]
+	if !ok {
+		a = &liveAd{}
+		c.ads[imp.AdID] = a
+	}
+	if a.seconds[i] != sec {
+		a.seconds[i], a.views[i], a.clicks[i] = sec, 0, 0
+	}
+	switch imp.ActionType {
+	case "view":
+		a.views[i] += max(imp.Weight, 1)
+	case "click":
+		a.clicks[i]++
+	}
+}
+
+// prune forgets ads with no traffic left in the window, at most once per
+// window, so ads that stop getting traffic don't stay in memory.
+func (c *liveCounter) prune(now time.Time) {
+	if now.Sub(c.pruned) < liveWindow*time.Second {
+		return
+	}
+	c.pruned = now
+	oldest := now.Unix() - liveWindow
+	for id, a := range c.ads {
+		if a.latest() <= oldest {
+			delete(c.ads, id)
+		}
+	}
+}
+
+// latest is the last second the ad had traffic in.
+func (a *liveAd) latest() int64 {
+	var latest int64
+	for _, sec := range a.seconds {
+		latest = max(latest, sec)
+	}
+	return latest
+}
+
+// LiveStats is one row of /api/analytics/live: an ad's views and clicks
+// over the last minute.
+type LiveStats struct {
+	AdID            int `json:"ad_id"`
+	ViewsPerMinute  int `json:"views_per_minute"`
+	ClicksPerMinute int `json:"clicks_per_minute"`
+}
+
+// Snapshot sums each ad's buckets still inside the window, forgetting ads
+// with no recent traffic.
+func (c *liveCounter) Snapshot(now time.Time) []LiveStats {
+	oldest := now.Unix() - liveWindow
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := []LiveStats{}
+	for id, a := range c.ads {
+		s := LiveStats{AdID: id}
+		for i, sec := range a.seconds {
+			if sec > oldest {
+				s.ViewsPerMinute += a.views[i]
+				s.ClicksPerMinute += a.clicks[i]
+			}
+		}
+		if s.ViewsPerMinute == 0 && s.ClicksPerMinute == 0 {
+			delete(c.ads, id)
+			continue
+		}
+		stats = append(stats, s)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].ViewsPerMinute != stats[j].ViewsPerMinute {
+			return stats[i].ViewsPerMinute > stats[j].ViewsPerMinute
+		}
+		return stats[i].AdID < stats[j].AdID
+	})
+	return stats
+}
+
+// handleLiveStats reports per-ad views and clicks over the last minute from
+// memory. Counts are per process and start from zero on restart.
+func handleLiveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	respondJSON(w, http.StatusOK, liveCounts.Snapshot(time.Now()))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLiveCountsOnlyStoredImpressions(t *testing.T) {
+	newTestDB(t)
+	liveCounts = &liveCounter{ads: map[int]*liveAd{}}
+	id := mustInsertAd(t, "live")
+
+	impressionLog.Enqueue(Impression{AdID: id, ActionType: "view"})
+	impressionLog.Enqueue(Impression{AdID: id + 1000, ActionType: "view"})
+	impressionLog.EnqueueClick(Impression{AdID: id + 1000, ActionType: "click"})
+	flushImpressions(t)
+
+	stats := liveCounts.Snapshot(time.Now())
+	if len(stats) != 1 || stats[0] != (LiveStats{AdID: id, ViewsPerMinute: 1}) {
+		t.Errorf("stats = %+v, want one view of ad %d only", stats, id)
+	}
+}
+
+func TestLiveCountsIgnoreOldImpressions(t *testing.T) {
+	c := &liveCounter{ads: map[int]*liveAd{}}
+	now := time.Now()
+	c.Record(Impression{AdID: 1, ActionType: "view", ViewedAt: now.Add(-2 * time.Minute).UTC().Format(sqlTimeLayout)}, now)
+	if len(c.ads) != 0 {
+		t.Errorf("an impression from two minutes ago was counted")
+	}
+}
+
+func TestLiveCountsPruneIdleAds(t *testing.T) {
+	c := &liveCounter{ads: map[int]*liveAd{}}
+	start := time.Now()
+	for id := 1; id <= 100; id++ {
+		c.Record(Impression{AdID: id, ActionType: "view", ViewedAt: start.UTC().Format(sqlTimeLayout)}, start)
+	}
+
+	later := start.Add(2 * time.Minute)
+	c.Record(Impression{AdID: 1, ActionType: "click", ViewedAt: later.UTC().Format(sqlTimeLayout)}, later)
+	if len(c.ads) != 1 {
+		t.Errorf("%d ads kept, want only the one with recent traffic", len(c.ads))
+	}
+	if stats := c.Snapshot(later); len(stats) != 1 || stats[0] != (LiveStats{AdID: 1, ClicksPerMinute: 1}) {
+		t.Errorf("stats = %+v", stats)
+	}
+}
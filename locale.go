@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// languageTag matches the BCP 47 tags localized content is keyed by, once
+// normalized: "fr", "pt-br", "zh-hant".
+var languageTag = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+
+// normalizeLanguage lowercases a language tag and accepts "_" for "-", so
+// "pt_BR" and "pt-br" are the same key.
+func normalizeLanguage(tag string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+}
+
+// requestLanguages lists the languages a request asks for, most preferred
+// first: the lang parameter if given, otherwise Accept-Language by quality.
+func requestLanguages(r *http.Request) []string {
+	if lang := normalizeLanguage(r.URL.Query().Get("lang")); lang != "" {
+		return []string{lang}
+	}
+
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var prefs []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = normalizeLanguage(tag)
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			prefs = append(prefs, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+
+	langs := make([]string, len(prefs))
+	for i, p := range prefs {
+		langs[i] = p.tag
+	}
+	return langs
+}
+
+// localize replaces a served ad's content with its variant for the first
+// of langs it has, trying each tag and then its primary language ("fr-ca",
+// then "fr"). It returns the language chosen, or "" when the default
+// content stays. The variants themselves are dropped from the response.
+func localize(ad *Ad, langs []string) string {
+	variants := ad.LocalizedContent
+	ad.LocalizedContent = nil
+	for _, lang := range langs {
+		primary, _, _ := strings.Cut(lang, "-")
+		for _, key := range []string{lang, primary} {
+			if content, ok := variants[key]; ok {
+				ad.Content = content
+				return key
+			}
+		}
+	}
+	return ""
+}
+
+// setContentLanguage labels a response whose content depends on the
+// request's languages.
+func setContentLanguage(w http.ResponseWriter, lang string) {
+	w.Header().Add("Vary", "Accept-Language")
+	if lang != "" {
+		w.Header().Set("Content-Language", lang)
+	}
+}
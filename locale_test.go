@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLocalizedContent(t *testing.T) {
+	newTestDB(t)
+	if _, err := insertAd(Ad{AdType: "text", Content: "Hello", RedirectURL: "https://example.com", Tags: []string{"greeting"},
+		LocalizedContent: map[string]string{"fr": "Bonjour", "pt-br": "Olá"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		query, acceptLanguage string
+		content, contentLang  string
+	}{
+		{"", "", "Hello", ""},
+		{"&lang=fr", "", "Bonjour", "fr"},
+		{"&lang=fr-CA", "", "Bonjour", "fr"},
+		{"&lang=pt_BR", "", "Olá", "pt-br"},
+		{"&lang=de", "", "Hello", ""},
+		{"", "de-DE, fr;q=0.8, pt-BR;q=0.9", "Olá", "pt-br"},
+		{"", "de, es;q=0.5", "Hello", ""},
+		{"&lang=fr", "pt-BR", "Bonjour", "fr"}, // lang wins
+	} {
+		req := newRequest(http.MethodGet, "/api/ad/random?track=none&tags=greeting"+tc.query, "")
+		if tc.acceptLanguage != "" {
+			req.Header.Set("Accept-Language", tc.acceptLanguage)
+		}
+		w := serve(handleRandomAd, req)
+		var ad Ad
+		decodeBody(t, w, http.StatusOK, &ad)
+		if ad.Content != tc.content || w.Header().Get("Content-Language") != tc.contentLang {
+			t.Errorf("%q, Accept-Language %q: content %q in %q, want %q in %q",
+				tc.query, tc.acceptLanguage, ad.Content, w.Header().Get("Content-Language"), tc.content, tc.contentLang)
+		}
+		if ad.LocalizedContent != nil {
+			t.Errorf("%q: served every variant: %v", tc.query, ad.LocalizedContent)
+		}
+	}
+
+	body := `{"ad_type":"text","content":"x","redirect_url":"https://example.com","localized_content":{"not a language":"x"}}`
+	if w := serve(handleAddAd, newRequest(http.MethodPost, "/api/ad/add", body)); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid language key: status %d, want 400", w.Code)
+	}
+}
@@ -1,58 +1,163 @@
 package main
 
 import (
-	"crypto/rand"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
 	"io"
 	"log"
-	"math/big"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
-
-	_ "github.com/mattn/go-sqlite3"
+	"unicode/utf8"
 )
 
 type Ad struct {
-	ID          int      `json:"id"`
-	AdType      string   `json:"ad_type"`
-	Content     string   `json:"content,omitempty"`
-	ImageURL    string   `json:"image_url,omitempty"`
-	RedirectURL string   `json:"redirect_url"`
-	Tags        []string `json:"tags,omitempty"`
-	CampaignID  int      `json:"campaign_id,omitempty"`
-	ExpiresAt   *string  `json:"expires_at,omitempty"`
+	XMLName  xml.Name `json:"-" xml:"ad"`
+	ID       int      `json:"id" xml:"id,attr"`
+	AdType   string   `json:"ad_type" xml:"ad_type"`
+	Content  string   `json:"content,omitempty" xml:"content,omitempty"`
+	ImageURL string   `json:"image_url,omitempty" xml:"image_url,omitempty"`
+	// Images lists alternative sizes of an image ad for responsive srcset
+	// rendering. image_url defaults to the widest of them.
+	Images   []AdImage `json:"images,omitempty" xml:"images>image,omitempty"`
+	VideoURL string    `json:"video_url,omitempty" xml:"video_url,omitempty"`
+	// VideoDuration is the video length in seconds.
+	VideoDuration int      `json:"video_duration,omitempty" xml:"video_duration,omitempty"`
+	RedirectURL   string   `json:"redirect_url" xml:"redirect_url"`
+	Tags          []string `json:"tags,omitempty" xml:"tags>tag,omitempty"`
+	// Category is one entry of the configured taxonomy (IAB tier-1 names
+	// by default), which publishers can require or exclude.
+	Category   string  `json:"category,omitempty" xml:"category,omitempty"`
+	CampaignID int     `json:"campaign_id,omitempty" xml:"campaign_id,omitempty"`
+	ExpiresAt  *string `json:"expires_at,omitempty" xml:"expires_at,omitempty"`
+	CreatedAt  string  `json:"created_at,omitempty" xml:"created_at,omitempty"`
+	UpdatedAt  string  `json:"updated_at,omitempty" xml:"updated_at,omitempty"`
+	// ReferrerAllow limits serving to these referring domains (and their
+	// subdomains); ReferrerDeny never serves to them.
+	ReferrerAllow []string `json:"referrer_allow,omitempty" xml:"referrer_allow>domain,omitempty"`
+	ReferrerDeny  []string `json:"referrer_deny,omitempty" xml:"referrer_deny>domain,omitempty"`
+	// DailyCap stops serving the ad once it has this many views today
+	// (server time). 0 means uncapped.
+	DailyCap int `json:"daily_cap,omitempty" xml:"daily_cap,omitempty"`
+	// Paused ads are kept but not served until resumed.
+	Paused bool `json:"paused,omitempty" xml:"paused,omitempty"`
+	// Priority is the inventory tier: an ad is only served when no matching
+	// ad has a higher priority (e.g. guaranteed above remnant).
+	Priority int `json:"priority,omitempty" xml:"priority,omitempty"`
+	// CampaignPriority is read from the ad's campaign and breaks ties
+	// between ads of equal Priority.
+	CampaignPriority int `json:"-" xml:"-"`
+	// CampaignTags and CampaignTagMode are read from the ad's campaign;
+	// see targetingTags.
+	CampaignTags    []string `json:"-" xml:"-"`
+	CampaignTagMode string   `json:"-" xml:"-"`
+	// Metadata holds advertiser-defined key/value pairs, such as an external
+	// creative id, that the server stores but never interprets.
+	Metadata map[string]string `json:"metadata,omitempty" xml:"-"`
+	// LocalizedContent holds Content translated per language tag; served
+	// ads carry the variant for the visitor's language instead.
+	LocalizedContent map[string]string `json:"localized_content,omitempty" xml:"-"`
+	// CompanionID names an ad shown alongside this one, such as a tile next
+	// to a banner. Companion is filled in on served ads that ask for it.
+	CompanionID int `json:"companion_id,omitempty" xml:"companion_id,omitempty"`
+	Companion   *Ad `json:"companion,omitempty" xml:"companion>ad,omitempty"`
+	// ViewCount and ClickCount are the ad's lifetime human views and clicks,
+	// kept on the ad as impressions are stored so listing by popularity
+	// needs no join.
+	ViewCount  int `json:"view_count,omitempty" xml:"view_count,omitempty"`
+	ClickCount int `json:"click_count,omitempty" xml:"click_count,omitempty"`
+	// Version counts the ad's changes. An update carrying the version it
+	// read is rejected once someone else has changed the ad since.
+	Version int `json:"version,omitempty" xml:"version,omitempty"`
+	// Tracking URLs are only filled in on served ads (/api/ad/random).
+	ImpressionURL string `json:"impression_url,omitempty" xml:"impression_url,omitempty"`
+	// BeaconURL reports the same view as ImpressionURL, for sendBeacon and
+	// image pixels; use one or the other.
+	BeaconURL string `json:"beacon_url,omitempty" xml:"beacon_url,omitempty"`
+	ClickURL  string `json:"click_url,omitempty" xml:"click_url,omitempty"`
+}
+
+// AdImage is one rendition of an image ad.
+type AdImage struct {
+	URL   string `json:"url" xml:"url,attr"`
+	Width int    `json:"width" xml:"width,attr"`
 }
 
 type Campaign struct {
-	ID        int    `json:"id"`
-	Name      string `json:"name"`
-	CreatedAt string `json:"created_at"`
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	// Priority ranks competing campaigns: among otherwise equal ads, those
+	// in the highest-priority campaign are served.
+	Priority int `json:"priority,omitempty"`
+	// Tags are default tags for the campaign's ads. With TagMode "merge"
+	// (the default) they are added to each ad's own tags when matching; with
+	// "override" they replace them. Stored ad tags are never changed.
+	Tags      []string `json:"tags,omitempty"`
+	TagMode   string   `json:"tag_mode,omitempty"`
+	CreatedAt string   `json:"created_at"`
 }
 
 type Impression struct {
 	ID         int    `json:"id"`
 	AdID       int    `json:"ad_id"`
-	ActionType string `json:"action_type"` // "view" or "click"
+	ActionType string `json:"action_type"` // "view", "click" or "conversion"
 	IP         string `json:"ip"`
 	UserAgent  string `json:"user_agent"`
 	ViewedAt   string `json:"viewed_at"`
+	Referrer   string `json:"referrer,omitempty"`
+	Bot        bool   `json:"bot,omitempty"`
+	// Internal marks traffic from ADSERVER_INTERNAL_IP_RANGES.
+	Internal bool `json:"internal,omitempty"`
+	// Weight is how many views this row stands for when views are sampled.
+	Weight int `json:"weight,omitempty"`
+	// Viewable marks a view the client reported as meeting the
+	// viewability threshold, on a nonce or view ID the server issued.
+	Viewable bool `json:"viewable,omitempty"`
+	// Value is the advertiser-reported worth of a conversion.
+	Value *float64 `json:"value,omitempty"`
 }
 
 type AnalyticsStats struct {
-	AdID       int    `json:"ad_id"`
-	Views      int    `json:"views"`
-	Clicks     int    `json:"clicks"`
-	CTR        string `json:"ctr"`
-	AdType     string `json:"ad_type"`
-	AdContent  string `json:"ad_content"`
-	ImageURL   string `json:"image_url"`
-	CampaignID int    `json:"campaign_id"`
+	AdID  int `json:"ad_id"`
+	Views int `json:"views"`
+	// ViewableViews are the views reported as viewable; ViewableRate is
+	// their share of all views.
+	ViewableViews int    `json:"viewable_views"`
+	ViewableRate  string `json:"viewable_rate"`
+	// UniqueViews counts distinct (ip, user_agent) pairs among the views.
+	UniqueViews int    `json:"unique_views"`
+	Clicks      int    `json:"clicks"`
+	CTR         string `json:"ctr"`
+	Conversions int    `json:"conversions"`
+	// ConversionRate is conversions per click.
+	ConversionRate  string  `json:"conversion_rate"`
+	ConversionValue float64 `json:"conversion_value"`
+	// AvgTimeToClick is the mean number of seconds between a client's view
+	// and click, over clicks that followed a recorded view; nil without any.
+	AvgTimeToClick *float64 `json:"avg_time_to_click,omitempty"`
+	AdType         string   `json:"ad_type"`
+	AdContent      string   `json:"ad_content"`
+	ImageURL       string   `json:"image_url"`
+	CampaignID     int      `json:"campaign_id"`
 }
 
 // Config
@@ -62,69 +167,370 @@ const (
 	preloadCampaigns   = "campaigns.json"
 	preloadImpressions = "impressions.json"
 	apiTokenEnvVar     = "ADSERVER_API_TOKEN"
-	uploadDir          = "./static/images"
-	maxUploadSize      = 10 << 20 // 10MB
+	adCacheTTLEnvVar   = "ADSERVER_AD_CACHE_TTL"
+	defaultAdCacheTTL  = 30 * time.Second
+
+	databaseURLEnvVar       = "ADSERVER_DATABASE_URL"
+	dbConnectTimeoutEnvVar  = "ADSERVER_DB_CONNECT_TIMEOUT"
+	defaultDBConnectTimeout = 30 * time.Second
+
+	corsOriginsEnvVar     = "ADSERVER_CORS_ORIGINS"
+	corsMaxAgeEnvVar      = "ADSERVER_CORS_MAX_AGE"
+	corsCredentialsEnvVar = "ADSERVER_CORS_CREDENTIALS"
+	defaultCORSMaxAge     = 24 * time.Hour
+
+	preloadDirEnvVar         = "ADSERVER_PRELOAD_DIR"
+	preloadAdsEnvVar         = "ADSERVER_PRELOAD_ADS"
+	preloadCampaignsEnvVar   = "ADSERVER_PRELOAD_CAMPAIGNS"
+	preloadImpressionsEnvVar = "ADSERVER_PRELOAD_IMPRESSIONS"
+	noPreloadEnvVar          = "ADSERVER_NO_PRELOAD"
+	strictPreloadEnvVar      = "ADSERVER_STRICT_PRELOAD"
+
+	impressionNoncesEnvVar = "ADSERVER_IMPRESSION_NONCES"
+	nonceTTLEnvVar         = "ADSERVER_NONCE_TTL"
+	defaultNonceTTL        = 5 * time.Minute
+
+	maxCandidatesEnvVar  = "ADSERVER_MAX_CANDIDATES"
+	defaultMaxCandidates = 10000
+
+	impressionBufferEnvVar       = "ADSERVER_IMPRESSION_BUFFER"
+	impressionBatchEnvVar        = "ADSERVER_IMPRESSION_BATCH"
+	impressionFlushEnvVar        = "ADSERVER_IMPRESSION_FLUSH_INTERVAL"
+	impressionBackpressureEnvVar = "ADSERVER_IMPRESSION_BACKPRESSURE" // "drop" (default) or "block"
+	impressionSampleEnvVar       = "ADSERVER_IMPRESSION_SAMPLE_RATE"  // log 1 in N views
+	impressionRetentionEnvVar    = "ADSERVER_IMPRESSION_RETENTION"
+	defaultImpressionBuffer      = 1024
+	defaultImpressionBatch       = 100
+	defaultImpressionFlush       = time.Second
+
+	fallbackAdEnvVar = "ADSERVER_FALLBACK_AD_ID"
+
+	selectionSeedEnvVar = "ADSERVER_SELECTION_SEED"
+
+	stickyTTLEnvVar  = "ADSERVER_STICKY_TTL"
+	defaultStickyTTL = 30 * time.Minute
+
+	exploreRateEnvVar      = "ADSERVER_EXPLORE_RATE"
+	exploreMaxViewsEnvVar  = "ADSERVER_EXPLORE_MAX_VIEWS"
+	defaultExploreMaxViews = 1000
+
+	debugRequestsEnvVar = "ADSERVER_DEBUG_REQUESTS"
+	prettyJSONEnvVar    = "ADSERVER_PRETTY_JSON"
+	readOnlyEnvVar      = "ADSERVER_READ_ONLY"
+
+	botTrafficEnvVar     = "ADSERVER_BOT_TRAFFIC" // "tag" (default) or "drop"
+	botUAPatternsEnvVar  = "ADSERVER_BOT_UA_PATTERNS"
+	botIPRangesEnvVar    = "ADSERVER_BOT_IP_RANGES"
+	internalIPsEnvVar    = "ADSERVER_INTERNAL_IP_RANGES"
+	anonymizeIPsEnvVar   = "ADSERVER_ANONYMIZE_IPS"
+	optOutPolicyEnvVar   = "ADSERVER_OPT_OUT_POLICY" // "ignore" (default), "anonymous" or "skip"
+	requireConsentEnvVar = "ADSERVER_REQUIRE_CONSENT"
+
+	geoIPCSVEnvVar = "ADSERVER_GEOIP_CSV"
+
+	sessionTTLEnvVar  = "ADSERVER_SESSION_TTL"
+	defaultSessionTTL = 12 * time.Hour
+
+	webhookURLEnvVar    = "ADSERVER_WEBHOOK_URL"
+	webhookSecretEnvVar = "ADSERVER_WEBHOOK_SECRET"
+
+	maxUploadSizeEnvVar  = "ADSERVER_MAX_UPLOAD_SIZE"
+	uploadTypesEnvVar    = "ADSERVER_UPLOAD_TYPES"
+	defaultMaxUploadSize = 10 << 20 // 10MB
+
+	svgUploadsEnvVar = "ADSERVER_SVG_UPLOADS" // "reject" (default) or "sanitize"
+
+	maxJSONBodyEnvVar    = "ADSERVER_MAX_JSON_BODY"
+	maxImportBodyEnvVar  = "ADSERVER_MAX_IMPORT_BODY"
+	defaultMaxJSONBody   = 1 << 20  // 1MB
+	defaultMaxImportBody = 50 << 20 // 50MB
+
+	redirectStatusEnvVar = "ADSERVER_REDIRECT_STATUS"
+
+	maxContentLengthEnvVar  = "ADSERVER_MAX_CONTENT_LENGTH"
+	maxURLLengthEnvVar      = "ADSERVER_MAX_URL_LENGTH"
+	defaultMaxContentLength = 5000
+	defaultMaxURLLength     = 2048
+
+	maxTagsEnvVar       = "ADSERVER_MAX_TAGS"
+	maxTagLengthEnvVar  = "ADSERVER_MAX_TAG_LENGTH"
+	defaultMaxTags      = 20
+	defaultMaxTagLength = 50
+
+	categoriesEnvVar = "ADSERVER_CATEGORIES"
 )
 
 var (
-	db *sql.DB
-	// Allow all origins for development (restrict in production)
+	db Repository
+	// Allow all origins for development; restrict with ADSERVER_CORS_ORIGINS
+	// in production.
 	allowedOrigins = []string{"*"}
 	apiToken       string
 )
 
 func main() {
+	noPreload := flag.Bool("no-preload", envBool(noPreloadEnvVar, false), "start against the existing database without loading the JSON preload files")
+	strictPreload := flag.Bool("strict-preload", envBool(strictPreloadEnvVar, false), "abort startup if a preload file is invalid or has records that can't be loaded")
+	flag.Parse()
+
 	// Validate API token on startup
 	apiToken = strings.TrimSpace(os.Getenv(apiTokenEnvVar))
 	if apiToken == "" {
 		log.Fatal("ERROR: API token not set. Set ADSERVER_API_TOKEN environment variable.")
 	}
 
+	candidateCache.ttl = envDuration(adCacheTTLEnvVar, defaultAdCacheTTL)
+	maxCandidates = envInt(maxCandidatesEnvVar, defaultMaxCandidates)
+	fallbackAdID = envInt(fallbackAdEnvVar, 0)
+	if v := strings.TrimSpace(os.Getenv(exploreRateEnvVar)); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			log.Fatalf("%s must be a number from 0 to 1, got %q", exploreRateEnvVar, v)
+		}
+		exploreRate = rate
+	}
+	exploreMaxViews = envInt(exploreMaxViewsEnvVar, defaultExploreMaxViews)
+	if v := strings.TrimSpace(os.Getenv(selectionSeedEnvVar)); v != "" {
+		seed, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			log.Fatalf("%s must be a non-negative integer: %v", selectionSeedEnvVar, err)
+		}
+		selectionRand = newLockedRand(seed)
+		log.Printf("Ad selection seeded with %d; picks are reproducible", seed)
+	}
+	sessions.ttl = envDuration(sessionTTLEnvVar, defaultSessionTTL)
+	maxJSONBody = int64(envInt(maxJSONBodyEnvVar, defaultMaxJSONBody))
+	maxImportBody = int64(envInt(maxImportBodyEnvVar, defaultMaxImportBody))
+	maxContentLength = envInt(maxContentLengthEnvVar, defaultMaxContentLength)
+	if origins := envList(os.Getenv(corsOriginsEnvVar)); len(origins) > 0 {
+		allowedOrigins = origins
+	}
+	corsMaxAge = envDuration(corsMaxAgeEnvVar, defaultCORSMaxAge)
+	maxUploadSize = int64(envInt(maxUploadSizeEnvVar, defaultMaxUploadSize))
+	if types := envList(os.Getenv(uploadTypesEnvVar)); len(types) > 0 {
+		uploadTypes = types
+	}
+	if os.Getenv(svgUploadsEnvVar) == svgSanitize {
+		svgUploadPolicy = svgSanitize
+	}
+	corsCredentials = envBool(corsCredentialsEnvVar, false)
+	if corsCredentials && len(allowedOrigins) == 1 && allowedOrigins[0] == "*" {
+		log.Printf("%s is set but %s is not; no cross-origin requests will be allowed", corsCredentialsEnvVar, corsOriginsEnvVar)
+	}
+	maxURLLength = envInt(maxURLLengthEnvVar, defaultMaxURLLength)
+	maxTags = envInt(maxTagsEnvVar, defaultMaxTags)
+	maxTagLength = envInt(maxTagLengthEnvVar, defaultMaxTagLength)
+	if categories := envList(os.Getenv(categoriesEnvVar)); len(categories) > 0 {
+		adCategories = categories
+	}
+	redirectStatus = envInt(redirectStatusEnvVar, http.StatusFound)
+	if !validRedirectStatus(redirectStatus) {
+		log.Fatalf("%s must be 301, 302, 303, 307 or 308, got %d", redirectStatusEnvVar, redirectStatus)
+	}
+
+	patterns := defaultBotUAPatterns
+	if v, ok := os.LookupEnv(botUAPatternsEnvVar); ok {
+		patterns = envList(v)
+	}
+	bots, err := newBotFilter(patterns, envList(os.Getenv(botIPRangesEnvVar)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	impressionFilter = bots
+	if os.Getenv(botTrafficEnvVar) == botTrafficDrop {
+		botTrafficMode = botTrafficDrop
+	}
+	if internalNetworks, err = parseNetworks(envList(os.Getenv(internalIPsEnvVar))); err != nil {
+		log.Fatalf("Invalid internal IP range %v", err)
+	}
+	anonymizeIPs = envBool(anonymizeIPsEnvVar, false)
+	prettyJSON = envBool(prettyJSONEnvVar, false)
+	readOnly.Store(envBool(readOnlyEnvVar, false))
+	stickyAds.ttl = envDuration(stickyTTLEnvVar, defaultStickyTTL)
+	if v := strings.TrimSpace(os.Getenv(optOutPolicyEnvVar)); v != "" {
+		if !validOptOutPolicy(v) {
+			log.Fatalf("%s must be ignore, anonymous or skip, got %q", optOutPolicyEnvVar, v)
+		}
+		optOutPolicy = v
+	}
+	requireConsent = envBool(requireConsentEnvVar, false)
+	if path := strings.TrimSpace(os.Getenv(geoIPCSVEnvVar)); path != "" {
+		geo, err := loadGeoCSV(path)
+		if err != nil {
+			log.Fatalf("Failed to load GeoIP data: %v", err)
+		}
+		geoIP = geo
+	}
+
 	// Ensure upload directory exists
 	if err := os.MkdirAll(uploadDir, 0755); err != nil {
 		log.Fatalf("Failed to create upload directory: %v", err)
 	}
 
-	var err error
-	db, err = sql.Open("sqlite3", dbFile+"?_fk=1")
+	db, err = openRepository(strings.TrimSpace(os.Getenv(databaseURLEnvVar)), dbFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
+	if err := waitForDB(db, envDuration(dbConnectTimeoutEnvVar, defaultDBConnectTimeout)); err != nil {
+		log.Fatalf("Database not available: %v", err)
+	}
 
 	createTables()
-	loadCampaignsFromJSON(preloadCampaigns)
-	loadAdsFromJSON(preloadJSONFile)
-	loadImpressionsFromJSON(preloadImpressions)
+
+	impressionLog = newImpressionWriter(
+		envInt(impressionBufferEnvVar, defaultImpressionBuffer),
+		envInt(impressionBatchEnvVar, defaultImpressionBatch),
+		envDuration(impressionFlushEnvVar, defaultImpressionFlush),
+		os.Getenv(impressionBackpressureEnvVar) == "block",
+	)
+	impressionLog.Start()
+
+	if impressionRetention = envDuration(impressionRetentionEnvVar, 0); impressionRetention > 0 {
+		go watchRollups(impressionRetention)
+	}
+	viewSampleRate = max(envInt(impressionSampleEnvVar, 1), 1)
+	if envBool(impressionNoncesEnvVar, false) {
+		if impressionNonces, err = newNonceStore(envDuration(nonceTTLEnvVar, defaultNonceTTL)); err != nil {
+			log.Fatalf("Failed to set up impression nonces: %v", err)
+		}
+	}
+
+	if url := strings.TrimSpace(os.Getenv(webhookURLEnvVar)); url != "" {
+		secret := os.Getenv(webhookSecretEnvVar)
+		if secret == "" {
+			log.Fatalf("%s must be set with %s, or webhooks would go out unsigned", webhookSecretEnvVar, webhookURLEnvVar)
+		}
+		webhooks = newWebhookNotifier(url, secret)
+		webhooks.Start()
+		go watchExpiredAds(time.Minute)
+	}
+
+	if err := preload(*noPreload, *strictPreload); err != nil {
+		log.Fatalf("Strict preload: %v, aborting startup", err)
+	}
 
 	mux := http.NewServeMux()
+	registerRoutes(mux)
+
+	addr := ":8080"
+	debug := envBool(debugRequestsEnvVar, false)
+	if debug {
+		log.Printf("%s is set; request headers and bodies will be logged", debugRequestsEnvVar)
+	}
+	srv := &http.Server{Addr: addr, Handler: serverHandler(mux, debug)}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
+	go func() {
+		log.Printf("✓ Ad server running on http://localhost%s\n", addr)
+		log.Printf("✓ Admin dashboard: http://localhost%s/admin\n", addr)
+		log.Printf("✓ API Token: %s\n", maskToken(apiToken))
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Shutdown error: %v", err)
+	}
+	impressionLog.Close()
+}
+
+// serverHandler wraps the routes in the middleware every request goes
+// through, logging requests as well when debug is set.
+func serverHandler(mux http.Handler, debug bool) http.Handler {
+	handler := withHead(withPrettyJSON(mux))
+	if debug {
+		handler = withDebugLog(handler)
+	}
+	return handler
+}
+
+// routeMux is what registerRoutes adds handlers to: an *http.ServeMux, or
+// a recorder in tests.
+type routeMux interface {
+	HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request))
+}
+
+// registerRoutes adds every endpoint the server serves to mux.
+func registerRoutes(mux routeMux) {
 	// Public endpoints
 	mux.HandleFunc("/api/ad/random", withCORS(handleRandomAd))
 	mux.HandleFunc("/api/redirect/", withCORS(handleRedirect))
 	mux.HandleFunc("/api/impression/", withCORS(handleImpression))
-	mux.HandleFunc("/embed.js", withCORS(handleEmbedJS))
+	mux.HandleFunc("/api/beacon/", withCORS(handleBeacon))
+	mux.HandleFunc("/api/conversion/", withCORS(handleConversion))
+	mux.HandleFunc("/api/ad/render", withCORS(handleRenderAd))
+	mux.HandleFunc("/api/ads/random", withCORS(handleRandomAds))
+	mux.HandleFunc("/embed.js", withCORS(withGzip(handleEmbedJS)))
+	mux.HandleFunc("/openapi.json", withCORS(withGzip(handleOpenAPI)))
+	mux.HandleFunc("/version", handleVersion)
+
+	// Dashboard sessions (same-origin only, so no CORS)
+	mux.HandleFunc("/api/login", handleLogin)
+	mux.HandleFunc("/api/logout", handleLogout)
 
 	// Protected endpoints
-	mux.HandleFunc("/api/ads", withCORS(withAuth(handleListAds)))
-	mux.HandleFunc("/api/ad/add", withCORS(withAuth(handleAddAd)))
-	mux.HandleFunc("/api/ad/delete/", withCORS(withAuth(handleDeleteAd)))
-	mux.HandleFunc("/api/ad/update/", withCORS(withAuth(handleUpdateAd)))
-	mux.HandleFunc("/api/campaigns", withCORS(withAuth(handleCampaigns)))
-	mux.HandleFunc("/api/campaign/add", withCORS(withAuth(handleAddCampaign)))
-	mux.HandleFunc("/api/analytics/stats", withCORS(withAuth(handleAnalyticsStats)))
-	mux.HandleFunc("/api/upload", withCORS(withAuth(handleUpload)))
+	mux.HandleFunc("/api/ads", withCORS(withAuth(withGzip(handleListAds))))
+	mux.HandleFunc("/api/ad/", withCORS(withAuth(withWritable(withGzip(handleAd)))))
+	mux.HandleFunc("/api/ad/preview", withCORS(withAuth(handlePreviewAds)))
+	mux.HandleFunc("/api/ad/add", withCORS(withAuth(withWritable(handleAddAd))))
+	mux.HandleFunc("/api/ad/validate", withCORS(withAuth(handleValidateAd)))
+	mux.HandleFunc("/api/ad/delete/", withCORS(withAuth(withWritable(handleDeleteAd))))
+	mux.HandleFunc("/api/ad/update/", withCORS(withAuth(withWritable(handleUpdateAd))))
+	mux.HandleFunc("/api/ads/bulk-delete", withCORS(withAuth(withWritable(handleBulkDelete))))
+	mux.HandleFunc("/api/campaigns", withCORS(withAuth(withGzip(handleCampaigns))))
+	mux.HandleFunc("/api/campaign/add", withCORS(withAuth(withWritable(handleAddCampaign))))
+	mux.HandleFunc("/api/campaign/", withCORS(withAuth(withWritable(handleCampaign))))
+	mux.HandleFunc("/api/analytics/stats", withCORS(withAuth(withGzip(handleAnalyticsStats))))
+	mux.HandleFunc("/api/analytics/ad/", withCORS(withAuth(withGzip(handleAnalyticsAd))))
+	mux.HandleFunc("/api/analytics/top", withCORS(withAuth(handleTopAds)))
+	mux.HandleFunc("/api/analytics/top/campaigns", withCORS(withAuth(handleTopAds)))
+	mux.HandleFunc("/api/analytics/referrers", withCORS(withAuth(handleReferrerStats)))
+	mux.HandleFunc("/api/analytics/geo", withCORS(withAuth(handleGeoStats)))
+	mux.HandleFunc("/api/analytics/useragents", withCORS(withAuth(handleUserAgentStats)))
+	mux.HandleFunc("/api/analytics/live", withCORS(withAuth(handleLiveStats)))
+	mux.HandleFunc("/api/analytics/reconcile", withCORS(withAuth(withWritable(handleReconcile))))
+	mux.HandleFunc("/api/summary", withCORS(withAuth(handleSummary)))
+	mux.HandleFunc("/api/audit", withCORS(withAuth(withGzip(handleAudit))))
+	mux.HandleFunc("/api/upload", withCORS(withAuth(withWritable(handleUpload))))
+	mux.HandleFunc("/api/export", withCORS(withAuth(withGzip(handleExport))))
+	mux.HandleFunc("/api/import", withCORS(withAuth(withWritable(handleImport))))
+	mux.HandleFunc("/api/impressions/export", withCORS(withAuth(handleImpressionExport)))
+	mux.HandleFunc("/api/read-only", withCORS(withAuth(handleReadOnly)))
 
 	// Static files and admin dashboard
 	mux.HandleFunc("/static/", handleStatic)
-	mux.HandleFunc("/admin", handleAdmin)
+	mux.HandleFunc("/admin", withAdminAuth(handleAdmin))
+	mux.HandleFunc("/admin/analytics", withAdminAuth(handleAnalyticsPage))
 	mux.HandleFunc("/", handleIndex)
+}
 
-	addr := ":8080"
-	log.Printf("✓ Ad server running on http://localhost%s\n", addr)
-	log.Printf("✓ Admin dashboard: http://localhost%s/admin\n", addr)
-	log.Printf("✓ API Token: %s\n", maskToken(apiToken))
-	log.Fatal(http.ListenAndServe(addr, mux))
+// waitForDB pings the database until it answers, backing off exponentially
+// between attempts, so the server can start before its volume is mounted.
+// It gives up once timeout has passed.
+func waitForDB(db Repository, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	delay := 250 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := db.Ping()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		}
+		log.Printf("Database ping %d failed, retrying in %s: %v", attempt, delay, err)
+		time.Sleep(delay)
+		delay = min(delay*2, 5*time.Second)
+	}
 }
 
 func maskToken(token string) string {
@@ -134,452 +540,1907 @@ func maskToken(token string) string {
 	return token[:4] + "****" + token[len(token)-4:]
 }
 
-func createTables() {
-	stmts := []string{
-		`CREATE TABLE IF NOT EXISTS campaigns (
+// tableDefs holds the current definition of every table, in creation order.
+var tableDefs = []struct{ name, ddl string }{
+	{"campaigns", `CREATE TABLE IF NOT EXISTS campaigns (
             id INTEGER PRIMARY KEY AUTOINCREMENT,
             name TEXT NOT NULL,
-            created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-        )`,
-		`CREATE TABLE IF NOT EXISTS ads (
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            priority INTEGER NOT NULL DEFAULT 0,
+            tags TEXT,
+            tag_mode TEXT NOT NULL DEFAULT 'merge' CHECK(tag_mode IN ('merge', 'override'))
+        )`},
+	{"ads", `CREATE TABLE IF NOT EXISTS ads (
             id INTEGER PRIMARY KEY AUTOINCREMENT,
-            ad_type TEXT NOT NULL CHECK(ad_type IN ('text', 'image')),
+            ad_type TEXT NOT NULL CHECK(ad_type IN ('text', 'image', 'video')),
             content TEXT,
             image_url TEXT,
+            video_url TEXT,
+            video_duration INTEGER,
             redirect_url TEXT NOT NULL,
             tags TEXT,
             campaign_id INTEGER,
             expires_at DATETIME,
             created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            referrer_allow TEXT,
+            referrer_deny TEXT,
+            daily_cap INTEGER NOT NULL DEFAULT 0,
+            images TEXT,
+            content_hash TEXT,
+            paused INTEGER NOT NULL DEFAULT 0,
+            priority INTEGER NOT NULL DEFAULT 0,
+            category TEXT,
+            metadata TEXT,
+            localized_content TEXT,
+            companion_id INTEGER REFERENCES ads(id) ON DELETE SET NULL DEFERRABLE INITIALLY DEFERRED,
+            version INTEGER NOT NULL DEFAULT 1,
+            view_count INTEGER NOT NULL DEFAULT 0,
+            click_count INTEGER NOT NULL DEFAULT 0,
             FOREIGN KEY (campaign_id) REFERENCES campaigns(id) ON DELETE SET NULL
-        )`,
-		`CREATE TABLE IF NOT EXISTS impressions (
+        )`},
+	{"impressions", `CREATE TABLE IF NOT EXISTS impressions (
             id INTEGER PRIMARY KEY AUTOINCREMENT,
             ad_id INTEGER NOT NULL,
-            action_type TEXT NOT NULL CHECK(action_type IN ('view', 'click')),
+            action_type TEXT NOT NULL CHECK(action_type IN ('view', 'click', 'conversion')),
             ip TEXT,
             user_agent TEXT,
             viewed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            bot INTEGER NOT NULL DEFAULT 0,
+            internal INTEGER NOT NULL DEFAULT 0,
+            referrer TEXT,
+            weight INTEGER NOT NULL DEFAULT 1,
+            value REAL,
+            time_to_click INTEGER,
+            viewable INTEGER NOT NULL DEFAULT 0,
             FOREIGN KEY (ad_id) REFERENCES ads(id) ON DELETE CASCADE
-        )`,
-		`CREATE INDEX IF NOT EXISTS idx_ads_expires ON ads(expires_at)`,
-		`CREATE INDEX IF NOT EXISTS idx_impressions_ad ON impressions(ad_id, action_type)`,
-	}
+        )`},
+	{"audit_log", `CREATE TABLE IF NOT EXISTS audit_log (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            action TEXT NOT NULL,
+            target_type TEXT NOT NULL,
+            target_id INTEGER,
+            actor TEXT NOT NULL,
+            ip TEXT,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        )`},
+	{"impression_daily", `CREATE TABLE IF NOT EXISTS impression_daily (
+            ad_id INTEGER NOT NULL,
+            day TEXT NOT NULL,
+            bot INTEGER NOT NULL DEFAULT 0,
+            internal INTEGER NOT NULL DEFAULT 0,
+            views INTEGER NOT NULL DEFAULT 0,
+            clicks INTEGER NOT NULL DEFAULT 0,
+            conversions INTEGER NOT NULL DEFAULT 0,
+            conversion_value REAL NOT NULL DEFAULT 0,
+            viewable_views INTEGER NOT NULL DEFAULT 0,
+            PRIMARY KEY (ad_id, day, bot, internal),
+            FOREIGN KEY (ad_id) REFERENCES ads(id) ON DELETE CASCADE
+        )`},
+	{"uploads", `CREATE TABLE IF NOT EXISTS uploads (
+            filename TEXT PRIMARY KEY,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        )`},
+	{"ad_tags", `CREATE TABLE IF NOT EXISTS ad_tags (
+            ad_id INTEGER NOT NULL,
+            tag TEXT NOT NULL,
+            PRIMARY KEY (ad_id, tag),
+            FOREIGN KEY (ad_id) REFERENCES ads(id) ON DELETE CASCADE
+        )`},
+	{"campaign_tags", `CREATE TABLE IF NOT EXISTS campaign_tags (
+            campaign_id INTEGER NOT NULL,
+            tag TEXT NOT NULL,
+            PRIMARY KEY (campaign_id, tag),
+            FOREIGN KEY (campaign_id) REFERENCES campaigns(id) ON DELETE CASCADE
+        )`},
+}
 
-	for _, stmt := range stmts {
-		if _, err := db.Exec(stmt); err != nil {
+var indexDefs = []string{
+	`CREATE INDEX IF NOT EXISTS idx_ads_expires ON ads(expires_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_ads_content_hash ON ads(content_hash)`,
+	`CREATE INDEX IF NOT EXISTS idx_ad_tags_tag ON ad_tags(tag)`,
+	`CREATE INDEX IF NOT EXISTS idx_campaign_tags_tag ON campaign_tags(tag)`,
+	`CREATE INDEX IF NOT EXISTS idx_impressions_ad ON impressions(ad_id, action_type)`,
+}
+
+func createTables() {
+	for _, t := range tableDefs {
+		if _, err := db.Exec(db.Schema(t.ddl)); err != nil {
 			log.Fatalf("DB init error: %v", err)
 		}
 	}
-}
 
-func loadAdsFromJSON(filename string) {
-	f, err := os.Open(filename)
+	hadCounts, err := columnExists("ads", "view_count")
 	if err != nil {
-		log.Println("No JSON preload file found, skipping.")
-		return
+		log.Fatalf("DB migration error: %v", err)
 	}
-	defer f.Close()
+	migrateColumns()
+	rebuildTables()
 
-	var ads []Ad
-	if err := json.NewDecoder(f).Decode(&ads); err != nil {
-		log.Printf("Invalid JSON preload: %v", err)
-		return
+	for _, stmt := range indexDefs {
+		if _, err := db.Exec(stmt); err != nil {
+			log.Fatalf("DB init error: %v", err)
+		}
 	}
 
-	for _, ad := range ads {
-		if err := validateAd(ad); err != nil {
-			log.Printf("Skipping invalid ad: %v", err)
-			continue
+	backfillAdTags()
+	backfillContentHashes()
+	if !hadCounts {
+		if _, err := reconcileCounts(); err != nil {
+			log.Fatalf("DB migration error: %v", err)
 		}
-		insertAd(ad)
 	}
-	log.Printf("Loaded %d ads from %s", len(ads), filename)
 }
 
-func loadCampaignsFromJSON(filename string) {
-	f, err := os.Open(filename)
-	if err != nil {
-		log.Println("No campaigns JSON file found, skipping.")
-		return
-	}
-	defer f.Close()
+// columnMigrations lists columns added after the initial schema. Fresh
+// databases get them from CREATE TABLE; existing ones are altered on startup.
+var columnMigrations = []struct {
+	table, column, definition, backfill string
+}{
+	{"ads", "updated_at", "DATETIME", "UPDATE ads SET updated_at = created_at WHERE updated_at IS NULL"},
+	{"ads", "video_url", "TEXT", ""},
+	{"ads", "video_duration", "INTEGER", ""},
+	{"impressions", "bot", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"ads", "referrer_allow", "TEXT", ""},
+	{"ads", "referrer_deny", "TEXT", ""},
+	{"impressions", "referrer", "TEXT", ""},
+	{"impressions", "weight", "INTEGER NOT NULL DEFAULT 1", ""},
+	{"impressions", "value", "REAL", ""},
+	{"ads", "daily_cap", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"ads", "images", "TEXT", ""},
+	{"ads", "content_hash", "TEXT", ""},
+	{"ads", "paused", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"ads", "priority", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"campaigns", "priority", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"impressions", "internal", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"ads", "category", "TEXT", ""},
+	{"ads", "metadata", "TEXT", ""},
+	{"ads", "version", "INTEGER NOT NULL DEFAULT 1", ""},
+	{"ads", "localized_content", "TEXT", ""},
+	{"impressions", "time_to_click", "INTEGER", ""},
+	// Deferred so an import can reference an ad that comes later in it.
+	{"ads", "companion_id", "INTEGER REFERENCES ads(id) ON DELETE SET NULL DEFERRABLE INITIALLY DEFERRED", ""},
+	// Filled by reconcileCounts once the impression tables are migrated too.
+	{"ads", "view_count", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"ads", "click_count", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"campaigns", "tags", "TEXT", ""},
+	{"campaigns", "tag_mode", "TEXT NOT NULL DEFAULT 'merge' CHECK(tag_mode IN ('merge', 'override'))", ""},
+	{"impressions", "viewable", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"impression_daily", "viewable_views", "INTEGER NOT NULL DEFAULT 0", ""},
+}
+
+// tableRebuilds lists tables whose constraints changed after release.
+// SQLite cannot alter a CHECK in place, so a table whose stored definition
+// lacks marker is copied into a fresh table built from tableDefs.
+var tableRebuilds = []struct{ table, marker string }{
+	{"ads", "'video'"},
+	{"impressions", "'conversion'"},
+	{"impression_daily", "internal"},
+}
 
-	var campaigns []Campaign
-	if err := json.NewDecoder(f).Decode(&campaigns); err != nil {
-		log.Printf("Invalid campaigns JSON: %v", err)
+func rebuildTables() {
+	// Postgres databases start out with the current constraints.
+	sqlite, ok := db.(*sqliteRepository)
+	if !ok {
 		return
 	}
-
-	for _, c := range campaigns {
-		if c.Name == "" {
-			log.Printf("Skipping invalid campaign with empty name")
-			continue
+	for _, rb := range tableRebuilds {
+		var stored string
+		if err := db.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?`, rb.table).Scan(&stored); err != nil {
+			log.Fatalf("DB migration error: %v", err)
 		}
-		_, err := db.Exec(`INSERT INTO campaigns (name) VALUES (?)`, c.Name)
-		if err != nil {
-			log.Printf("Failed to insert campaign %s: %v", c.Name, err)
+		if strings.Contains(stored, rb.marker) {
 			continue
 		}
+		if err := rebuildTable(sqlite, rb.table); err != nil {
+			log.Fatalf("DB migration error rebuilding %s: %v", rb.table, err)
+		}
+		log.Printf("Rebuilt table %s", rb.table)
 	}
-	log.Printf("Loaded %d campaigns from %s", len(campaigns), filename)
 }
 
-func loadImpressionsFromJSON(filename string) {
-	f, err := os.Open(filename)
+// rebuildTable follows SQLite's recommended procedure for schema changes:
+// with foreign keys off, copy into a new table, drop the old one and rename.
+func rebuildTable(sqlite *sqliteRepository, table string) error {
+	var ddl string
+	for _, t := range tableDefs {
+		if t.name == table {
+			ddl = t.ddl
+		}
+	}
+	if ddl == "" {
+		return fmt.Errorf("no definition for table %s", table)
+	}
+	tmp := table + "_rebuild"
+	ddl = strings.Replace(ddl, "CREATE TABLE IF NOT EXISTS "+table+" (", "CREATE TABLE "+tmp+" (", 1)
+
+	cols, err := sqlite.Columns(table)
 	if err != nil {
-		log.Println("No impressions JSON file found, skipping.")
-		return
+		return err
 	}
-	defer f.Close()
+	colList := strings.Join(cols, ", ")
 
-	var impressions []Impression
-	if err := json.NewDecoder(f).Decode(&impressions); err != nil {
-		log.Printf("Invalid impressions JSON: %v", err)
-		return
+	ctx := context.Background()
+	conn, err := sqlite.Conn(ctx)
+	if err != nil {
+		return err
 	}
+	defer conn.Close()
 
-	for _, imp := range impressions {
-		if imp.AdID == 0 || (imp.ActionType != "view" && imp.ActionType != "click") {
-			log.Printf("Skipping invalid impression: %+v", imp)
-			continue
+	// Dropping the old table must not cascade into rows that reference it.
+	if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `PRAGMA foreign_keys = ON`)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmts := []string{
+		ddl,
+		fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", tmp, colList, colList, table),
+		"DROP TABLE " + table,
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", tmp, table),
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
 		}
-		_, err := db.Exec(`INSERT INTO impressions (ad_id, action_type, ip, user_agent, viewed_at) VALUES (?, ?, ?, ?, ?)`,
-			imp.AdID, imp.ActionType, imp.IP, imp.UserAgent, imp.ViewedAt)
+	}
+	return tx.Commit()
+}
+
+func migrateColumns() {
+	for _, m := range columnMigrations {
+		exists, err := columnExists(m.table, m.column)
 		if err != nil {
-			log.Printf("Failed to insert impression for ad %d: %v", imp.AdID, err)
+			log.Fatalf("DB migration error: %v", err)
+		}
+		if exists {
 			continue
 		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, db.Schema(m.definition))); err != nil {
+			log.Fatalf("DB migration error: %v", err)
+		}
+		if m.backfill != "" {
+			if _, err := db.Exec(m.backfill); err != nil {
+				log.Fatalf("DB migration error: %v", err)
+			}
+		}
+		log.Printf("Added column %s.%s", m.table, m.column)
 	}
-	log.Printf("Loaded %d impressions from %s", len(impressions), filename)
 }
 
-func validateAd(ad Ad) error {
-	if ad.AdType != "text" && ad.AdType != "image" {
-		return fmt.Errorf("invalid ad_type: %s", ad.AdType)
-	}
-	if ad.RedirectURL == "" {
-		return fmt.Errorf("redirect_url is required")
+func columnExists(table, column string) (bool, error) {
+	cols, err := db.Columns(table)
+	if err != nil {
+		return false, err
 	}
-	if ad.AdType == "text" && ad.Content == "" {
-		return fmt.Errorf("content is required for text ads")
+	for _, c := range cols {
+		if c == column {
+			return true, nil
+		}
 	}
-	if ad.AdType == "image" && ad.ImageURL == "" {
-		return fmt.Errorf("image_url is required for image ads")
+	return false, nil
+}
+
+// preload loads the JSON preload files unless disabled. Under strict, a file
+// that is invalid or has records that can't be loaded is an error.
+func preload(disabled, strict bool) error {
+	if disabled {
+		log.Println("Preloading disabled, skipping JSON preload files.")
+		return nil
+	}
+	results := []preloadResult{
+		loadCampaignsFromJSON(preloadPath(preloadCampaignsEnvVar, preloadCampaigns)),
+		loadAdsFromJSON(preloadPath(preloadAdsEnvVar, preloadJSONFile)),
+		loadImpressionsFromJSON(preloadPath(preloadImpressionsEnvVar, preloadImpressions)),
+	}
+	for _, res := range results {
+		log.Printf("Preload %s", res)
+		if strict && !res.Clean() {
+			return fmt.Errorf("%s has invalid records", res.File)
+		}
 	}
 	return nil
 }
 
-func insertAd(ad Ad) error {
-	tags := strings.Join(ad.Tags, ",")
-	var expiresAt interface{}
-	if ad.ExpiresAt != nil {
-		expiresAt = *ad.ExpiresAt
+// preloadPath returns the preload file named by envVar, or def when unset.
+// Relative names are resolved against ADSERVER_PRELOAD_DIR (default: the
+// working directory).
+func preloadPath(envVar, def string) string {
+	name := strings.TrimSpace(os.Getenv(envVar))
+	if name == "" {
+		name = def
 	}
-
-	_, err := db.Exec(`INSERT INTO ads (ad_type, content, image_url, redirect_url, tags, campaign_id, expires_at)
-                       VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		ad.AdType, ad.Content, ad.ImageURL, ad.RedirectURL, tags, ad.CampaignID, expiresAt)
-	return err
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(os.Getenv(preloadDirEnvVar), name)
 }
 
-// === HANDLERS ===
+// preloadResult summarizes loading one preload file.
+type preloadResult struct {
+	File    string
+	Loaded  int
+	Present int            // ads skipped because they are already stored
+	Skipped map[string]int // records left out, counted by reason
+	Err     error          // the file exists but is not a JSON array
+}
 
-func handleIndex(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/" {
-		http.NotFound(w, r)
-		return
+func (p *preloadResult) skip(reason string) {
+	if p.Skipped == nil {
+		p.Skipped = map[string]int{}
 	}
-	html := `<!DOCTYPE html>
-<html>
-<head><title>Ad Server</title></head>
-<body style="font-family: sans-serif; max-width: 800px; margin: 50px auto; padding: 20px;">
-	<h1>🎯 Ad Server</h1>
-	<p>Welcome to the ad server. Available endpoints:</p>
-	<ul>
-		<li><a href="/admin">Admin Dashboard</a> (requires API token)</li>
-		<li><code>GET /api/ad/random?tags=tech,go</code> - Get random ad</li>
-		<li><code>GET /api/ads</code> - List all ads (requires auth)</li>
-		<li><code>GET /embed.js</code> - Embed script for websites</li>
-	</ul>
-	<h3>Quick Test:</h3>
-	<div id="ad-container"></div>
-	<script src="/embed.js"></script>
-</body>
-</html>`
-	w.Header().Set("Content-Type", "text/html")
-	io.WriteString(w, html)
+	p.Skipped[reason]++
 }
 
-func handleRandomAd(w http.ResponseWriter, r *http.Request) {
-	tags := strings.Split(r.URL.Query().Get("tags"), ",")
+// Clean reports whether every record in the file was usable.
+func (p preloadResult) Clean() bool {
+	return p.Err == nil && len(p.Skipped) == 0
+}
 
-	query := `SELECT id, ad_type, content, image_url, redirect_url, tags, campaign_id 
-	          FROM ads 
-	          WHERE (expires_at IS NULL OR expires_at > datetime('now'))
-	          ORDER BY RANDOM() LIMIT 100`
+func (p preloadResult) String() string {
+	if p.Err != nil {
+		return fmt.Sprintf("%s: invalid file: %v", p.File, p.Err)
+	}
+	skipped := 0
+	var reasons []string
+	for reason, n := range p.Skipped {
+		skipped += n
+		reasons = append(reasons, fmt.Sprintf("%d %s", n, reason))
+	}
+	sort.Strings(reasons)
+	msg := fmt.Sprintf("%s: %d loaded, %d already present, %d skipped", p.File, p.Loaded, p.Present, skipped)
+	if len(reasons) > 0 {
+		msg += " (" + strings.Join(reasons, "; ") + ")"
+	}
+	return msg
+}
 
-	rows, err := db.Query(query)
+// readPreload splits a preload file into its array elements so one bad
+// record doesn't discard the rest. A missing file yields no records.
+func readPreload(filename string, res *preloadResult) []json.RawMessage {
+	f, err := os.Open(filename)
 	if err != nil {
-		respondJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
-		return
+		log.Printf("No preload file %s found, skipping.", filename)
+		return nil
 	}
-	defer rows.Close()
+	defer f.Close()
 
-	var candidates []Ad
-	for rows.Next() {
-		var a Ad
-		var tagsStr string
+	var records []json.RawMessage
+	if err := json.NewDecoder(f).Decode(&records); err != nil {
+		res.Err = err
+		return nil
+	}
+	return records
+}
 
-		err := rows.Scan(&a.ID, &a.AdType, &a.Content, &a.ImageURL, &a.RedirectURL, &tagsStr, &a.CampaignID, &a.ExpiresAt)
-		if err != nil {
+func loadAdsFromJSON(filename string) preloadResult {
+	res := preloadResult{File: filename}
+	for _, raw := range readPreload(filename, &res) {
+		var ad Ad
+		if err := json.Unmarshal(raw, &ad); err != nil {
+			res.skip("malformed: " + err.Error())
 			continue
 		}
-
-		if tagsStr != "" {
-			a.Tags = strings.Split(tagsStr, ",")
+		if err := validateAd(ad); err != nil {
+			res.skip("invalid: " + err.Error())
+			continue
 		}
-
-		if matchesTags(a.Tags, tags) {
-			candidates = append(candidates, a)
+		// Ads already in the database are skipped, so restarts don't
+		// duplicate the preload.
+		id, err := insertNewAd(ad)
+		switch {
+		case err == nil:
+			res.Loaded++
+			notifyAdCreated(id)
+		case errors.Is(err, errDuplicateAd):
+			res.Present++
+		default:
+			res.skip("insert failed: " + err.Error())
 		}
 	}
-
-	if len(candidates) == 0 {
-		respondJSON(w, http.StatusNotFound, map[string]string{"error": "no ads available"})
-		return
-	}
-
-	rand_idx, _ := rand.Int(rand.Reader, big.NewInt(int64(len(candidates))))
-	ad := candidates[rand_idx.Int64()]
-	respondJSON(w, http.StatusOK, ad)
+	return res
 }
 
-func matchesTags(adTags, userTags []string) bool {
-	if len(userTags) == 0 || (len(userTags) == 1 && strings.TrimSpace(userTags[0]) == "") {
-		return true
+func loadCampaignsFromJSON(filename string) preloadResult {
+	res := preloadResult{File: filename}
+	for _, raw := range readPreload(filename, &res) {
+		var c Campaign
+		if err := json.Unmarshal(raw, &c); err != nil {
+			res.skip("malformed: " + err.Error())
+			continue
+		}
+		if err := validateCampaign(c); err != nil {
+			res.skip("invalid: " + err.Error())
+			continue
+		}
+		if _, err := insertCampaign(c); err != nil {
+			res.skip("insert failed: " + err.Error())
+			continue
+		}
+		res.Loaded++
 	}
+	return res
+}
 
-	for _, ut := range userTags {
-		ut = strings.TrimSpace(strings.ToLower(ut))
-		if ut == "" {
+func loadImpressionsFromJSON(filename string) preloadResult {
+	res := preloadResult{File: filename}
+	for _, raw := range readPreload(filename, &res) {
+		var imp Impression
+		if err := json.Unmarshal(raw, &imp); err != nil {
+			res.skip("malformed: " + err.Error())
 			continue
 		}
-		for _, at := range adTags {
-			at = strings.TrimSpace(strings.ToLower(at))
-			if ut == at {
-				return true
-			}
+		if imp.AdID == 0 || (imp.ActionType != "view" && imp.ActionType != "click" && imp.ActionType != "conversion") {
+			res.skip("invalid: needs an ad_id and an action_type of view, click or conversion")
+			continue
+		}
+		if err := insertImpression(imp); err != nil {
+			res.skip("insert failed: " + err.Error())
+			continue
 		}
+		res.Loaded++
 	}
-	return false
+	return res
 }
 
-func handleListAds(w http.ResponseWriter, r *http.Request) {
-	activeOnly := r.URL.Query().Get("active") == "true"
+// Length limits on ad fields, in characters. Ad content is injected into
+// every page that embeds the ad, so it is kept short. Tags are limited in
+// number as well, since each one is a row in ad_tags.
+var (
+	maxContentLength = defaultMaxContentLength
+	maxURLLength     = defaultMaxURLLength
+	maxTags          = defaultMaxTags
+	maxTagLength     = defaultMaxTagLength
+)
 
-	query := `SELECT id, ad_type, content, image_url, redirect_url, tags, campaign_id, expires_at 
-	          FROM ads`
-	if activeOnly {
-		query += ` WHERE (expires_at IS NULL OR expires_at > datetime('now'))`
+func validateAd(ad Ad) error {
+	var errs validationErrors
+	if ad.AdType != "text" && ad.AdType != "image" && ad.AdType != "video" {
+		errs.add("ad_type", "invalid ad_type: %s", ad.AdType)
 	}
-	query += ` ORDER BY created_at DESC`
-
-	rows, err := db.Query(query)
-	if err != nil {
-		respondJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
-		return
+	if ad.RedirectURL == "" {
+		errs.add("redirect_url", "redirect_url is required")
 	}
-	defer rows.Close()
-
-	var ads []Ad
-	for rows.Next() {
-		var a Ad
-		var tagsStr string
-		var expiresAt sql.NullString
-
-		rows.Scan(&a.ID, &a.AdType, &a.Content, &a.ImageURL, &a.RedirectURL, &tagsStr, &a.CampaignID, &expiresAt)
-
-		if tagsStr != "" {
-			a.Tags = strings.Split(tagsStr, ",")
-		}
-		if expiresAt.Valid {
-			a.ExpiresAt = &expiresAt.String
-		}
-
-		ads = append(ads, a)
+	if ad.AdType == "text" && ad.Content == "" {
+		errs.add("content", "content is required for text ads")
 	}
-
-	respondJSON(w, http.StatusOK, ads)
-}
-
-func handleAddAd(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		respondJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use POST"})
-		return
+	if n := utf8.RuneCountInString(ad.Content); n > maxContentLength {
+		errs.add("content", "content is %d characters, the limit is %d", n, maxContentLength)
 	}
-
-	var ad Ad
-	if err := json.NewDecoder(r.Body).Decode(&ad); err != nil {
-		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
-		return
+	if n := utf8.RuneCountInString(ad.RedirectURL); n > maxURLLength {
+		errs.add("redirect_url", "redirect_url is %d characters, the limit is %d", n, maxURLLength)
 	}
-
-	if err := validateAd(ad); err != nil {
-		respondJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
-		return
+	if err := validateTags("ad", ad.Tags); err != nil {
+		errs.add("tags", "%s", err)
 	}
-
-	if err := insertAd(ad); err != nil {
-		respondJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to insert ad"})
-		return
+	if ad.AdType == "image" && ad.ImageURL == "" && len(ad.Images) == 0 {
+		errs.add("image_url", "image_url or images is required for image ads")
 	}
+	for i, img := range ad.Images {
+		if img.URL == "" || img.Width <= 0 {
+			errs.add(fmt.Sprintf("images[%d]", i), "images[%d] needs a url and a positive width", i)
+		}
+	}
+	if ad.AdType == "video" && ad.VideoURL == "" {
+		errs.add("video_url", "video_url is required for video ads")
+	}
+	if ad.VideoDuration < 0 {
+		errs.add("video_duration", "video_duration must not be negative")
+	}
+	if ad.DailyCap < 0 {
+		errs.add("daily_cap", "daily_cap must not be negative")
+	}
+	if ad.Priority < 0 {
+		errs.add("priority", "priority must not be negative")
+	}
+	if ad.CompanionID < 0 {
+		errs.add("companion_id", "companion_id must not be negative")
+	}
+	if _, ok := ad.Metadata[""]; ok {
+		errs.add("metadata", "metadata keys must not be empty")
+	}
+	for lang, content := range ad.LocalizedContent {
+		if !languageTag.MatchString(normalizeLanguage(lang)) {
+			errs.add("localized_content", "invalid language tag %q", lang)
+		} else if strings.TrimSpace(content) == "" {
+			errs.add("localized_content", "localized content for %q must not be empty", lang)
+		}
+	}
+	if c := normalizeCategory(ad.Category); c != "" && !knownCategory(c) {
+		errs.add("category", "unknown category %q, use one of %s", ad.Category, strings.Join(adCategories, ", "))
+	}
+	if ad.ExpiresAt != nil && *ad.ExpiresAt != "" {
+		if _, err := time.Parse(time.RFC3339, *ad.ExpiresAt); err != nil {
+			errs.add("expires_at", "expires_at must be an RFC3339 timestamp such as 2025-12-31T23:59:59Z")
+		}
+	}
+	for _, d := range ad.ReferrerAllow {
+		if !validReferrerDomain(d) {
+			errs.add("referrer_allow", "invalid referrer domain %q", d)
+		}
+	}
+	for _, d := range ad.ReferrerDeny {
+		if !validReferrerDomain(d) {
+			errs.add("referrer_deny", "invalid referrer domain %q", d)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func validReferrerDomain(d string) bool {
+	return !strings.ContainsAny(d, ",/ ") && referrerHost(d) != ""
+}
+
+// FieldError is a validation failure of one request field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationErrors collects every problem found with a request, so clients
+// can show them all at once. As an error it reads as the first of them.
+type validationErrors []FieldError
+
+func (v *validationErrors) add(field, format string, args ...interface{}) {
+	*v = append(*v, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v validationErrors) Error() string {
+	return v[0].Message
+}
+
+// companionProblem checks that an ad's companion exists and isn't the ad
+// itself, whose id is 0 for a new ad. It returns what is wrong, or "".
+func companionProblem(ad Ad, id int) (string, error) {
+	if ad.CompanionID <= 0 {
+		return "", nil
+	}
+	if ad.CompanionID == id {
+		return "an ad can't be its own companion", nil
+	}
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM ads WHERE id = ?)`, ad.CompanionID).Scan(&exists); err != nil {
+		return "", err
+	}
+	if !exists {
+		return fmt.Sprintf("companion ad %d does not exist", ad.CompanionID), nil
+	}
+	return "", nil
+}
+
+// validCompanion runs companionProblem for a write handler, responding
+// with the error if there is one.
+func validCompanion(w http.ResponseWriter, ad Ad, id int) bool {
+	problem, err := companionProblem(ad, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return false
+	}
+	if problem != "" {
+		respondInvalid(w, validationErrors{{Field: "companion_id", Message: problem}})
+		return false
+	}
+	return true
+}
+
+// validateTags applies the tag count and length limits to an ad's or a
+// campaign's tags.
+func validateTags(owner string, tags []string) error {
+	tags = normalizeTags(tags)
+	if len(tags) > maxTags {
+		return fmt.Errorf("%s has %d tags, the limit is %d", owner, len(tags), maxTags)
+	}
+	for _, t := range tags {
+		if n := utf8.RuneCountInString(t); n > maxTagLength {
+			return fmt.Errorf("tag %q is %d characters, the limit is %d", t, n, maxTagLength)
+		}
+	}
+	return nil
+}
+
+// adWriteColumns are the client-settable ad columns, in adValues order.
+// paused isn't one: an update leaves it alone, so it only changes through
+// pause and resume, and insertAd sets it separately.
+var adWriteColumns = []string{"ad_type", "content", "image_url", "video_url", "video_duration", "redirect_url", "tags", "campaign_id", "expires_at", "referrer_allow", "referrer_deny", "daily_cap", "images", "content_hash", "priority", "category", "metadata", "localized_content", "companion_id"}
+
+func adValues(ad Ad) []interface{} {
+	return []interface{}{
+		ad.AdType, ad.Content, ad.ImageURL, ad.VideoURL, ad.VideoDuration, ad.RedirectURL,
+		strings.Join(ad.Tags, ","), nullableID(ad.CampaignID), expiresAtValue(ad.ExpiresAt),
+		strings.Join(ad.ReferrerAllow, ","), strings.Join(ad.ReferrerDeny, ","), ad.DailyCap,
+		imagesJSON(ad.Images), adContentHash(ad), ad.Priority, normalizeCategory(ad.Category),
+		metadataJSON(ad.Metadata), localizedJSON(ad.LocalizedContent),
+		nullableID(ad.CompanionID),
+	}
+}
+
+// errDuplicateAd reports a preloaded ad whose creative matches an existing ad.
+var errDuplicateAd = errors.New("an identical ad already exists")
+
+// errVersionConflict reports an update based on an outdated version of an ad.
+var errVersionConflict = errors.New("the ad was changed since it was read; reload it and retry")
+
+// adContentHash is the natural key that stops the preload and imports storing
+// the same creative twice: a hash of the fields that make up what is shown
+// and where it links.
+func adContentHash(ad Ad) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{ad.AdType, ad.Content, ad.ImageURL, ad.VideoURL, ad.RedirectURL}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// imagesJSON stores an image ad's renditions, or NULL when it has none.
+func imagesJSON(images []AdImage) interface{} {
+	if len(images) == 0 {
+		return nil
+	}
+	b, _ := json.Marshal(images)
+	return string(b)
+}
+
+// metadataJSON stores an ad's metadata, or NULL when it has none.
+func metadataJSON(metadata map[string]string) interface{} {
+	if len(metadata) == 0 {
+		return nil
+	}
+	b, _ := json.Marshal(metadata)
+	return string(b)
+}
+
+// localizedJSON stores an ad's localized content keyed by normalized
+// language tag, or NULL when it has none.
+func localizedJSON(content map[string]string) interface{} {
+	if len(content) == 0 {
+		return nil
+	}
+	normalized := make(map[string]string, len(content))
+	for lang, c := range content {
+		normalized[normalizeLanguage(lang)] = c
+	}
+	b, _ := json.Marshal(normalized)
+	return string(b)
+}
+
+func widestImage(images []AdImage) string {
+	var best AdImage
+	for _, img := range images {
+		if img.Width > best.Width {
+			best = img
+		}
+	}
+	return best.URL
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func insertAd(ad Ad) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRow(`INSERT INTO ads (`+strings.Join(adWriteColumns, ", ")+`, paused, updated_at)
+                       VALUES (`+placeholders(len(adWriteColumns))+`, ?, `+db.Now()+`)
+                       RETURNING id`,
+		append(adValues(ad), ad.Paused)...).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	if err := replaceAdTags(tx, id, ad.Tags); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// insertNewAd is insertAd for the preload, which runs on every start: an ad
+// identical to one already stored is skipped with errDuplicateAd.
+func insertNewAd(ad Ad) (int64, error) {
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM ads WHERE content_hash = ?)`, adContentHash(ad)).Scan(&exists); err != nil {
+		return 0, err
+	}
+	if exists {
+		return 0, errDuplicateAd
+	}
+	return insertAd(ad)
+}
+
+// updateAd overwrites the stored ad and returns its new version, or 0 if it
+// doesn't exist. A non-zero ad.Version must match the stored one, else
+// errVersionConflict; zero skips the check, for clients that predate it.
+func updateAd(id int, ad Ad) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	set := strings.Join(adWriteColumns, "=?, ") + "=?"
+	result, err := tx.Exec(`UPDATE ads SET `+set+`, version=version+1, updated_at=`+db.Now()+`
+	                        WHERE id=? AND (?=0 OR version=?)`,
+		append(adValues(ad), id, ad.Version, ad.Version)...)
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		err := tx.QueryRow(`SELECT version FROM ads WHERE id=?`, id).Scan(&version)
+		if err == nil {
+			return 0, errVersionConflict
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if err := replaceAdTags(tx, int64(id), ad.Tags); err != nil {
+		return 0, err
+	}
+	if err := tx.QueryRow(`SELECT version FROM ads WHERE id=?`, id).Scan(&version); err != nil {
+		return 0, err
+	}
+	return version, tx.Commit()
+}
+
+// replaceAdTags rewrites the normalized ad_tags rows used for matching.
+// The comma-separated ads.tags column stays the source for responses.
+func replaceAdTags(tx *Tx, adID int64, tags []string) error {
+	if _, err := tx.Exec(`DELETE FROM ad_tags WHERE ad_id = ?`, adID); err != nil {
+		return err
+	}
+	for _, tag := range normalizeTags(tags) {
+		if _, err := tx.Exec(`INSERT INTO ad_tags (ad_id, tag) VALUES (?, ?) ON CONFLICT DO NOTHING`, adID, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillContentHashes fills content_hash for ads stored before it existed.
+func backfillContentHashes() {
+	rows, err := db.Query(`SELECT ` + adColumns + ` FROM ads WHERE content_hash IS NULL ORDER BY id`)
+	if err != nil {
+		log.Printf("content_hash backfill failed: %v", err)
+		return
+	}
+	var pending []Ad
+	for rows.Next() {
+		if a, err := scanAd(rows); err == nil {
+			pending = append(pending, a)
+		}
+	}
+	rows.Close()
+
+	for _, a := range pending {
+		if _, err := db.Exec(`UPDATE ads SET content_hash = ? WHERE id = ?`, adContentHash(a), a.ID); err != nil {
+			log.Printf("content_hash backfill failed: %v", err)
+			return
+		}
+	}
+	if len(pending) > 0 {
+		log.Printf("Backfilled content hashes for %d ads", len(pending))
+	}
+}
+
+// backfillAdTags populates ad_tags for ads stored before the table existed.
+func backfillAdTags() {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM ad_tags`).Scan(&n); err != nil || n > 0 {
+		return
+	}
+
+	rows, err := db.Query(`SELECT id, tags FROM ads WHERE tags IS NOT NULL AND tags != ''`)
+	if err != nil {
+		log.Printf("ad_tags backfill failed: %v", err)
+		return
+	}
+	pending := map[int64][]string{}
+	for rows.Next() {
+		var id int64
+		var tags string
+		if err := rows.Scan(&id, &tags); err == nil {
+			pending[id] = strings.Split(tags, ",")
+		}
+	}
+	rows.Close()
+	if len(pending) == 0 {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("ad_tags backfill failed: %v", err)
+		return
+	}
+	defer tx.Rollback()
+	for id, tags := range pending {
+		if err := replaceAdTags(tx, id, tags); err != nil {
+			log.Printf("ad_tags backfill failed: %v", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err == nil {
+		log.Printf("Backfilled tags for %d ads", len(pending))
+	}
+}
+
+// normalizeTags lowercases, trims, and de-duplicates tags, returning them
+// sorted so equivalent tag sets compare equal.
+func normalizeTags(tags []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, t := range tags {
+		t = strings.TrimSpace(strings.ToLower(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		out = append(out, t)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// adColumns is the column list scanAd expects, in order. Queries using it
+// must select FROM ads without an alias.
+const adColumns = `id, ad_type, content, image_url, video_url, video_duration, redirect_url, tags, campaign_id, expires_at, created_at, updated_at, referrer_allow, referrer_deny, daily_cap, images, paused, priority, category, metadata, localized_content, companion_id, version, view_count, click_count,
+	COALESCE((SELECT campaigns.priority FROM campaigns WHERE campaigns.id = ads.campaign_id), 0) AS campaign_priority,
+	COALESCE((SELECT campaigns.tags FROM campaigns WHERE campaigns.id = ads.campaign_id), '') AS campaign_tags,
+	COALESCE((SELECT campaigns.tag_mode FROM campaigns WHERE campaigns.id = ads.campaign_id), 'merge') AS campaign_tag_mode`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAd(s rowScanner) (Ad, error) {
+	var a Ad
+	var content, imageURL, videoURL, tagsStr sql.NullString
+	var videoDuration, campaignID, dailyCap, companionID sql.NullInt64
+	var expiresAt, createdAt, updatedAt, referrerAllow, referrerDeny, images, category, metadata, localized sql.NullString
+	var campaignTags string
+
+	if err := s.Scan(&a.ID, &a.AdType, &content, &imageURL, &videoURL, &videoDuration, &a.RedirectURL, &tagsStr, &campaignID, &expiresAt, &createdAt, &updatedAt, &referrerAllow, &referrerDeny, &dailyCap, &images, &a.Paused, &a.Priority, &category, &metadata, &localized, &companionID, &a.Version, &a.ViewCount, &a.ClickCount, &a.CampaignPriority, &campaignTags, &a.CampaignTagMode); err != nil {
+		return a, err
+	}
+
+	a.Content = content.String
+	a.ImageURL = imageURL.String
+	a.VideoURL = videoURL.String
+	a.VideoDuration = int(videoDuration.Int64)
+	a.CampaignID = int(campaignID.Int64)
+	a.DailyCap = int(dailyCap.Int64)
+	a.CompanionID = int(companionID.Int64)
+	a.CreatedAt = storedTime(createdAt.String)
+	a.UpdatedAt = storedTime(updatedAt.String)
+	a.Category = category.String
+	if tagsStr.String != "" {
+		a.Tags = strings.Split(tagsStr.String, ",")
+	}
+	if campaignTags != "" {
+		a.CampaignTags = strings.Split(campaignTags, ",")
+	}
+	if expiresAt.Valid {
+		expires := storedTime(expiresAt.String)
+		a.ExpiresAt = &expires
+	}
+	if referrerAllow.String != "" {
+		a.ReferrerAllow = strings.Split(referrerAllow.String, ",")
+	}
+	if referrerDeny.String != "" {
+		a.ReferrerDeny = strings.Split(referrerDeny.String, ",")
+	}
+	if images.String != "" {
+		if err := json.Unmarshal([]byte(images.String), &a.Images); err != nil {
+			return a, err
+		}
+		if a.ImageURL == "" {
+			a.ImageURL = widestImage(a.Images)
+		}
+	}
+	if metadata.String != "" {
+		if err := json.Unmarshal([]byte(metadata.String), &a.Metadata); err != nil {
+			return a, err
+		}
+	}
+	if localized.String != "" {
+		if err := json.Unmarshal([]byte(localized.String), &a.LocalizedContent); err != nil {
+			return a, err
+		}
+	}
+	return a, nil
+}
+
+// === HANDLERS ===
+
+func handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	html := `<!DOCTYPE html>
+<html>
+<head><title>Ad Server</title></head>
+<body style="font-family: sans-serif; max-width: 800px; margin: 50px auto; padding: 20px;">
+	<h1>🎯 Ad Server</h1>
+	<p>Welcome to the ad server. Available endpoints:</p>
+	<ul>
+		<li><a href="/admin">Admin Dashboard</a> (requires API token)</li>
+		<li><code>GET /api/ad/random?tags=tech,go</code> - Get random ad</li>
+		<li><code>GET /api/ads</code> - List all ads (requires auth)</li>
+		<li><code>GET /embed.js</code> - Embed script for websites</li>
+	</ul>
+	<h3>Quick Test:</h3>
+	<div id="ad-container"></div>
+	<script src="/embed.js"></script>
+</body>
+</html>`
+	w.Header().Set("Content-Type", "text/html")
+	io.WriteString(w, html)
+}
+
+func handleRandomAd(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "json", "xml", "vast":
+	default:
+		respondError(w, http.StatusBadRequest, "format must be json, xml or vast")
+		return
+	}
+
+	q, err := servingQuery(r)
+	if err != nil {
+		respondNegotiated(w, r, http.StatusBadRequest, errorBody(http.StatusBadRequest, err.Error()))
+		return
+	}
+	tracking, err := parseTracking(r)
+	if err != nil {
+		respondNegotiated(w, r, http.StatusBadRequest, errorBody(http.StatusBadRequest, err.Error()))
+		return
+	}
+	var withCompanion bool
+	if v := r.URL.Query().Get("companion"); v != "" {
+		if withCompanion, err = strconv.ParseBool(v); err != nil {
+			respondNegotiated(w, r, http.StatusBadRequest, errorBody(http.StatusBadRequest, "companion must be true or false"))
+			return
+		}
+	}
+
+	now := time.Now()
+	candidates, err := servableCandidates(q, now)
+	if err != nil {
+		respondNegotiated(w, r, http.StatusInternalServerError, errorBody(http.StatusInternalServerError, "database error"))
+		return
+	}
+
+	if format == "vast" {
+		// VAST only carries video creatives and signals no fill with an
+		// empty document rather than an error status.
+		var videos []Ad
+		for _, a := range candidates {
+			if a.AdType == "video" {
+				videos = append(videos, a)
+			}
+		}
+		picked, err := pickAd(q, videos, now)
+		if err != nil {
+			respondNegotiated(w, r, http.StatusInternalServerError, errorBody(http.StatusInternalServerError, "database error"))
+			return
+		}
+		if picked == nil {
+			respondVAST(w, buildVAST(nil))
+			return
+		}
+		ad := *picked
+		base := baseURL(r)
+		trackServedAd(r, base, &ad, tracking)
+		ad.ClickURL = clickURL(base, ad.ID)
+		respondVAST(w, buildVAST(&ad))
+		return
+	}
+
+	if len(candidates) == 0 {
+		respondNegotiated(w, r, http.StatusNotFound, errorBody(http.StatusNotFound, "no ads available"))
+		return
+	}
+
+	picked, err := pickAd(q, candidates, now)
+	if err != nil {
+		respondNegotiated(w, r, http.StatusInternalServerError, errorBody(http.StatusInternalServerError, "database error"))
+		return
+	}
+	ad := *picked
+	langs := requestLanguages(r)
+	setContentLanguage(w, localize(&ad, langs))
+	base := baseURL(r)
+	trackServedAd(r, base, &ad, tracking)
+	ad.ClickURL = clickURL(base, ad.ID)
+	if withCompanion && ad.CompanionID != 0 {
+		companion, err := loadCompanion(ad.CompanionID, now)
+		if err != nil {
+			respondNegotiated(w, r, http.StatusInternalServerError, errorBody(http.StatusInternalServerError, "database error"))
+			return
+		}
+		if companion != nil {
+			localize(companion, langs)
+			trackServedAd(r, base, companion, tracking)
+			companion.ClickURL = clickURL(base, companion.ID)
+			ad.Companion = companion
+		}
+	}
+	respondNegotiated(w, r, http.StatusOK, ad)
+}
+
+// maxAdsPerRequest bounds count on /api/ads/random.
+const maxAdsPerRequest = 10
+
+// handleRandomAds serves up to count distinct ads in one response, for pages
+// with several slots. Each is picked like /api/ad/random from the candidates
+// not yet picked, so a sticky client keeps its ad in the first slot; fewer
+// than count, possibly none, are returned when not enough ads match.
+func handleRandomAds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	q, err := servingQuery(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	tracking, err := parseTracking(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	count := 1
+	if v := r.URL.Query().Get("count"); v != "" {
+		if count, err = strconv.Atoi(v); err != nil || count < 1 || count > maxAdsPerRequest {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("count must be from 1 to %d", maxAdsPerRequest))
+			return
+		}
+	}
+
+	now := time.Now()
+	candidates, err := servableCandidates(q, now)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	langs := requestLanguages(r)
+	base := baseURL(r)
+	ads := []Ad{}
+	var chosen string
+	for len(ads) < count && len(candidates) > 0 {
+		pick := chooseAd
+		if len(ads) == 0 {
+			pick = pickAd
+		}
+		picked, err := pick(q, candidates, now)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		ad := *picked
+		candidates = slices.DeleteFunc(candidates, func(a Ad) bool { return a.ID == ad.ID })
+
+		if lang := localize(&ad, langs); chosen == "" {
+			chosen = lang
+		}
+		trackServedAd(r, base, &ad, tracking)
+		ad.ClickURL = clickURL(base, ad.ID)
+		ads = append(ads, ad)
+	}
+	setContentLanguage(w, chosen)
+	respondJSON(w, http.StatusOK, ads)
+}
+
+// loadCompanion returns a served ad's companion, or nil when it can't be
+// shown: deleted, expired or paused. The ad is then served alone rather
+// than failing the request.
+func loadCompanion(id int, now time.Time) (*Ad, error) {
+	companion, err := scanAd(db.QueryRow(`SELECT `+adColumns+` FROM ads WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if isExpired(companion, now) || companion.Paused {
+		return nil, nil
+	}
+	return &companion, nil
+}
+
+// handleListAds lists ads, optionally filtered by status (active, expired
+// or all), campaign_id and tags (any of them).
+func handleListAds(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	status := q.Get("status")
+	if status == "" && q.Get("active") == "true" {
+		status = "active"
+	}
+
+	var where []string
+	var args []interface{}
+	expiresAt, now := db.Time("expires_at"), db.Time(db.Now())
+	switch status {
+	case "", "all":
+	case "active":
+		where = append(where, `(expires_at IS NULL OR `+expiresAt+` > `+now+`)`)
+	case "expired":
+		where = append(where, `expires_at IS NOT NULL AND `+expiresAt+` <= `+now)
+	default:
+		respondError(w, http.StatusBadRequest, "status must be active, expired or all")
+		return
+	}
+	if v := q.Get("campaign_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "invalid campaign_id")
+			return
+		}
+		where = append(where, `campaign_id = ?`)
+		args = append(args, id)
+	}
+	if tags := normalizeTags(strings.Split(q.Get("tags"), ",")); len(tags) > 0 {
+		where = append(where, `id IN (SELECT ad_id FROM ad_tags WHERE tag IN (`+placeholders(len(tags))+`))`)
+		for _, t := range tags {
+			args = append(args, t)
+		}
+	}
+	order := `created_at DESC`
+	if v := q.Get("expiring_within"); v != "" {
+		span, err := parseSpan(v)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "expiring_within: "+err.Error())
+			return
+		}
+		where = append(where, `expires_at IS NOT NULL AND `+expiresAt+` > `+now+` AND `+expiresAt+` <= `+db.Time("?"))
+		args = append(args, time.Now().UTC().Add(span).Format("2006-01-02 15:04:05"))
+		order = expiresAt + `, id`
+	}
+	switch q.Get("sort") {
+	case "":
+	case "created":
+		order = `created_at DESC`
+	case "views":
+		order = `view_count DESC, id`
+	case "clicks":
+		order = `click_count DESC, id`
+	default:
+		respondError(w, http.StatusBadRequest, "sort must be created, views or clicks")
+		return
+	}
+
+	query := `SELECT ` + adColumns + ` FROM ads`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY ` + order
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer rows.Close()
+
+	var ads []Ad
+	for rows.Next() {
+		a, err := scanAd(rows)
+		if err != nil {
+			continue
+		}
+		ads = append(ads, a)
+	}
+
+	respondJSONWithETag(w, r, ads)
+}
+
+// parseSpan reads a positive duration as a number of days ("7", "7d") or a
+// Go duration ("36h").
+func parseSpan(v string) (time.Duration, error) {
+	var span time.Duration
+	if days, err := strconv.Atoi(strings.TrimSuffix(v, "d")); err == nil {
+		span = time.Duration(days) * 24 * time.Hour
+	} else if span, err = time.ParseDuration(v); err != nil {
+		return 0, fmt.Errorf("invalid duration %q, use days (7d) or a Go duration (36h)", v)
+	}
+	if span <= 0 {
+		return 0, fmt.Errorf("duration must be positive")
+	}
+	return span, nil
+}
+
+// handleAd dispatches /api/ad/{id} and /api/ad/{id}/{action}.
+func handleAd(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/ad/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid ad ID")
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		handleGetAd(w, r, id)
+	case len(parts) == 2 && parts[1] == "pause":
+		handlePauseAd(w, r, id, true)
+	case len(parts) == 2 && parts[1] == "resume":
+		handlePauseAd(w, r, id, false)
+	case len(parts) == 2 && parts[1] == "similar":
+		handleSimilarAds(w, r, id)
+	case len(parts) == 2 && parts[1] == "clone":
+		handleCloneAd(w, r, id)
+	default:
+		respondError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func handleGetAd(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	ad, err := scanAd(db.QueryRow(`SELECT `+adColumns+` FROM ads WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "ad not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	if t, err := time.Parse(time.RFC3339, ad.UpdatedAt); err == nil {
+		w.Header().Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+	}
+	respondJSONWithETag(w, r, ad)
+}
+
+// handlePauseAd stops or resumes serving an ad without touching the rest of
+// it. Paused ads still appear in listings and analytics.
+func handlePauseAd(w http.ResponseWriter, r *http.Request, id int, paused bool) {
+	if r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	result, err := db.Exec(`UPDATE ads SET paused = ?, version = version + 1, updated_at = `+db.Now()+` WHERE id = ?`, paused, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		respondError(w, http.StatusNotFound, "ad not found")
+		return
+	}
+	candidateCache.Invalidate()
+
+	status, action := "resumed", auditResume
+	if paused {
+		status, action = "paused", auditPause
+	}
+	recordAudit(r, action, "ad", id)
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{"status": status, "id": id})
+}
+
+// handleCloneAd creates a new ad from an existing one. The optional body
+// holds ad fields to change in the copy; anything it leaves out is copied.
+func handleCloneAd(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	ad, err := scanAd(db.QueryRow(`SELECT `+adColumns+` FROM ads WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "ad not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	if r.ContentLength != 0 && !decodeJSONBody(w, r, &ad, maxJSONBody) {
+		return
+	}
+	ad.ID, ad.CreatedAt, ad.UpdatedAt = 0, "", ""
+
+	if err := validateAd(ad); err != nil {
+		respondInvalid(w, err)
+		return
+	}
+	if !validCompanion(w, ad, 0) {
+		return
+	}
+	if isExpired(ad, time.Now()) {
+		respondError(w, http.StatusBadRequest, "expires_at is in the past")
+		return
+	}
+
+	newID, err := insertAd(ad)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to insert ad")
+		return
+	}
+	candidateCache.Invalidate()
+
+	clone, err := scanAd(db.QueryRow(`SELECT `+adColumns+` FROM ads WHERE id = ?`, newID))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	recordAudit(r, auditCreate, "ad", clone.ID)
+	webhooks.Notify(eventAdCreated, clone)
+
+	respondJSON(w, http.StatusCreated, clone)
+}
+
+// handleValidateAd checks an ad the way /api/ad/add would, reporting every
+// invalid field, without storing anything.
+func handleValidateAd(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	var ad Ad
+	if !decodeJSONBody(w, r, &ad, maxJSONBody) {
+		return
+	}
+
+	var errs validationErrors
+	if err := validateAd(ad); err != nil && !errors.As(err, &errs) {
+		respondInvalid(w, err)
+		return
+	}
+	if isExpired(ad, time.Now()) {
+		errs.add("expires_at", "expires_at is in the past")
+	}
+	if problem, err := companionProblem(ad, 0); err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	} else if problem != "" {
+		errs.add("companion_id", "%s", problem)
+	}
+	if len(errs) > 0 {
+		respondInvalid(w, errs)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]bool{"valid": true})
+}
+
+func handleAddAd(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	var ad Ad
+	if !decodeJSONBody(w, r, &ad, maxJSONBody) {
+		return
+	}
+
+	if err := validateAd(ad); err != nil {
+		respondInvalid(w, err)
+		return
+	}
+	if isExpired(ad, time.Now()) {
+		respondError(w, http.StatusBadRequest, "expires_at is in the past")
+		return
+	}
+	if !validCompanion(w, ad, 0) {
+		return
+	}
+
+	id, err := insertAd(ad)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to insert ad")
+		return
+	}
+	candidateCache.Invalidate()
+
+	recordAudit(r, auditCreate, "ad", int(id))
+	notifyAdCreated(id)
+
+	respondJSON(w, http.StatusCreated, map[string]interface{}{"status": "created", "id": id})
+}
 
-	respondJSON(w, http.StatusCreated, map[string]string{"status": "created"})
-}
-
 func handleDeleteAd(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete {
-		respondJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use DELETE"})
+		respondError(w, http.StatusMethodNotAllowed, "use DELETE")
 		return
 	}
 
 	idStr := strings.TrimPrefix(r.URL.Path, "/api/ad/delete/")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid ad ID"})
+		respondError(w, http.StatusBadRequest, "invalid ad ID")
 		return
 	}
 
+	old, _ := scanAd(db.QueryRow(`SELECT `+adColumns+` FROM ads WHERE id = ?`, id))
 	result, err := db.Exec("DELETE FROM ads WHERE id = ?", id)
 	if err != nil {
-		respondJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		respondError(w, http.StatusInternalServerError, "database error")
 		return
 	}
 
 	rows, _ := result.RowsAffected()
 	if rows == 0 {
-		respondJSON(w, http.StatusNotFound, map[string]string{"error": "ad not found"})
+		respondError(w, http.StatusNotFound, "ad not found")
 		return
 	}
+	candidateCache.Invalidate()
+	recordAudit(r, auditDelete, "ad", id)
+	removeOrphanedUploads(adUploadFiles(old))
 
 	respondJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
 }
 
+// bulkDeleteRequest selects ads for /api/ads/bulk-delete: either explicit
+// ids or a filter, currently only "expired".
+type bulkDeleteRequest struct {
+	IDs    []int  `json:"ids"`
+	Filter string `json:"filter"`
+}
+
+// handleBulkDelete deletes the selected ads in one transaction and reports
+// how many were removed. Ids that don't exist are skipped.
+func handleBulkDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	var req bulkDeleteRequest
+	if !decodeJSONBody(w, r, &req, maxJSONBody) {
+		return
+	}
+	switch {
+	case len(req.IDs) > 0 && req.Filter != "":
+		respondError(w, http.StatusBadRequest, "give either ids or filter, not both")
+		return
+	case len(req.IDs) == 0 && req.Filter == "":
+		respondError(w, http.StatusBadRequest, "ids or filter is required")
+		return
+	case req.Filter != "" && req.Filter != "expired":
+		respondError(w, http.StatusBadRequest, "filter must be expired")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer tx.Rollback()
+
+	ids := req.IDs
+	if req.Filter == "expired" {
+		rows, err := tx.Query(`SELECT id FROM ads WHERE expires_at IS NOT NULL AND ` + db.Time("expires_at") + ` <= ` + db.Time(db.Now()))
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err == nil {
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+	}
+
+	var deleted []int
+	var files []string
+	for _, id := range ids {
+		old, _ := scanAd(tx.QueryRow(`SELECT `+adColumns+` FROM ads WHERE id = ?`, id))
+		result, err := tx.Exec(`DELETE FROM ads WHERE id = ?`, id)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			deleted = append(deleted, id)
+			files = append(files, adUploadFiles(old)...)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	if len(deleted) > 0 {
+		candidateCache.Invalidate()
+	}
+	for _, id := range deleted {
+		recordAudit(r, auditDelete, "ad", id)
+	}
+	removeOrphanedUploads(files)
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{"status": "deleted", "deleted": len(deleted)})
+}
+
 func handleUpdateAd(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPut {
-		respondJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use PUT"})
+		respondError(w, http.StatusMethodNotAllowed, "use PUT")
 		return
 	}
 
 	idStr := strings.TrimPrefix(r.URL.Path, "/api/ad/update/")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid ad ID"})
+		respondError(w, http.StatusBadRequest, "invalid ad ID")
 		return
 	}
 
 	var ad Ad
-	if err := json.NewDecoder(r.Body).Decode(&ad); err != nil {
-		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+	if !decodeJSONBody(w, r, &ad, maxJSONBody) {
 		return
 	}
 
 	if err := validateAd(ad); err != nil {
-		respondJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		respondInvalid(w, err)
 		return
 	}
-
-	tags := strings.Join(ad.Tags, ",")
-	var expiresAt interface{}
-	if ad.ExpiresAt != nil {
-		expiresAt = *ad.ExpiresAt
+	if !validCompanion(w, ad, id) {
+		return
 	}
 
-	result, err := db.Exec(`UPDATE ads SET ad_type=?, content=?, image_url=?, redirect_url=?, tags=?, campaign_id=?, expires_at=? WHERE id=?`,
-		ad.AdType, ad.Content, ad.ImageURL, ad.RedirectURL, tags, ad.CampaignID, expiresAt, id)
-
+	old, _ := scanAd(db.QueryRow(`SELECT `+adColumns+` FROM ads WHERE id = ?`, id))
+	version, err := updateAd(id, ad)
+	if errors.Is(err, errVersionConflict) {
+		respondError(w, http.StatusConflict, err.Error())
+		return
+	}
 	if err != nil {
-		respondJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		respondError(w, http.StatusInternalServerError, "database error")
 		return
 	}
-
-	rows, _ := result.RowsAffected()
-	if rows == 0 {
-		respondJSON(w, http.StatusNotFound, map[string]string{"error": "ad not found"})
+	if version == 0 {
+		respondError(w, http.StatusNotFound, "ad not found")
 		return
 	}
+	candidateCache.Invalidate()
+	recordAudit(r, auditUpdate, "ad", id)
+	removeOrphanedUploads(adUploadFiles(old))
 
-	respondJSON(w, http.StatusOK, map[string]string{"status": "updated"})
+	respondJSON(w, http.StatusOK, map[string]interface{}{"status": "updated", "version": version})
 }
 
 func handleCampaigns(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
-		rows, err := db.Query(`SELECT id, name, created_at FROM campaigns ORDER BY created_at DESC`)
+		rows, err := db.Query(`SELECT ` + campaignColumns + ` FROM campaigns ORDER BY created_at DESC`)
 		if err != nil {
-			respondJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+			respondError(w, http.StatusInternalServerError, "database error")
 			return
 		}
 		defer rows.Close()
 
 		var campaigns []Campaign
 		for rows.Next() {
-			var c Campaign
-			rows.Scan(&c.ID, &c.Name, &c.CreatedAt)
-			campaigns = append(campaigns, c)
+			if c, err := scanCampaign(rows); err == nil {
+				campaigns = append(campaigns, c)
+			}
 		}
 		respondJSON(w, http.StatusOK, campaigns)
 		return
 	}
 
-	respondJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use GET"})
+	respondError(w, http.StatusMethodNotAllowed, "use GET")
 }
 
 func handleAddCampaign(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		respondJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use POST"})
+		respondError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	var c Campaign
+	if !decodeJSONBody(w, r, &c, maxJSONBody) {
+		return
+	}
+
+	if err := validateCampaign(c); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	id, err := insertCampaign(c)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to create campaign")
+		return
+	}
+
+	recordAudit(r, auditCreate, "campaign", int(id))
+	respondJSON(w, http.StatusCreated, map[string]interface{}{"status": "created", "id": id})
+}
+
+func validateCampaign(c Campaign) error {
+	if c.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if c.Priority < 0 {
+		return fmt.Errorf("priority must not be negative")
+	}
+	if !validTagMode(c.TagMode) {
+		return fmt.Errorf("tag_mode must be merge or override")
+	}
+	return validateTags("campaign", c.Tags)
+}
+
+// Campaign tag modes.
+const (
+	tagModeMerge    = "merge"
+	tagModeOverride = "override"
+)
+
+// campaignColumns is the column list scanCampaign expects, in order.
+const campaignColumns = `id, name, priority, tags, tag_mode, created_at`
+
+func scanCampaign(s rowScanner) (Campaign, error) {
+	var c Campaign
+	var tags sql.NullString
+	if err := s.Scan(&c.ID, &c.Name, &c.Priority, &tags, &c.TagMode, &c.CreatedAt); err != nil {
+		return c, err
+	}
+	c.CreatedAt = storedTime(c.CreatedAt)
+	if tags.String != "" {
+		c.Tags = strings.Split(tags.String, ",")
+	}
+	return c, nil
+}
+
+func validTagMode(mode string) bool {
+	return mode == "" || mode == tagModeMerge || mode == tagModeOverride
+}
+
+// tagModeValue stores an unset tag mode as the default, merge.
+func tagModeValue(mode string) string {
+	if mode == "" {
+		return tagModeMerge
+	}
+	return mode
+}
+
+// insertCampaign creates a campaign along with its campaign_tags rows.
+func insertCampaign(c Campaign) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	tags := normalizeTags(c.Tags)
+	var id int64
+	if err := tx.QueryRow(`INSERT INTO campaigns (name, priority, tags, tag_mode) VALUES (?, ?, ?, ?) RETURNING id`,
+		c.Name, c.Priority, strings.Join(tags, ","), tagModeValue(c.TagMode)).Scan(&id); err != nil {
+		return 0, err
+	}
+	if err := replaceCampaignTags(tx, id, tags); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// replaceCampaignTags rewrites the normalized campaign_tags rows that ad
+// selection matches on, mirroring ad_tags.
+func replaceCampaignTags(tx *Tx, campaignID int64, tags []string) error {
+	if _, err := tx.Exec(`DELETE FROM campaign_tags WHERE campaign_id = ?`, campaignID); err != nil {
+		return err
+	}
+	for _, tag := range normalizeTags(tags) {
+		if _, err := tx.Exec(`INSERT INTO campaign_tags (campaign_id, tag) VALUES (?, ?) ON CONFLICT DO NOTHING`, campaignID, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// campaignPriorityRequest is the body of PUT /api/campaign/{id}/priority.
+type campaignPriorityRequest struct {
+	Priority *int `json:"priority"`
+}
+
+// handleCampaign dispatches /api/campaign/{id}/{action}.
+func handleCampaign(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/campaign/"), "/")
+	if len(parts) != 2 {
+		respondError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid campaign ID")
+		return
+	}
+
+	switch parts[1] {
+	case "priority":
+		handleCampaignPriority(w, r, id)
+	case "tags":
+		handleCampaignTags(w, r, id)
+	default:
+		respondError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// handleCampaignPriority sets a campaign's priority, changing which of the
+// ads competing for a request are served.
+func handleCampaignPriority(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPut {
+		respondError(w, http.StatusMethodNotAllowed, "use PUT")
+		return
+	}
+
+	var req campaignPriorityRequest
+	if !decodeJSONBody(w, r, &req, maxJSONBody) {
+		return
+	}
+	if req.Priority == nil {
+		respondError(w, http.StatusBadRequest, "priority is required")
+		return
+	}
+	if *req.Priority < 0 {
+		respondError(w, http.StatusBadRequest, "priority must not be negative")
+		return
+	}
+
+	result, err := db.Exec(`UPDATE campaigns SET priority = ? WHERE id = ?`, *req.Priority, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		respondError(w, http.StatusNotFound, "campaign not found")
+		return
+	}
+	candidateCache.Invalidate()
+	recordAudit(r, auditUpdate, "campaign", id)
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{"status": "updated", "id": id})
+}
+
+// campaignTagsRequest is the body of PUT /api/campaign/{id}/tags.
+type campaignTagsRequest struct {
+	Tags    []string `json:"tags"`
+	TagMode string   `json:"tag_mode,omitempty"`
+}
+
+// handleCampaignTags replaces a campaign's default tags and tag mode. The
+// campaign's ads keep their own tags; only what they are matched on changes.
+func handleCampaignTags(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPut {
+		respondError(w, http.StatusMethodNotAllowed, "use PUT")
 		return
 	}
 
-	var c Campaign
-	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
-		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+	var req campaignTagsRequest
+	if !decodeJSONBody(w, r, &req, maxJSONBody) {
+		return
+	}
+	if !validTagMode(req.TagMode) {
+		respondError(w, http.StatusBadRequest, "tag_mode must be merge or override")
+		return
+	}
+	if err := validateTags("campaign", req.Tags); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	if c.Name == "" {
-		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "name is required"})
+	tx, err := db.Begin()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
 		return
 	}
+	defer tx.Rollback()
 
-	result, err := db.Exec(`INSERT INTO campaigns (name) VALUES (?)`, c.Name)
+	tags := normalizeTags(req.Tags)
+	result, err := tx.Exec(`UPDATE campaigns SET tags = ?, tag_mode = ? WHERE id = ?`, strings.Join(tags, ","), tagModeValue(req.TagMode), id)
 	if err != nil {
-		respondJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to create campaign"})
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		respondError(w, http.StatusNotFound, "campaign not found")
+		return
+	}
+	if err := replaceCampaignTags(tx, int64(id), tags); err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
 		return
 	}
+	candidateCache.Invalidate()
+	recordAudit(r, auditUpdate, "campaign", id)
 
-	id, _ := result.LastInsertId()
-	respondJSON(w, http.StatusCreated, map[string]interface{}{"status": "created", "id": id})
+	respondJSON(w, http.StatusOK, map[string]interface{}{"status": "updated", "id": id})
+}
+
+// impressionRequest is the optional body of POST /api/impression/{id}.
+type impressionRequest struct {
+	// Action is "view" (the default) or "click".
+	Action string `json:"action"`
+	// Nonce is the single-use token from the served impression_url,
+	// required for views and clicks when impression nonces are enabled.
+	Nonce string `json:"nonce,omitempty"`
 }
 
+// handleImpression records a view, or a click for integrations that handle
+// clicks themselves instead of going through /api/redirect. The action comes
+// from the body or the action query parameter.
 func handleImpression(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		respondJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use POST"})
+	// GET is accepted for tracking pixels such as VAST <Impression> URLs.
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, "use GET or POST")
 		return
 	}
 
 	idStr := strings.TrimPrefix(r.URL.Path, "/api/impression/")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid ad ID"})
+		respondError(w, http.StatusBadRequest, "invalid ad ID")
 		return
 	}
 
-	_, err = db.Exec("INSERT INTO impressions (ad_id, ad_type, ip, user_agent) VALUES (?, ?, ?, ?)",
-		id, "view", r.RemoteAddr, r.UserAgent())
+	req := impressionRequest{Action: r.URL.Query().Get("action"), Nonce: r.URL.Query().Get("nonce")}
+	if r.Method == http.MethodPost {
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBody))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			respondDecodeError(w, err)
+			return
+		}
+	}
+	if req.Action == "" {
+		req.Action = "view"
+	}
+	if req.Action != "view" && req.Action != "click" {
+		respondError(w, http.StatusBadRequest, "action must be view or click")
+		return
+	}
+	if impressionNonces != nil {
+		if err := impressionNonces.Redeem(req.Nonce, id, req.Action, time.Now()); err != nil {
+			respondError(w, http.StatusForbidden, err.Error())
+			return
+		}
+	}
 
-	if err != nil {
-		respondJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to log impression"})
+	// Dropped bot traffic and unsampled views get the normal response.
+	// Without a nonce anyone can replay the call, so its viewable flag is
+	// ignored.
+	if !recordImpression(r, id, req.Action, impressionNonces != nil && viewableParam(r)) {
+		respondError(w, http.StatusServiceUnavailable, "impression queue full")
 		return
 	}
 
@@ -590,42 +2451,106 @@ func handleRedirect(w http.ResponseWriter, r *http.Request) {
 	idStr := strings.TrimPrefix(r.URL.Path, "/api/redirect/")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		http.Error(w, "invalid ad ID", http.StatusBadRequest)
+		respondErrorPage(w, r, http.StatusBadRequest, "invalid ad ID")
 		return
 	}
 
 	var redirectURL string
 	err = db.QueryRow("SELECT redirect_url FROM ads WHERE id = ?", id).Scan(&redirectURL)
 	if err != nil {
-		http.Error(w, "ad not found", http.StatusNotFound)
+		respondErrorPage(w, r, http.StatusNotFound, "ad not found")
 		return
 	}
 
-	_, _ = db.Exec("INSERT INTO impressions (ad_id, ad_type, ip, user_agent) VALUES (?, ?, ?, ?)",
-		id, "click", r.RemoteAddr, r.UserAgent())
+	// A HEAD is a link checker or preview fetching the target, not a click.
+	if r.Method != http.MethodHead {
+		if imp, ok := newImpression(r, id, "click"); ok {
+			impressionLog.EnqueueClick(imp)
+		}
+	}
+
+	http.Redirect(w, r, redirectURL, redirectStatus)
+}
+
+// redirectStatus is the status handleRedirect answers with. 302 suits most
+// integrations; 301 lets clients cache the hop (skipping later clicks), and
+// 307/308 preserve the request method.
+var redirectStatus = http.StatusFound
 
-	http.Redirect(w, r, redirectURL, http.StatusFound)
+func validRedirectStatus(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
 }
 
 func handleAnalyticsStats(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	where := []string{"1=1"}
+	var args []interface{}
+	if v := q.Get("campaign_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "invalid campaign_id")
+			return
+		}
+		where = append(where, `a.campaign_id = ?`)
+		args = append(args, id)
+	}
+	if v := q.Get("ad_type"); v != "" {
+		if v != "text" && v != "image" && v != "video" {
+			respondError(w, http.StatusBadRequest, "ad_type must be text, image or video")
+			return
+		}
+		where = append(where, `a.ad_type = ?`)
+		args = append(args, v)
+	}
+
 	query := `
 		SELECT 
 			a.id,
 			a.ad_type,
-			a.content,
-			a.image_url,
-			a.campaign_id,
-			COALESCE(SUM(CASE WHEN i.action_type = 'view' THEN 1 ELSE 0 END), 0) as views,
-			COALESCE(SUM(CASE WHEN i.action_type = 'click' THEN 1 ELSE 0 END), 0) as clicks
+			COALESCE(a.content, ''),
+			COALESCE(a.image_url, ''),
+			COALESCE(a.campaign_id, 0),
+			COALESCE(c.views, 0) as views,
+			COALESCE(c.viewable_views, 0) as viewable_views,
+			COALESCE(u.unique_views, 0) as unique_views,
+			COALESCE(c.clicks, 0) as clicks,
+			COALESCE(c.conversions, 0) as conversions,
+			COALESCE(c.conversion_value, 0) as conversion_value,
+			t.avg_time_to_click
 		FROM ads a
-		LEFT JOIN impressions i ON a.id = i.ad_id
-		GROUP BY a.id
+		LEFT JOIN (
+			SELECT ad_id, SUM(views) AS views, SUM(viewable_views) AS viewable_views, SUM(clicks) AS clicks,
+				SUM(conversions) AS conversions, SUM(conversion_value) AS conversion_value
+			FROM (` + impressionCountsSQL + `) i
+			WHERE ` + trafficCondition(r) + `
+			GROUP BY ad_id
+		) c ON c.ad_id = a.id
+		-- Unique viewers and time to click need the raw rows, so rolled-up
+		-- days don't count.
+		LEFT JOIN (
+			SELECT ad_id, COUNT(DISTINCT COALESCE(ip, '') || '|' || COALESCE(user_agent, '')) AS unique_views
+			FROM impressions
+			WHERE action_type = 'view' AND ` + trafficCondition(r) + `
+			GROUP BY ad_id
+		) u ON u.ad_id = a.id
+		LEFT JOIN (
+			SELECT ad_id, AVG(time_to_click) AS avg_time_to_click
+			FROM impressions
+			WHERE action_type = 'click' AND time_to_click IS NOT NULL AND ` + trafficCondition(r) + `
+			GROUP BY ad_id
+		) t ON t.ad_id = a.id
+		WHERE ` + strings.Join(where, " AND ") + `
 		ORDER BY views DESC
 	`
 
-	rows, err := db.Query(query)
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		respondJSON(w, http.StatusInternalServerError, map[string]string{"error": "database error"})
+		respondError(w, http.StatusInternalServerError, "database error")
 		return
 	}
 	defer rows.Close()
@@ -633,14 +2558,11 @@ func handleAnalyticsStats(w http.ResponseWriter, r *http.Request) {
 	var stats []AnalyticsStats
 	for rows.Next() {
 		var s AnalyticsStats
-		rows.Scan(&s.AdID, &s.AdType, &s.AdContent, &s.ImageURL, &s.CampaignID, &s.Views, &s.Clicks)
+		rows.Scan(&s.AdID, &s.AdType, &s.AdContent, &s.ImageURL, &s.CampaignID, &s.Views, &s.ViewableViews, &s.UniqueViews, &s.Clicks, &s.Conversions, &s.ConversionValue, &s.AvgTimeToClick)
 
-		if s.Views > 0 {
-			ctr := float64(s.Clicks) / float64(s.Views) * 100
-			s.CTR = fmt.Sprintf("%.2f%%", ctr)
-		} else {
-			s.CTR = "0%"
-		}
+		s.CTR = formatCTR(s.Clicks, s.Views)
+		s.ViewableRate = formatCTR(s.ViewableViews, s.Views)
+		s.ConversionRate = formatCTR(s.Conversions, s.Clicks)
 
 		stats = append(stats, s)
 	}
@@ -648,62 +2570,69 @@ func handleAnalyticsStats(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusOK, stats)
 }
 
-func handleUpload(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		respondJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use POST"})
+func handleStatic(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/static/")
+	// The dashboard is only served through /admin, which checks credentials.
+	if strings.EqualFold(filepath.Clean(path), "admin.html") {
+		http.Redirect(w, r, "/admin", http.StatusFound)
 		return
 	}
-
-	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
-	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
-		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "file too large"})
-		return
+	w.Header().Set("Cache-Control", staticCacheControl(path))
+	if t, ok := videoTypes[strings.ToLower(filepath.Ext(path))]; ok {
+		w.Header().Set("Content-Type", t)
 	}
-
-	file, header, err := r.FormFile("image")
-	if err != nil {
-		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "no file uploaded"})
-		return
+	filepath := filepath.Join(".", "static", path)
+	if strings.HasSuffix(strings.ToLower(path), ".svg") {
+		// Opened directly, an SVG is a document; never let it run script.
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src data:")
 	}
-	defer file.Close()
+	// ServeFile answers Range requests with 206 Partial Content, which video
+	// players need to seek.
+	http.ServeFile(w, r, filepath)
+}
 
-	// Validate file ad_type
-	content_type := header.Header.Get("Content-Type")
-	if !strings.HasPrefix(content_type, "image/") {
-		respondJSON(w, http.StatusBadRequest, map[string]string{"error": "only images allowed"})
-		return
-	}
+// videoTypes fixes the Content-Type of video files, which the system MIME
+// table may not list; sniffing a ranged response's bytes can't be relied on.
+var videoTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".ogv":  "video/ogg",
+	".mov":  "video/quicktime",
+}
 
-	// Generate unique filename
-	ext := filepath.Ext(header.Filename)
-	filename := fmt.Sprintf("%d%s", time.Now().UnixNano(), ext)
-	filepath := filepath.Join(uploadDir, filename)
+// Cache policies for static files. Images and videos are cached by browsers
+// and CDNs; one whose name is a hash or upload id never changes, so it can
+// be cached for good. Everything else, the dashboard included, is
+// revalidated.
+const (
+	cacheImmutable  = "public, max-age=31536000, immutable"
+	cacheImage      = "public, max-age=86400"
+	cacheRevalidate = "no-cache"
+)
 
-	dst, err := os.Create(filepath)
-	if err != nil {
-		respondJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to save file"})
-		return
-	}
-	defer dst.Close()
+// hashedName matches file names carrying a content hash or unique id:
+// uploads ("1718031234567890123.png") and build-tool output
+// ("logo.3f9a2b1c.png").
+var hashedName = regexp.MustCompile(`(^|[.-])[0-9a-f]{8,}\.[a-z0-9]+$`)
 
-	if _, err := io.Copy(dst, file); err != nil {
-		respondJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to save file"})
-		return
+// staticCacheControl picks the Cache-Control header for a file under
+// /static/.
+func staticCacheControl(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if _, video := videoTypes[ext]; !video && !strings.HasPrefix(mime.TypeByExtension(ext), "image/") {
+		return cacheRevalidate
 	}
-
-	url := fmt.Sprintf("/static/images/%s", filename)
-	respondJSON(w, http.StatusOK, map[string]string{"url": url})
-}
-
-func handleStatic(w http.ResponseWriter, r *http.Request) {
-	path := strings.TrimPrefix(r.URL.Path, "/static/")
-	filepath := filepath.Join(".", "static", path)
-	http.ServeFile(w, r, filepath)
+	if hashedName.MatchString(strings.ToLower(filepath.Base(path))) {
+		return cacheImmutable
+	}
+	return cacheImage
 }
 
 func handleAdmin(w http.ResponseWriter, r *http.Request) {
 	// Admin dashboard HTML will be served here
 	// See separate artifact for the full dashboard
+	w.Header().Set("Cache-Control", cacheRevalidate)
 	http.ServeFile(w, r, "./static/admin.html")
 }
 
@@ -718,29 +2647,88 @@ func handleEmbedJS(w http.ResponseWriter, r *http.Request) {
   var tags = container.getAttribute('data-tags') || '';
   var apiUrl = container.getAttribute('data-api-url') || 'http://localhost:8080';
 
+  // Uploaded creatives have server-relative paths; resolve them against the
+  // ad server rather than the publisher's page.
+  function qualify(u) {
+    return u && u.charAt(0) === '/' && u.charAt(1) !== '/' ? apiUrl + u : u;
+  }
+
+  // sendBeacon is queued by the browser and still goes out if the visitor
+  // leaves the page right away.
+  function logView(ad, viewable) {
+    var flag = viewable ? 'viewable=1' : '';
+    function withFlag(u) {
+      return flag ? u + (u.indexOf('?') < 0 ? '?' : '&') + flag : u;
+    }
+    if (ad.beacon_url && navigator.sendBeacon && navigator.sendBeacon(withFlag(ad.beacon_url))) return;
+    if (ad.impression_url) fetch(withFlag(ad.impression_url), { method: 'POST', keepalive: true });
+  }
+
   fetch(apiUrl + '/api/ad/random?tags=' + encodeURIComponent(tags))
-    .then(function(res) { return res.json(); })
+    .then(function(res) { return res.ok ? res.json() : null; })
     .then(function(ad) {
+      if (!ad) return;
       var adEl = document.createElement('div');
       adEl.style.cssText = 'border:1px solid #ddd;padding:15px;border-radius:8px;background:#f9f9f9;max-width:300px;';
 
-      if (ad.AdType === 'text') {
-        adEl.innerHTML = '<p style="margin:0;font-size:14px;">' + ad.content + '</p>';
-      } else if (ad.AdType === 'image' && ad.image_url) {
-        adEl.innerHTML = '<img src="' + ad.image_url + '" style="max-width:100%;height:auto;" />';
+      if (ad.ad_type === 'image' && ad.image_url) {
+        var img = document.createElement('img');
+        img.src = qualify(ad.image_url);
+        img.alt = ad.content || '';
+        if (ad.images && ad.images.length) {
+          img.srcset = ad.images.map(function(i) { return qualify(i.url) + ' ' + i.width + 'w'; }).join(', ');
+          img.sizes = '300px';
+        }
+        img.style.cssText = 'max-width:100%;height:auto;';
+        adEl.appendChild(img);
+      } else if (ad.ad_type === 'video' && ad.video_url) {
+        var video = document.createElement('video');
+        video.src = qualify(ad.video_url);
+        video.muted = true;
+        video.autoplay = true;
+        video.playsInline = true;
+        video.style.cssText = 'max-width:100%;';
+        adEl.appendChild(video);
+      } else if (ad.content) {
+        // Text ads, and any type this script doesn't know how to show.
+        var p = document.createElement('p');
+        p.style.cssText = 'margin:0;font-size:14px;';
+        p.textContent = ad.content;
+        adEl.appendChild(p);
       }
 
       var link = document.createElement('a');
-      link.href = apiUrl + '/api/redirect/' + ad.id;
+      link.href = ad.click_url || apiUrl + '/api/redirect/' + ad.id;
       link.textContent = 'Learn More';
       link.style.cssText = 'display:inline-block;margin-top:10px;color:#0066cc;text-decoration:none;';
       link.target = '_blank';
+      link.rel = 'noopener sponsored';
       adEl.appendChild(link);
 
       container.appendChild(adEl);
 
-      // Log impression
-      fetch(apiUrl + '/api/impression/' + ad.id, { method: 'POST' });
+      // Log the view only once the ad is viewable by the IAB definition:
+      // at least half of it on screen for a continuous second, or two for
+      // video. Browsers without IntersectionObserver log it right away,
+      // without the viewable flag.
+      if (!window.IntersectionObserver) {
+        logView(ad, false);
+        return;
+      }
+      var timer = null;
+      var observer = new IntersectionObserver(function(entries) {
+        var visible = entries[entries.length - 1].intersectionRatio >= 0.5;
+        if (visible && !timer) {
+          timer = setTimeout(function() {
+            observer.disconnect();
+            logView(ad, true);
+          }, ad.ad_type === 'video' ? 2000 : 1000);
+        } else if (!visible && timer) {
+          clearTimeout(timer);
+          timer = null;
+        }
+      }, { threshold: [0, 0.5, 1] });
+      observer.observe(adEl);
     })
     .catch(function(err) {
       console.error('Failed to load ad:', err);
@@ -754,13 +2742,46 @@ func handleEmbedJS(w http.ResponseWriter, r *http.Request) {
 
 // === MIDDLEWARE ===
 
+// withAdminAuth guards the dashboard page with a session cookie or HTTP
+// Basic auth (any user name, the API token as password). A Basic login
+// also starts a session so the dashboard's API calls are authenticated.
+func withAdminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hasSession(r) {
+			_, password, ok := r.BasicAuth()
+			if !ok || !validToken(password) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="adserver admin", charset="UTF-8"`)
+				respondErrorPage(w, r, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+			if err := startSession(w); err != nil {
+				respondErrorPage(w, r, http.StatusInternalServerError, "session error")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// withAuth accepts the API token as a bearer header or a dashboard session
+// cookie from /api/login. Cookie-authenticated writes must also carry the
+// session's CSRF token; bearer clients are exempt since browsers never
+// attach that header on their own.
 func withAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
-		token := strings.TrimPrefix(authHeader, "Bearer ")
+		if token, bearer := strings.CutPrefix(authHeader, "Bearer "); bearer && validToken(token) {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-		if token != apiToken {
-			respondJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		sess, ok := requestSession(r)
+		if !ok {
+			respondError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		if !validCSRF(r, sess) {
+			respondError(w, http.StatusForbidden, "missing or invalid CSRF token")
 			return
 		}
 
@@ -768,20 +2789,42 @@ func withAuth(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// CORS settings. Browsers refuse credentialed responses that allow "*", so
+// with corsCredentials set only origins listed explicitly are echoed back
+// and every other origin gets no Access-Control-Allow-Origin at all.
+var (
+	corsMaxAge      = defaultCORSMaxAge
+	corsCredentials bool
+)
+
 func withCORS(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		origin := r.Header.Get("Origin")
 
-		if origin != "" && isAllowedOrigin(origin) {
+		// The CORS headers depend on the Origin (and, for preflights, the
+		// requested method and headers), so shared caches must key on them
+		// whichever branch is taken.
+		w.Header().Add("Vary", "Origin")
+		if r.Method == http.MethodOptions {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		switch {
+		case corsCredentials:
+			if origin != "" && isAllowedOrigin(origin) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		case origin != "" && isAllowedOrigin(origin):
 			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Vary", "Origin")
-		} else {
+		default:
 			w.Header().Set("Access-Control-Allow-Origin", "*")
 		}
 
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		w.Header().Set("Access-Control-Max-Age", "86400")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-CSRF-Token")
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusNoContent)
@@ -792,6 +2835,120 @@ func withCORS(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// sideEffectPaths do more than read on GET, so withHead leaves HEAD requests
+// to them alone: a monitor or link checker must not count. The tracking
+// paths record an impression or click, and the serving paths pick an ad,
+// which can log its view, charge its daily cap and move round-robin and
+// sticky state along.
+var sideEffectPaths = []string{
+	"/api/impression/", "/api/beacon/", "/api/redirect/",
+	"/api/ad/random", "/api/ads/random", "/api/ad/render",
+}
+
+// withHead serves HEAD requests with the GET handler. The handlers only
+// check for GET; the server drops the body of a HEAD response itself, so
+// clients get the same status and headers without it.
+func withHead(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && !hasSideEffects(r.URL.Path) {
+			// The server decides on the body from its own copy of the
+			// request, which stays HEAD.
+			r = r.Clone(r.Context())
+			r.Method = http.MethodGet
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func hasSideEffects(path string) bool {
+	for _, p := range sideEffectPaths {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// withGzip compresses text-like responses for clients that accept gzip.
+// Binary payloads such as images are passed through untouched.
+func withGzip(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(enc)
+		if enc == "gzip" || (strings.HasPrefix(enc, "gzip;") && !strings.HasSuffix(enc, "q=0")) {
+			return true
+		}
+	}
+	return false
+}
+
+func isCompressible(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	return strings.HasPrefix(contentType, "text/") ||
+		strings.Contains(contentType, "json") ||
+		strings.Contains(contentType, "javascript") ||
+		strings.Contains(contentType, "xml")
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+
+	h := g.Header()
+	if status != http.StatusNoContent && status != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" && isCompressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+func (g *gzipResponseWriter) Close() error {
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	return nil
+}
+
 func isAllowedOrigin(o string) bool {
 	for _, allowed := range allowedOrigins {
 		if strings.EqualFold(o, allowed) {
@@ -803,8 +2960,319 @@ func isAllowedOrigin(o string) bool {
 
 // === HELPERS ===
 
+// baseURL returns the scheme and host the client used to reach the server,
+// honoring X-Forwarded-Proto from a TLS-terminating proxy.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "https" || proto == "http" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// clientIP is the remote address without its port, so repeat visits from
+// one client share an IP in the impressions table.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// anonymizeIPs truncates client IPs before they are stored with an
+// impression, click or conversion.
+var anonymizeIPs bool
+
+// anonymizeIP zeroes the last octet of an IPv4 address and the last 80 bits
+// of an IPv6 one. Anything that doesn't parse is dropped rather than stored.
+func anonymizeIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// impressionURL is where a served ad reports its view, with its nonce
+// when those are enabled.
+func impressionURL(base string, id int, nonce string) string {
+	u := base + "/api/impression/" + strconv.Itoa(id)
+	if nonce != "" {
+		u += "?nonce=" + nonce
+	}
+	return u
+}
+
+func clickURL(base string, id int) string {
+	return base + "/api/redirect/" + strconv.Itoa(id)
+}
+
+// nullableID maps the zero ID to NULL so optional foreign keys stay valid.
+func nullableID(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// expiresAtValue stores a validated RFC3339 expiry in UTC sqlTimeLayout,
+// the format the database's own timestamps use.
+func expiresAtValue(s *string) interface{} {
+	if s == nil || *s == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, *s)
+	if err != nil {
+		return *s
+	}
+	return t.UTC().Format(sqlTimeLayout)
+}
+
+// envInt reads an integer from the environment, falling back to def when
+// unset or invalid.
+func envInt(name string, def int) int {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %d", name, v, def)
+		return def
+	}
+	return n
+}
+
+// envBool reads a boolean (true/false, 1/0) from the environment, falling
+// back to def when unset or invalid.
+func envBool(name string, def bool) bool {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %t", name, v, def)
+		return def
+	}
+	return b
+}
+
+// envList splits a comma-separated setting, dropping empty entries.
+func envList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// envDuration reads a Go duration (e.g. "30s") from the environment,
+// falling back to def when unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %s", name, v, def)
+		return def
+	}
+	return d
+}
+
+// Request body limits for JSON endpoints, in bytes. Imports get their own
+// limit since a full catalog is much larger than a single ad.
+var (
+	maxJSONBody   int64 = defaultMaxJSONBody
+	maxImportBody int64 = defaultMaxImportBody
+)
+
+// decodeJSONBody strictly decodes at most limit bytes of r's body into v,
+// rejecting fields v doesn't have so typos don't pass silently. On failure
+// it writes a 413 or 400 response and returns false.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}, limit int64) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		return true
+	}
+	respondDecodeError(w, err)
+	return false
+}
+
+func respondDecodeError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &tooLarge):
+		respondError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("field %q must be %s", typeErr.Field, typeErr.Type))
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		respondError(w, http.StatusBadRequest, strings.TrimPrefix(err.Error(), "json: "))
+	default:
+		respondError(w, http.StatusBadRequest, "invalid JSON")
+	}
+}
+
 func respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(data)
+	enc := json.NewEncoder(w)
+	if wantsPretty(w) {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(data)
+}
+
+// APIError is the body of every error response, as
+// {"error": {"code": "not_found", "message": "ad not found"}}. Code is
+// derived from the status so clients can branch on it; Message is for
+// people.
+type APIError struct {
+	Error APIErrorDetail `json:"error"`
+}
+
+type APIErrorDetail struct {
+	XMLName xml.Name `json:"-" xml:"error"`
+	Code    string   `json:"code" xml:"code,attr"`
+	Message string   `json:"message" xml:",chardata"`
+	// Fields lists every invalid field when a request fails validation.
+	Fields []FieldError `json:"fields,omitempty" xml:"-"`
+}
+
+func errorBody(status int, message string) APIError {
+	return APIError{Error: APIErrorDetail{Code: errorCode(status), Message: message}}
+}
+
+// errorCode names a status in snake case, e.g. 404 -> "not_found".
+func errorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.ToLower(strings.ReplaceAll(strings.ReplaceAll(text, "-", "_"), " ", "_"))
+}
+
+func respondError(w http.ResponseWriter, status int, message string) {
+	respondJSON(w, status, errorBody(status, message))
+}
+
+// respondInvalid answers a request that failed validation with 400, listing
+// the invalid fields when err carries them.
+func respondInvalid(w http.ResponseWriter, err error) {
+	body := errorBody(http.StatusBadRequest, err.Error())
+	var fields validationErrors
+	if errors.As(err, &fields) {
+		body.Error.Fields = fields
+	}
+	respondJSON(w, http.StatusBadRequest, body)
+}
+
+// respondErrorPage is respondError for endpoints people open in a browser:
+// clients that prefer HTML get a plain page with the message instead.
+func respondErrorPage(w http.ResponseWriter, r *http.Request, status int, message string) {
+	w.Header().Add("Vary", "Accept")
+	accept := r.Header.Get("Accept")
+	if !strings.Contains(accept, "text/html") || strings.Contains(accept, "application/json") {
+		respondError(w, status, message)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<title>%d %s</title>\n<p>%s</p>\n", status, http.StatusText(status), html.EscapeString(message))
+}
+
+// respondNegotiated writes data as XML when the client asks for it with
+// ?format=xml or an Accept header preferring XML, and as JSON otherwise.
+// Errors are rendered as <error code="...">message</error>.
+func respondNegotiated(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
+	w.Header().Add("Vary", "Accept")
+	if !wantsXML(r) {
+		respondJSON(w, status, data)
+		return
+	}
+
+	if e, ok := data.(APIError); ok {
+		data = e.Error
+	}
+
+	body, err := xml.Marshal(data)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "encoding error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	w.Write(body)
+}
+
+func wantsXML(r *http.Request) bool {
+	switch r.URL.Query().Get("format") {
+	case "xml":
+		return true
+	case "json":
+		return false
+	}
+
+	// The first supported media type listed wins; JSON is the default.
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.Split(part, ";")[0])
+		switch mediaType {
+		case "application/json":
+			return false
+		case "application/xml", "text/xml":
+			return true
+		}
+	}
+	return false
+}
+
+// respondJSONWithETag writes data as JSON with an ETag derived from the
+// encoded body, answering 304 when the client already holds that version.
+func respondJSONWithETag(w http.ResponseWriter, r *http.Request, data interface{}) {
+	body, err := marshalJSON(w, data)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "encoding error")
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+	w.Write([]byte("\n"))
+}
+
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
 }
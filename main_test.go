@@ -0,0 +1,1161 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestDB points the server at an empty SQLite database in a temporary
+// directory, with a running impression writer, for the length of the test.
+func newTestDB(t *testing.T) {
+	t.Helper()
+	repo, err := openSQLite(filepath.Join(t.TempDir(), "ads.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTestDB(t, repo)
+}
+
+// useTestDB installs repo, which must be empty, as the server's database and
+// creates the tables.
+func useTestDB(t *testing.T, repo Repository) {
+	t.Helper()
+	db = repo
+	t.Cleanup(func() { repo.Close() })
+	createTables()
+
+	impressionLog = newImpressionWriter(100, 10, 10*time.Millisecond, false)
+	impressionLog.Start()
+	t.Cleanup(impressionLog.Close)
+	candidateCache.Invalidate()
+}
+
+// flushImpressions waits for the queued impressions to be stored, then
+// starts a fresh writer for the rest of the test.
+func flushImpressions(t *testing.T) {
+	t.Helper()
+	impressionLog.Close()
+	impressionLog = newImpressionWriter(100, 10, 10*time.Millisecond, false)
+	impressionLog.Start()
+	t.Cleanup(impressionLog.Close)
+}
+
+// countImpressions counts the stored impressions of ad with action.
+func countImpressions(t *testing.T, adID int, action string) int {
+	t.Helper()
+	flushImpressions(t)
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM impressions WHERE ad_id = ? AND action_type = ?`, adID, action).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// mustInsertAd stores a text ad with the given content and tags.
+func mustInsertAd(t *testing.T, content string, tags ...string) int {
+	t.Helper()
+	id, err := insertAd(Ad{AdType: "text", Content: content, RedirectURL: "https://example.com/" + content, Tags: tags})
+	if err != nil {
+		t.Fatalf("insertAd(%q): %v", content, err)
+	}
+	return int(id)
+}
+
+func mustGetAd(t *testing.T, id int) Ad {
+	t.Helper()
+	ad, err := scanAd(db.QueryRow(`SELECT `+adColumns+` FROM ads WHERE id = ?`, id))
+	if err != nil {
+		t.Fatalf("reading ad %d: %v", id, err)
+	}
+	return ad
+}
+
+// testToken is the API token the tests authenticate with.
+const testToken = "test-token"
+
+// newRequest builds a request with an optional JSON body, authenticated
+// with testToken.
+func newRequest(method, target, body string) *http.Request {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, r)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	apiToken = testToken
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	return req
+}
+
+// serve runs req through h and returns the recorded response.
+func serve(h http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, req)
+	return w
+}
+
+// decodeBody unmarshals a JSON response into v, failing the test unless the
+// status is want.
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder, want int, v interface{}) {
+	t.Helper()
+	if w.Code != want {
+		t.Fatalf("status %d, want %d: %s", w.Code, want, w.Body)
+	}
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("decoding %s: %v", w.Body, err)
+		}
+	}
+}
+
+func TestETagNotModified(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "etag")
+
+	for _, tc := range []struct {
+		name   string
+		h      http.HandlerFunc
+		target string
+	}{
+		{"list", handleListAds, "/api/ads"},
+		{"single", handleAd, "/api/ad/" + itoa(id)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serve(tc.h, newRequest(http.MethodGet, tc.target, ""))
+			etag := w.Header().Get("ETag")
+			if w.Code != http.StatusOK || etag == "" {
+				t.Fatalf("status %d, ETag %q", w.Code, etag)
+			}
+
+			req := newRequest(http.MethodGet, tc.target, "")
+			req.Header.Set("If-None-Match", etag)
+			w = serve(tc.h, req)
+			if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+				t.Errorf("re-fetch: status %d with %d bytes, want an empty 304", w.Code, w.Body.Len())
+			}
+
+			req = newRequest(http.MethodGet, tc.target, "")
+			req.Header.Set("If-None-Match", `"stale"`)
+			if w := serve(tc.h, req); w.Code != http.StatusOK {
+				t.Errorf("stale ETag: status %d, want 200", w.Code)
+			}
+		})
+	}
+
+	// A change to the ad changes the ETag.
+	w := serve(handleAd, newRequest(http.MethodGet, "/api/ad/"+itoa(id), ""))
+	before := w.Header().Get("ETag")
+	ad := mustGetAd(t, id)
+	ad.Content = "changed"
+	if _, err := updateAd(id, ad); err != nil {
+		t.Fatal(err)
+	}
+	req := newRequest(http.MethodGet, "/api/ad/"+itoa(id), "")
+	req.Header.Set("If-None-Match", before)
+	if w := serve(handleAd, req); w.Code != http.StatusOK {
+		t.Errorf("after update: status %d, want 200", w.Code)
+	}
+}
+
+func itoa(n int) string { return strconv.Itoa(n) }
+
+func TestUpdateChangesUpdatedAtOnly(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "timestamps")
+	if _, err := db.Exec(`UPDATE ads SET created_at = ?, updated_at = ? WHERE id = ?`, "2020-01-01 00:00:00", "2020-01-01 00:00:00", id); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(handleUpdateAd, newRequest(http.MethodPut, "/api/ad/update/"+itoa(id),
+		`{"ad_type":"text","content":"timestamps, updated","redirect_url":"https://example.com/timestamps"}`))
+	decodeBody(t, w, http.StatusOK, nil)
+
+	ad := mustGetAd(t, id)
+	if ad.CreatedAt != "2020-01-01T00:00:00Z" {
+		t.Errorf("created_at = %s, want it unchanged", ad.CreatedAt)
+	}
+	updated, err := time.Parse(time.RFC3339, ad.UpdatedAt)
+	if err != nil || time.Since(updated) > time.Minute {
+		t.Errorf("updated_at = %s, want about now", ad.UpdatedAt)
+	}
+
+	w = serve(handleAd, newRequest(http.MethodGet, "/api/ad/"+itoa(id), ""))
+	if got, want := w.Header().Get("Last-Modified"), updated.UTC().Format(http.TimeFormat); got != want {
+		t.Errorf("Last-Modified = %q, want %q", got, want)
+	}
+}
+
+func TestConcurrentStaleUpdateConflicts(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "contended")
+
+	// Both clients read version 1, then save their edits at once.
+	codes := make(chan int, 2)
+	var wg sync.WaitGroup
+	for _, content := range []string{"first edit", "second edit"} {
+		body := `{"ad_type":"text","content":"` + content + `","redirect_url":"https://example.com","version":1}`
+		req := newRequest(http.MethodPut, "/api/ad/update/"+itoa(id), body)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- serve(handleUpdateAd, req).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	got := map[int]int{}
+	for code := range codes {
+		got[code]++
+	}
+	if got[http.StatusOK] != 1 || got[http.StatusConflict] != 1 {
+		t.Fatalf("statuses %v, want one 200 and one 409", got)
+	}
+	if ad := mustGetAd(t, id); ad.Version != 2 || ad.Content == "contended" {
+		t.Errorf("ad = %+v, want the winning edit at version 2", ad)
+	}
+
+	w := serve(handleUpdateAd, newRequest(http.MethodPut, "/api/ad/update/"+itoa(id), `{"ad_type":"text","content":"third edit","redirect_url":"https://example.com","version":2}`))
+	var result map[string]interface{}
+	decodeBody(t, w, http.StatusOK, &result)
+	if result["version"] != float64(3) {
+		t.Errorf("update answered %v, want version 3", result)
+	}
+}
+
+func TestGzipResponses(t *testing.T) {
+	newTestDB(t)
+	mustInsertAd(t, "compressed", "go")
+	plain := serve(handleListAds, newRequest(http.MethodGet, "/api/ads", ""))
+
+	req := newRequest(http.MethodGet, "/api/ads", "")
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	w := serve(withGzip(handleListAds), req)
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", w.Header().Get("Content-Encoding"))
+	}
+	if !strings.Contains(w.Header().Get("Vary"), "Accept-Encoding") {
+		t.Errorf("Vary = %q", w.Header().Get("Vary"))
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, plain.Body.Bytes()) {
+		t.Errorf("decompressed body = %s, want %s", body, plain.Body)
+	}
+	var ads []Ad
+	if err := json.Unmarshal(body, &ads); err != nil || len(ads) != 1 {
+		t.Errorf("decoded %v, %v", ads, err)
+	}
+
+	w = serve(withGzip(handleListAds), newRequest(http.MethodGet, "/api/ads", ""))
+	if w.Header().Get("Content-Encoding") != "" || !bytes.Equal(w.Body.Bytes(), plain.Body.Bytes()) {
+		t.Errorf("client without gzip got Content-Encoding %q and %s", w.Header().Get("Content-Encoding"), w.Body)
+	}
+}
+
+func TestHeadServedLikeGet(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "headed")
+	apiToken = testToken
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+	srv := httptest.NewServer(serverHandler(mux, false))
+	defer srv.Close()
+
+	head := func(path string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodHead, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+testToken)
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if body, _ := io.ReadAll(resp.Body); len(body) != 0 {
+			t.Errorf("HEAD %s: body %q, want none", path, body)
+		}
+		return resp
+	}
+	for _, path := range []string{"/api/ads", "/version", "/api/ad/" + itoa(id)} {
+		if resp := head(path); resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+			t.Errorf("HEAD %s: status %d, Content-Type %q", path, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+	}
+	if resp := head("/api/ad/add"); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("HEAD of a POST endpoint: status %d, want 405", resp.StatusCode)
+	}
+
+	// A link checker's HEAD is redirected but isn't a click.
+	if resp := head("/api/redirect/" + itoa(id)); resp.StatusCode != redirectStatus {
+		t.Errorf("HEAD redirect: status %d", resp.StatusCode)
+	}
+	if n := countImpressions(t, id, "click"); n != 0 {
+		t.Errorf("HEAD logged %d clicks", n)
+	}
+
+	// Nor does a HEAD of a serving path pick an ad and count its view.
+	for _, path := range []string{"/api/ad/random", "/api/ads/random", "/api/ad/render", "/api/impression/" + itoa(id), "/api/beacon/" + itoa(id)} {
+		if resp := head(path + "?track=server"); resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("HEAD %s: status %d, want 405", path, resp.StatusCode)
+		}
+	}
+	if n := countImpressions(t, id, "view"); n != 0 {
+		t.Errorf("HEAD logged %d views", n)
+	}
+	if ad := mustGetAd(t, id); ad.ViewCount != 0 {
+		t.Errorf("view_count = %d after HEAD requests, want 0", ad.ViewCount)
+	}
+}
+
+func TestRandomAdXML(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "xml <&> ad", "go")
+
+	for _, tc := range []struct {
+		name   string
+		target string
+		accept string
+	}{
+		{"accept header", "/api/ad/random?track=none", "text/html, application/xml;q=0.9"},
+		{"format param", "/api/ad/random?track=none&format=xml", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newRequest(http.MethodGet, tc.target, "")
+			req.Header.Set("Accept", tc.accept)
+			w := serve(handleRandomAd, req)
+			if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/xml") {
+				t.Fatalf("status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+			}
+			var ad Ad
+			if err := xml.Unmarshal(w.Body.Bytes(), &ad); err != nil {
+				t.Fatalf("malformed XML %s: %v", w.Body, err)
+			}
+			if ad.ID != id || ad.Content != "xml <&> ad" || len(ad.Tags) != 1 || ad.Tags[0] != "go" {
+				t.Errorf("decoded %+v", ad)
+			}
+		})
+	}
+
+	w := serve(handleRandomAd, newRequest(http.MethodGet, "/api/ad/random?track=none", ""))
+	var ad Ad
+	decodeBody(t, w, http.StatusOK, &ad)
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") || ad.ID != id {
+		t.Errorf("default: Content-Type %q, ad %d", w.Header().Get("Content-Type"), ad.ID)
+	}
+
+	req := newRequest(http.MethodGet, "/api/ad/random?tags=none&format=xml", "")
+	w = serve(handleRandomAd, req)
+	var e APIErrorDetail
+	if err := xml.Unmarshal(w.Body.Bytes(), &e); w.Code != http.StatusNotFound || err != nil || e.Code != "not_found" {
+		t.Errorf("no match as XML: status %d, %s", w.Code, w.Body)
+	}
+}
+
+func TestAnalyticsUniqueViews(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "unique")
+	now := time.Now().UTC().Format(sqlTimeLayout)
+	for _, c := range []struct {
+		ip, ua string
+		views  int
+	}{
+		{"1.1.1.1", "Firefox", 4},
+		{"1.1.1.1", "Chrome", 1}, // same IP, another browser
+		{"2.2.2.2", "Firefox", 2},
+	} {
+		for range c.views {
+			if err := insertImpression(Impression{AdID: id, ActionType: "view", IP: c.ip, UserAgent: c.ua, ViewedAt: now}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var stats []AnalyticsStats
+	decodeBody(t, serve(handleAnalyticsStats, newRequest(http.MethodGet, "/api/analytics/stats", "")), http.StatusOK, &stats)
+	if len(stats) != 1 || stats[0].Views != 7 || stats[0].UniqueViews != 3 {
+		t.Errorf("stats = %+v, want 7 views from 3 unique viewers", stats)
+	}
+}
+
+func TestOversizedJSONBody(t *testing.T) {
+	newTestDB(t)
+	saved := maxJSONBody
+	maxJSONBody = 1024
+	defer func() { maxJSONBody = saved }()
+
+	huge := `{"ad_type":"text","content":"` + strings.Repeat("x", 2048) + `","redirect_url":"https://example.com"}`
+	for _, tc := range []struct {
+		name   string
+		h      http.HandlerFunc
+		method string
+		target string
+	}{
+		{"add", handleAddAd, http.MethodPost, "/api/ad/add"},
+		{"update", handleUpdateAd, http.MethodPut, "/api/ad/update/1"},
+		{"campaign", handleAddCampaign, http.MethodPost, "/api/campaign/add"},
+	} {
+		var e APIError
+		decodeBody(t, serve(tc.h, newRequest(tc.method, tc.target, huge)), http.StatusRequestEntityTooLarge, &e)
+		if e.Error.Message != "request body exceeds 1024 bytes" {
+			t.Errorf("%s: message %q", tc.name, e.Error.Message)
+		}
+	}
+}
+
+func TestUnknownFieldRejected(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "typo")
+	for _, tc := range []struct {
+		name   string
+		h      http.HandlerFunc
+		method string
+		target string
+		body   string
+		field  string
+	}{
+		{"add", handleAddAd, http.MethodPost, "/api/ad/add", `{"ad_type":"text","content":"a","redrectUrl":"https://example.com"}`, "redrectUrl"},
+		{"update", handleUpdateAd, http.MethodPut, "/api/ad/update/" + itoa(id), `{"ad_type":"text","content":"a","redirect_url":"https://example.com","tag":["go"]}`, "tag"},
+		{"campaign", handleAddCampaign, http.MethodPost, "/api/campaign/add", `{"name":"c","budget":10}`, "budget"},
+	} {
+		var e APIError
+		decodeBody(t, serve(tc.h, newRequest(tc.method, tc.target, tc.body)), http.StatusBadRequest, &e)
+		if want := `unknown field "` + tc.field + `"`; e.Error.Message != want {
+			t.Errorf("%s: message %q, want %q", tc.name, e.Error.Message, want)
+		}
+	}
+	if ad := mustGetAd(t, id); ad.Content != "typo" {
+		t.Errorf("rejected update changed the ad: %+v", ad)
+	}
+}
+
+func TestErrorsShareOneSchema(t *testing.T) {
+	newTestDB(t)
+	unauthenticated := httptest.NewRequest(http.MethodGet, "/api/ads", nil)
+	for _, tc := range []struct {
+		name   string
+		h      http.HandlerFunc
+		req    *http.Request
+		status int
+		code   string
+	}{
+		{"bad id", handleAd, newRequest(http.MethodGet, "/api/ad/abc", ""), http.StatusBadRequest, "bad_request"},
+		{"missing ad", handleAd, newRequest(http.MethodGet, "/api/ad/999", ""), http.StatusNotFound, "not_found"},
+		{"wrong method", handleAddAd, newRequest(http.MethodGet, "/api/ad/add", ""), http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"invalid ad", handleAddAd, newRequest(http.MethodPost, "/api/ad/add", `{"ad_type":"text"}`), http.StatusBadRequest, "bad_request"},
+		{"no token", withAuth(handleListAds), unauthenticated, http.StatusUnauthorized, "unauthorized"},
+		{"redirect", handleRedirect, newRequest(http.MethodGet, "/api/redirect/999", ""), http.StatusNotFound, "not_found"},
+	} {
+		w := serve(tc.h, tc.req)
+		var e APIError
+		decodeBody(t, w, tc.status, &e)
+		if e.Error.Code != tc.code || e.Error.Message == "" {
+			t.Errorf("%s: error %+v, want code %q and a message", tc.name, e.Error, tc.code)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("%s: Content-Type %q", tc.name, ct)
+		}
+	}
+
+	// People follow click links in a browser, so they get a page instead.
+	req := newRequest(http.MethodGet, "/api/redirect/999", "")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	w := serve(handleRedirect, req)
+	if w.Code != http.StatusNotFound || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") || !strings.Contains(w.Body.String(), "ad not found") {
+		t.Errorf("browser redirect error: %d %q %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+}
+
+func TestExpiresAtValidation(t *testing.T) {
+	newTestDB(t)
+	add := func(content, expires string) *httptest.ResponseRecorder {
+		return serve(handleAddAd, newRequest(http.MethodPost, "/api/ad/add",
+			`{"ad_type":"text","content":"`+content+`","redirect_url":"https://example.com","expires_at":"`+expires+`"}`))
+	}
+
+	var created Ad
+	decodeBody(t, add("valid", "2030-06-01T12:00:00+02:00"), http.StatusCreated, &created)
+	if ad := mustGetAd(t, created.ID); ad.ExpiresAt == nil || *ad.ExpiresAt != "2030-06-01T10:00:00Z" {
+		t.Errorf("expires_at = %v, want it normalized to UTC", ad.ExpiresAt)
+	}
+
+	for _, tc := range []struct{ expires, message string }{
+		{"tomorrow", "expires_at must be an RFC3339 timestamp"},
+		{"2030-06-01", "expires_at must be an RFC3339 timestamp"},
+		{"2020-01-01T00:00:00Z", "expires_at is in the past"},
+	} {
+		w := add(tc.expires, tc.expires)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tc.message) {
+			t.Errorf("%s: status %d %s, want 400 saying %q", tc.expires, w.Code, w.Body, tc.message)
+		}
+	}
+}
+
+// mustInsertExpiringAd stores a text ad that expires at expires.
+func mustInsertExpiringAd(t *testing.T, content string, expires time.Time, tags ...string) int {
+	t.Helper()
+	at := expires.UTC().Format(time.RFC3339)
+	id, err := insertAd(Ad{AdType: "text", Content: content, RedirectURL: "https://example.com/" + content, Tags: tags, ExpiresAt: &at})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(id)
+}
+
+func TestTagLimits(t *testing.T) {
+	newTestDB(t)
+	savedTags, savedLength := maxTags, maxTagLength
+	maxTags, maxTagLength = 3, 5
+	defer func() { maxTags, maxTagLength = savedTags, savedLength }()
+
+	for i, tc := range []struct {
+		tags string
+		want int
+	}{
+		{`["a","b","c"]`, http.StatusCreated},
+		{`["a","b","c","d"]`, http.StatusBadRequest},
+		{`["a","b","c","C"]`, http.StatusCreated}, // duplicates count once
+		{`["gopher"]`, http.StatusBadRequest},
+		{`["gophr"]`, http.StatusCreated},
+		{`["gophé"]`, http.StatusCreated}, // characters, not bytes
+	} {
+		body := `{"ad_type":"text","content":"ad ` + itoa(i) + `","redirect_url":"https://example.com","tags":` + tc.tags + `}`
+		if w := serve(handleAddAd, newRequest(http.MethodPost, "/api/ad/add", body)); w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d: %s", tc.tags, w.Code, tc.want, w.Body)
+		}
+	}
+}
+
+func TestValidateAdStoresNothing(t *testing.T) {
+	newTestDB(t)
+	var valid map[string]bool
+	decodeBody(t, serve(handleValidateAd, newRequest(http.MethodPost, "/api/ad/validate",
+		`{"ad_type":"text","content":"fine","redirect_url":"https://example.com"}`)), http.StatusOK, &valid)
+	if !valid["valid"] {
+		t.Errorf("valid ad answered %v", valid)
+	}
+
+	var e APIError
+	decodeBody(t, serve(handleValidateAd, newRequest(http.MethodPost, "/api/ad/validate",
+		`{"ad_type":"banner","expires_at":"2020-01-01T00:00:00Z"}`)), http.StatusBadRequest, &e)
+	fields := map[string]bool{}
+	for _, f := range e.Error.Fields {
+		fields[f.Field] = true
+	}
+	for _, want := range []string{"ad_type", "redirect_url", "expires_at"} {
+		if !fields[want] {
+			t.Errorf("fields %+v, missing %s", e.Error.Fields, want)
+		}
+	}
+
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM ads`).Scan(&n); err != nil || n != 0 {
+		t.Errorf("validation stored %d ads (%v)", n, err)
+	}
+}
+
+func TestListExpiredAds(t *testing.T) {
+	newTestDB(t)
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	expiredGo := mustInsertExpiringAd(t, "expired go", past, "go")
+	expiredRust := mustInsertExpiringAd(t, "expired rust", past, "rust")
+	liveGo := mustInsertExpiringAd(t, "live go", future, "go")
+	forever := mustInsertAd(t, "forever", "go")
+
+	for _, tc := range []struct {
+		query string
+		want  []int
+	}{
+		{"status=expired", []int{expiredGo, expiredRust}},
+		{"status=expired&tags=go", []int{expiredGo}},
+		{"status=active", []int{liveGo, forever}},
+	} {
+		var ads []Ad
+		decodeBody(t, serve(handleListAds, newRequest(http.MethodGet, "/api/ads?"+tc.query, "")), http.StatusOK, &ads)
+		got := map[int]bool{}
+		for _, a := range ads {
+			got[a.ID] = true
+		}
+		if len(ads) != len(tc.want) {
+			t.Errorf("%s: listed %v, want %v", tc.query, adIDs(ads), tc.want)
+		}
+		for _, id := range tc.want {
+			if !got[id] {
+				t.Errorf("%s: listed %v, want %v", tc.query, adIDs(ads), tc.want)
+			}
+		}
+	}
+
+	if w := serve(handleListAds, newRequest(http.MethodGet, "/api/ads?status=stale", "")); w.Code != http.StatusBadRequest {
+		t.Errorf("bad status: %d, want 400", w.Code)
+	}
+}
+
+func TestListAdsExpiringWithin(t *testing.T) {
+	newTestDB(t)
+	now := time.Now()
+	day := 24 * time.Hour
+	soon := mustInsertExpiringAd(t, "tomorrow", now.Add(day))
+	later := mustInsertExpiringAd(t, "in six days", now.Add(6*day))
+	mustInsertExpiringAd(t, "in eight days", now.Add(8*day))
+	mustInsertExpiringAd(t, "expired", now.Add(-day))
+	mustInsertAd(t, "forever")
+
+	for _, tc := range []struct {
+		window string
+		want   []int
+	}{
+		{"7d", []int{soon, later}},
+		{"7", []int{soon, later}},
+		{"48h", []int{soon}},
+		{"1h", []int{}},
+	} {
+		var ads []Ad
+		decodeBody(t, serve(handleListAds, newRequest(http.MethodGet, "/api/ads?expiring_within="+tc.window, "")), http.StatusOK, &ads)
+		if got := adIDs(ads); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: listed %v, want %v soonest first", tc.window, got, tc.want)
+		}
+	}
+	for _, window := range []string{"-1d", "soon", "0"} {
+		if w := serve(handleListAds, newRequest(http.MethodGet, "/api/ads?expiring_within="+window, "")); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", window, w.Code)
+		}
+	}
+}
+
+func TestBulkDelete(t *testing.T) {
+	newTestDB(t)
+	a, b, kept := mustInsertAd(t, "a"), mustInsertAd(t, "b"), mustInsertAd(t, "kept")
+	expired := mustInsertExpiringAd(t, "expired", time.Now().Add(-time.Hour))
+
+	var result struct {
+		Deleted int `json:"deleted"`
+	}
+	// 999 doesn't exist and isn't counted.
+	w := serve(handleBulkDelete, newRequest(http.MethodPost, "/api/ads/bulk-delete", `{"ids":[`+itoa(a)+`,`+itoa(b)+`,999]}`))
+	decodeBody(t, w, http.StatusOK, &result)
+	if result.Deleted != 2 {
+		t.Errorf("deleted = %d, want 2", result.Deleted)
+	}
+	var ads []Ad
+	decodeBody(t, serve(handleListAds, newRequest(http.MethodGet, "/api/ads", "")), http.StatusOK, &ads)
+	if len(ads) != 2 {
+		t.Errorf("left %v, want ads %d and %d", adIDs(ads), kept, expired)
+	}
+
+	w = serve(handleBulkDelete, newRequest(http.MethodPost, "/api/ads/bulk-delete", `{"filter":"expired"}`))
+	decodeBody(t, w, http.StatusOK, &result)
+	if result.Deleted != 1 {
+		t.Errorf("expired filter deleted %d, want 1", result.Deleted)
+	}
+	decodeBody(t, serve(handleListAds, newRequest(http.MethodGet, "/api/ads", "")), http.StatusOK, &ads)
+	if len(ads) != 1 || ads[0].ID != kept {
+		t.Errorf("left %v, want only ad %d", adIDs(ads), kept)
+	}
+
+	for _, body := range []string{`{}`, `{"ids":[1],"filter":"expired"}`, `{"filter":"old"}`} {
+		if w := serve(handleBulkDelete, newRequest(http.MethodPost, "/api/ads/bulk-delete", body)); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, w.Code)
+		}
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "pausable", "go")
+
+	var result map[string]interface{}
+	decodeBody(t, serve(handleAd, newRequest(http.MethodPost, "/api/ad/"+itoa(id)+"/pause", "")), http.StatusOK, &result)
+	if result["status"] != "paused" {
+		t.Errorf("pause answered %v", result)
+	}
+	if _, code := randomAd(t, "tags=go"); code != http.StatusNotFound {
+		t.Errorf("paused ad served: status %d, want 404", code)
+	}
+	var ads []Ad
+	decodeBody(t, serve(handleListAds, newRequest(http.MethodGet, "/api/ads", "")), http.StatusOK, &ads)
+	if len(ads) != 1 || !ads[0].Paused {
+		t.Errorf("listed %+v, want the paused ad", ads)
+	}
+	var summary Summary
+	decodeBody(t, serve(handleSummary, newRequest(http.MethodGet, "/api/summary", "")), http.StatusOK, &summary)
+	if summary.TotalAds != 1 || summary.ActiveAds != 0 {
+		t.Errorf("summary %+v, want the paused ad counted but not active", summary)
+	}
+
+	// An update leaves the ad paused; only resume serves it again.
+	decodeBody(t, serve(handleUpdateAd, newRequest(http.MethodPut, "/api/ad/update/"+itoa(id),
+		`{"ad_type":"text","content":"edited","redirect_url":"https://example.com/","tags":["go"]}`)), http.StatusOK, nil)
+	if ad := mustGetAd(t, id); !ad.Paused || ad.Content != "edited" {
+		t.Errorf("after update: %+v, want the edit and still paused", ad)
+	}
+
+	decodeBody(t, serve(handleAd, newRequest(http.MethodPost, "/api/ad/"+itoa(id)+"/resume", "")), http.StatusOK, &result)
+	if ad, code := randomAd(t, "tags=go"); code != http.StatusOK || ad.ID != id {
+		t.Errorf("resumed ad: got ad %d (status %d), want %d", ad.ID, code, id)
+	}
+
+	if w := serve(handleAd, newRequest(http.MethodPost, "/api/ad/999/pause", "")); w.Code != http.StatusNotFound {
+		t.Errorf("missing ad: status %d, want 404", w.Code)
+	}
+	if w := serve(handleAd, newRequest(http.MethodGet, "/api/ad/"+itoa(id)+"/pause", "")); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d, want 405", w.Code)
+	}
+}
+
+func TestRedirectStatus(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "target")
+	defer func() { redirectStatus = http.StatusFound }()
+
+	for _, code := range []int{http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect} {
+		if !validRedirectStatus(code) {
+			t.Errorf("%d rejected", code)
+		}
+		redirectStatus = code
+		w := serve(handleRedirect, newRequest(http.MethodGet, "/api/redirect/"+itoa(id), ""))
+		if w.Code != code || w.Header().Get("Location") != "https://example.com/target" {
+			t.Errorf("configured %d: got %d to %q", code, w.Code, w.Header().Get("Location"))
+		}
+	}
+	for _, code := range []int{200, 300, 304, 404} {
+		if validRedirectStatus(code) {
+			t.Errorf("%d accepted as a redirect status", code)
+		}
+	}
+}
+
+func TestAdsIncludeCreatedAt(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "dated")
+
+	var ad Ad
+	decodeBody(t, serve(handleAd, newRequest(http.MethodGet, "/api/ad/"+itoa(id), "")), http.StatusOK, &ad)
+	if _, err := time.Parse(time.RFC3339, ad.CreatedAt); err != nil {
+		t.Errorf("fetched created_at = %q, want an RFC 3339 time", ad.CreatedAt)
+	}
+	var ads []Ad
+	decodeBody(t, serve(handleListAds, newRequest(http.MethodGet, "/api/ads", "")), http.StatusOK, &ads)
+	if len(ads) != 1 || ads[0].CreatedAt != ad.CreatedAt {
+		t.Errorf("listed %+v, want created_at %q", ads, ad.CreatedAt)
+	}
+}
+
+func TestCloneAd(t *testing.T) {
+	newTestDB(t)
+	campaign, err := insertCampaign(Campaign{Name: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceID, err := insertAd(Ad{AdType: "text", Content: "source", RedirectURL: "https://example.com/s", Tags: []string{"go", "web"}, CampaignID: int(campaign), Priority: 2, Category: "technology-computing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := mustGetAd(t, int(sourceID))
+	clone := func(body string) *httptest.ResponseRecorder {
+		return serve(handleAd, newRequest(http.MethodPost, "/api/ad/"+itoa(source.ID)+"/clone", body))
+	}
+
+	var copied Ad
+	decodeBody(t, clone(`{"content":"variant","tags":["rust"]}`), http.StatusCreated, &copied)
+	if copied.ID == source.ID || copied.Content != "variant" || len(copied.Tags) != 1 || copied.Tags[0] != "rust" {
+		t.Errorf("clone = %+v, want a new ad with the overrides", copied)
+	}
+	if copied.RedirectURL != source.RedirectURL || copied.CampaignID != source.CampaignID || copied.Priority != source.Priority || copied.Category != source.Category {
+		t.Errorf("clone = %+v, want the other fields of %+v", copied, source)
+	}
+	if ad := mustGetAd(t, source.ID); ad.Content != "source" {
+		t.Errorf("source changed to %+v", ad)
+	}
+
+	var plain Ad
+	decodeBody(t, clone(""), http.StatusCreated, &plain)
+	if plain.ID == source.ID || plain.Content != source.Content || plain.RedirectURL != source.RedirectURL {
+		t.Errorf("plain clone = %+v, want an identical new ad", plain)
+	}
+	if w := clone(`{"content":"x","ad_type":"banner"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid override: status %d, want 400", w.Code)
+	}
+	if w := serve(handleAd, newRequest(http.MethodPost, "/api/ad/999/clone", "")); w.Code != http.StatusNotFound {
+		t.Errorf("missing ad: status %d, want 404", w.Code)
+	}
+}
+
+func TestAdMetadata(t *testing.T) {
+	newTestDB(t)
+	var created struct {
+		ID int `json:"id"`
+	}
+	decodeBody(t, serve(handleAddAd, newRequest(http.MethodPost, "/api/ad/add",
+		`{"ad_type":"text","content":"meta","redirect_url":"https://example.com","metadata":{"creative_id":"cr-42","utm_source":"news"}}`)), http.StatusCreated, &created)
+	if ad := mustGetAd(t, created.ID); ad.Metadata["creative_id"] != "cr-42" || ad.Metadata["utm_source"] != "news" {
+		t.Errorf("stored metadata %v", ad.Metadata)
+	}
+
+	decodeBody(t, serve(handleUpdateAd, newRequest(http.MethodPut, "/api/ad/update/"+itoa(created.ID),
+		`{"ad_type":"text","content":"meta","redirect_url":"https://example.com","metadata":{"creative_id":"cr-43"}}`)), http.StatusOK, nil)
+	var ads []Ad
+	decodeBody(t, serve(handleListAds, newRequest(http.MethodGet, "/api/ads", "")), http.StatusOK, &ads)
+	if len(ads) != 1 || len(ads[0].Metadata) != 1 || ads[0].Metadata["creative_id"] != "cr-43" {
+		t.Errorf("listed %+v, want the updated metadata", ads)
+	}
+
+	for _, metadata := range []string{`["cr-42"]`, `"cr-42"`, `{"creative_id":42}`, `{"":"x"}`} {
+		body := `{"ad_type":"text","content":"bad","redirect_url":"https://example.com","metadata":` + metadata + `}`
+		if w := serve(handleAddAd, newRequest(http.MethodPost, "/api/ad/add", body)); w.Code != http.StatusBadRequest {
+			t.Errorf("metadata %s: status %d, want 400", metadata, w.Code)
+		}
+	}
+}
+
+func TestContentLengthLimit(t *testing.T) {
+	saved := maxContentLength
+	maxContentLength = 10
+	defer func() { maxContentLength = saved }()
+
+	ad := Ad{AdType: "text", RedirectURL: "https://example.com"}
+	ad.Content = strings.Repeat("é", 10)
+	if err := validateAd(ad); err != nil {
+		t.Errorf("10 characters: %v", err)
+	}
+	ad.Content = strings.Repeat("é", 11)
+	if err := validateAd(ad); err == nil || !strings.Contains(err.Error(), "content is 11 characters, the limit is 10") {
+		t.Errorf("11 characters: %v", err)
+	}
+
+	ad.Content = "ok"
+	ad.RedirectURL = "https://example.com/" + strings.Repeat("a", maxURLLength-len("https://example.com/"))
+	if err := validateAd(ad); err != nil {
+		t.Errorf("redirect_url at the limit: %v", err)
+	}
+	ad.RedirectURL += "a"
+	if err := validateAd(ad); err == nil || !strings.Contains(err.Error(), "redirect_url is") {
+		t.Errorf("redirect_url over the limit: %v", err)
+	}
+
+	newTestDB(t)
+	w := serve(handleAddAd, newRequest(http.MethodPost, "/api/ad/add", `{"ad_type":"text","content":"`+strings.Repeat("x", 11)+`","redirect_url":"https://example.com"}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("add over the limit: status %d, want 400", w.Code)
+	}
+}
+
+func TestImpressionClickAction(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "headless")
+	target := "/api/impression/" + itoa(id)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPost, target, strings.NewReader(`{"action":"click"}`)),
+		httptest.NewRequest(http.MethodPost, target+"?action=click", nil),
+	} {
+		w := serve(handleImpression, req)
+		decodeBody(t, w, http.StatusOK, nil)
+		if w.Header().Get("Location") != "" {
+			t.Errorf("click redirected to %s", w.Header().Get("Location"))
+		}
+	}
+	serve(handleImpression, httptest.NewRequest(http.MethodPost, target, nil))
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPost, target, strings.NewReader(`{"action":"hover"}`)),
+		httptest.NewRequest(http.MethodPost, target+"?action=conversion", nil),
+	} {
+		if w := serve(handleImpression, req); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", req.URL, w.Code)
+		}
+	}
+
+	if clicks, views := countImpressions(t, id, "click"), countImpressions(t, id, "view"); clicks != 2 || views != 1 {
+		t.Errorf("stored %d clicks and %d views, want 2 and 1 (view is the default)", clicks, views)
+	}
+}
+
+// writePreload writes content to name in dir and returns its path.
+func writePreload(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPreloadTwiceAddsNoDuplicates(t *testing.T) {
+	newTestDB(t)
+	path := writePreload(t, t.TempDir(), "ads.json", `[
+		{"ad_type":"text","content":"one","redirect_url":"https://example.com/1"},
+		{"ad_type":"text","content":"two","redirect_url":"https://example.com/2"},
+		{"ad_type":"text","content":"one","redirect_url":"https://example.com/1"}
+	]`)
+
+	first := loadAdsFromJSON(path)
+	if first.Loaded != 2 || first.Present != 1 {
+		t.Errorf("first load: %s, want 2 loaded and the repeat already present", first)
+	}
+	second := loadAdsFromJSON(path)
+	if second.Loaded != 0 || second.Present != 3 {
+		t.Errorf("second load: %s, want all 3 already present", second)
+	}
+
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM ads`).Scan(&n); err != nil || n != 2 {
+		t.Errorf("stored %d ads (%v), want 2", n, err)
+	}
+
+	// Only the preload skips duplicates; the API stores what it is sent.
+	body := `{"ad_type":"text","content":"one","redirect_url":"https://example.com/1"}`
+	if w := serve(handleAddAd, newRequest(http.MethodPost, "/api/ad/add", body)); w.Code != http.StatusCreated {
+		t.Errorf("adding a preloaded ad through the API: status %d, want 201", w.Code)
+	}
+}
+
+func TestPreloadPathsFromEnvironment(t *testing.T) {
+	newTestDB(t)
+	dir := t.TempDir()
+	writePreload(t, dir, "my-campaigns.json", `[{"name":"mounted"}]`)
+	writePreload(t, dir, "my-ads.json", `[{"ad_type":"text","content":"mounted","redirect_url":"https://example.com"}]`)
+	other := writePreload(t, t.TempDir(), "views.json", `[{"ad_id":1,"action_type":"view"}]`)
+
+	t.Setenv(preloadDirEnvVar, dir)
+	t.Setenv(preloadCampaignsEnvVar, "my-campaigns.json")
+	t.Setenv(preloadAdsEnvVar, "my-ads.json")
+	t.Setenv(preloadImpressionsEnvVar, other) // absolute paths ignore the directory
+
+	if got, want := preloadPath(preloadAdsEnvVar, preloadJSONFile), filepath.Join(dir, "my-ads.json"); got != want {
+		t.Errorf("ads path = %s, want %s", got, want)
+	}
+	if got := preloadPath(preloadImpressionsEnvVar, preloadImpressions); got != other {
+		t.Errorf("impressions path = %s, want %s", got, other)
+	}
+
+	for _, res := range []preloadResult{
+		loadCampaignsFromJSON(preloadPath(preloadCampaignsEnvVar, preloadCampaigns)),
+		loadAdsFromJSON(preloadPath(preloadAdsEnvVar, preloadJSONFile)),
+		loadImpressionsFromJSON(preloadPath(preloadImpressionsEnvVar, preloadImpressions)),
+	} {
+		if res.Loaded != 1 || !res.Clean() {
+			t.Errorf("%s, want 1 loaded", res)
+		}
+	}
+
+	// A missing file is skipped, not an error.
+	t.Setenv(preloadAdsEnvVar, "missing.json")
+	if res := loadAdsFromJSON(preloadPath(preloadAdsEnvVar, preloadJSONFile)); res.Loaded != 0 || !res.Clean() {
+		t.Errorf("missing file: %s", res)
+	}
+}
+
+func TestPreloadDisabled(t *testing.T) {
+	newTestDB(t)
+	dir := t.TempDir()
+	writePreload(t, dir, preloadCampaigns, `[{"name":"preloaded"}]`)
+	writePreload(t, dir, preloadJSONFile, `[{"ad_type":"text","content":"preloaded","redirect_url":"https://example.com"}]`)
+	t.Setenv(preloadDirEnvVar, dir)
+
+	if err := preload(true, true); err != nil {
+		t.Fatal(err)
+	}
+	var ads, campaigns int
+	db.QueryRow(`SELECT COUNT(*) FROM ads`).Scan(&ads)
+	db.QueryRow(`SELECT COUNT(*) FROM campaigns`).Scan(&campaigns)
+	if ads != 0 || campaigns != 0 {
+		t.Errorf("disabled preload stored %d ads and %d campaigns", ads, campaigns)
+	}
+
+	if err := preload(false, false); err != nil {
+		t.Fatal(err)
+	}
+	db.QueryRow(`SELECT COUNT(*) FROM ads`).Scan(&ads)
+	if ads != 1 {
+		t.Errorf("enabled preload stored %d ads, want 1", ads)
+	}
+}
+
+func TestPreloadSummaryAndStrictMode(t *testing.T) {
+	newTestDB(t)
+	dir := t.TempDir()
+	t.Setenv(preloadDirEnvVar, dir)
+	writePreload(t, dir, preloadJSONFile, `[
+		{"ad_type":"text","content":"good","redirect_url":"https://example.com/1"},
+		{"ad_type":"banner","content":"bad type","redirect_url":"https://example.com/2"},
+		{"ad_type":"text","content":"no url"},
+		"not an ad",
+		{"ad_type":"text","content":"also good","redirect_url":"https://example.com/3"}
+	]`)
+
+	res := loadAdsFromJSON(filepath.Join(dir, preloadJSONFile))
+	skipped := 0
+	for _, n := range res.Skipped {
+		skipped += n
+	}
+	if res.Loaded != 2 || skipped != 3 || res.Clean() {
+		t.Errorf("%s, want 2 loaded and 3 skipped", res)
+	}
+	if !strings.Contains(res.String(), "invalid: ") || !strings.Contains(res.String(), "malformed: ") {
+		t.Errorf("summary %q doesn't give the reasons", res)
+	}
+
+	writePreload(t, dir, "broken.json", `[{"ad_type":`)
+	if res := loadAdsFromJSON(filepath.Join(dir, "broken.json")); res.Err == nil || res.Clean() {
+		t.Errorf("truncated file: %s", res)
+	}
+
+	newTestDB(t)
+	if err := preload(false, false); err != nil {
+		t.Errorf("lenient preload: %v", err)
+	}
+	newTestDB(t)
+	if err := preload(false, true); err == nil || !strings.Contains(err.Error(), preloadJSONFile) {
+		t.Errorf("strict preload: %v, want an error naming %s", err, preloadJSONFile)
+	}
+}
+
+// withCORSConfig sets the allowed origins and credentials mode for the
+// length of the test.
+func withCORSConfig(t *testing.T, origins []string, credentials bool) {
+	t.Helper()
+	savedOrigins, savedCredentials := allowedOrigins, corsCredentials
+	allowedOrigins, corsCredentials = origins, credentials
+	t.Cleanup(func() { allowedOrigins, corsCredentials = savedOrigins, savedCredentials })
+}
+
+// corsResponse serves method from origin through withCORS.
+func corsResponse(method, origin string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/api/ads", nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	return serve(withCORS(func(w http.ResponseWriter, r *http.Request) {}), req)
+}
+
+func TestCORSCredentials(t *testing.T) {
+	withCORSConfig(t, []string{"https://dash.example.com"}, true)
+	w := corsResponse(http.MethodGet, "https://dash.example.com")
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://dash.example.com" {
+		t.Errorf("allowed origin: Allow-Origin %q, want it echoed", got)
+	}
+	if w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Error("allowed origin: no Allow-Credentials")
+	}
+	w = corsResponse(http.MethodGet, "https://evil.example.com")
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("other origin: Allow-Origin %q, want none", got)
+	}
+
+	withCORSConfig(t, []string{"*"}, false)
+	w = corsResponse(http.MethodGet, "https://anywhere.example.com")
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("without credentials: Allow-Origin %q, Allow-Credentials %q", got, w.Header().Get("Access-Control-Allow-Credentials"))
+	}
+
+	saved := corsMaxAge
+	corsMaxAge = 10 * time.Minute
+	defer func() { corsMaxAge = saved }()
+	if got := corsResponse(http.MethodOptions, "https://anywhere.example.com").Header().Get("Access-Control-Max-Age"); got != "600" {
+		t.Errorf("Max-Age = %q, want 600", got)
+	}
+}
+
+func TestCORSVary(t *testing.T) {
+	withCORSConfig(t, []string{"https://dash.example.com"}, false)
+	for _, tc := range []struct {
+		name, method, origin string
+		want                 []string
+	}{
+		{"matched", http.MethodGet, "https://dash.example.com", []string{"Origin"}},
+		{"unmatched", http.MethodGet, "https://other.example.com", []string{"Origin"}},
+		{"no origin", http.MethodGet, "", []string{"Origin"}},
+		{"preflight", http.MethodOptions, "https://other.example.com", []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"}},
+	} {
+		w := corsResponse(tc.method, tc.origin)
+		vary := w.Header().Values("Vary")
+		if strings.Join(vary, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%s: Vary = %v, want %v", tc.name, vary, tc.want)
+		}
+		if tc.method == http.MethodOptions {
+			if w.Code != http.StatusNoContent || !strings.Contains(w.Header().Get("Access-Control-Allow-Methods"), "DELETE") ||
+				!strings.Contains(w.Header().Get("Access-Control-Allow-Headers"), "X-CSRF-Token") {
+				t.Errorf("%s: status %d, methods %q, headers %q", tc.name, w.Code,
+					w.Header().Get("Access-Control-Allow-Methods"), w.Header().Get("Access-Control-Allow-Headers"))
+			}
+		}
+	}
+}
+
+func TestStaticCacheControl(t *testing.T) {
+	image := serve(handleStatic, newRequest(http.MethodGet, "/static/images/image1.jpg", ""))
+	if image.Code != http.StatusOK || image.Header().Get("Cache-Control") != cacheImage {
+		t.Errorf("image: status %d, Cache-Control %q", image.Code, image.Header().Get("Cache-Control"))
+	}
+	admin := serve(handleAdmin, newRequest(http.MethodGet, "/admin", ""))
+	if admin.Code != http.StatusOK || admin.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("admin: status %d, Cache-Control %q", admin.Code, admin.Header().Get("Cache-Control"))
+	}
+
+	for _, tc := range []struct{ path, want string }{
+		{"images/1718031234567890123.png", cacheImmutable},
+		{"images/logo.3f9a2b1c.PNG", cacheImmutable},
+		{"images/promo.mp4", cacheImage},
+		{"images/logo.png", cacheImage},
+		{"images/cafe.png", cacheImage}, // hex, but too short for a hash
+		{"app.3f9a2b1c.js", cacheRevalidate},
+		{"admin.html", cacheRevalidate},
+	} {
+		if got := staticCacheControl(tc.path); got != tc.want {
+			t.Errorf("%s: %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestStaticVideoRangeRequest(t *testing.T) {
+	f, err := os.CreateTemp(filepath.Join("static", "images"), "range-*.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	req := newRequest(http.MethodGet, "/static/images/"+filepath.Base(f.Name()), "")
+	req.Header.Set("Range", "bytes=100-199")
+	w := serve(handleStatic, req)
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("status %d, want 206", w.Code)
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 100-199/1000" {
+		t.Errorf("Content-Range = %q", got)
+	}
+	if got := w.Header().Get("Content-Type"); got != "video/mp4" {
+		t.Errorf("Content-Type = %q, want video/mp4", got)
+	}
+	if !bytes.Equal(w.Body.Bytes(), data[100:200]) {
+		t.Errorf("body = %q, want bytes 100-199", w.Body)
+	}
+}
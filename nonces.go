@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Impression nonces stop a script from inflating views by replaying the
+// impression call. When enabled, each served ad's impression_url carries a
+// nonce signed for that ad, good for one view and one click within the nonce
+// TTL. Spent nonces are kept in memory until they expire, so the signing key
+// is also per process: a restart invalidates outstanding nonces.
+type nonceStore struct {
+	key []byte
+	ttl time.Duration
+
+	mu     sync.Mutex
+	spent  map[string]time.Time // action + " " + nonce -> expiry
+	pruned time.Time
+}
+
+// impressionNonces is nil when nonces are disabled.
+var impressionNonces *nonceStore
+
+var (
+	errNonceInvalid = errors.New("missing, invalid or expired nonce")
+	errNonceSpent   = errors.New("nonce already used")
+)
+
+func newNonceStore(ttl time.Duration) (*nonceStore, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &nonceStore{key: key, ttl: ttl, spent: map[string]time.Time{}}, nil
+}
+
+// Issue returns a nonce for one view and one click of ad adID, formatted as
+// "adID.expiry.random.signature".
+func (s *nonceStore) Issue(adID int, now time.Time) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	payload := fmt.Sprintf("%d.%d.%s", adID, now.Add(s.ttl).Unix(), hex.EncodeToString(b))
+	return payload + "." + s.sign(payload)
+}
+
+func (s *nonceStore) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Redeem checks that nonce was issued for adID and is unexpired and not yet
+// used for action, then marks it spent for action.
+func (s *nonceStore) Redeem(nonce string, adID int, action string, now time.Time) error {
+	payload, sig, ok := cutLast(nonce, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.sign(payload))) {
+		return errNonceInvalid
+	}
+	parts := strings.Split(payload, ".")
+	if len(parts) != 3 {
+		return errNonceInvalid
+	}
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || id != adID {
+		return errNonceInvalid
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || now.Unix() > exp {
+		return errNonceInvalid
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.pruned) > s.ttl {
+		for n, expires := range s.spent {
+			if now.After(expires) {
+				delete(s.spent, n)
+			}
+		}
+		s.pruned = now
+	}
+	key := action + " " + nonce
+	if _, used := s.spent[key]; used {
+		return errNonceSpent
+	}
+	s.spent[key] = time.Unix(exp, 0).Add(time.Second)
+	return nil
+}
+
+// cutLast slices s around the last instance of sep.
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
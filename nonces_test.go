@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// withNonces turns impression nonces on for the length of the test.
+func withNonces(t *testing.T) {
+	t.Helper()
+	store, err := newNonceStore(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	impressionNonces = store
+	t.Cleanup(func() { impressionNonces = nil })
+}
+
+func postImpression(id int, query string) int {
+	w := httptest.NewRecorder()
+	handleImpression(w, httptest.NewRequest(http.MethodPost, "/api/impression/"+itoa(id)+"?"+query, nil))
+	return w.Code
+}
+
+func TestNonceLogsOnceAndRejectsReuse(t *testing.T) {
+	newTestDB(t)
+	withNonces(t)
+	id := mustInsertAd(t, "nonce")
+	nonce := impressionNonces.Issue(id, time.Now())
+
+	if code := postImpression(id, "nonce="+nonce); code != http.StatusOK {
+		t.Fatalf("fresh nonce: status %d, want 200", code)
+	}
+	if code := postImpression(id, "nonce="+nonce); code != http.StatusForbidden {
+		t.Errorf("reused nonce: status %d, want 403", code)
+	}
+	if code := postImpression(id, ""); code != http.StatusForbidden {
+		t.Errorf("no nonce: status %d, want 403", code)
+	}
+	if code := postImpression(id+1, "nonce="+impressionNonces.Issue(id, time.Now())); code != http.StatusForbidden {
+		t.Errorf("nonce for another ad: status %d, want 403", code)
+	}
+	if n := countImpressions(t, id, "view"); n != 1 {
+		t.Errorf("logged %d views, want 1", n)
+	}
+}
+
+func TestNonceRequiredForClicks(t *testing.T) {
+	newTestDB(t)
+	withNonces(t)
+	id := mustInsertAd(t, "click")
+	nonce := impressionNonces.Issue(id, time.Now())
+
+	if code := postImpression(id, "action=click"); code != http.StatusForbidden {
+		t.Errorf("click without nonce: status %d, want 403", code)
+	}
+	// A served ad's nonce covers its view and then its click.
+	if code := postImpression(id, "nonce="+nonce); code != http.StatusOK {
+		t.Fatalf("view: status %d, want 200", code)
+	}
+	if code := postImpression(id, "action=click&nonce="+nonce); code != http.StatusOK {
+		t.Fatalf("click: status %d, want 200", code)
+	}
+	if code := postImpression(id, "action=click&nonce="+nonce); code != http.StatusForbidden {
+		t.Errorf("replayed click: status %d, want 403", code)
+	}
+	if n := countImpressions(t, id, "click"); n != 1 {
+		t.Errorf("logged %d clicks, want 1", n)
+	}
+}
+
+func TestNonceExpires(t *testing.T) {
+	withNonces(t)
+	nonce := impressionNonces.Issue(1, time.Now())
+	if err := impressionNonces.Redeem(nonce, 1, "view", time.Now().Add(2*time.Minute)); err != errNonceInvalid {
+		t.Errorf("expired nonce: got %v, want errNonceInvalid", err)
+	}
+}
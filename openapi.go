@@ -0,0 +1,312 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// apiRoute describes one operation for the OpenAPI document. Keep this list
+// in step with the routes in registerRoutes.
+type apiRoute struct {
+	Method  string
+	Path    string
+	Summary string
+	Auth    bool
+	Query   []string
+	// Body and Response name a schema from apiSchemas; a "[]" prefix means
+	// an array of it. Body "multipart" documents a file upload.
+	Body     string
+	Response string
+}
+
+var apiRoutes = []apiRoute{
+	{Method: "get", Path: "/api/ad/random", Summary: "Get a random (optionally targeted) ad", Query: []string{"tags", "exclude_tags", "match", "referrer", "optimize", "explore", "strategy", "sticky", "client_id", "lang", "track", "companion", "format", "categories", "exclude_categories", "exclude_campaigns", "exclude_domains"}, Response: "Ad"},
+	{Method: "get", Path: "/api/ad/render", Summary: "Get a random (optionally targeted) ad as an HTML fragment", Query: []string{"tags", "exclude_tags", "match", "referrer", "optimize", "explore", "strategy", "sticky", "client_id", "lang", "track", "categories", "exclude_categories", "exclude_campaigns", "exclude_domains"}},
+	{Method: "get", Path: "/api/ads/random", Summary: "Get up to count distinct random (optionally targeted) ads", Query: []string{"count", "tags", "exclude_tags", "match", "referrer", "optimize", "explore", "strategy", "sticky", "client_id", "lang", "track", "categories", "exclude_categories", "exclude_campaigns", "exclude_domains"}, Response: "[]Ad"},
+	{Method: "get", Path: "/api/redirect/{id}", Summary: "Record a click and redirect to the ad's landing page", Query: []string{"consent"}},
+	{Method: "post", Path: "/api/impression/{id}", Summary: "Record a view or click", Query: []string{"action", "nonce", "viewable", "consent"}, Body: "ImpressionRequest", Response: "Status"},
+	{Method: "get", Path: "/api/impression/{id}", Summary: "Record a view or click from a tracking pixel", Query: []string{"action", "nonce", "viewable", "consent"}, Response: "Status"},
+	{Method: "post", Path: "/api/beacon/{id}", Summary: "Record a served ad's view from navigator.sendBeacon, once per view ID", Query: []string{"view", "viewable", "consent"}},
+	{Method: "get", Path: "/api/beacon/{id}", Summary: "Record a served ad's view from an image pixel, once per view ID", Query: []string{"view", "viewable", "consent"}},
+	{Method: "post", Path: "/api/conversion/{id}", Summary: "Record a conversion, optionally with a value", Body: "Conversion", Response: "Status"},
+	{Method: "get", Path: "/embed.js", Summary: "Embed script for publisher pages"},
+	{Method: "get", Path: "/openapi.json", Summary: "This document"},
+	{Method: "get", Path: "/version", Summary: "Build version, commit and Go version", Response: "VersionInfo"},
+
+	{Method: "post", Path: "/api/login", Summary: "Exchange the API token for a session cookie", Body: "Login", Response: "Status"},
+	{Method: "post", Path: "/api/logout", Summary: "End the current session", Response: "Status"},
+
+	{Method: "get", Path: "/api/ads", Summary: "List ads", Auth: true, Query: []string{"status", "campaign_id", "tags", "active", "expiring_within", "sort"}, Response: "[]Ad"},
+	{Method: "get", Path: "/api/ad/{id}", Summary: "Get a single ad", Auth: true, Response: "Ad"},
+	{Method: "get", Path: "/api/ad/{id}/similar", Summary: "Other servable ads sharing the most tags with an ad", Auth: true, Query: []string{"limit"}, Response: "[]SimilarAd"},
+	{Method: "post", Path: "/api/ad/{id}/clone", Summary: "Copy an ad into a new one, with optional field overrides", Auth: true, Body: "Ad", Response: "Ad"},
+	{Method: "post", Path: "/api/ad/{id}/pause", Summary: "Stop serving an ad", Auth: true, Response: "Status"},
+	{Method: "post", Path: "/api/ad/{id}/resume", Summary: "Serve a paused ad again", Auth: true, Response: "Status"},
+	{Method: "get", Path: "/api/ad/preview", Summary: "List every ad a targeting query matches", Auth: true, Query: []string{"tags", "exclude_tags", "match", "referrer", "categories", "exclude_categories", "exclude_campaigns", "exclude_domains"}, Response: "[]PreviewCandidate"},
+	{Method: "post", Path: "/api/ad/add", Summary: "Create an ad", Auth: true, Body: "Ad", Response: "Status"},
+	{Method: "post", Path: "/api/ad/validate", Summary: "Check an ad without creating it", Auth: true, Body: "Ad", Response: "Validation"},
+	{Method: "delete", Path: "/api/ad/delete/{id}", Summary: "Delete an ad", Auth: true, Response: "Status"},
+	{Method: "post", Path: "/api/ads/bulk-delete", Summary: "Delete several ads, by id or all expired", Auth: true, Body: "BulkDelete", Response: "BulkDeleteResult"},
+	{Method: "put", Path: "/api/ad/update/{id}", Summary: "Replace an ad", Auth: true, Body: "Ad", Response: "Status"},
+	{Method: "get", Path: "/api/campaigns", Summary: "List campaigns", Auth: true, Response: "[]Campaign"},
+	{Method: "post", Path: "/api/campaign/add", Summary: "Create a campaign", Auth: true, Body: "Campaign", Response: "Status"},
+	{Method: "put", Path: "/api/campaign/{id}/priority", Summary: "Set a campaign's serving priority", Auth: true, Body: "CampaignPriority", Response: "Status"},
+	{Method: "put", Path: "/api/campaign/{id}/tags", Summary: "Set a campaign's default tags and tag mode", Auth: true, Body: "CampaignTags", Response: "Status"},
+	{Method: "get", Path: "/api/analytics/stats", Summary: "Lifetime views, clicks and CTR per ad", Auth: true, Query: []string{"campaign_id", "ad_type", "include_bots", "include_internal"}, Response: "[]AnalyticsStats"},
+	{Method: "get", Path: "/api/analytics/ad/{id}/timeseries", Summary: "Views and clicks per day or hour for an ad", Auth: true, Query: []string{"from", "to", "interval", "include_bots", "include_internal"}, Response: "[]TimeseriesBucket"},
+	{Method: "get", Path: "/api/analytics/top", Summary: "Top ads by clicks, views or CTR", Auth: true, Query: []string{"metric", "limit", "min_views", "from", "to", "include_bots", "include_internal"}, Response: "[]LeaderboardEntry"},
+	{Method: "get", Path: "/api/analytics/top/campaigns", Summary: "Top campaigns by clicks, views or CTR", Auth: true, Query: []string{"metric", "limit", "min_views", "from", "to", "include_bots", "include_internal"}, Response: "[]LeaderboardEntry"},
+	{Method: "get", Path: "/api/analytics/referrers", Summary: "Views and clicks by referring domain", Auth: true, Query: []string{"ad_id", "from", "to", "include_bots", "include_internal"}, Response: "[]ReferrerStats"},
+	{Method: "get", Path: "/api/analytics/geo", Summary: "Views and clicks by client country", Auth: true, Query: []string{"ad_id", "from", "to", "include_bots", "include_internal"}, Response: "[]GeoStats"},
+	{Method: "get", Path: "/api/analytics/useragents", Summary: "Views and clicks by browser and by OS family", Auth: true, Query: []string{"ad_id", "from", "to", "include_bots", "include_internal"}, Response: "UserAgentStats"},
+	{Method: "get", Path: "/api/analytics/live", Summary: "Per-ad views and clicks over the last minute, from memory", Auth: true, Response: "[]LiveStats"},
+	{Method: "post", Path: "/api/analytics/reconcile", Summary: "Recompute ad view and click counters from the impressions", Auth: true, Response: "ReconcileResult"},
+	{Method: "get", Path: "/api/summary", Summary: "Ad, campaign and today's view totals", Auth: true, Query: []string{"include_bots", "include_internal"}, Response: "Summary"},
+	{Method: "get", Path: "/api/audit", Summary: "Admin actions, newest first", Auth: true, Query: []string{"limit", "offset"}, Response: "[]AuditEntry"},
+	{Method: "post", Path: "/api/upload", Summary: "Upload an image", Auth: true, Body: "multipart", Response: "Upload"},
+	{Method: "get", Path: "/api/export", Summary: "Export all campaigns and ads", Auth: true, Response: "Catalog"},
+	{Method: "post", Path: "/api/import", Summary: "Import an export, upserting by id", Auth: true, Body: "Catalog", Response: "Status"},
+	{Method: "get", Path: "/api/impressions/export", Summary: "Stream raw impressions as newline-delimited JSON", Auth: true, Query: []string{"from", "to", "ad_id"}},
+	{Method: "get", Path: "/api/read-only", Summary: "Whether the server is read-only", Auth: true, Response: "ReadOnly"},
+	{Method: "put", Path: "/api/read-only", Summary: "Switch read-only mode", Auth: true, Body: "ReadOnly", Response: "ReadOnly"},
+}
+
+// apiSchemas maps schema names to the Go types they are generated from.
+var apiSchemas = map[string]interface{}{
+	"Ad":                Ad{},
+	"Campaign":          Campaign{},
+	"Impression":        Impression{},
+	"AnalyticsStats":    AnalyticsStats{},
+	"PreviewCandidate":  PreviewCandidate{},
+	"SimilarAd":         SimilarAd{},
+	"TimeseriesBucket":  TimeseriesBucket{},
+	"LeaderboardEntry":  LeaderboardEntry{},
+	"ReferrerStats":     ReferrerStats{},
+	"UserAgentStats":    UserAgentStats{},
+	"LiveStats":         LiveStats{},
+	"ReconcileResult":   ReconcileResult{},
+	"ImpressionRequest": impressionRequest{},
+	"Conversion":        conversionRequest{},
+	"AuditEntry":        AuditEntry{},
+	"Summary":           Summary{},
+	"BulkDelete":        bulkDeleteRequest{},
+	"CampaignPriority":  campaignPriorityRequest{},
+	"CampaignTags":      campaignTagsRequest{},
+	"Catalog":           Catalog{},
+	"ReadOnly":          readOnlyState{},
+	"Error":             APIError{},
+}
+
+// Schemas for the ad-hoc map responses the handlers write.
+var staticSchemas = map[string]interface{}{
+	"Status": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"status": map[string]interface{}{"type": "string"},
+			"id":     map[string]interface{}{"type": "integer"},
+		},
+	},
+	"BulkDeleteResult": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"status":  map[string]interface{}{"type": "string"},
+			"deleted": map[string]interface{}{"type": "integer"},
+		},
+	},
+	"Validation": map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{"valid": map[string]interface{}{"type": "boolean"}},
+	},
+	"Login": map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{"token": map[string]interface{}{"type": "string"}},
+	},
+	"Upload": map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{"url": map[string]interface{}{"type": "string"}},
+	},
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  map[string]interface{}
+)
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() { openAPIDoc = buildOpenAPI() })
+	respondJSON(w, http.StatusOK, openAPIDoc)
+}
+
+var pathParamPattern = regexp.MustCompile(`\{(\w+)\}`)
+
+func buildOpenAPI() map[string]interface{} {
+	schemas := map[string]interface{}{}
+	for name, v := range apiSchemas {
+		schemas[name] = inlineSchema(reflect.TypeOf(v))
+	}
+	for name, s := range staticSchemas {
+		schemas[name] = s
+	}
+
+	paths := map[string]interface{}{}
+	for _, rt := range apiRoutes {
+		item, ok := paths[rt.Path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[rt.Path] = item
+		}
+		item[rt.Method] = buildOperation(rt)
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "taggy adserver",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func buildOperation(rt apiRoute) map[string]interface{} {
+	var params []interface{}
+	for _, m := range pathParamPattern.FindAllStringSubmatch(rt.Path, -1) {
+		params = append(params, map[string]interface{}{
+			"name": m[1], "in": "path", "required": true,
+			"schema": map[string]interface{}{"type": "integer"},
+		})
+	}
+	for _, q := range rt.Query {
+		params = append(params, map[string]interface{}{
+			"name": q, "in": "query",
+			"schema": map[string]interface{}{"type": "string"},
+		})
+	}
+
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content":     jsonContent(schemaRef("Error")),
+	}
+	success := map[string]interface{}{"description": "OK"}
+	if rt.Response != "" {
+		success["content"] = jsonContent(schemaRef(rt.Response))
+	}
+
+	op := map[string]interface{}{
+		"summary":   rt.Summary,
+		"responses": map[string]interface{}{"200": success, "400": errorResponse, "default": errorResponse},
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	if rt.Auth {
+		op["security"] = []interface{}{map[string]interface{}{"bearerAuth": []string{}}}
+		op["responses"].(map[string]interface{})["401"] = errorResponse
+	}
+
+	switch rt.Body {
+	case "":
+	case "multipart":
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"multipart/form-data": map[string]interface{}{
+					"schema": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"image": map[string]interface{}{"type": "string", "format": "binary"},
+						},
+					},
+				},
+			},
+		}
+	default:
+		op["requestBody"] = map[string]interface{}{"required": true, "content": jsonContent(schemaRef(rt.Body))}
+	}
+	return op
+}
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+func schemaRef(name string) map[string]interface{} {
+	if strings.HasPrefix(name, "[]") {
+		return map[string]interface{}{"type": "array", "items": schemaRef(strings.TrimPrefix(name, "[]"))}
+	}
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// schemaFor references a named schema when t has one and otherwise derives
+// an inline JSON schema from the type and its json tags.
+func schemaFor(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	for name, v := range apiSchemas {
+		if reflect.TypeOf(v) == t {
+			return schemaRef(name)
+		}
+	}
+	return inlineSchema(t)
+}
+
+func inlineSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return inlineSchema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		addStructProperties(t, props)
+		return map[string]interface{}{"type": "object", "properties": props}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func addStructProperties(t reflect.Type, props map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			addStructProperties(ft, props)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = schemaFor(f.Type)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// routeRecorder collects the patterns registerRoutes adds.
+type routeRecorder []string
+
+func (r *routeRecorder) HandleFunc(pattern string, _ func(http.ResponseWriter, *http.Request)) {
+	*r = append(*r, pattern)
+}
+
+func TestOpenAPICoversEveryRoute(t *testing.T) {
+	var doc struct {
+		OpenAPI string                            `json:"openapi"`
+		Paths   map[string]map[string]interface{} `json:"paths"`
+	}
+	decodeBody(t, serve(handleOpenAPI, newRequest(http.MethodGet, "/openapi.json", "")), http.StatusOK, &doc)
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Errorf("openapi = %q", doc.OpenAPI)
+	}
+
+	// HTML pages and static files aren't part of the API.
+	pages := map[string]bool{"/": true, "/static/": true, "/admin": true, "/admin/analytics": true}
+
+	var routes routeRecorder
+	registerRoutes(&routes)
+	for _, pattern := range routes {
+		if pages[pattern] {
+			continue
+		}
+		found := false
+		for path := range doc.Paths {
+			// A pattern ending in / serves the paths below it.
+			if path == pattern || strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("route %s has no path in the spec", pattern)
+		}
+	}
+
+	for path, item := range doc.Paths {
+		for method, op := range item {
+			if _, ok := op.(map[string]interface{})["responses"]; !ok {
+				t.Errorf("%s %s has no responses", method, path)
+			}
+		}
+	}
+}
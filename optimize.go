@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// CTR-optimized selection (optimize=ctr) weights each candidate by its
+// smoothed click-through rate over the recent window. The prior acts like
+// ctrPriorViews views at a 1% CTR, so new ads start at a reasonable weight
+// and a handful of lucky clicks can't dominate. A share of requests still
+// ignore CTR so every ad keeps being shown and its CTR keeps updating.
+const (
+	ctrWindow      = 7 * 24 * time.Hour
+	ctrPriorClicks = 1
+	ctrPriorViews  = 100
+	ctrExploreRate = 0.1
+)
+
+// Exploration (epsilon-greedy) keeps relevance and CTR weighting from
+// starving ads that have barely been shown: a share of requests, the
+// explore rate, is served uniformly among the candidates with fewer than
+// exploreMaxViews lifetime views. Off unless ADSERVER_EXPLORE_RATE or the
+// explore parameter sets a rate.
+var (
+	exploreRate     float64
+	exploreMaxViews = defaultExploreMaxViews
+)
+
+type ctrTotals struct{ views, clicks int }
+
+// ctrCache holds per-ad view and click totals for the recent window, leaving
+// out bot and internal traffic, reloaded at most once per candidate cache TTL.
+type ctrCache struct {
+	mu       sync.Mutex
+	totals   map[int]ctrTotals
+	loadedAt time.Time
+}
+
+var recentCTR = &ctrCache{}
+
+func (c *ctrCache) Get(now time.Time) (map[int]ctrTotals, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.totals != nil && now.Sub(c.loadedAt) < candidateCache.ttl {
+		return c.totals, nil
+	}
+
+	rows, err := db.Query(`SELECT ad_id, SUM(views), SUM(clicks)
+		FROM (`+impressionCountsSQL+`) i
+		WHERE bot = 0 AND internal = 0 AND `+db.Time("viewed_at")+` >= `+db.Time("?")+`
+		GROUP BY ad_id`, now.Add(-ctrWindow).UTC().Format(sqlTimeLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := map[int]ctrTotals{}
+	for rows.Next() {
+		var id int
+		var t ctrTotals
+		if err := rows.Scan(&id, &t.views, &t.clicks); err != nil {
+			return nil, err
+		}
+		totals[id] = t
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	c.totals, c.loadedAt = totals, now
+	return totals, nil
+}
+
+// unexplored returns the candidates that have yet to reach exploreMaxViews.
+func unexplored(ads []Ad) []Ad {
+	var fresh []Ad
+	for _, a := range ads {
+		if a.ViewCount < exploreMaxViews {
+			fresh = append(fresh, a)
+		}
+	}
+	return fresh
+}
+
+// smoothedCTR is the click-through rate pulled toward the prior.
+func smoothedCTR(t ctrTotals) float64 {
+	return float64(t.clicks+ctrPriorClicks) / float64(t.views+ctrPriorViews)
+}
+
+// pickAd chooses the ad to serve. A sticky request gets the client's
+// assigned ad again while it remains a candidate.
+func pickAd(q adQuery, ads []Ad, now time.Time) (*Ad, error) {
+	if !q.Sticky {
+		return chooseAd(q, ads, now)
+	}
+	key := stickyKey(q)
+	if a := stickyAds.Lookup(key, ads, now); a != nil {
+		return a, nil
+	}
+	a, err := chooseAd(q, ads, now)
+	if a != nil {
+		stickyAds.Assign(key, a.ID, now)
+	}
+	return a, err
+}
+
+// chooseAd picks among the highest-priority candidates, weighted by tag
+// relevance and, when q asks for it, by recent CTR.
+func chooseAd(q adQuery, ads []Ad, now time.Time) (*Ad, error) {
+	ads = topPriority(ads)
+	if len(ads) < 2 {
+		return pickRandom(ads), nil
+	}
+	if q.Explore > 0 && selectionRand.Float64() < q.Explore {
+		// When every candidate is new there is nothing to make room for.
+		if fresh := unexplored(ads); len(fresh) > 0 && len(fresh) < len(ads) {
+			return pickRandom(fresh), nil
+		}
+	}
+
+	var totals map[int]ctrTotals
+	if q.OptimizeCTR && selectionRand.Float64() >= ctrExploreRate {
+		var err error
+		if totals, err = recentCTR.Get(now); err != nil {
+			return nil, err
+		}
+	}
+
+	weights := make([]float64, len(ads))
+	sum := 0.0
+	for i, a := range ads {
+		weights[i] = relevance(a, q)
+		if totals != nil {
+			weights[i] *= smoothedCTR(totals[a.ID])
+		}
+		sum += weights[i]
+	}
+	if q.Strategy == strategyRoundRobin {
+		return &ads[rotation.Next(rotationKey(q), ads, weights)], nil
+	}
+	x := selectionRand.Float64() * sum
+	for i, w := range weights {
+		if x < w {
+			return &ads[i], nil
+		}
+		x -= w
+	}
+	return &ads[len(ads)-1], nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRecentCTRIgnoresBotAndInternalTraffic(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "ctr")
+	now := time.Now()
+	for _, imp := range []Impression{
+		{AdID: id, ActionType: "view"},
+		{AdID: id, ActionType: "view", Internal: true},
+		{AdID: id, ActionType: "click", Internal: true},
+		{AdID: id, ActionType: "click", Bot: true},
+	} {
+		imp.ViewedAt = now.UTC().Format(sqlTimeLayout)
+		if err := insertImpression(imp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	totals, err := (&ctrCache{}).Get(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := totals[id]; got != (ctrTotals{views: 1}) {
+		t.Errorf("totals = %+v, want 1 view and no clicks", got)
+	}
+}
+
+func TestOptimizeCTRFavorsBetterAds(t *testing.T) {
+	newTestDB(t)
+	recentCTR = &ctrCache{}
+	defer func() { recentCTR = &ctrCache{} }()
+	now := time.Now()
+	good, poor, fresh := mustInsertAd(t, "good"), mustInsertAd(t, "poor"), mustInsertAd(t, "fresh")
+	mustLogImpressions(t, good, "view", now.Add(-time.Hour), 200)
+	mustLogImpressions(t, good, "click", now.Add(-time.Hour), 40)
+	mustLogImpressions(t, poor, "view", now.Add(-time.Hour), 200)
+
+	ads, err := loadServableAds(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := map[int]int{}
+	for range 3000 {
+		a, err := chooseAd(adQuery{OptimizeCTR: true}, ads, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		served[a.ID]++
+	}
+	if served[good] < 3*served[poor] || served[good] < 3*served[fresh] {
+		t.Errorf("served %v: want the high-CTR ad %d well ahead", served, good)
+	}
+	// Smoothing and the exploration share keep the others showing.
+	if served[fresh] == 0 || served[poor] == 0 {
+		t.Errorf("served %v: want every ad shown sometimes", served)
+	}
+
+	served = map[int]int{}
+	for range 3000 {
+		a, _ := chooseAd(adQuery{}, ads, now)
+		served[a.ID]++
+	}
+	if served[good] > 2*served[poor] {
+		t.Errorf("without optimize=ctr served %v, want about even", served)
+	}
+}
+
+func TestExploreGivesNewAdsTheirShare(t *testing.T) {
+	newTestDB(t)
+	saved := selectionRand
+	selectionRand = newLockedRand(1)
+	defer func() { selectionRand = saved }()
+	exploreMaxViews = 100
+	defer func() { exploreMaxViews = defaultExploreMaxViews }()
+	first, second := mustInsertAd(t, "first", "go", "web", "cloud"), mustInsertAd(t, "second", "go", "web", "cloud")
+	fresh := mustInsertAd(t, "fresh", "go")
+	if _, err := db.Exec(`UPDATE ads SET view_count = 5000 WHERE id IN (?, ?)`, first, second); err != nil {
+		t.Fatal(err)
+	}
+
+	ads, err := loadServableAds(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Matching every tag makes the established ads about 200 times as
+	// likely as the new one.
+	q := adQuery{Tags: []string{"go", "web", "cloud"}, TagWeights: map[string]float64{"web": 50, "cloud": 50}}
+	share := func(explore float64) float64 {
+		q.Explore = explore
+		n := 0
+		for range 5000 {
+			a, err := chooseAd(q, ads, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.ID == fresh {
+				n++
+			}
+		}
+		return float64(n) / 5000
+	}
+	if got := share(0); got > 0.02 {
+		t.Errorf("without exploration the new ad got %.3f of traffic, want almost none", got)
+	}
+	if got := share(0.2); got < 0.17 || got > 0.24 {
+		t.Errorf("explore=0.2 gave the new ad %.3f of traffic, want about 0.2", got)
+	}
+
+	if _, code := randomAd(t, "tags=go&explore=1.5"); code != http.StatusBadRequest {
+		t.Errorf("explore=1.5: status %d, want 400", code)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// prettyJSON indents every JSON response, for development. Without it,
+// responses are compact unless a request asks for ?pretty=true.
+var prettyJSON bool
+
+// prettyResponse marks a response whose request asked for ?pretty=true.
+// Writers wrapped around it further in must implement Unwrap, as they do
+// for http.ResponseController.
+type prettyResponse struct {
+	http.ResponseWriter
+}
+
+func (p *prettyResponse) Unwrap() http.ResponseWriter {
+	return p.ResponseWriter
+}
+
+// withPrettyJSON marks responses to ?pretty=true requests for indenting.
+func withPrettyJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty")); pretty {
+			w = &prettyResponse{w}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// wantsPretty reports whether JSON written to w should be indented.
+func wantsPretty(w http.ResponseWriter) bool {
+	if prettyJSON {
+		return true
+	}
+	for {
+		if _, ok := w.(*prettyResponse); ok {
+			return true
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return false
+		}
+		w = u.Unwrap()
+	}
+}
+
+// marshalJSON encodes v for w, indented when wantsPretty.
+func marshalJSON(w http.ResponseWriter, v interface{}) ([]byte, error) {
+	if wantsPretty(w) {
+		return json.MarshalIndent(v, "", "  ")
+	}
+	return json.Marshal(v)
+}
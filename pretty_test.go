@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPrettyJSON(t *testing.T) {
+	newTestDB(t)
+	mustInsertAd(t, "pretty")
+	list := func(target string) string {
+		t.Helper()
+		w := serve(withPrettyJSON(http.HandlerFunc(handleListAds)).ServeHTTP, newRequest(http.MethodGet, target, ""))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", target, w.Code)
+		}
+		return w.Body.String()
+	}
+
+	if body := list("/api/ads"); strings.Contains(body, "\n  ") {
+		t.Errorf("default response is indented:\n%s", body)
+	}
+	if body := list("/api/ads?pretty=true"); !strings.HasPrefix(body, "[\n  {\n    \"id\": ") {
+		t.Errorf("?pretty=true response isn't indented:\n%s", body)
+	}
+
+	prettyJSON = true
+	defer func() { prettyJSON = false }()
+	if body := list("/api/ads"); !strings.Contains(body, "\n    \"content\": \"pretty\"") {
+		t.Errorf("response with pretty-printing on isn't indented:\n%s", body)
+	}
+}
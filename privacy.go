@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Policies for impressions from visitors who opted out of tracking.
+const (
+	trackingIgnore    = "ignore"    // record them like any other (default)
+	trackingAnonymous = "anonymous" // record them without IP and user agent
+	trackingSkip      = "skip"      // don't record them
+)
+
+var (
+	optOutPolicy = trackingIgnore
+	// requireConsent treats a request without a consent=1 parameter as
+	// opted out, for sites that only track after the visitor agrees.
+	requireConsent bool
+)
+
+func validOptOutPolicy(p string) bool {
+	return p == trackingIgnore || p == trackingAnonymous || p == trackingSkip
+}
+
+// trackingRefused reports whether the visitor opted out, through DNT: 1 or
+// Sec-GPC: 1, or gave no consent when consent is required. An explicit
+// consent=0 always counts as a refusal.
+func trackingRefused(r *http.Request) bool {
+	if r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1" {
+		return true
+	}
+	v := r.URL.Query().Get("consent")
+	if v == "" {
+		return requireConsent
+	}
+	consent, err := strconv.ParseBool(v)
+	return err != nil || !consent
+}
+
+// applyOptOut reduces or drops an impression according to optOutPolicy,
+// reporting whether it should still be recorded.
+func applyOptOut(r *http.Request, imp *Impression) bool {
+	if optOutPolicy == trackingIgnore || !trackingRefused(r) {
+		return true
+	}
+	if optOutPolicy == trackingSkip {
+		return false
+	}
+	imp.IP, imp.UserAgent = "", ""
+	return true
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDoNotTrackPolicies(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "private")
+	defer func() { optOutPolicy, requireConsent = trackingIgnore, false }()
+
+	view := func(query string, header ...string) {
+		t.Helper()
+		req := newRequest(http.MethodPost, "/api/impression/"+itoa(id)+query, "")
+		req.Header.Set("User-Agent", "Mozilla/5.0 Firefox/125.0")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		if w := serve(handleImpression, req); w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+	}
+	// stored counts the impressions logged since it was last called, and
+	// those that kept the visitor's IP or user agent.
+	stored := func() (rows, identified int) {
+		t.Helper()
+		flushImpressions(t)
+		if err := db.QueryRow(`SELECT COUNT(*), COUNT(CASE WHEN ip <> '' OR user_agent <> '' THEN 1 END) FROM impressions`).Scan(&rows, &identified); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(`DELETE FROM impressions`); err != nil {
+			t.Fatal(err)
+		}
+		return rows, identified
+	}
+
+	view("", "DNT", "1")
+	if rows, identified := stored(); rows != 1 || identified != 1 {
+		t.Errorf("ignore: stored %d views, %d identified; want the full view", rows, identified)
+	}
+
+	optOutPolicy = trackingAnonymous
+	view("", "DNT", "1")
+	view("", "Sec-GPC", "1")
+	view("")
+	if rows, identified := stored(); rows != 3 || identified != 1 {
+		t.Errorf("anonymous: stored %d views, %d identified; want 3 and only 1", rows, identified)
+	}
+
+	optOutPolicy = trackingSkip
+	view("", "DNT", "1")
+	view("?consent=0")
+	view("")
+	if rows, _ := stored(); rows != 1 {
+		t.Errorf("skip: stored %d views, want only the one without DNT", rows)
+	}
+
+	requireConsent = true
+	view("")
+	view("?consent=1")
+	if rows, _ := stored(); rows != 1 {
+		t.Errorf("consent required: stored %d views, want only the consented one", rows)
+	}
+
+	// A refused click still gets where it was going.
+	req := newRequest(http.MethodGet, "/api/redirect/"+itoa(id), "")
+	req.Header.Set("DNT", "1")
+	if w := serve(handleRedirect, req); w.Code != redirectStatus {
+		t.Errorf("redirect: status %d", w.Code)
+	}
+	if rows, _ := stored(); rows != 0 {
+		t.Errorf("skip: stored %d clicks, want none", rows)
+	}
+}
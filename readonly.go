@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// readOnly stops the management API from changing ads, campaigns and
+// uploads, for migrations and incidents. Serving, tracking and reads carry
+// on. It starts from ADSERVER_READ_ONLY and is switched at
+// /api/read-only.
+var readOnly atomic.Bool
+
+// readOnlyState is the body of /api/read-only.
+type readOnlyState struct {
+	ReadOnly bool `json:"read_only"`
+}
+
+// withWritable rejects requests that would change data while the server is
+// read-only. GET and HEAD pass, so dispatchers serving both reads and writes
+// can be wrapped whole.
+func withWritable(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if readOnly.Load() && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			respondError(w, http.StatusServiceUnavailable, "the server is read-only; try again later")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// handleReadOnly reports read-only mode on GET and switches it on PUT.
+func handleReadOnly(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req readOnlyState
+		if !decodeJSONBody(w, r, &req, maxJSONBody) {
+			return
+		}
+		if readOnly.Swap(req.ReadOnly) != req.ReadOnly {
+			action := auditReadWrite
+			if req.ReadOnly {
+				action = auditReadOnly
+			}
+			recordAudit(r, action, "server", 0)
+			log.Printf("Read-only mode %s by %s", action, auditActor(r))
+		}
+	default:
+		respondError(w, http.StatusMethodNotAllowed, "use GET or PUT")
+		return
+	}
+	respondJSON(w, http.StatusOK, readOnlyState{ReadOnly: readOnly.Load()})
+}
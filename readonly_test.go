@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadOnlyBlocksWritesOnly(t *testing.T) {
+	newTestDB(t)
+	adID := mustInsertAd(t, "frozen", "go")
+	id := itoa(adID)
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+	do := func(method, target, body string) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, newRequest(method, target, body))
+		return w.Code
+	}
+	defer readOnly.Store(false)
+
+	if code := do(http.MethodPut, "/api/read-only", `{"read_only":true}`); code != http.StatusOK {
+		t.Fatalf("switching on: status %d", code)
+	}
+	adBody := `{"ad_type":"text","content":"new","redirect_url":"https://example.com"}`
+	for _, tc := range []struct{ method, target, body string }{
+		{http.MethodPost, "/api/ad/add", adBody},
+		{http.MethodPut, "/api/ad/update/" + id, adBody},
+		{http.MethodDelete, "/api/ad/delete/" + id, ""},
+		{http.MethodPost, "/api/ad/" + id + "/pause", ""},
+		{http.MethodPost, "/api/ads/bulk-delete", `{"ids":[` + id + `]}`},
+		{http.MethodPost, "/api/campaign/add", `{"name":"c"}`},
+		{http.MethodPost, "/api/upload", ""},
+		{http.MethodPost, "/api/import", `{}`},
+	} {
+		if code := do(tc.method, tc.target, tc.body); code != http.StatusServiceUnavailable {
+			t.Errorf("%s %s: status %d, want 503", tc.method, tc.target, code)
+		}
+	}
+	for _, target := range []string{"/api/ads", "/api/ad/" + id, "/api/ad/random?tags=go", "/api/campaigns", "/api/analytics/stats"} {
+		if code := do(http.MethodGet, target, ""); code != http.StatusOK {
+			t.Errorf("GET %s: status %d, want 200", target, code)
+		}
+	}
+	if code := do(http.MethodPost, "/api/impression/"+id, ""); code != http.StatusOK {
+		t.Errorf("impression: status %d, want it still tracked", code)
+	}
+	if ad := mustGetAd(t, adID); ad.Content != "frozen" || ad.Paused {
+		t.Errorf("ad changed while read-only: %+v", ad)
+	}
+
+	if code := do(http.MethodPut, "/api/read-only", `{"read_only":false}`); code != http.StatusOK {
+		t.Fatalf("switching off: status %d", code)
+	}
+	if code := do(http.MethodPost, "/api/ad/add", adBody); code != http.StatusCreated {
+		t.Errorf("add after read-only: status %d, want 201", code)
+	}
+}
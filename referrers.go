@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// referrerHost reduces a Referer header (or a bare domain) to its lowercase
+// host name, or "" when there isn't one.
+func referrerHost(ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return ""
+	}
+	if !strings.Contains(ref, "://") {
+		ref = "http://" + ref
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// domainMatches reports whether host is domain or one of its subdomains.
+func domainMatches(host, domain string) bool {
+	domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	return domain != "" && (host == domain || strings.HasSuffix(host, "."+domain))
+}
+
+// referrerAllowed applies an ad's referrer deny and allow lists. An ad with
+// an allow list is only served when the referring host is on it.
+func referrerAllowed(a Ad, host string) bool {
+	for _, d := range a.ReferrerDeny {
+		if domainMatches(host, d) {
+			return false
+		}
+	}
+	if len(a.ReferrerAllow) == 0 {
+		return true
+	}
+	for _, d := range a.ReferrerAllow {
+		if domainMatches(host, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// directReferrer labels traffic that arrived without a Referer.
+const directReferrer = "(direct)"
+
+// ReferrerStats is one row of /api/analytics/referrers.
+type ReferrerStats struct {
+	Domain string `json:"domain"`
+	Views  int    `json:"views"`
+	Clicks int    `json:"clicks"`
+	CTR    string `json:"ctr"`
+}
+
+// handleReferrerStats breaks views and clicks down by referring domain,
+// optionally for a single ad.
+func handleReferrerStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	from, to, err := parseRange(r, 7*24*time.Hour)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	query := `
+		SELECT COALESCE(referrer, ''),
+			SUM(CASE WHEN action_type = 'view' THEN weight ELSE 0 END),
+			SUM(CASE WHEN action_type = 'click' THEN 1 ELSE 0 END)
+		FROM impressions
+		WHERE ` + inRangeSQL("viewed_at") + `
+			AND ` + trafficCondition(r)
+	args := []interface{}{from.Format(sqlTimeLayout), to.Format(sqlTimeLayout)}
+	if v := r.URL.Query().Get("ad_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "invalid ad_id")
+			return
+		}
+		query += ` AND ad_id = ?`
+		args = append(args, id)
+	}
+	query += ` GROUP BY referrer`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer rows.Close()
+
+	// Referrers are stored as full URLs, so fold them by host here.
+	byDomain := map[string]*ReferrerStats{}
+	for rows.Next() {
+		var ref string
+		var views, clicks int
+		if err := rows.Scan(&ref, &views, &clicks); err != nil {
+			continue
+		}
+		domain := referrerHost(ref)
+		if domain == "" {
+			domain = directReferrer
+		}
+		s, ok := byDomain[domain]
+		if !ok {
+			s = &ReferrerStats{Domain: domain}
+			byDomain[domain] = s
+		}
+		s.Views += views
+		s.Clicks += clicks
+	}
+
+	stats := []ReferrerStats{}
+	for _, s := range byDomain {
+		s.CTR = formatCTR(s.Clicks, s.Views)
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Views != stats[j].Views {
+			return stats[i].Views > stats[j].Views
+		}
+		return stats[i].Domain < stats[j].Domain
+	})
+
+	respondJSON(w, http.StatusOK, stats)
+}
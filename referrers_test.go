@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReferrerStoredAndReported(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "referred")
+	for _, ref := range []string{"https://blog.example.com/post/1", "https://blog.example.com/post/2", ""} {
+		req := httptest.NewRequest(http.MethodPost, "/api/impression/"+itoa(id), nil)
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		req.Header.Set("Referer", ref)
+		serve(handleImpression, req)
+	}
+	flushImpressions(t)
+
+	var stored string
+	if err := db.QueryRow(`SELECT referrer FROM impressions WHERE referrer LIKE '%post/1'`).Scan(&stored); err != nil || stored != "https://blog.example.com/post/1" {
+		t.Errorf("referrer = %q, %v", stored, err)
+	}
+
+	var stats []ReferrerStats
+	decodeBody(t, serve(handleReferrerStats, newRequest(http.MethodGet, "/api/analytics/referrers?ad_id="+itoa(id)+"&to="+time.Now().Add(time.Hour).UTC().Format(time.RFC3339), "")), http.StatusOK, &stats)
+	want := []ReferrerStats{{Domain: "blog.example.com", Views: 2, CTR: "0.00%"}, {Domain: directReferrer, Views: 1, CTR: "0.00%"}}
+	if len(stats) != 2 || stats[0] != want[0] || stats[1] != want[1] {
+		t.Errorf("referrers = %+v, want %+v", stats, want)
+	}
+}
+
+func TestReferrerTargeting(t *testing.T) {
+	newTestDB(t)
+	allowed, err := insertAd(Ad{AdType: "text", Content: "news only", RedirectURL: "https://example.com/n", Tags: []string{"ref"}, ReferrerAllow: []string{"news.example"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	denied, err := insertAd(Ad{AdType: "text", Content: "not on news", RedirectURL: "https://example.com/d", Tags: []string{"ref"}, ReferrerDeny: []string{"news.example"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		referer string
+		query   string
+		want    int64
+	}{
+		{"allow list by header", "https://www.news.example/story", "", allowed},
+		{"allow list by parameter", "", "&referrer=news.example", allowed},
+		{"deny list", "https://other.example/", "", denied},
+		{"no referrer", "", "", denied},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for range 10 {
+				req := newRequest(http.MethodGet, "/api/ad/random?track=none&tags=ref"+tc.query, "")
+				req.Header.Set("Referer", tc.referer)
+				var ad Ad
+				decodeBody(t, serve(handleRandomAd, req), http.StatusOK, &ad)
+				if ad.ID != int(tc.want) {
+					t.Fatalf("served ad %d, want %d", ad.ID, tc.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adFragment is the markup served by /api/ad/render. html/template escapes
+// ad content and URLs, so the fragment is safe to insert as-is.
+var adFragment = template.Must(template.New("ad").Parse(`<div class="taggy-ad" data-ad-id="{{.ID}}">
+<a href="{{.ClickURL}}" target="_blank" rel="noopener sponsored">
+{{- if eq .AdType "image"}}<img src="{{.ImageURL}}"{{if .Srcset}} srcset="{{.Srcset}}" sizes="100vw"{{end}} alt="{{.Content}}" style="max-width:100%;height:auto;">
+{{- else if eq .AdType "video"}}<video src="{{.VideoURL}}" muted autoplay playsinline style="max-width:100%;"></video>
+{{- else}}<p>{{.Content}}</p>
+{{- end}}</a>
+{{- if .BeaconURL}}
+<img src="{{.BeaconURL}}" width="1" height="1" alt="" style="position:absolute;width:1px;height:1px;border:0;">
+{{- end}}
+</div>
+`))
+
+// handleRenderAd selects an ad like /api/ad/random and returns it as an
+// HTML fragment with the click link and impression pixel already in place.
+// An empty 204 means nothing matched.
+func handleRenderAd(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	q, err := servingQuery(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	tracking, err := parseTracking(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	now := time.Now()
+	candidates, err := servableCandidates(q, now)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	picked, err := pickAd(q, candidates, now)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	if picked == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	ad := *picked
+	setContentLanguage(w, localize(&ad, requestLanguages(r)))
+	base := baseURL(r)
+	trackServedAd(r, base, &ad, tracking)
+	ad.ClickURL = clickURL(base, ad.ID)
+	// Uploaded creatives have server-relative paths, which would resolve
+	// against the publisher's page once the fragment is embedded.
+	ad.ImageURL = qualifyURL(base, ad.ImageURL)
+	ad.VideoURL = qualifyURL(base, ad.VideoURL)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	adFragment.Execute(w, struct {
+		Ad
+		Srcset string
+	}{ad, imageSrcset(ad.Images, base)})
+}
+
+// imageSrcset renders an image ad's renditions as a srcset value.
+func imageSrcset(images []AdImage, base string) string {
+	var parts []string
+	for _, img := range images {
+		parts = append(parts, qualifyURL(base, img.URL)+" "+strconv.Itoa(img.Width)+"w")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// qualifyURL prefixes server-relative paths with base.
+func qualifyURL(base, u string) string {
+	if strings.HasPrefix(u, "/") && !strings.HasPrefix(u, "//") {
+		return base + u
+	}
+	return u
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRenderFragment(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, `<script>alert("x")</script>`, "text")
+
+	w := serve(handleRenderAd, newRequest(http.MethodGet, "/api/ad/render?tags=text", ""))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	html := w.Body.String()
+	if strings.Contains(html, "<script>") || !strings.Contains(html, "&lt;script&gt;") {
+		t.Errorf("content isn't escaped: %s", html)
+	}
+	if !strings.Contains(html, `href="http://example.com/api/redirect/`+itoa(id)+`"`) {
+		t.Errorf("no click link: %s", html)
+	}
+	if !strings.Contains(html, `<img src="http://example.com/api/beacon/`+itoa(id)+`?view=`) {
+		t.Errorf("no impression pixel: %s", html)
+	}
+
+	image, err := insertAd(Ad{AdType: "image", ImageURL: "/static/uploads/banner.png", Content: "banner", RedirectURL: "https://example.com", Tags: []string{"image"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = serve(handleRenderAd, newRequest(http.MethodGet, "/api/ad/render?tags=image&track=none", ""))
+	html = w.Body.String()
+	if !strings.Contains(html, `src="http://example.com/static/uploads/banner.png"`) || !strings.Contains(html, `alt="banner"`) {
+		t.Errorf("image ad %d: %s", image, html)
+	}
+	if strings.Contains(html, "/api/beacon/") {
+		t.Errorf("track=none still has a pixel: %s", html)
+	}
+
+	if w := serve(handleRenderAd, newRequest(http.MethodGet, "/api/ad/render?tags=none", "")); w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Errorf("no match: status %d with %q, want an empty 204", w.Code, w.Body)
+	}
+}
+
+func TestRenderSrcset(t *testing.T) {
+	newTestDB(t)
+	w := serve(handleAddAd, newRequest(http.MethodPost, "/api/ad/add", `{"ad_type":"image","content":"sizes","redirect_url":"https://example.com","tags":["srcset"],
+		"images":[{"url":"/static/images/small.png","width":320},{"url":"https://cdn.example.com/large.png","width":1280}]}`))
+	var created Ad
+	decodeBody(t, w, http.StatusCreated, &created)
+	if ad := mustGetAd(t, created.ID); ad.ImageURL != "https://cdn.example.com/large.png" || len(ad.Images) != 2 {
+		t.Errorf("stored image_url %q with %d images, want the widest of 2", ad.ImageURL, len(ad.Images))
+	}
+
+	html := serve(handleRenderAd, newRequest(http.MethodGet, "/api/ad/render?tags=srcset&track=none", "")).Body.String()
+	if want := `srcset="http://example.com/static/images/small.png 320w, https://cdn.example.com/large.png 1280w"`; !strings.Contains(html, want) {
+		t.Errorf("fragment lacks %s: %s", want, html)
+	}
+
+	// A single image_url still renders, without a srcset.
+	if _, err := insertAd(Ad{AdType: "image", ImageURL: "https://cdn.example.com/one.png", RedirectURL: "https://example.com", Tags: []string{"single"}}); err != nil {
+		t.Fatal(err)
+	}
+	html = serve(handleRenderAd, newRequest(http.MethodGet, "/api/ad/render?tags=single&track=none", "")).Body.String()
+	if !strings.Contains(html, `src="https://cdn.example.com/one.png"`) || strings.Contains(html, "srcset") {
+		t.Errorf("single image: %s", html)
+	}
+
+	for _, body := range []string{
+		`{"ad_type":"image","redirect_url":"https://example.com"}`,
+		`{"ad_type":"image","redirect_url":"https://example.com","images":[{"url":"/a.png"}]}`,
+	} {
+		if w := serve(handleAddAd, newRequest(http.MethodPost, "/api/ad/add", body)); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, w.Code)
+		}
+	}
+}
+
+func TestEmbedScriptUsesJSONFieldNames(t *testing.T) {
+	w := serve(handleEmbedJS, newRequest(http.MethodGet, "/embed.js", ""))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/javascript" {
+		t.Fatalf("status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	script := w.Body.String()
+
+	fields := map[string]bool{}
+	typ := reflect.TypeOf(Ad{})
+	for i := range typ.NumField() {
+		name, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+		fields[name] = true
+	}
+	used := regexp.MustCompile(`\bad\.([A-Za-z_]+)`).FindAllStringSubmatch(script, -1)
+	if len(used) == 0 {
+		t.Fatal("script reads no ad fields")
+	}
+	for _, m := range used {
+		if !fields[m[1]] {
+			t.Errorf("script reads ad.%s, which the ad JSON doesn't have", m[1])
+		}
+	}
+	if !strings.Contains(script, "ad.ad_type") {
+		t.Error("script doesn't check ad.ad_type")
+	}
+}
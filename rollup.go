@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// impressionRetention is how long raw impressions are kept before being
+// rolled up into impression_daily; 0 keeps them forever.
+var impressionRetention time.Duration
+
+const rollupInterval = time.Hour
+
+// impressionCountsSQL presents raw impressions and their daily rollups as one
+// set of rows with per-row view, click and conversion counts, so analytics
+// can sum over both. Rolled-up rows are timestamped at midnight UTC.
+const impressionCountsSQL = `
+	SELECT ad_id, viewed_at, bot, internal,
+		CASE WHEN action_type = 'view' THEN weight ELSE 0 END AS views,
+		CASE WHEN action_type = 'click' THEN 1 ELSE 0 END AS clicks,
+		CASE WHEN action_type = 'conversion' THEN 1 ELSE 0 END AS conversions,
+		CASE WHEN action_type = 'conversion' THEN COALESCE(value, 0) ELSE 0 END AS conversion_value,
+		CASE WHEN action_type = 'view' AND viewable = 1 THEN weight ELSE 0 END AS viewable_views
+	FROM impressions
+	UNION ALL
+	SELECT ad_id, day || ' 00:00:00', bot, internal, views, clicks, conversions, conversion_value, viewable_views
+	FROM impression_daily`
+
+// rollupCutoff is the start of the UTC day containing now minus the
+// retention, so a day is always rolled up whole.
+func rollupCutoff(now time.Time, retention time.Duration) time.Time {
+	return now.Add(-retention).UTC().Truncate(24 * time.Hour)
+}
+
+// rollupImpressions folds raw impressions older than cutoff into per-day
+// totals and deletes them, in one transaction.
+func rollupImpressions(cutoff time.Time) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	c := cutoff.UTC().Format(sqlTimeLayout)
+	// "WHERE true" keeps SQLite from reading ON CONFLICT as part of the
+	// SELECT.
+	if _, err := tx.Exec(`
+		INSERT INTO impression_daily (ad_id, day, bot, internal, views, clicks, conversions, conversion_value, viewable_views)
+		SELECT ad_id, `+db.Day("viewed_at")+`, bot, internal,
+			SUM(CASE WHEN action_type = 'view' THEN weight ELSE 0 END),
+			SUM(CASE WHEN action_type = 'click' THEN 1 ELSE 0 END),
+			SUM(CASE WHEN action_type = 'conversion' THEN 1 ELSE 0 END),
+			SUM(CASE WHEN action_type = 'conversion' THEN COALESCE(value, 0) ELSE 0 END),
+			SUM(CASE WHEN action_type = 'view' AND viewable = 1 THEN weight ELSE 0 END)
+		FROM impressions
+		WHERE true AND `+db.Time("viewed_at")+` < `+db.Time("?")+`
+		GROUP BY ad_id, `+db.Day("viewed_at")+`, bot, internal
+		ON CONFLICT (ad_id, day, bot, internal) DO UPDATE SET
+			views = impression_daily.views + excluded.views,
+			clicks = impression_daily.clicks + excluded.clicks,
+			conversions = impression_daily.conversions + excluded.conversions,
+			conversion_value = impression_daily.conversion_value + excluded.conversion_value,
+			viewable_views = impression_daily.viewable_views + excluded.viewable_views`, c); err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(`DELETE FROM impressions WHERE `+db.Time("viewed_at")+` < `+db.Time("?"), c)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := result.RowsAffected()
+	return n, tx.Commit()
+}
+
+// watchRollups rolls up old impressions now and then every rollupInterval.
+func watchRollups(retention time.Duration) {
+	for {
+		n, err := rollupImpressions(rollupCutoff(time.Now(), retention))
+		if err != nil {
+			log.Printf("Impression rollup failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Rolled up %d impressions", n)
+		}
+		time.Sleep(rollupInterval)
+	}
+}
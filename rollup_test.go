@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRollupKeepsAnalyticsTotals(t *testing.T) {
+	newTestDB(t)
+	a, b := mustInsertAd(t, "a"), mustInsertAd(t, "b")
+	now := time.Now()
+	old := now.Add(-40 * 24 * time.Hour)
+	mustLogImpressions(t, a, "view", old, 5)
+	mustLogImpressions(t, a, "click", old.Add(time.Minute), 2)
+	mustLogImpressions(t, a, "conversion", old.Add(time.Hour), 1)
+	mustLogImpressions(t, a, "view", now.Add(-time.Hour), 3)
+	mustLogImpressions(t, b, "view", old.Add(24*time.Hour), 4)
+	mustLogImpressions(t, b, "click", now.Add(-time.Hour), 1)
+	if err := insertImpression(Impression{AdID: b, ActionType: "view", Bot: true, ViewedAt: old.UTC().Format(sqlTimeLayout)}); err != nil {
+		t.Fatal(err)
+	}
+
+	report := func() map[int]AnalyticsStats {
+		t.Helper()
+		var stats []AnalyticsStats
+		decodeBody(t, serve(handleAnalyticsStats, newRequest(http.MethodGet, "/api/analytics/stats", "")), http.StatusOK, &stats)
+		byAd := map[int]AnalyticsStats{}
+		for _, s := range stats {
+			// Unique viewers and time to click need raw rows.
+			s.UniqueViews, s.AvgTimeToClick = 0, nil
+			byAd[s.AdID] = s
+		}
+		return byAd
+	}
+	top := func() []LeaderboardEntry {
+		t.Helper()
+		var entries []LeaderboardEntry
+		decodeBody(t, serve(handleTopAds, newRequest(http.MethodGet, "/api/analytics/top?metric=views&from=2000-01-01", "")), http.StatusOK, &entries)
+		return entries
+	}
+	before, beforeTop := report(), top()
+
+	n, err := rollupImpressions(rollupCutoff(now, 30*24*time.Hour))
+	if err != nil || n != 13 {
+		t.Fatalf("rollupImpressions = %d, %v; want the 13 old rows", n, err)
+	}
+	var raw int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM impressions`).Scan(&raw); err != nil || raw != 4 {
+		t.Errorf("%d raw impressions left (%v), want the 4 recent ones", raw, err)
+	}
+
+	after, afterTop := report(), top()
+	for id, s := range before {
+		if after[id] != s {
+			t.Errorf("ad %d: stats %+v after rollup, %+v before", id, after[id], s)
+		}
+	}
+	if len(afterTop) != len(beforeTop) || afterTop[0] != beforeTop[0] || afterTop[1] != beforeTop[1] {
+		t.Errorf("leaderboard %+v after rollup, %+v before", afterTop, beforeTop)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// roundRobin implements smooth weighted round-robin (as in nginx): each
+// pick adds every candidate's weight to its running credit, serves the
+// candidate with the most credit and charges it the total weight. Over any
+// stretch of requests each ad is served close to its share, without the
+// clustering random picks show over small samples. Credits are kept per
+// tag set, in memory.
+type roundRobin struct {
+	mu      sync.Mutex
+	credits map[string]map[int]float64
+}
+
+var rotation = &roundRobin{credits: map[string]map[int]float64{}}
+
+// Next returns the index in ads of the ad to serve for the tag set key.
+// weights holds each ad's weight, in the same order.
+func (rr *roundRobin) Next(key string, ads []Ad, weights []float64) int {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	credit, ok := rr.credits[key]
+	if !ok {
+		if len(rr.credits) >= maxCachedTagSets {
+			rr.credits = map[string]map[int]float64{}
+		}
+		credit = map[int]float64{}
+		rr.credits[key] = credit
+	}
+
+	// Ads that are no longer candidates lose their credit.
+	current := make(map[int]float64, len(ads))
+	best, total := 0, 0.0
+	for i, a := range ads {
+		current[a.ID] = credit[a.ID] + weights[i]
+		total += weights[i]
+		if current[a.ID] > current[ads[best].ID] {
+			best = i
+		}
+	}
+	current[ads[best].ID] -= total
+	rr.credits[key] = current
+	return best
+}
+
+func rotationKey(q adQuery) string {
+	return strings.Join(q.Tags, ",")
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// adQuery holds the targeting parameters shared by the selection endpoints.
+type adQuery struct {
+	Tags []string
+	// TagWeights scores requested tags for relevance ranking; tags without
+	// an entry weigh 1.
+	TagWeights map[string]float64
+	// MatchAll requires every requested tag instead of any one of them.
+	MatchAll bool
+	// ExcludeTags drops ads carrying any of these tags, whatever they match.
+	ExcludeTags []string
+	// Referrer is the host of the page the ad will appear on, checked
+	// against each ad's referrer allow and deny lists.
+	Referrer string
+	// OptimizeCTR favors ads with a better recent click-through rate.
+	OptimizeCTR bool
+	// Explore is the share of requests served among barely-shown ads; see
+	// exploreRate.
+	Explore float64
+	// Strategy is how the ad is chosen among the weighted candidates:
+	// strategyRandom or strategyRoundRobin.
+	Strategy string
+	// Sticky keeps serving ClientID the same ad; see stickyStore.
+	Sticky   bool
+	ClientID string
+	// Categories, when set, limits serving to ads in these categories;
+	// ExcludeCategories never serves ads in them.
+	Categories        []string
+	ExcludeCategories []string
+	// ExcludeCampaigns and ExcludeDomains let a publisher block campaigns,
+	// or advertisers by the host of their redirect_url.
+	ExcludeCampaigns []int
+	ExcludeDomains   []string
+}
+
+// Selection strategies.
+const (
+	strategyRandom     = "random"
+	strategyRoundRobin = "round_robin"
+)
+
+// maxClientIDLength bounds the client_id kept for sticky ads.
+const maxClientIDLength = 200
+
+func parseAdQuery(r *http.Request) (adQuery, error) {
+	q := r.URL.Query()
+	aq := adQuery{Referrer: referrerHost(q.Get("referrer"))}
+
+	// Tags may carry a weight, as in tags=go:3,backend.
+	var tags []string
+	for _, t := range strings.Split(q.Get("tags"), ",") {
+		name, weight, ok := strings.Cut(t, ":")
+		tags = append(tags, name)
+		if !ok {
+			continue
+		}
+		w, err := strconv.ParseFloat(weight, 64)
+		if err != nil || !(w > 0) || math.IsInf(w, 1) {
+			return aq, fmt.Errorf("tag weights must be positive numbers")
+		}
+		if aq.TagWeights == nil {
+			aq.TagWeights = map[string]float64{}
+		}
+		aq.TagWeights[strings.TrimSpace(strings.ToLower(name))] = w
+	}
+	aq.Tags = normalizeTags(tags)
+	aq.ExcludeTags = normalizeTags(strings.Split(q.Get("exclude_tags"), ","))
+
+	switch q.Get("match") {
+	case "", "any":
+	case "all":
+		aq.MatchAll = true
+	default:
+		return aq, fmt.Errorf("match must be any or all")
+	}
+
+	var err error
+	if aq.Categories, err = parseCategories("categories", q.Get("categories")); err != nil {
+		return aq, err
+	}
+	if aq.ExcludeCategories, err = parseCategories("exclude_categories", q.Get("exclude_categories")); err != nil {
+		return aq, err
+	}
+
+	for _, v := range strings.Split(q.Get("exclude_campaigns"), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		id, err := strconv.Atoi(v)
+		if err != nil || id <= 0 {
+			return aq, fmt.Errorf("exclude_campaigns must be campaign ids")
+		}
+		aq.ExcludeCampaigns = append(aq.ExcludeCampaigns, id)
+	}
+	for _, d := range strings.Split(q.Get("exclude_domains"), ",") {
+		if d = strings.TrimSpace(d); d == "" {
+			continue
+		}
+		if strings.ContainsAny(d, "/ ") || referrerHost(d) == "" {
+			return aq, fmt.Errorf("exclude_domains: invalid domain %q", d)
+		}
+		aq.ExcludeDomains = append(aq.ExcludeDomains, d)
+	}
+
+	if v := q.Get("sticky"); v != "" {
+		sticky, err := strconv.ParseBool(v)
+		if err != nil {
+			return aq, fmt.Errorf("sticky must be true or false")
+		}
+		aq.Sticky = sticky
+	}
+	aq.ClientID = q.Get("client_id")
+	if aq.Sticky && aq.ClientID == "" {
+		return aq, fmt.Errorf("sticky requires a client_id")
+	}
+	if len(aq.ClientID) > maxClientIDLength {
+		return aq, fmt.Errorf("client_id is longer than %d characters", maxClientIDLength)
+	}
+
+	switch aq.Strategy = q.Get("strategy"); aq.Strategy {
+	case "", strategyRandom:
+	case strategyRoundRobin:
+	default:
+		return aq, fmt.Errorf("strategy must be random or round_robin")
+	}
+
+	switch q.Get("optimize") {
+	case "":
+	case "ctr":
+		aq.OptimizeCTR = true
+	default:
+		return aq, fmt.Errorf("optimize must be ctr")
+	}
+
+	aq.Explore = exploreRate
+	if v := q.Get("explore"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return aq, fmt.Errorf("explore must be a number from 0 to 1")
+		}
+		aq.Explore = rate
+	}
+	return aq, nil
+}
+
+// servingQuery parses the targeting for a request that will serve an ad.
+// Without an explicit referrer parameter, the page's Referer is used.
+func servingQuery(r *http.Request) (adQuery, error) {
+	q, err := parseAdQuery(r)
+	if err == nil && q.Referrer == "" {
+		q.Referrer = referrerHost(r.Referer())
+	}
+	return q, err
+}
+
+// candidatesFor returns the servable ads that satisfy q.
+func candidatesFor(q adQuery, now time.Time) ([]Ad, error) {
+	ads, err := candidateCache.Get(q.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []Ad
+	for _, a := range ads {
+		if isExpired(a, now) {
+			continue
+		}
+		if q.MatchAll && len(matchedTags(targetingTags(a), q.Tags)) < len(q.Tags) {
+			continue
+		}
+		if !referrerAllowed(a, q.Referrer) {
+			continue
+		}
+		if publisherExcludes(a, q) {
+			continue
+		}
+		candidates = append(candidates, a)
+	}
+	return withinDailyCaps(candidates, now)
+}
+
+// withinDailyCaps drops ads that have reached their daily_cap of views
+// since local midnight, not counting bot or internal traffic. Counts come
+// from the impressions table, so they lag by up to one impression flush
+// interval.
+func withinDailyCaps(ads []Ad, now time.Time) ([]Ad, error) {
+	var ids []interface{}
+	for _, a := range ads {
+		if a.DailyCap > 0 {
+			ids = append(ids, a.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return ads, nil
+	}
+
+	y, m, d := now.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	args := append([]interface{}{midnight.UTC().Format(sqlTimeLayout), now.UTC().Format(sqlTimeLayout)}, ids...)
+	rows, err := db.Query(`SELECT ad_id, SUM(weight) FROM impressions
+		WHERE action_type = 'view' AND bot = 0 AND internal = 0
+			AND `+db.Time("viewed_at")+` >= `+db.Time("?")+` AND `+db.Time("viewed_at")+` <= `+db.Time("?")+`
+			AND ad_id IN (`+placeholders(len(ids))+`)
+		GROUP BY ad_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	views := map[int]int{}
+	for rows.Next() {
+		var id, n int
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		views[id] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var kept []Ad
+	for _, a := range ads {
+		if a.DailyCap > 0 && views[a.ID] >= a.DailyCap {
+			notifyCapReached(a, views[a.ID], midnight.Format("2006-01-02"))
+			continue
+		}
+		kept = append(kept, a)
+	}
+	return kept, nil
+}
+
+// servableCandidates is candidatesFor with the house ad substituted when
+// nothing matches.
+func servableCandidates(q adQuery, now time.Time) ([]Ad, error) {
+	candidates, err := candidatesFor(q, now)
+	if err != nil || len(candidates) > 0 {
+		return candidates, err
+	}
+	fallback, err := fallbackAd(now)
+	if err != nil || fallback == nil {
+		return nil, err
+	}
+	if publisherExcludes(*fallback, q) {
+		return nil, nil
+	}
+	return []Ad{*fallback}, nil
+}
+
+// publisherExcludes reports whether the requesting publisher ruled the ad
+// out by tag, category, campaign or landing page domain. These apply to the
+// house ad too.
+func publisherExcludes(a Ad, q adQuery) bool {
+	if len(matchedTags(targetingTags(a), q.ExcludeTags)) > 0 || !categoryAllowed(a, q) {
+		return true
+	}
+	for _, id := range q.ExcludeCampaigns {
+		if a.CampaignID == id {
+			return true
+		}
+	}
+	if len(q.ExcludeDomains) == 0 {
+		return false
+	}
+	host := referrerHost(a.RedirectURL)
+	for _, d := range q.ExcludeDomains {
+		if domainMatches(host, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// pickRandom returns a uniformly chosen ad, or nil for an empty slice.
+func pickRandom(ads []Ad) *Ad {
+	if len(ads) == 0 {
+		return nil
+	}
+	return &ads[selectionRand.IntN(len(ads))]
+}
+
+// selectionRand drives every random choice in ad selection. It is seeded
+// randomly unless ADSERVER_SELECTION_SEED fixes the seed, which makes the
+// picks for a given sequence of requests reproducible in tests.
+var selectionRand = newLockedRand(rand.Uint64())
+
+// lockedRand is a seeded generator safe for concurrent use.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newLockedRand(seed uint64) *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewPCG(seed, seed))}
+}
+
+func (l *lockedRand) IntN(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.IntN(n)
+}
+
+func (l *lockedRand) Float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float64()
+}
+
+// topPriority returns the ads in the highest priority tier present, so
+// lower tiers only fill when nothing above them matched. Within a tier, ads
+// from higher-priority campaigns win.
+func topPriority(ads []Ad) []Ad {
+	var tier []Ad
+	for _, a := range ads {
+		if len(tier) > 0 {
+			switch c := comparePriority(a, tier[0]); {
+			case c < 0:
+				continue
+			case c > 0:
+				tier = tier[:0]
+			}
+		}
+		tier = append(tier, a)
+	}
+	return tier
+}
+
+func comparePriority(a, b Ad) int {
+	if c := cmp.Compare(a.Priority, b.Priority); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.CampaignPriority, b.CampaignPriority)
+}
+
+// fallbackAdID names the house ad served when targeting matches nothing;
+// 0 disables the fallback.
+var fallbackAdID int
+
+// fallbackAd returns the configured house ad, or nil when none is
+// configured or it has expired, been paused or been deleted.
+func fallbackAd(now time.Time) (*Ad, error) {
+	if fallbackAdID == 0 {
+		return nil, nil
+	}
+	a, err := scanAd(db.QueryRow(`SELECT `+adColumns+` FROM ads WHERE id = ?`, fallbackAdID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if isExpired(a, now) || a.Paused {
+		return nil, nil
+	}
+	return &a, nil
+}
+
+// targetingTags returns the tags an ad is matched on: its own tags merged
+// with its campaign's defaults, or the campaign's alone when the campaign's
+// tag_mode is override.
+func targetingTags(a Ad) []string {
+	if a.CampaignID == 0 {
+		return a.Tags
+	}
+	if a.CampaignTagMode == tagModeOverride {
+		return a.CampaignTags
+	}
+	if len(a.CampaignTags) == 0 {
+		return a.Tags
+	}
+	return append(append([]string{}, a.Tags...), a.CampaignTags...)
+}
+
+// matchedTags returns the wanted (normalized) tags that the ad carries.
+func matchedTags(adTags, wanted []string) []string {
+	have := map[string]bool{}
+	for _, t := range normalizeTags(adTags) {
+		have[t] = true
+	}
+
+	var matched []string
+	for _, t := range wanted {
+		if have[t] {
+			matched = append(matched, t)
+		}
+	}
+	return matched
+}
+
+// relevance scores how well an ad fits the requested tags: the summed
+// weights of the tags it matches. Without requested tags every ad scores 1.
+func relevance(a Ad, q adQuery) float64 {
+	if len(q.Tags) == 0 {
+		return 1
+	}
+	score := 0.0
+	for _, t := range matchedTags(targetingTags(a), q.Tags) {
+		if w, ok := q.TagWeights[t]; ok {
+			score += w
+		} else {
+			score++
+		}
+	}
+	return score
+}
+
+// PreviewCandidate is an ad /api/ad/random could serve for a query, along
+// with why it qualified and its relevance score.
+type PreviewCandidate struct {
+	Ad
+	MatchedTags []string `json:"matched_tags,omitempty"`
+	Score       float64  `json:"score"`
+	Reason      string   `json:"reason"`
+}
+
+// handlePreviewAds lists every ad that would be eligible for the given
+// targeting without picking one or logging an impression.
+func handlePreviewAds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	q, err := parseAdQuery(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ads, err := candidatesFor(q, time.Now())
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	preview := []PreviewCandidate{}
+	for _, a := range ads {
+		c := PreviewCandidate{Ad: a, MatchedTags: matchedTags(targetingTags(a), q.Tags), Score: relevance(a, q)}
+		if len(q.Tags) == 0 {
+			c.Reason = "no tags requested; all active ads are eligible"
+		} else {
+			c.Reason = "matched tags: " + strings.Join(c.MatchedTags, ", ")
+		}
+		preview = append(preview, c)
+	}
+
+	respondJSON(w, http.StatusOK, preview)
+}
+
+// SimilarAd is another ad that shares tags with the one asked about.
+type SimilarAd struct {
+	Ad
+	SharedTags []string `json:"shared_tags"`
+}
+
+// handleSimilarAds lists servable ads sharing targeting tags with ad id, most
+// shared tags first.
+func handleSimilarAds(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			respondError(w, http.StatusBadRequest, "limit must be between 1 and 100")
+			return
+		}
+		limit = n
+	}
+
+	ad, err := scanAd(db.QueryRow(`SELECT `+adColumns+` FROM ads WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "ad not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	// Both sides are compared on the tags they are served on, campaign
+	// defaults included, and only ads that could be served are listed.
+	tags := normalizeTags(targetingTags(ad))
+	similar := []SimilarAd{}
+	if len(tags) > 0 {
+		candidates, err := loadServableAds(tags)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		for _, a := range candidates {
+			if a.ID != ad.ID {
+				similar = append(similar, SimilarAd{Ad: a, SharedTags: matchedTags(targetingTags(a), tags)})
+			}
+		}
+	}
+	sort.SliceStable(similar, func(i, j int) bool {
+		return len(similar[i].SharedTags) > len(similar[j].SharedTags)
+	})
+	if len(similar) > limit {
+		similar = similar[:limit]
+	}
+
+	respondJSON(w, http.StatusOK, similar)
+}
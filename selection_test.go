@@ -0,0 +1,671 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSimilarAdsUseServableAdsAndCampaignTags(t *testing.T) {
+	newTestDB(t)
+	source := mustInsertAd(t, "source", "go", "web")
+	twoShared := mustInsertAd(t, "two", "go", "web")
+	paused, err := insertAd(Ad{AdType: "text", Content: "paused", RedirectURL: "https://example.com/p", Tags: []string{"go", "web"}, Paused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	campaign, err := insertCampaign(Campaign{Name: "web", Tags: []string{"web"}, TagMode: tagModeOverride})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Shares web through its campaign; its own go tag is overridden.
+	viaCampaign, err := insertAd(Ad{AdType: "text", Content: "campaign", RedirectURL: "https://example.com/c", Tags: []string{"go"}, CampaignID: int(campaign)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	handleSimilarAds(w, httptest.NewRequest(http.MethodGet, "/api/ad/1/similar", nil), source)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var similar []SimilarAd
+	if err := json.Unmarshal(w.Body.Bytes(), &similar); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(similar) != 2 {
+		t.Fatalf("got %d similar ads, want 2 (paused ad %d left out): %+v", len(similar), paused, similar)
+	}
+	if similar[0].ID != twoShared || len(similar[0].SharedTags) != 2 {
+		t.Errorf("first = ad %d sharing %v, want ad %d sharing go and web", similar[0].ID, similar[0].SharedTags, twoShared)
+	}
+	if similar[1].ID != int(viaCampaign) || len(similar[1].SharedTags) != 1 || similar[1].SharedTags[0] != "web" {
+		t.Errorf("second = ad %d sharing %v, want ad %d sharing web", similar[1].ID, similar[1].SharedTags, viaCampaign)
+	}
+
+	w = httptest.NewRecorder()
+	handleSimilarAds(w, httptest.NewRequest(http.MethodGet, "/api/ad/1/similar?limit=1", nil), source)
+	if err := json.Unmarshal(w.Body.Bytes(), &similar); err != nil {
+		t.Fatal(err)
+	}
+	if len(similar) != 1 || similar[0].ID != twoShared {
+		t.Errorf("limit=1 returned %+v, want only ad %d", similar, twoShared)
+	}
+	w = httptest.NewRecorder()
+	handleSimilarAds(w, httptest.NewRequest(http.MethodGet, "/api/ad/1/similar?limit=0", nil), source)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("limit=0: status %d, want 400", w.Code)
+	}
+}
+
+func TestDailyCapIgnoresBotAndInternalViews(t *testing.T) {
+	newTestDB(t)
+	id := mustInsertAd(t, "capped")
+	now := time.Now()
+	for _, imp := range []Impression{
+		{AdID: id, ActionType: "view", Bot: true},
+		{AdID: id, ActionType: "view", Internal: true},
+		{AdID: id, ActionType: "view", Internal: true},
+	} {
+		imp.ViewedAt = now.UTC().Format(sqlTimeLayout)
+		if err := insertImpression(imp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ads, err := withinDailyCaps([]Ad{{ID: id, DailyCap: 1}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ads) != 1 {
+		t.Fatal("ad capped by bot and internal views")
+	}
+}
+
+// randomAd serves /api/ad/random with query, without tracking, and returns
+// the ad picked.
+func randomAd(t *testing.T, query string) (Ad, int) {
+	t.Helper()
+	w := serve(handleRandomAd, newRequest(http.MethodGet, "/api/ad/random?track=none&"+query, ""))
+	var ad Ad
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &ad); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ad, w.Code
+}
+
+func TestHighIDMatchServedAmongManyAds(t *testing.T) {
+	newTestDB(t)
+	for i := range 150 {
+		mustInsertAd(t, "filler "+itoa(i), "common")
+	}
+	rare := mustInsertAd(t, "rare", "rare")
+
+	ad, code := randomAd(t, "tags=rare")
+	if code != http.StatusOK || ad.ID != rare {
+		t.Errorf("got ad %d (status %d), want the only match %d", ad.ID, code, rare)
+	}
+}
+
+func TestOnlyMatchingAdsServedAtRandom(t *testing.T) {
+	newTestDB(t)
+	matching := map[int]bool{}
+	for _, c := range []string{"a", "b", "c"} {
+		matching[mustInsertAd(t, "go "+c, "go")] = true
+		mustInsertAd(t, "rust "+c, "rust")
+	}
+	mustInsertAd(t, "gopher", "golang") // a prefix, not a match
+
+	seen := map[int]int{}
+	for range 300 {
+		ad, code := randomAd(t, "tags=go")
+		if code != http.StatusOK {
+			t.Fatalf("status %d", code)
+		}
+		if !matching[ad.ID] {
+			t.Fatalf("served ad %d, which isn't tagged go", ad.ID)
+		}
+		seen[ad.ID]++
+	}
+	// Each of three equal ads is picked about 100 times in 300.
+	for id := range matching {
+		if seen[id] < 50 {
+			t.Errorf("ad %d served %d times in 300, want about 100", id, seen[id])
+		}
+	}
+
+	if _, code := randomAd(t, "tags=python"); code != http.StatusNotFound {
+		t.Errorf("no match: status %d, want 404", code)
+	}
+}
+
+func TestPreviewListsEveryCandidateWithoutLogging(t *testing.T) {
+	newTestDB(t)
+	both := mustInsertAd(t, "both", "go", "web")
+	goOnly := mustInsertAd(t, "go only", "go")
+	mustInsertAd(t, "rust", "rust")
+
+	var preview []PreviewCandidate
+	decodeBody(t, serve(handlePreviewAds, newRequest(http.MethodGet, "/api/ad/preview?tags=go,web", "")), http.StatusOK, &preview)
+	if len(preview) != 2 {
+		t.Fatalf("preview has %d candidates, want 2: %+v", len(preview), preview)
+	}
+	got := map[int]PreviewCandidate{}
+	for _, c := range preview {
+		got[c.ID] = c
+	}
+	if c := got[both]; len(c.MatchedTags) != 2 || c.Reason != "matched tags: go, web" {
+		t.Errorf("ad %d matched %v because %q", both, c.MatchedTags, c.Reason)
+	}
+	if c := got[goOnly]; len(c.MatchedTags) != 1 || c.MatchedTags[0] != "go" {
+		t.Errorf("ad %d matched %v", goOnly, c.MatchedTags)
+	}
+
+	decodeBody(t, serve(handlePreviewAds, newRequest(http.MethodGet, "/api/ad/preview?tags=go,web&match=all", "")), http.StatusOK, &preview)
+	if len(preview) != 1 || preview[0].ID != both {
+		t.Errorf("match=all previewed %+v, want only ad %d", preview, both)
+	}
+
+	flushImpressions(t)
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM impressions`).Scan(&n); err != nil || n != 0 {
+		t.Errorf("preview logged %d impressions (%v), want none", n, err)
+	}
+}
+
+func TestFallbackAdServedOnNoMatch(t *testing.T) {
+	newTestDB(t)
+	mustInsertAd(t, "targeted", "go")
+	house := mustInsertAd(t, "house")
+
+	if _, code := randomAd(t, "tags=rust"); code != http.StatusNotFound {
+		t.Errorf("no fallback: status %d, want 404", code)
+	}
+
+	fallbackAdID = house
+	defer func() { fallbackAdID = 0 }()
+	if ad, code := randomAd(t, "tags=rust"); code != http.StatusOK || ad.ID != house {
+		t.Errorf("no match: got ad %d (status %d), want the house ad %d", ad.ID, code, house)
+	}
+	for range 20 {
+		if ad, _ := randomAd(t, "tags=go"); ad.ID == house {
+			t.Fatal("house ad served although a targeted ad matched")
+		}
+	}
+
+	if _, err := db.Exec(`DELETE FROM ads WHERE id = ?`, house); err != nil {
+		t.Fatal(err)
+	}
+	if _, code := randomAd(t, "tags=rust"); code != http.StatusNotFound {
+		t.Errorf("deleted fallback: status %d, want 404", code)
+	}
+}
+
+func TestDailyCapResetsAtMidnight(t *testing.T) {
+	newTestDB(t)
+	capped, err := insertAd(Ad{AdType: "text", Content: "capped", RedirectURL: "https://example.com/c", Tags: []string{"cap"}, DailyCap: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustInsertAd(t, "uncapped", "cap")
+
+	// The clock is frozen at 10:00 server time; views are logged an hour
+	// earlier.
+	now := time.Date(2026, 5, 4, 10, 0, 0, 0, time.Local)
+	served := func(now time.Time) bool {
+		t.Helper()
+		ads, err := candidatesFor(adQuery{Tags: []string{"cap"}}, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, a := range ads {
+			if a.ID == int(capped) {
+				return true
+			}
+		}
+		return false
+	}
+	for i := range 3 {
+		if !served(now) {
+			t.Fatalf("capped ad stopped after %d views, want 3", i)
+		}
+		mustLogImpressions(t, int(capped), "view", now.Add(-time.Hour), 1)
+	}
+	if served(now) {
+		t.Error("ad served after reaching its daily cap")
+	}
+	if served(now.Add(13*time.Hour + 59*time.Minute)) {
+		t.Error("ad served again before midnight")
+	}
+	if !served(now.Add(14*time.Hour + time.Minute)) {
+		t.Error("ad not served again the next day")
+	}
+}
+
+func TestHigherPriorityTierAlwaysServed(t *testing.T) {
+	newTestDB(t)
+	guaranteed, err := insertAd(Ad{AdType: "text", Content: "guaranteed", RedirectURL: "https://example.com/g", Tags: []string{"go"}, Priority: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustInsertAd(t, "remnant a", "go", "rust")
+	mustInsertAd(t, "remnant b", "go", "rust")
+
+	for range 50 {
+		if ad, code := randomAd(t, "tags=go"); code != http.StatusOK || ad.ID != int(guaranteed) {
+			t.Fatalf("got ad %d (status %d), want the guaranteed ad %d", ad.ID, code, guaranteed)
+		}
+	}
+	// The guaranteed ad doesn't match rust, so remnant fills in.
+	if ad, code := randomAd(t, "tags=rust"); code != http.StatusOK || ad.Priority != 0 {
+		t.Errorf("rust: got ad %d (status %d), want a remnant ad", ad.ID, code)
+	}
+}
+
+func TestAdMatchingMoreTagsFavored(t *testing.T) {
+	newTestDB(t)
+	both := mustInsertAd(t, "both", "go", "web")
+	goOnly := mustInsertAd(t, "go only", "go")
+
+	served := 0
+	for range 300 {
+		if ad, _ := randomAd(t, "tags=go,web"); ad.ID == both {
+			served++
+		}
+	}
+	// Scoring 2 against 1, it is picked about 200 times in 300.
+	if served < 160 {
+		t.Errorf("ad matching both tags served %d times in 300, want about 200", served)
+	}
+
+	var preview []PreviewCandidate
+	decodeBody(t, serve(handlePreviewAds, newRequest(http.MethodGet, "/api/ad/preview?tags=go:3,web", "")), http.StatusOK, &preview)
+	scores := map[int]float64{}
+	for _, c := range preview {
+		scores[c.ID] = c.Score
+	}
+	if len(scores) != 2 || scores[both] != 4 || scores[goOnly] != 3 {
+		t.Errorf("weighted scores = %v, want 4 for ad %d and 3 for ad %d", scores, both, goOnly)
+	}
+
+	if w := serve(handlePreviewAds, newRequest(http.MethodGet, "/api/ad/preview?tags=go:-1", "")); w.Code != http.StatusBadRequest {
+		t.Errorf("negative weight: status %d, want 400", w.Code)
+	}
+}
+
+func TestCampaignPriorityBreaksTies(t *testing.T) {
+	newTestDB(t)
+	low, err := insertCampaign(Campaign{Name: "low"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	high, err := insertCampaign(Campaign{Name: "high"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lowAd, err := insertAd(Ad{AdType: "text", Content: "low", RedirectURL: "https://example.com/l", Tags: []string{"go"}, CampaignID: int(low)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	highAd, err := insertAd(Ad{AdType: "text", Content: "high", RedirectURL: "https://example.com/h", Tags: []string{"go"}, CampaignID: int(high)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setPriority := func(campaign int64, body string) int {
+		return serve(handleCampaign, newRequest(http.MethodPut, "/api/campaign/"+itoa(int(campaign))+"/priority", body)).Code
+	}
+	if code := setPriority(high, `{"priority":5}`); code != http.StatusOK {
+		t.Fatalf("set priority: status %d", code)
+	}
+	for range 30 {
+		if ad, _ := randomAd(t, "tags=go"); ad.ID != int(highAd) {
+			t.Fatalf("served ad %d, want %d from the higher-priority campaign", ad.ID, highAd)
+		}
+	}
+
+	// An ad's own tier still outranks its campaign's.
+	if _, err := db.Exec(`UPDATE ads SET priority = 1 WHERE id = ?`, lowAd); err != nil {
+		t.Fatal(err)
+	}
+	candidateCache.Invalidate()
+	if ad, _ := randomAd(t, "tags=go"); ad.ID != int(lowAd) {
+		t.Errorf("served ad %d, want the higher-tier ad %d", ad.ID, lowAd)
+	}
+
+	for _, body := range []string{`{"priority":-1}`, `{}`} {
+		if code := setPriority(high, body); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, code)
+		}
+	}
+	if code := setPriority(999, `{"priority":1}`); code != http.StatusNotFound {
+		t.Errorf("missing campaign: status %d, want 404", code)
+	}
+}
+
+func TestSeededSelectionIsReproducible(t *testing.T) {
+	newTestDB(t)
+	for _, c := range []string{"a", "b", "c", "d"} {
+		mustInsertAd(t, c, "go")
+	}
+	saved := selectionRand
+	defer func() { selectionRand = saved }()
+
+	picks := func(seed uint64) []int {
+		selectionRand = newLockedRand(seed)
+		var ids []int
+		for range 20 {
+			ad, code := randomAd(t, "tags=go")
+			if code != http.StatusOK {
+				t.Fatalf("status %d", code)
+			}
+			ids = append(ids, ad.ID)
+		}
+		return ids
+	}
+	first, again, other := picks(42), picks(42), picks(7)
+	distinct := map[int]bool{}
+	for i := range first {
+		if first[i] != again[i] {
+			t.Fatalf("seed 42 picked %v, then %v", first, again)
+		}
+		distinct[first[i]] = true
+	}
+	if len(distinct) < 2 {
+		t.Errorf("seed 42 picked %v, want a mix of ads", first)
+	}
+	if slices.Equal(first, other) {
+		t.Errorf("seeds 42 and 7 both picked %v", first)
+	}
+}
+
+func TestPublisherBlocklist(t *testing.T) {
+	newTestDB(t)
+	campaign, err := insertCampaign(Campaign{Name: "blocked"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func(content, redirect string, campaignID int64) int {
+		t.Helper()
+		id, err := insertAd(Ad{AdType: "text", Content: content, RedirectURL: redirect, CampaignID: int(campaignID)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(id)
+	}
+	inCampaign := add("campaign", "https://shop.example.org/a", campaign)
+	subdomain := add("subdomain", "https://deals.rival.example/b", 0)
+	kept := add("kept", "https://example.org/c", 0)
+
+	candidates := func(query string) []int {
+		t.Helper()
+		var preview []PreviewCandidate
+		decodeBody(t, serve(handlePreviewAds, newRequest(http.MethodGet, "/api/ad/preview?"+query, "")), http.StatusOK, &preview)
+		var ids []int
+		for _, c := range preview {
+			ids = append(ids, c.ID)
+		}
+		slices.Sort(ids)
+		return ids
+	}
+	for _, tc := range []struct {
+		query string
+		want  []int
+	}{
+		{"exclude_campaigns=" + itoa(int(campaign)), []int{subdomain, kept}},
+		{"exclude_domains=rival.example", []int{inCampaign, kept}},
+		{"exclude_campaigns=" + itoa(int(campaign)) + "&exclude_domains=RIVAL.example", []int{kept}},
+		{"exclude_domains=example.com", []int{inCampaign, subdomain, kept}},
+	} {
+		if got := candidates(tc.query); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: candidates %v, want %v", tc.query, got, tc.want)
+		}
+	}
+
+	for _, query := range []string{"exclude_campaigns=abc", "exclude_domains=example.org/path"} {
+		if _, code := randomAd(t, query); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, code)
+		}
+	}
+}
+
+func TestExcludedTagsFilterMatchingAds(t *testing.T) {
+	newTestDB(t)
+	gambling := mustInsertAd(t, "casino", "sports", "gambling")
+	clean := mustInsertAd(t, "boots", "sports")
+	campaign, err := insertCampaign(Campaign{Name: "bets", Tags: []string{"gambling"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Excluded through the tag its campaign adds.
+	if _, err := insertAd(Ad{AdType: "text", Content: "odds", RedirectURL: "https://example.com/o", Tags: []string{"sports"}, CampaignID: int(campaign)}); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 30 {
+		ad, code := randomAd(t, "tags=sports,gambling&exclude_tags=Gambling")
+		if code != http.StatusOK || ad.ID != clean {
+			t.Fatalf("got ad %d (status %d), want only ad %d; ad %d carries an excluded tag", ad.ID, code, clean, gambling)
+		}
+	}
+	if _, code := randomAd(t, "tags=gambling&exclude_tags=gambling"); code != http.StatusNotFound {
+		t.Errorf("every match excluded: status %d, want 404", code)
+	}
+}
+
+func TestAdsInheritCampaignTags(t *testing.T) {
+	newTestDB(t)
+	campaign, err := insertCampaign(Campaign{Name: "spring"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := insertAd(Ad{AdType: "text", Content: "sale", RedirectURL: "https://example.com/s", Tags: []string{"shoes"}, CampaignID: int(campaign)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTags := func(body string) {
+		t.Helper()
+		decodeBody(t, serve(handleCampaign, newRequest(http.MethodPut, "/api/campaign/"+itoa(int(campaign))+"/tags", body)), http.StatusOK, nil)
+	}
+	served := func(tags string) bool {
+		t.Helper()
+		ad, code := randomAd(t, "tags="+tags)
+		return code == http.StatusOK && ad.ID == int(id)
+	}
+
+	setTags(`{"tags":["spring","sale"]}`)
+	if !served("spring") || !served("shoes") {
+		t.Error("merged: ad not matched on both its own and its campaign's tags")
+	}
+	setTags(`{"tags":["spring"],"tag_mode":"override"}`)
+	if !served("spring") || served("shoes") {
+		t.Error("override: ad still matched on its own tags")
+	}
+
+	if ad := mustGetAd(t, int(id)); len(ad.Tags) != 1 || ad.Tags[0] != "shoes" {
+		t.Errorf("stored tags = %v, want only shoes", ad.Tags)
+	}
+	if w := serve(handleCampaign, newRequest(http.MethodPut, "/api/campaign/"+itoa(int(campaign))+"/tags", `{"tags":["x"],"tag_mode":"replace"}`)); w.Code != http.StatusBadRequest {
+		t.Errorf("bad tag_mode: status %d, want 400", w.Code)
+	}
+}
+
+func TestStickyAdsUntilExpiry(t *testing.T) {
+	newTestDB(t)
+	for _, c := range []string{"a", "b", "c", "d", "e"} {
+		mustInsertAd(t, c, "go")
+	}
+	saved := stickyAds
+	stickyAds = &stickyStore{ttl: time.Minute, entries: map[string]stickyEntry{}}
+	defer func() { stickyAds = saved }()
+
+	first, code := randomAd(t, "tags=go&sticky=true&client_id=visitor-1")
+	if code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	for range 20 {
+		if ad, _ := randomAd(t, "tags=go&sticky=true&client_id=visitor-1"); ad.ID != first.ID {
+			t.Fatalf("sticky request served ad %d, then %d", first.ID, ad.ID)
+		}
+	}
+
+	// Pausing the ad ends the assignment.
+	decodeBody(t, serve(handleAd, newRequest(http.MethodPost, "/api/ad/"+itoa(first.ID)+"/pause", "")), http.StatusOK, nil)
+	next, _ := randomAd(t, "tags=go&sticky=true&client_id=visitor-1")
+	if next.ID == first.ID {
+		t.Fatal("paused sticky ad still served")
+	}
+	if ad, _ := randomAd(t, "tags=go&sticky=true&client_id=visitor-1"); ad.ID != next.ID {
+		t.Errorf("new assignment didn't stick: ad %d, then %d", next.ID, ad.ID)
+	}
+
+	ads, err := candidatesFor(adQuery{Tags: []string{"go"}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := stickyKey(adQuery{Tags: []string{"go"}, ClientID: "visitor-1"})
+	if a := stickyAds.Lookup(key, ads, time.Now().Add(59*time.Second)); a == nil || a.ID != next.ID {
+		t.Errorf("assignment gone before its TTL")
+	}
+	if a := stickyAds.Lookup(key, ads, time.Now().Add(time.Minute+time.Second)); a != nil {
+		t.Errorf("assignment to ad %d outlived its TTL", a.ID)
+	}
+
+	if _, code := randomAd(t, "tags=go&sticky=true"); code != http.StatusBadRequest {
+		t.Errorf("sticky without client_id: status %d, want 400", code)
+	}
+}
+
+func TestRoundRobinServesInProportion(t *testing.T) {
+	newTestDB(t)
+	ids := []int{mustInsertAd(t, "a", "go"), mustInsertAd(t, "b", "go"), mustInsertAd(t, "c", "go")}
+	saved := rotation
+	rotation = &roundRobin{credits: map[string]map[int]float64{}}
+	defer func() { rotation = saved }()
+
+	// Every window of three requests serves each equal ad once.
+	seen := map[int]int{}
+	for i := range 9 {
+		ad, code := randomAd(t, "tags=go&strategy=round_robin")
+		if code != http.StatusOK {
+			t.Fatalf("status %d", code)
+		}
+		seen[ad.ID]++
+		if i%3 == 2 {
+			for _, id := range ids {
+				if seen[id] != i/3+1 {
+					t.Fatalf("after %d requests served %v, want each ad %d times", i+1, seen, i/3+1)
+				}
+			}
+		}
+	}
+
+	// Weighted 1:2, the heavier ad is never served more than twice running
+	// and gets exactly its share.
+	ads := []Ad{{ID: 1}, {ID: 2}}
+	rr := &roundRobin{credits: map[string]map[int]float64{}}
+	counts, run, last := map[int]int{}, 0, 0
+	for range 30 {
+		id := ads[rr.Next("k", ads, []float64{1, 2})].ID
+		counts[id]++
+		if id == last {
+			run++
+		} else {
+			run, last = 1, id
+		}
+		if run > 2 {
+			t.Fatalf("ad %d served %d times running", id, run)
+		}
+	}
+	if counts[1] != 10 || counts[2] != 20 {
+		t.Errorf("served %v in 30, want 10 and 20", counts)
+	}
+
+	if _, code := randomAd(t, "strategy=fifo"); code != http.StatusBadRequest {
+		t.Errorf("unknown strategy: status %d, want 400", code)
+	}
+}
+
+func TestCompanionAd(t *testing.T) {
+	newTestDB(t)
+	tile := mustInsertAd(t, "tile")
+	banner, err := insertAd(Ad{AdType: "text", Content: "banner", RedirectURL: "https://example.com/b", Tags: []string{"banner"}, CompanionID: tile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ad, _ := randomAd(t, "tags=banner&companion=true")
+	if ad.ID != int(banner) || ad.Companion == nil || ad.Companion.ID != tile || ad.Companion.ClickURL == "" {
+		t.Fatalf("served %+v, want ad %d with companion %d and its click URL", ad, banner, tile)
+	}
+	if ad, _ := randomAd(t, "tags=banner"); ad.Companion != nil {
+		t.Error("companion included without companion=true")
+	}
+
+	// A companion that can't be shown leaves the ad to be served alone.
+	decodeBody(t, serve(handleAd, newRequest(http.MethodPost, "/api/ad/"+itoa(tile)+"/pause", "")), http.StatusOK, nil)
+	if ad, code := randomAd(t, "tags=banner&companion=true"); code != http.StatusOK || ad.Companion != nil {
+		t.Errorf("paused companion: status %d, companion %+v", code, ad.Companion)
+	}
+	if _, err := db.Exec(`DELETE FROM ads WHERE id = ?`, tile); err != nil {
+		t.Fatal(err)
+	}
+	if ad, code := randomAd(t, "tags=banner&companion=true"); code != http.StatusOK || ad.Companion != nil {
+		t.Errorf("deleted companion: status %d, companion %+v", code, ad.Companion)
+	}
+
+	body := `{"ad_type":"text","content":"x","redirect_url":"https://example.com","companion_id":999}`
+	if w := serve(handleAddAd, newRequest(http.MethodPost, "/api/ad/add", body)); w.Code != http.StatusBadRequest {
+		t.Errorf("missing companion: status %d, want 400", w.Code)
+	}
+	body = `{"ad_type":"text","content":"banner","redirect_url":"https://example.com/b","companion_id":` + itoa(int(banner)) + `}`
+	if w := serve(handleUpdateAd, newRequest(http.MethodPut, "/api/ad/update/"+itoa(int(banner)), body)); w.Code != http.StatusBadRequest {
+		t.Errorf("own companion: status %d, want 400", w.Code)
+	}
+}
+
+func TestRandomAdsAreDistinct(t *testing.T) {
+	newTestDB(t)
+	var want []int
+	for _, c := range []string{"a", "b", "c", "d", "e"} {
+		want = append(want, mustInsertAd(t, c, "go"))
+	}
+	mustInsertAd(t, "other", "rust")
+	randomAds := func(query string) []Ad {
+		t.Helper()
+		var ads []Ad
+		decodeBody(t, serve(handleRandomAds, newRequest(http.MethodGet, "/api/ads/random?track=none&"+query, "")), http.StatusOK, &ads)
+		return ads
+	}
+
+	for range 20 {
+		ads := randomAds("tags=go&count=3")
+		if ids := adIDs(ads); len(ids) != 3 || len(slices.Compact(slices.Sorted(slices.Values(ids)))) != 3 {
+			t.Fatalf("count=3 served %v, want 3 distinct ads", ids)
+		}
+		for _, a := range ads {
+			if a.ClickURL == "" {
+				t.Errorf("ad %d served without a click URL", a.ID)
+			}
+		}
+	}
+	ids := adIDs(randomAds("tags=go&count=8"))
+	if slices.Sort(ids); !slices.Equal(ids, want) {
+		t.Errorf("count=8 served %v, want each of %v once", ids, want)
+	}
+	if ads := randomAds("tags=none&count=2"); len(ads) != 0 {
+		t.Errorf("no matches served %d ads, want an empty list", len(ads))
+	}
+
+	for _, count := range []string{"0", "-1", itoa(maxAdsPerRequest + 1), "x"} {
+		if w := serve(handleRandomAds, newRequest(http.MethodGet, "/api/ads/random?count="+count, "")); w.Code != http.StatusBadRequest {
+			t.Errorf("count=%s: status %d, want 400", count, w.Code)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sessionCookieName holds the dashboard session id. Sessions live in memory
+// and end when the server restarts.
+const sessionCookieName = "adserver_session"
+
+// csrfCookieName exposes the session's CSRF token to the dashboard script,
+// which echoes it in csrfHeaderName on every state-changing request.
+const (
+	csrfCookieName = "adserver_csrf"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+type session struct {
+	expires time.Time
+	csrf    string
+}
+
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]session
+	ttl      time.Duration
+}
+
+var sessions = &sessionStore{sessions: map[string]session{}, ttl: defaultSessionTTL}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Create starts a session and returns its id and CSRF token.
+func (s *sessionStore) Create() (id, csrf string, err error) {
+	if id, err = randomToken(); err != nil {
+		return "", "", err
+	}
+	if csrf, err = randomToken(); err != nil {
+		return "", "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for sid, sess := range s.sessions {
+		if now.After(sess.expires) {
+			delete(s.sessions, sid)
+		}
+	}
+	s.sessions[id] = session{expires: now.Add(s.ttl), csrf: csrf}
+	return id, csrf, nil
+}
+
+// Get returns the live session with the given id.
+func (s *sessionStore) Get(id string) (session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok || time.Now().After(sess.expires) {
+		return session{}, false
+	}
+	return sess, true
+}
+
+func (s *sessionStore) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// requestSession returns the live session r's cookie refers to.
+func requestSession(r *http.Request) (session, bool) {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return session{}, false
+	}
+	return sessions.Get(c.Value)
+}
+
+func hasSession(r *http.Request) bool {
+	_, ok := requestSession(r)
+	return ok
+}
+
+// validCSRF checks the CSRF header of a cookie-authenticated request.
+// Safe methods don't need one.
+func validCSRF(r *http.Request, sess session) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	token := r.Header.Get(csrfHeaderName)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(sess.csrf)) == 1
+}
+
+// validToken compares a presented API token in constant time.
+func validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) == 1
+}
+
+// startSession creates a session and sets its cookies on w.
+func startSession(w http.ResponseWriter) error {
+	id, csrf, err := sessions.Create()
+	if err != nil {
+		return err
+	}
+	setSessionCookies(w, id, csrf, int(sessions.ttl.Seconds()))
+	return nil
+}
+
+// setSessionCookies writes the session and CSRF cookies; a negative maxAge
+// clears them.
+func setSessionCookies(w http.ResponseWriter, id, csrf string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	// Readable by script on purpose: the page proves it is same-origin by
+	// copying this into the request header.
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    csrf,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// handleLogin exchanges the API token for a session cookie, so the
+// dashboard never has to keep the token in script-visible storage.
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	var creds struct {
+		Token string `json:"token"`
+	}
+	if !decodeJSONBody(w, r, &creds, maxJSONBody) {
+		return
+	}
+	if !validToken(creds.Token) {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	if err := startSession(w); err != nil {
+		respondError(w, http.StatusInternalServerError, "session error")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": "logged in"})
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		sessions.Delete(c.Value)
+	}
+	setSessionCookies(w, "", "", -1)
+	respondJSON(w, http.StatusOK, map[string]string{"status": "logged out"})
+}
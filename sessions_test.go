@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminRequiresAuth(t *testing.T) {
+	apiToken = testToken
+	admin := withAdminAuth(handleAdmin)
+
+	w := serve(admin, httptest.NewRequest(http.MethodGet, "/admin", nil))
+	if w.Code != http.StatusUnauthorized || !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic ") {
+		t.Errorf("anonymous: status %d, WWW-Authenticate %q; want a Basic challenge", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+	if strings.Contains(w.Body.String(), "Admin Dashboard") {
+		t.Error("anonymous request got the dashboard")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	req.SetBasicAuth("admin", "wrong")
+	if w := serve(admin, req); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password: status %d, want 401", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/admin", nil)
+	req.SetBasicAuth("admin", testToken)
+	w = serve(admin, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Admin Dashboard") {
+		t.Fatalf("with credentials: status %d", w.Code)
+	}
+
+	// The Basic login starts a session, so the page's cookie is enough.
+	req = httptest.NewRequest(http.MethodGet, "/admin", nil)
+	for _, c := range w.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	if w := serve(admin, req); w.Code != http.StatusOK {
+		t.Errorf("with session cookie: status %d, want 200", w.Code)
+	}
+}
+
+// login signs in with token and returns the cookies set.
+func login(t *testing.T, token string) []*http.Cookie {
+	t.Helper()
+	apiToken = testToken
+	w := serve(handleLogin, httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(`{"token":"`+token+`"}`)))
+	if w.Code != http.StatusOK {
+		return nil
+	}
+	return w.Result().Cookies()
+}
+
+// cookieRequest builds a request carrying cookies instead of a bearer token.
+func cookieRequest(method, target, body string, cookies []*http.Cookie) *http.Request {
+	var req *http.Request
+	if body != "" {
+		req = httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func TestLoginSessionCookie(t *testing.T) {
+	newTestDB(t)
+	if login(t, "wrong") != nil {
+		t.Fatal("login with a wrong token set cookies")
+	}
+
+	cookies := login(t, testToken)
+	var session *http.Cookie
+	for _, c := range cookies {
+		if c.Name == sessionCookieName {
+			session = c
+		}
+	}
+	if session == nil || !session.HttpOnly || !session.Secure || session.SameSite != http.SameSiteStrictMode {
+		t.Fatalf("session cookie = %+v, want HttpOnly, Secure and SameSite=Strict", session)
+	}
+
+	list := withAuth(handleListAds)
+	if w := serve(list, cookieRequest(http.MethodGet, "/api/ads", "", cookies)); w.Code != http.StatusOK {
+		t.Errorf("with cookie: status %d, want 200", w.Code)
+	}
+	if w := serve(list, cookieRequest(http.MethodGet, "/api/ads", "", nil)); w.Code != http.StatusUnauthorized {
+		t.Errorf("without cookie: status %d, want 401", w.Code)
+	}
+
+	w := serve(handleLogout, cookieRequest(http.MethodPost, "/api/logout", "", cookies))
+	decodeBody(t, w, http.StatusOK, nil)
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge >= 0 {
+			t.Errorf("logout left cookie %s with max age %d", c.Name, c.MaxAge)
+		}
+	}
+	if w := serve(list, cookieRequest(http.MethodGet, "/api/ads", "", cookies)); w.Code != http.StatusUnauthorized {
+		t.Errorf("after logout: status %d, want 401", w.Code)
+	}
+}
+
+func TestCSRFOnCookieWrites(t *testing.T) {
+	newTestDB(t)
+	cookies := login(t, testToken)
+	var csrf string
+	for _, c := range cookies {
+		if c.Name == csrfCookieName {
+			csrf = c.Value
+		}
+	}
+	if csrf == "" {
+		t.Fatal("login set no CSRF cookie")
+	}
+
+	add := withAuth(handleAddAd)
+	body := func(content string) string {
+		return `{"ad_type":"text","content":"` + content + `","redirect_url":"https://example.com"}`
+	}
+
+	if w := serve(add, cookieRequest(http.MethodPost, "/api/ad/add", body("no token"), cookies)); w.Code != http.StatusForbidden {
+		t.Errorf("without CSRF token: status %d, want 403", w.Code)
+	}
+	req := cookieRequest(http.MethodPost, "/api/ad/add", body("bad token"), cookies)
+	req.Header.Set(csrfHeaderName, csrf+"0")
+	if w := serve(add, req); w.Code != http.StatusForbidden {
+		t.Errorf("with a wrong CSRF token: status %d, want 403", w.Code)
+	}
+
+	req = cookieRequest(http.MethodPost, "/api/ad/add", body("with token"), cookies)
+	req.Header.Set(csrfHeaderName, csrf)
+	if w := serve(add, req); w.Code != http.StatusCreated {
+		t.Errorf("with CSRF token: status %d, want 201", w.Code)
+	}
+
+	// Bearer clients don't need one.
+	if w := serve(add, newRequest(http.MethodPost, "/api/ad/add", body("bearer"))); w.Code != http.StatusCreated {
+		t.Errorf("bearer: status %d, want 201", w.Code)
+	}
+
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM ads`).Scan(&n); err != nil || n != 2 {
+		t.Errorf("stored %d ads (%v), want 2", n, err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxStickyClients bounds the sticky assignments held in memory. Past it,
+// expired ones are pruned, and if that isn't enough all are forgotten, as
+// adCache does with tag sets.
+const maxStickyClients = 100000
+
+// stickyStore remembers which ad each client was shown for a placement, so
+// sticky requests keep serving it until the assignment expires or the ad
+// stops being a candidate. Assignments live in memory and end on restart.
+type stickyStore struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]stickyEntry
+}
+
+type stickyEntry struct {
+	adID    int
+	expires time.Time
+}
+
+var stickyAds = &stickyStore{ttl: defaultStickyTTL, entries: map[string]stickyEntry{}}
+
+// stickyKey identifies a client's placement: the same client asking with
+// different targeting gets a separate assignment.
+func stickyKey(q adQuery) string {
+	return q.ClientID + "\x00" + strings.Join(q.Tags, ",")
+}
+
+// Lookup returns the client's unexpired assigned ad if it is still among
+// ads.
+func (s *stickyStore) Lookup(key string, ads []Ad, now time.Time) *Ad {
+	s.mu.Lock()
+	e, ok := s.entries[key]
+	s.mu.Unlock()
+	if !ok || !now.Before(e.expires) {
+		return nil
+	}
+	for i := range ads {
+		if ads[i].ID == e.adID {
+			return &ads[i]
+		}
+	}
+	return nil
+}
+
+// Assign records adID as the client's ad for the next ttl.
+func (s *stickyStore) Assign(key string, adID int, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.entries) >= maxStickyClients {
+		for k, e := range s.entries {
+			if !now.Before(e.expires) {
+				delete(s.entries, k)
+			}
+		}
+		if len(s.entries) >= maxStickyClients {
+			s.entries = map[string]stickyEntry{}
+		}
+	}
+	s.entries[key] = stickyEntry{adID: adID, expires: now.Add(s.ttl)}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Repository is the database the server keeps its ads, campaigns and
+// impressions in: a SQLite file by default, or Postgres when
+// ADSERVER_DATABASE_URL is set. Queries are written once, with ?
+// placeholders (?N to reuse an argument, but not both in one query), and
+// each implementation rewrites them for its driver. Where the two dialects
+// differ, queries ask the repository for the SQL rather than spelling it
+// out.
+type Repository interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Begin() (*Tx, error)
+	Ping() error
+	Close() error
+
+	// Time is expr as a timestamp that compares chronologically. expr is a
+	// column or placeholder holding a sqlTimeLayout string.
+	Time(expr string) string
+	// Now is the current UTC time in sqlTimeLayout, for storing; wrap it in
+	// Time to compare.
+	Now() string
+	// Day is the UTC date of expr, as YYYY-MM-DD.
+	Day(expr string) string
+	// FormatTime formats expr with a Go time layout using the year, month,
+	// day, hour, minute and second fields (2006, 01, 02, 15, 04, 05).
+	FormatTime(expr, layout string) string
+	// Seconds is the whole number of seconds from one timestamp to another.
+	Seconds(from, to string) string
+	// Random is a random number, for ORDER BY.
+	Random() string
+	// Contains is a predicate for substr occurring in s.
+	Contains(s, substr string) string
+
+	// Schema rewrites a table or column definition, written for SQLite as
+	// in tableDefs and columnMigrations, for this database.
+	Schema(ddl string) string
+	// Columns lists a table's columns, in order.
+	Columns(table string) ([]string, error)
+	// SyncIDs makes sure table's next generated id is above any inserted
+	// explicitly, as imports do.
+	SyncIDs(tx *Tx, table string) error
+
+	binder
+}
+
+// binder rewrites a query and its arguments for a driver.
+type binder interface {
+	bind(query string, args []interface{}) (string, []interface{})
+}
+
+// Tx is a transaction on a Repository. It takes the same queries.
+type Tx struct {
+	*sql.Tx
+	binder
+}
+
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	query, args = tx.bind(query, args)
+	return tx.Tx.Exec(query, args...)
+}
+
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	query, args = tx.bind(query, args)
+	return tx.Tx.Query(query, args...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	query, args = tx.bind(query, args)
+	return tx.Tx.QueryRow(query, args...)
+}
+
+// sqlRepository runs queries on a database/sql pool, bound for its
+// dialect.
+type sqlRepository struct {
+	*sql.DB
+	dialect binder
+}
+
+func (r sqlRepository) Exec(query string, args ...interface{}) (sql.Result, error) {
+	query, args = r.dialect.bind(query, args)
+	return r.DB.Exec(query, args...)
+}
+
+func (r sqlRepository) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	query, args = r.dialect.bind(query, args)
+	return r.DB.Query(query, args...)
+}
+
+func (r sqlRepository) QueryRow(query string, args ...interface{}) *sql.Row {
+	query, args = r.dialect.bind(query, args)
+	return r.DB.QueryRow(query, args...)
+}
+
+func (r sqlRepository) Begin() (*Tx, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{tx, r.dialect}, nil
+}
+
+// openRepository opens the Postgres database at dsn, or the SQLite file at
+// path when dsn is empty.
+func openRepository(dsn, path string) (Repository, error) {
+	if dsn != "" {
+		return openPostgres(dsn)
+	}
+	return openSQLite(path)
+}
+
+// numberPlaceholders rewrites ? and ?N placeholders outside string literals
+// and comments as prefix followed by the argument's position, as in $1.
+func numberPlaceholders(query, prefix string) string {
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		if !quoted && strings.HasPrefix(query[i:], "--") {
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			b.WriteString(query[i : i+end])
+			i += end - 1
+			continue
+		}
+		if c == '\'' {
+			quoted = !quoted
+		}
+		if c != '?' || quoted {
+			b.WriteByte(c)
+			continue
+		}
+		j := i + 1
+		for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+			j++
+		}
+		b.WriteString(prefix)
+		if j > i+1 {
+			b.WriteString(query[i+1 : j])
+		} else {
+			n++
+			b.WriteString(strconv.Itoa(n))
+		}
+		i = j - 1
+	}
+	return b.String()
+}
+
+// goTimeFields are the Go layout fields FormatTime understands.
+var goTimeFields = []string{"2006", "01", "02", "15", "04", "05"}
+
+// translateLayout rewrites a Go time layout with fields[i] standing in for
+// goTimeFields[i], passing other text through quote.
+func translateLayout(layout string, fields []string, quote func(string) string) string {
+	var b strings.Builder
+	literal := ""
+	for layout != "" {
+		matched := false
+		for i, f := range goTimeFields {
+			if strings.HasPrefix(layout, f) {
+				if literal != "" {
+					b.WriteString(quote(literal))
+					literal = ""
+				}
+				b.WriteString(fields[i])
+				layout = layout[len(f):]
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			literal += layout[:1]
+			layout = layout[1:]
+		}
+	}
+	if literal != "" {
+		b.WriteString(quote(literal))
+	}
+	return b.String()
+}
+
+// inRangeSQL is the predicate for the timestamp column col falling between
+// two placeholders, the first inclusive and the second exclusive.
+func inRangeSQL(col string) string {
+	return db.Time(col) + " >= " + db.Time("?") + " AND " + db.Time(col) + " < " + db.Time("?")
+}
+
+// storedTime formats a timestamp read back from the database as RFC 3339.
+// The SQLite driver already does for DATETIME columns; Postgres returns the
+// sqlTimeLayout text as stored.
+func storedTime(s string) string {
+	if t, err := time.Parse(sqlTimeLayout, s); err == nil {
+		return t.Format(time.RFC3339)
+	}
+	return s
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+// postgresRepository stores everything in a Postgres database, so several
+// instances can share it. The schema mirrors SQLite's: timestamps are
+// sqlTimeLayout text in UTC and flags are 0/1 integers, so rows read back
+// the same from either.
+type postgresRepository struct {
+	sqlRepository
+	postgresDialect
+}
+
+func openPostgres(dsn string) (*postgresRepository, error) {
+	conn, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresRepository{sqlRepository{conn, postgresDialect{}}, postgresDialect{}}, nil
+}
+
+func (r *postgresRepository) Columns(table string) ([]string, error) {
+	rows, err := r.Query(`SELECT column_name FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = ?
+		ORDER BY ordinal_position`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cols []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		cols = append(cols, name)
+	}
+	return cols, rows.Err()
+}
+
+// SyncIDs moves table's identity sequence up to its largest id. Rows
+// inserted with an explicit id don't advance it, and the next generated id
+// would collide with them.
+func (r *postgresRepository) SyncIDs(tx *Tx, table string) error {
+	seq := `pg_get_serial_sequence('` + table + `', 'id')`
+	_, err := tx.Exec(`SELECT setval(` + seq + `, MAX(id)) FROM ` + table + `
+		HAVING MAX(id) > COALESCE(pg_sequence_last_value(` + seq + `::regclass), 0)`)
+	return err
+}
+
+// postgresDialect is the SQL Postgres speaks.
+type postgresDialect struct{}
+
+// bind numbers the placeholders and stores bools as the 0/1 integers the
+// schema uses, as the SQLite driver does.
+func (postgresDialect) bind(query string, args []interface{}) (string, []interface{}) {
+	bound := make([]interface{}, len(args))
+	for i, a := range args {
+		if b, ok := a.(bool); ok {
+			a = 0
+			if b {
+				a = 1
+			}
+		}
+		bound[i] = a
+	}
+	return numberPlaceholders(query, "$"), bound
+}
+
+func (postgresDialect) Time(expr string) string { return "CAST(" + expr + " AS TIMESTAMP)" }
+
+func (postgresDialect) Now() string {
+	return "to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')"
+}
+
+func (postgresDialect) Day(expr string) string {
+	return "to_char(CAST(" + expr + " AS TIMESTAMP), 'YYYY-MM-DD')"
+}
+
+func (postgresDialect) FormatTime(expr, layout string) string {
+	format := translateLayout(layout, []string{"YYYY", "MM", "DD", "HH24", "MI", "SS"}, func(s string) string {
+		return `"` + s + `"`
+	})
+	return "to_char(CAST(" + expr + " AS TIMESTAMP), '" + format + "')"
+}
+
+func (postgresDialect) Seconds(from, to string) string {
+	return "CAST(ROUND(EXTRACT(EPOCH FROM CAST(" + to + " AS TIMESTAMP) - CAST(" + from + " AS TIMESTAMP))) AS INTEGER)"
+}
+
+func (postgresDialect) Random() string { return "random()" }
+
+func (postgresDialect) Contains(s, substr string) string {
+	return "strpos(" + s + ", " + substr + ") > 0"
+}
+
+// postgresTypes maps the SQLite column types in tableDefs to Postgres
+// ones. Longer patterns come first so they win over their prefixes.
+var postgresTypes = strings.NewReplacer(
+	"INTEGER PRIMARY KEY AUTOINCREMENT", "INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY",
+	"DATETIME DEFAULT CURRENT_TIMESTAMP", "TEXT DEFAULT "+postgresDialect{}.Now(),
+	"DATETIME", "TEXT",
+	"REAL", "DOUBLE PRECISION",
+)
+
+func (postgresDialect) Schema(ddl string) string { return postgresTypes.Replace(ddl) }
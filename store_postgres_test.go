@@ -0,0 +1,33 @@
+//go:build postgres
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// The Postgres tests run with go test -tags postgres against the database
+// in ADSERVER_TEST_DATABASE_URL. Its tables are dropped and recreated.
+const testDatabaseURLEnvVar = "ADSERVER_TEST_DATABASE_URL"
+
+func TestPostgresRepository(t *testing.T) {
+	// Asking for the Postgres tests without a database is a broken setup,
+	// not a reason to pass quietly.
+	dsn := os.Getenv(testDatabaseURLEnvVar)
+	if dsn == "" {
+		t.Fatalf("%s must be set to run the postgres-tagged tests", testDatabaseURLEnvVar)
+	}
+	testRepository(t, func(t *testing.T) {
+		repo, err := openPostgres(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := len(tableDefs) - 1; i >= 0; i-- {
+			if _, err := repo.Exec(`DROP TABLE IF EXISTS ` + tableDefs[i].name + ` CASCADE`); err != nil {
+				t.Fatal(err)
+			}
+		}
+		useTestDB(t, repo)
+	})
+}
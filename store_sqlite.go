@@ -0,0 +1,89 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteRepository stores everything in a single SQLite file. Queries are
+// passed through as written.
+type sqliteRepository struct {
+	sqlRepository
+	sqliteDialect
+}
+
+func openSQLite(path string) (*sqliteRepository, error) {
+	conn, err := sql.Open("sqlite3", path+"?_fk=1")
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteRepository{sqlRepository{conn, sqliteDialect{}}, sqliteDialect{}}, nil
+}
+
+func (r *sqliteRepository) Columns(table string) ([]string, error) {
+	rows, err := r.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cols []string
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return nil, err
+		}
+		cols = append(cols, name)
+	}
+	return cols, rows.Err()
+}
+
+// SyncIDs has nothing to do: AUTOINCREMENT already continues from the
+// largest id ever inserted.
+func (r *sqliteRepository) SyncIDs(tx *Tx, table string) error {
+	return nil
+}
+
+// sqliteDialect is the SQL SQLite speaks. Timestamps are stored as
+// sqlTimeLayout text and compared through datetime(), which also accepts
+// the ISO 8601 forms older rows may hold.
+type sqliteDialect struct{}
+
+func (sqliteDialect) bind(query string, args []interface{}) (string, []interface{}) {
+	return query, args
+}
+
+func (sqliteDialect) Time(expr string) string { return "datetime(" + expr + ")" }
+
+func (sqliteDialect) Now() string { return "CURRENT_TIMESTAMP" }
+
+func (sqliteDialect) Day(expr string) string { return "date(" + expr + ")" }
+
+func (sqliteDialect) FormatTime(expr, layout string) string {
+	format := translateLayout(layout, []string{"%Y", "%m", "%d", "%H", "%M", "%S"}, func(s string) string {
+		return strings.ReplaceAll(s, "%", "%%")
+	})
+	return "strftime('" + format + "', " + expr + ")"
+}
+
+func (sqliteDialect) Seconds(from, to string) string {
+	return "CAST(ROUND((julianday(" + to + ") - julianday(" + from + ")) * 86400) AS INTEGER)"
+}
+
+func (sqliteDialect) Random() string { return "RANDOM()" }
+
+func (sqliteDialect) Contains(s, substr string) string {
+	return "instr(" + s + ", " + substr + ") > 0"
+}
+
+func (sqliteDialect) Schema(ddl string) string { return ddl }
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSQLiteRepository(t *testing.T) {
+	testRepository(t, newTestDB)
+}
+
+// testRepository runs the queries the server depends on against the
+// database fresh sets up, so every Repository behaves the same.
+func testRepository(t *testing.T, fresh func(*testing.T)) {
+	t.Run("ads", func(t *testing.T) {
+		fresh(t)
+		expires := "2030-01-02T03:04:05Z"
+		id, err := insertAd(Ad{AdType: "text", Content: "hello", RedirectURL: "https://example.com", Tags: []string{"go"}, ExpiresAt: &expires})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := insertNewAd(Ad{AdType: "text", Content: "hello", RedirectURL: "https://example.com"}); !errors.Is(err, errDuplicateAd) {
+			t.Fatalf("duplicate preload insert: got %v, want errDuplicateAd", err)
+		}
+		if _, err := insertAd(Ad{AdType: "text", Content: "hello", RedirectURL: "https://example.com"}); err != nil {
+			t.Fatalf("duplicate insert: %v", err)
+		}
+
+		ad := mustGetAd(t, int(id))
+		if ad.ExpiresAt == nil || *ad.ExpiresAt != expires {
+			t.Errorf("expires_at = %v, want %s", ad.ExpiresAt, expires)
+		}
+		if _, err := time.Parse(time.RFC3339, ad.CreatedAt); err != nil {
+			t.Errorf("created_at %q is not RFC 3339", ad.CreatedAt)
+		}
+		if ad.Version != 1 {
+			t.Errorf("version = %d, want 1", ad.Version)
+		}
+
+		ad.Content = "hello again"
+		version, err := updateAd(int(id), ad)
+		if err != nil || version != 2 {
+			t.Fatalf("updateAd = %d, %v; want 2", version, err)
+		}
+		if _, err := updateAd(int(id), ad); !errors.Is(err, errVersionConflict) {
+			t.Errorf("stale update: got %v, want errVersionConflict", err)
+		}
+		if version, err := updateAd(int(id)+100, ad); version != 0 || err != nil {
+			t.Errorf("update of missing ad = %d, %v; want 0, nil", version, err)
+		}
+	})
+
+	t.Run("tag matching", func(t *testing.T) {
+		fresh(t)
+		own := mustInsertAd(t, "own", "go")
+		mustInsertAd(t, "other", "rust")
+		campaign, err := insertCampaign(Campaign{Name: "c", Tags: []string{"go"}, TagMode: tagModeOverride})
+		if err != nil {
+			t.Fatal(err)
+		}
+		inherited, err := insertAd(Ad{AdType: "text", Content: "campaign", RedirectURL: "https://example.com/c", Tags: []string{"rust"}, CampaignID: int(campaign)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ads, err := loadServableAds([]string{"go"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ads) != 2 || ads[0].ID != own || ads[1].ID != int(inherited) {
+			t.Errorf("go matched %v, want ads %d and %d", adIDs(ads), own, inherited)
+		}
+		if ads, _ := loadServableAds([]string{"rust"}); len(ads) != 1 {
+			t.Errorf("rust matched %v, want only the ad outside the override campaign", adIDs(ads))
+		}
+		if ads, _ := loadServableAds(nil); len(ads) != 3 {
+			t.Errorf("no tags matched %d ads, want 3", len(ads))
+		}
+	})
+
+	t.Run("impressions", func(t *testing.T) {
+		fresh(t)
+		id := mustInsertAd(t, "counted")
+		day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+		at := func(d time.Duration) string { return day.Add(d).Format(sqlTimeLayout) }
+		for _, imp := range []Impression{
+			{AdID: id, ActionType: "view", IP: "1.2.3.4", UserAgent: "ua", ViewedAt: at(time.Hour)},
+			{AdID: id, ActionType: "click", IP: "1.2.3.4", UserAgent: "ua", ViewedAt: at(time.Hour + 90*time.Second)},
+			{AdID: id, ActionType: "view", ViewedAt: at(26 * time.Hour), Viewable: true},
+			{AdID: id, ActionType: "view", ViewedAt: at(26 * time.Hour), Bot: true},
+		} {
+			if err := insertImpression(imp); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var ttc int
+		if err := db.QueryRow(`SELECT time_to_click FROM impressions WHERE action_type = 'click'`).Scan(&ttc); err != nil || ttc != 90 {
+			t.Errorf("time_to_click = %d, %v; want 90", ttc, err)
+		}
+		ad := mustGetAd(t, id)
+		if ad.ViewCount != 2 || ad.ClickCount != 1 {
+			t.Errorf("counts = %d views, %d clicks; want 2, 1", ad.ViewCount, ad.ClickCount)
+		}
+
+		tr := timeseriesRange{from: day, to: day.Add(48 * time.Hour), step: 24 * time.Hour, goFormat: "2006-01-02"}
+		want := []TimeseriesBucket{{Date: "2026-03-01", Views: 1, Clicks: 1}, {Date: "2026-03-02", Views: 1}}
+		check := func(when string) {
+			t.Helper()
+			series, err := adTimeseries(id, tr, "bot = 0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(series) != len(want) || series[0] != want[0] || series[1] != want[1] {
+				t.Errorf("%s: series = %+v, want %+v", when, series, want)
+			}
+		}
+		check("raw")
+
+		n, err := rollupImpressions(day.Add(48 * time.Hour))
+		if err != nil || n != 4 {
+			t.Fatalf("rollupImpressions = %d, %v; want 4", n, err)
+		}
+		check("rolled up")
+		var viewable int
+		if err := db.QueryRow(`SELECT SUM(viewable_views) FROM impression_daily WHERE bot = 0`).Scan(&viewable); err != nil || viewable != 1 {
+			t.Errorf("viewable_views = %d, %v; want 1", viewable, err)
+		}
+		if fixes, err := reconcileCounts(); err != nil || len(fixes) != 0 {
+			t.Errorf("reconcileCounts = %v, %v; want no fixes", fixes, err)
+		}
+	})
+
+	t.Run("import keeps ids", func(t *testing.T) {
+		fresh(t)
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := upsertCampaign(tx, Campaign{ID: 7, Name: "imported"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := upsertAd(tx, Ad{ID: 40, AdType: "text", Content: "imported", RedirectURL: "https://example.com", CampaignID: 7}); err != nil {
+			t.Fatal(err)
+		}
+		for _, table := range []string{"campaigns", "ads"} {
+			if err := db.SyncIDs(tx, table); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		if id := mustInsertAd(t, "new"); id <= 40 {
+			t.Errorf("new ad got id %d, want one above the imported 40", id)
+		}
+		if ad := mustGetAd(t, 40); ad.CampaignID != 7 {
+			t.Errorf("imported ad has campaign %d, want 7", ad.CampaignID)
+		}
+	})
+}
+
+func adIDs(ads []Ad) []int {
+	ids := []int{}
+	for _, a := range ads {
+		ids = append(ids, a.ID)
+	}
+	return ids
+}
+
+func TestNumberPlaceholders(t *testing.T) {
+	for _, tc := range []struct{ query, want string }{
+		{`SELECT ? + ?`, `SELECT $1 + $2`},
+		{`WHERE a = ?2 OR b = ?1`, `WHERE a = $2 OR b = $1`},
+		{`WHERE a = '?' AND b = ?`, `WHERE a = '?' AND b = $1`},
+		{"-- don't ? here\nWHERE a = ?", "-- don't ? here\nWHERE a = $1"},
+	} {
+		if got := numberPlaceholders(tc.query, "$"); got != tc.want {
+			t.Errorf("numberPlaceholders(%q) = %q, want %q", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestFormatTime(t *testing.T) {
+	layout := "2006-01-02T15:00:00Z"
+	if got, want := (sqliteDialect{}).FormatTime("x", layout), "strftime('%Y-%m-%dT%H:00:00Z', x)"; got != want {
+		t.Errorf("sqlite: %s, want %s", got, want)
+	}
+	if got, want := (postgresDialect{}).FormatTime("x", layout), `to_char(CAST(x AS TIMESTAMP), 'YYYY"-"MM"-"DD"T"HH24":00:00Z"')`; got != want {
+		t.Errorf("postgres: %s, want %s", got, want)
+	}
+}
+
+func TestPostgresBindsBools(t *testing.T) {
+	query, args := postgresDialect{}.bind(`UPDATE ads SET paused = ? WHERE id = ?`, []interface{}{true, 3})
+	if query != `UPDATE ads SET paused = $1 WHERE id = $2` || args[0] != 1 || args[1] != 3 {
+		t.Errorf("bind = %q, %v", query, args)
+	}
+}
+
+// flakyRepository refuses pings until it has been pinged failures times,
+// like a database that is still starting.
+type flakyRepository struct {
+	Repository
+	failures, pings int
+}
+
+func (r *flakyRepository) Ping() error {
+	r.pings++
+	if r.pings <= r.failures {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestWaitForDB(t *testing.T) {
+	repo := &flakyRepository{failures: 2}
+	if err := waitForDB(repo, 10*time.Second); err != nil {
+		t.Fatalf("waitForDB: %v", err)
+	}
+	if repo.pings != 3 {
+		t.Errorf("pinged %d times, want 3", repo.pings)
+	}
+
+	repo = &flakyRepository{failures: 1000}
+	start := time.Now()
+	if err := waitForDB(repo, time.Second); err == nil {
+		t.Fatal("waitForDB succeeded against a database that never answers")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("gave up after %s, want about the 1s timeout", elapsed)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+// SVG upload policies for ADSERVER_SVG_UPLOADS. SVGs can carry scripts that
+// run when the file is opened from /static, so they are refused unless the
+// operator opts into sanitizing them.
+const (
+	svgReject   = "reject"
+	svgSanitize = "sanitize"
+)
+
+var svgUploadPolicy = svgReject
+
+// svgDropElements are removed from sanitized SVGs along with their content.
+var svgDropElements = map[string]bool{
+	"script": true, "foreignobject": true, "iframe": true, "embed": true,
+	"object": true, "style": true, "handler": true, "listener": true,
+}
+
+// isSVG reports whether data is an XML document whose root is <svg>.
+func isSVG(data []byte) bool {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := d.RawToken()
+		if err != nil {
+			return false
+		}
+		if se, ok := tok.(xml.StartElement); ok {
+			return strings.EqualFold(se.Name.Local, "svg")
+		}
+	}
+}
+
+// sanitizeSVG re-serializes an SVG without scripts, embedded documents,
+// event handler attributes, links other than in-document "#" references,
+// doctypes and processing instructions.
+func sanitizeSVG(data []byte) ([]byte, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = true
+	var buf bytes.Buffer
+	e := xml.NewEncoder(&buf)
+
+	skip := 0 // depth inside a dropped element
+	for {
+		tok, err := d.RawToken()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if skip > 0 || svgDropElements[strings.ToLower(t.Name.Local)] {
+				skip++
+				continue
+			}
+			t.Name = flatName(t.Name)
+			var attrs []xml.Attr
+			for _, a := range t.Attr {
+				if !svgAttrAllowed(a) {
+					continue
+				}
+				a.Name = flatName(a.Name)
+				attrs = append(attrs, a)
+			}
+			t.Attr = attrs
+			tok = t
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			t.Name = flatName(t.Name)
+			tok = t
+		case xml.CharData:
+			if skip > 0 {
+				continue
+			}
+		default:
+			// Comments, processing instructions and doctypes.
+			continue
+		}
+		if err := e.EncodeToken(tok); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func svgAttrAllowed(a xml.Attr) bool {
+	name := strings.ToLower(a.Name.Local)
+	if strings.HasPrefix(name, "on") {
+		return false
+	}
+	// Catches animations that set a link, e.g. <set attributeName="href" to="javascript:...">.
+	if strings.Contains(strings.ToLower(strings.Join(strings.Fields(a.Value), "")), "javascript:") {
+		return false
+	}
+	if name == "href" {
+		return strings.HasPrefix(strings.TrimSpace(a.Value), "#")
+	}
+	return true
+}
+
+// flatName keeps a raw token's namespace prefix as part of the name, so the
+// encoder writes it back unchanged instead of inventing new prefixes.
+func flatName(n xml.Name) xml.Name {
+	if n.Space == "" {
+		return n
+	}
+	return xml.Name{Local: n.Space + ":" + n.Local}
+}
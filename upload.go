@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// uploadDir holds the uploaded files, served under uploadURLPrefix.
+	uploadDir = "./static/images"
+
+	maxUploadSize int64 = defaultMaxUploadSize
+	// uploadTypes lists the accepted image types. They are checked against
+	// the sniffed content, not the type the client claims.
+	uploadTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+)
+
+// uploadExtensions fixes the stored extension for the common types, since
+// mime.ExtensionsByType returns them in no useful order (".jfif" for JPEG).
+var uploadExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+func uploadTypeAllowed(contentType string) bool {
+	for _, t := range uploadTypes {
+		if strings.EqualFold(t, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("file too large, the limit is %d bytes", maxUploadSize))
+			return
+		}
+		respondError(w, http.StatusBadRequest, "invalid multipart form")
+		return
+	}
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "no file uploaded")
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "failed to read file")
+		return
+	}
+
+	// Trust the bytes, not the client's Content-Type or file name.
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	var ext string
+	switch {
+	case isSVG(data):
+		if svgUploadPolicy != svgSanitize {
+			respondError(w, http.StatusBadRequest, "SVG uploads are not allowed")
+			return
+		}
+		if data, err = sanitizeSVG(data); err != nil {
+			respondError(w, http.StatusBadRequest, "invalid SVG: "+err.Error())
+			return
+		}
+		ext = ".svg"
+	case uploadTypeAllowed(contentType):
+		ext = uploadExtensions[contentType]
+		if ext == "" {
+			if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+				ext = exts[0]
+			}
+		}
+	default:
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("file type %s not allowed, use one of %s", contentType, strings.Join(uploadTypes, ", ")))
+		return
+	}
+
+	filename := fmt.Sprintf("%d%s", time.Now().UnixNano(), ext)
+
+	dst, err := os.Create(filepath.Join(uploadDir, filename))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to save file")
+		return
+	}
+	defer dst.Close()
+
+	if _, err := dst.Write(data); err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to save file")
+		return
+	}
+
+	if _, err := db.Exec(`INSERT INTO uploads (filename) VALUES (?)`, filename); err != nil {
+		log.Printf("Failed to record upload %s: %v", filename, err)
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"url": uploadURLPrefix + filename})
+}
+
+// uploadURLPrefix is where uploaded files are served from.
+const uploadURLPrefix = "/static/images/"
+
+// adUploadFiles returns the uploaded files an ad's images point at, as bare
+// file names. URLs elsewhere (CDNs, other static paths) are ignored.
+func adUploadFiles(a Ad) []string {
+	urls := []string{a.ImageURL}
+	for _, img := range a.Images {
+		urls = append(urls, img.URL)
+	}
+	var names []string
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil || !strings.HasPrefix(parsed.Path, uploadURLPrefix) {
+			continue
+		}
+		if name := strings.TrimPrefix(parsed.Path, uploadURLPrefix); name != "" && !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// removeOrphanedUploads deletes those of names that came from /api/upload
+// and that no ad mentions any more. Files shipped in static/images are never
+// recorded as uploads, so they are left alone. Failures are only logged:
+// a leaked file is better than a failed request.
+func removeOrphanedUploads(names []string) {
+	for _, name := range names {
+		var orphaned bool
+		err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM uploads WHERE filename = ?)
+				AND NOT EXISTS (SELECT 1 FROM ads WHERE `+db.Contains(`COALESCE(image_url, '') || COALESCE(images, '')`, "?")+`)`,
+			name, name).Scan(&orphaned)
+		if err != nil {
+			log.Printf("Orphaned upload check for %s failed: %v", name, err)
+			continue
+		}
+		if !orphaned {
+			continue
+		}
+		if err := os.Remove(filepath.Join(uploadDir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Failed to remove orphaned upload %s: %v", name, err)
+			continue
+		}
+		if _, err := db.Exec(`DELETE FROM uploads WHERE filename = ?`, name); err != nil {
+			log.Printf("Failed to forget upload %s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// pngHeader is enough of a PNG for content sniffing.
+const pngHeader = "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+
+// withUploadDir stores uploads in a temporary directory for the length of
+// the test and returns it.
+func withUploadDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	saved := uploadDir
+	uploadDir = dir
+	t.Cleanup(func() { uploadDir = saved })
+	return dir
+}
+
+// upload posts data as the image field of a multipart form, claiming
+// claimedType for it.
+func upload(t *testing.T, claimedType string, data []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", `form-data; name="image"; filename="upload"`)
+	h.Set("Content-Type", claimedType)
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	mw.Close()
+
+	req := newRequest(http.MethodPost, "/api/upload", body.String())
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return serve(handleUpload, req)
+}
+
+func TestUploadTypesAndSize(t *testing.T) {
+	newTestDB(t)
+	dir := withUploadDir(t)
+
+	var res struct {
+		URL string `json:"url"`
+	}
+	decodeBody(t, upload(t, "image/png", []byte(pngHeader+strings.Repeat("\x00", 100))), http.StatusOK, &res)
+	name := strings.TrimPrefix(res.URL, uploadURLPrefix)
+	if !strings.HasSuffix(name, ".png") {
+		t.Errorf("url = %s, want a .png under %s", res.URL, uploadURLPrefix)
+	}
+	if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+		t.Errorf("upload not stored: %v", err)
+	}
+
+	// A BMP claiming to be a PNG is judged by its bytes.
+	bmp := "BM" + strings.Repeat("\x00", 100)
+	if w := upload(t, "image/png", []byte(bmp)); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "image/bmp not allowed") {
+		t.Errorf("bmp: status %d: %s", w.Code, w.Body)
+	}
+
+	saved := maxUploadSize
+	maxUploadSize = 1024
+	defer func() { maxUploadSize = saved }()
+	if w := upload(t, "image/png", []byte(pngHeader+strings.Repeat("\x00", 2048))); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized: status %d, want 413", w.Code)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("upload dir has %d files, want only the accepted PNG", len(entries))
+	}
+}
+
+const maliciousSVG = `<?xml version="1.0"?>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" onload="alert(1)">
+<script>alert(document.cookie)</script>
+<a xlink:href="javascript:alert(2)"><rect width="10" height="10" onclick="alert(3)" fill="red"/></a>
+<foreignObject><iframe src="https://evil.example"></iframe></foreignObject>
+<use href="#shape"/>
+</svg>`
+
+func TestMaliciousSVGUpload(t *testing.T) {
+	newTestDB(t)
+	dir := withUploadDir(t)
+
+	if w := upload(t, "image/svg+xml", []byte(maliciousSVG)); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "SVG uploads are not allowed") {
+		t.Errorf("default policy: status %d: %s", w.Code, w.Body)
+	}
+	// Claiming another type doesn't get it past the sniffing.
+	if w := upload(t, "image/png", []byte(maliciousSVG)); w.Code != http.StatusBadRequest {
+		t.Errorf("SVG posing as PNG: status %d, want 400", w.Code)
+	}
+
+	svgUploadPolicy = svgSanitize
+	defer func() { svgUploadPolicy = svgReject }()
+	var res struct {
+		URL string `json:"url"`
+	}
+	decodeBody(t, upload(t, "image/svg+xml", []byte(maliciousSVG)), http.StatusOK, &res)
+	stored, err := os.ReadFile(filepath.Join(dir, strings.TrimPrefix(res.URL, uploadURLPrefix)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svg := strings.ToLower(string(stored))
+	for _, bad := range []string{"<script", "alert", "onload", "onclick", "javascript:", "foreignobject", "iframe"} {
+		if strings.Contains(svg, bad) {
+			t.Errorf("sanitized SVG still contains %q: %s", bad, stored)
+		}
+	}
+	for _, kept := range []string{"<rect", `fill="red"`, `href="#shape"`} {
+		if !strings.Contains(svg, kept) {
+			t.Errorf("sanitized SVG lost %q: %s", kept, stored)
+		}
+	}
+}
+
+func TestOrphanedUploadsRemoved(t *testing.T) {
+	newTestDB(t)
+	dir := withUploadDir(t)
+	uploaded := func() string {
+		t.Helper()
+		var res struct {
+			URL string `json:"url"`
+		}
+		decodeBody(t, upload(t, "image/png", []byte(pngHeader)), http.StatusOK, &res)
+		return res.URL
+	}
+	exists := func(u string) bool {
+		_, err := os.Stat(filepath.Join(dir, strings.TrimPrefix(u, uploadURLPrefix)))
+		return err == nil
+	}
+	imageAd := func(content, url string) int {
+		t.Helper()
+		id, err := insertAd(Ad{AdType: "image", Content: content, ImageURL: url, RedirectURL: "https://example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(id)
+	}
+	remove := func(id int) {
+		t.Helper()
+		decodeBody(t, serve(handleDeleteAd, newRequest(http.MethodDelete, "/api/ad/delete/"+itoa(id), "")), http.StatusOK, nil)
+	}
+
+	own, shared := uploaded(), uploaded()
+	solo := imageAd("solo", own)
+	first, second := imageAd("first", shared), imageAd("second", shared)
+	// Shipped with the server, never uploaded.
+	shipped := imageAd("shipped", uploadURLPrefix+"logo.png")
+	if err := os.WriteFile(filepath.Join(dir, "logo.png"), []byte(pngHeader), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	remove(solo)
+	if exists(own) {
+		t.Error("file of the deleted ad was kept")
+	}
+	remove(first)
+	if !exists(shared) {
+		t.Error("file still used by another ad was removed")
+	}
+
+	// Replacing the image orphans the old file too.
+	w := serve(handleUpdateAd, newRequest(http.MethodPut, "/api/ad/update/"+itoa(second),
+		`{"ad_type":"image","content":"second","image_url":"https://cdn.example.com/new.png","redirect_url":"https://example.com"}`))
+	decodeBody(t, w, http.StatusOK, nil)
+	if exists(shared) {
+		t.Error("file replaced by an update was kept")
+	}
+
+	remove(shipped)
+	if !exists(uploadURLPrefix + "logo.png") {
+		t.Error("a file that wasn't uploaded was removed")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uaFamily maps a User-Agent substring, lowercase, to a browser or OS
+// family.
+type uaFamily struct {
+	token, family string
+}
+
+// browserFamilies are tried in order. Browsers built on Chromium also
+// claim Chrome and Safari, and Chrome claims Safari, so the more specific
+// tokens come first.
+var browserFamilies = []uaFamily{
+	{"edg/", "Edge"}, {"edga/", "Edge"}, {"edgios/", "Edge"}, {"edge/", "Edge"},
+	{"opr/", "Opera"}, {"opera", "Opera"},
+	{"samsungbrowser/", "Samsung Internet"},
+	{"yabrowser/", "Yandex Browser"},
+	{"vivaldi/", "Vivaldi"},
+	{"ucbrowser/", "UC Browser"},
+	{"firefox/", "Firefox"}, {"fxios/", "Firefox"},
+	{"crios/", "Chrome"}, {"chrome/", "Chrome"}, {"chromium/", "Chromium"},
+	{"msie ", "Internet Explorer"}, {"trident/", "Internet Explorer"},
+	{"safari/", "Safari"},
+}
+
+// osFamilies are tried in order: Android UAs also say Linux, and iOS ones
+// "like Mac OS X".
+var osFamilies = []uaFamily{
+	{"windows phone", "Windows Phone"},
+	{"windows", "Windows"},
+	{"iphone", "iOS"}, {"ipad", "iOS"}, {"ipod", "iOS"},
+	{"android", "Android"},
+	{"cros", "Chrome OS"},
+	{"mac os x", "macOS"}, {"macintosh", "macOS"},
+	{"linux", "Linux"},
+}
+
+// otherFamily labels User-Agents no family matches, including empty ones.
+const otherFamily = "Other"
+
+func matchFamily(ua string, families []uaFamily) string {
+	for _, f := range families {
+		if strings.Contains(ua, f.token) {
+			return f.family
+		}
+	}
+	return otherFamily
+}
+
+// parseUserAgent reduces a User-Agent to its browser and OS families.
+func parseUserAgent(ua string) (browser, os string) {
+	ua = strings.ToLower(ua)
+	return matchFamily(ua, browserFamilies), matchFamily(ua, osFamilies)
+}
+
+// FamilyStats is the views and clicks of one browser or OS family.
+type FamilyStats struct {
+	Family string `json:"family"`
+	Views  int    `json:"views"`
+	Clicks int    `json:"clicks"`
+	CTR    string `json:"ctr"`
+}
+
+// UserAgentStats is the body of /api/analytics/useragents.
+type UserAgentStats struct {
+	Browsers []FamilyStats `json:"browsers"`
+	OS       []FamilyStats `json:"os"`
+}
+
+// handleUserAgentStats breaks views and clicks down by browser and by OS,
+// optionally for a single ad.
+func handleUserAgentStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	from, to, err := parseRange(r, 7*24*time.Hour)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	query := `
+		SELECT COALESCE(user_agent, ''),
+			SUM(CASE WHEN action_type = 'view' THEN weight ELSE 0 END),
+			SUM(CASE WHEN action_type = 'click' THEN 1 ELSE 0 END)
+		FROM impressions
+		WHERE ` + inRangeSQL("viewed_at") + `
+			AND ` + trafficCondition(r)
+	args := []interface{}{from.Format(sqlTimeLayout), to.Format(sqlTimeLayout)}
+	if v := r.URL.Query().Get("ad_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "invalid ad_id")
+			return
+		}
+		query += ` AND ad_id = ?`
+		args = append(args, id)
+	}
+	query += ` GROUP BY user_agent`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer rows.Close()
+
+	// Families aren't stored, so parse each distinct User-Agent and fold here.
+	byBrowser := map[string]*FamilyStats{}
+	byOS := map[string]*FamilyStats{}
+	add := func(m map[string]*FamilyStats, family string, views, clicks int) {
+		s, ok := m[family]
+		if !ok {
+			s = &FamilyStats{Family: family}
+			m[family] = s
+		}
+		s.Views += views
+		s.Clicks += clicks
+	}
+	for rows.Next() {
+		var ua string
+		var views, clicks int
+		if err := rows.Scan(&ua, &views, &clicks); err != nil {
+			continue
+		}
+		browser, os := parseUserAgent(ua)
+		add(byBrowser, browser, views, clicks)
+		add(byOS, os, views, clicks)
+	}
+
+	respondJSON(w, http.StatusOK, UserAgentStats{
+		Browsers: rankFamilies(byBrowser),
+		OS:       rankFamilies(byOS),
+	})
+}
+
+// rankFamilies lists families by views, most first.
+func rankFamilies(m map[string]*FamilyStats) []FamilyStats {
+	stats := []FamilyStats{}
+	for _, s := range m {
+		s.CTR = formatCTR(s.Clicks, s.Views)
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Views != stats[j].Views {
+			return stats[i].Views > stats[j].Views
+		}
+		return stats[i].Family < stats[j].Family
+	})
+	return stats
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+const (
+	chromeWindows = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+	edgeWindows   = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 Edg/124.0.2478.67"
+	safariIPhone  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1"
+	chromeIPhone  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/124.0.6367.88 Mobile/15E148 Safari/604.1"
+	firefoxLinux  = "Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0"
+	samsungPhone  = "Mozilla/5.0 (Linux; Android 14; SM-S918B) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/24.0 Chrome/117.0.0.0 Mobile Safari/537.36"
+	safariMac     = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15"
+	operaMac      = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 OPR/109.0.0.0"
+	chromebook    = "Mozilla/5.0 (X11; CrOS x86_64 14541.0.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+	ie11          = "Mozilla/5.0 (Windows NT 10.0; WOW64; Trident/7.0; rv:11.0) like Gecko"
+)
+
+func TestParseUserAgent(t *testing.T) {
+	for _, tc := range []struct{ ua, browser, os string }{
+		{chromeWindows, "Chrome", "Windows"},
+		{edgeWindows, "Edge", "Windows"},
+		{safariIPhone, "Safari", "iOS"},
+		{chromeIPhone, "Chrome", "iOS"},
+		{firefoxLinux, "Firefox", "Linux"},
+		{samsungPhone, "Samsung Internet", "Android"},
+		{safariMac, "Safari", "macOS"},
+		{operaMac, "Opera", "macOS"},
+		{chromebook, "Chrome", "Chrome OS"},
+		{ie11, "Internet Explorer", "Windows"},
+		{"curl/8.5.0", otherFamily, otherFamily},
+		{"", otherFamily, otherFamily},
+	} {
+		if browser, os := parseUserAgent(tc.ua); browser != tc.browser || os != tc.os {
+			t.Errorf("%q: %s on %s, want %s on %s", tc.ua, browser, os, tc.browser, tc.os)
+		}
+	}
+}
+
+func TestUserAgentStatsGroupFamilies(t *testing.T) {
+	newTestDB(t)
+	id, other := mustInsertAd(t, "ua"), mustInsertAd(t, "other")
+	at := time.Now().Add(-time.Hour).UTC().Format(sqlTimeLayout)
+	for _, imp := range []Impression{
+		{AdID: id, ActionType: "view", UserAgent: chromeWindows},
+		{AdID: id, ActionType: "view", UserAgent: chromeWindows},
+		{AdID: id, ActionType: "click", UserAgent: chromeWindows},
+		{AdID: id, ActionType: "view", UserAgent: chromeIPhone},
+		{AdID: id, ActionType: "view", UserAgent: safariIPhone},
+		{AdID: id, ActionType: "view", UserAgent: edgeWindows},
+		{AdID: other, ActionType: "view", UserAgent: firefoxLinux},
+	} {
+		imp.IP, imp.ViewedAt = "203.0.113.1", at
+		if err := insertImpression(imp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stats UserAgentStats
+	w := serve(handleUserAgentStats, newRequest(http.MethodGet, "/api/analytics/useragents?ad_id="+itoa(id), ""))
+	decodeBody(t, w, http.StatusOK, &stats)
+	wantBrowsers := []FamilyStats{
+		{Family: "Chrome", Views: 3, Clicks: 1, CTR: formatCTR(1, 3)},
+		{Family: "Edge", Views: 1, CTR: formatCTR(0, 1)},
+		{Family: "Safari", Views: 1, CTR: formatCTR(0, 1)},
+	}
+	wantOS := []FamilyStats{
+		{Family: "Windows", Views: 3, Clicks: 1, CTR: formatCTR(1, 3)},
+		{Family: "iOS", Views: 2, CTR: formatCTR(0, 2)},
+	}
+	if !slices.Equal(stats.Browsers, wantBrowsers) {
+		t.Errorf("browsers = %+v, want %+v", stats.Browsers, wantBrowsers)
+	}
+	if !slices.Equal(stats.OS, wantOS) {
+		t.Errorf("os = %+v, want %+v", stats.OS, wantOS)
+	}
+
+	stats = UserAgentStats{}
+	w = serve(handleUserAgentStats, newRequest(http.MethodGet, "/api/analytics/useragents", ""))
+	decodeBody(t, w, http.StatusOK, &stats)
+	if !slices.Contains(stats.Browsers, FamilyStats{Family: "Firefox", Views: 1, CTR: formatCTR(0, 1)}) {
+		t.Errorf("every ad: browsers = %+v, want Firefox included", stats.Browsers)
+	}
+
+	if w := serve(handleUserAgentStats, newRequest(http.MethodGet, "/api/analytics/useragents?ad_id=x", "")); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid ad_id: status %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+)
+
+// Minimal VAST 3.0 document model, covering one inline linear creative.
+type vastDocument struct {
+	XMLName xml.Name `xml:"VAST"`
+	Version string   `xml:"version,attr"`
+	Ads     []vastAd `xml:"Ad,omitempty"`
+}
+
+type vastAd struct {
+	ID     string     `xml:"id,attr"`
+	InLine vastInLine `xml:"InLine"`
+}
+
+type vastInLine struct {
+	AdSystem   string         `xml:"AdSystem"`
+	AdTitle    string         `xml:"AdTitle"`
+	Impression *vastCDATA     `xml:"Impression,omitempty"`
+	Creatives  []vastCreative `xml:"Creatives>Creative"`
+}
+
+type vastCreative struct {
+	ID     string     `xml:"id,attr"`
+	Linear vastLinear `xml:"Linear"`
+}
+
+type vastLinear struct {
+	Duration     string          `xml:"Duration"`
+	MediaFiles   []vastMediaFile `xml:"MediaFiles>MediaFile"`
+	ClickThrough vastCDATA       `xml:"VideoClicks>ClickThrough"`
+}
+
+type vastMediaFile struct {
+	Delivery string `xml:"delivery,attr"`
+	Type     string `xml:"type,attr"`
+	Width    int    `xml:"width,attr"`
+	Height   int    `xml:"height,attr"`
+	URL      string `xml:",cdata"`
+}
+
+type vastCDATA struct {
+	URL string `xml:",cdata"`
+}
+
+// Players need dimensions on MediaFile; ads don't record them, so a common
+// 16:9 size is advertised and the player scales to fit.
+const (
+	vastDefaultWidth  = 640
+	vastDefaultHeight = 360
+)
+
+// buildVAST wraps a served video ad in a VAST document whose impression and
+// click trackers are the ad's ImpressionURL and ClickURL; without an
+// ImpressionURL the document has no impression tracker. A nil ad yields the
+// empty document VAST uses to signal "no fill".
+func buildVAST(ad *Ad) vastDocument {
+	doc := vastDocument{Version: "3.0"}
+	if ad == nil {
+		return doc
+	}
+
+	id := strconv.Itoa(ad.ID)
+	mediaType := mime.TypeByExtension(path.Ext(ad.VideoURL))
+	if mediaType == "" {
+		mediaType = "video/mp4"
+	}
+
+	title := ad.Content
+	if title == "" {
+		title = "Ad " + id
+	}
+
+	var impression *vastCDATA
+	if ad.ImpressionURL != "" {
+		impression = &vastCDATA{URL: ad.ImpressionURL}
+	}
+
+	doc.Ads = []vastAd{{
+		ID: id,
+		InLine: vastInLine{
+			AdSystem:   "taggy adserver",
+			AdTitle:    title,
+			Impression: impression,
+			Creatives: []vastCreative{{
+				ID: id,
+				Linear: vastLinear{
+					Duration: formatVASTDuration(ad.VideoDuration),
+					MediaFiles: []vastMediaFile{{
+						Delivery: "progressive",
+						Type:     mediaType,
+						Width:    vastDefaultWidth,
+						Height:   vastDefaultHeight,
+						URL:      ad.VideoURL,
+					}},
+					ClickThrough: vastCDATA{URL: ad.ClickURL},
+				},
+			}},
+		},
+	}}
+	return doc
+}
+
+// formatVASTDuration renders seconds as the HH:MM:SS VAST expects.
+func formatVASTDuration(seconds int) string {
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
+
+func respondVAST(w http.ResponseWriter, doc vastDocument) {
+	body, err := xml.Marshal(doc)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "encoding error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, xml.Header)
+	w.Write(body)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"testing"
+)
+
+func TestVASTDocument(t *testing.T) {
+	newTestDB(t)
+	mustInsertAd(t, "not a video")
+	id, err := insertAd(Ad{AdType: "video", Content: "trailer", VideoURL: "https://cdn.example.com/trailer.webm", VideoDuration: 95, RedirectURL: "https://example.com/watch"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(handleRandomAd, newRequest(http.MethodGet, "/api/ad/random?format=vast", ""))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/xml; charset=utf-8" {
+		t.Fatalf("status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	var doc vastDocument
+	if err := xml.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("malformed VAST %s: %v", w.Body, err)
+	}
+	if doc.Version != "3.0" || len(doc.Ads) != 1 || doc.Ads[0].ID != itoa(int(id)) {
+		t.Fatalf("document %+v, want one ad %d in VAST 3.0", doc, id)
+	}
+	inline := doc.Ads[0].InLine
+	if inline.AdTitle != "trailer" || len(inline.Creatives) != 1 {
+		t.Fatalf("inline %+v", inline)
+	}
+	if inline.Impression == nil || inline.Impression.URL != "http://example.com/api/impression/"+itoa(int(id)) {
+		t.Errorf("impression tracker = %+v", inline.Impression)
+	}
+	linear := inline.Creatives[0].Linear
+	if linear.ClickThrough.URL != "http://example.com/api/redirect/"+itoa(int(id)) {
+		t.Errorf("click through = %q", linear.ClickThrough.URL)
+	}
+	if linear.Duration != "00:01:35" {
+		t.Errorf("duration = %q", linear.Duration)
+	}
+	if len(linear.MediaFiles) != 1 || linear.MediaFiles[0].URL != "https://cdn.example.com/trailer.webm" || linear.MediaFiles[0].Type != "video/webm" {
+		t.Errorf("media files = %+v", linear.MediaFiles)
+	}
+
+	// No matching video is an empty document, not an error.
+	w = serve(handleRandomAd, newRequest(http.MethodGet, "/api/ad/random?format=vast&tags=none", ""))
+	var empty vastDocument
+	if err := xml.Unmarshal(w.Body.Bytes(), &empty); w.Code != http.StatusOK || err != nil || len(empty.Ads) != 0 {
+		t.Errorf("no fill: status %d, %s", w.Code, w.Body)
+	}
+}
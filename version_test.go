@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	var fields map[string]string
+	decodeBody(t, serve(handleVersion, httptest.NewRequest(http.MethodGet, "/version", nil)), http.StatusOK, &fields)
+	want := map[string]string{"version": "dev", "commit": "dev", "build_time": "dev", "go_version": runtime.Version()}
+	if len(fields) != len(want) {
+		t.Errorf("fields = %v, want %v", fields, want)
+	}
+	for k, v := range want {
+		if fields[k] != v {
+			t.Errorf("%s = %q, want %q", k, fields[k], v)
+		}
+	}
+
+	version, commit = "1.2.0", "abc1234"
+	defer func() { version, commit = "dev", "dev" }()
+	var info VersionInfo
+	decodeBody(t, serve(handleVersion, httptest.NewRequest(http.MethodGet, "/version", nil)), http.StatusOK, &info)
+	if info.Version != "1.2.0" || info.Commit != "abc1234" || info.BuildTime != "dev" {
+		t.Errorf("injected build = %+v", info)
+	}
+}
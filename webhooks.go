@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Webhook event names.
+const (
+	eventAdCreated    = "ad.created"
+	eventAdExpired    = "ad.expired"
+	eventAdCapReached = "ad.cap_reached"
+)
+
+// webhookSignatureHeader carries "sha256=<hex HMAC of the body>" keyed with
+// the configured secret, so receivers can verify the sender.
+const webhookSignatureHeader = "X-Adserver-Signature"
+
+type webhookEvent struct {
+	Event      string      `json:"event"`
+	OccurredAt string      `json:"occurred_at"`
+	Data       interface{} `json:"data"`
+}
+
+// webhookNotifier POSTs events to a single URL from a background goroutine,
+// retrying failed deliveries with exponential backoff.
+type webhookNotifier struct {
+	url         string
+	secret      string
+	client      *http.Client
+	queue       chan webhookEvent
+	maxAttempts int
+	backoff     time.Duration
+}
+
+// webhooks is nil when no webhook URL is configured.
+var webhooks *webhookNotifier
+
+func newWebhookNotifier(url, secret string) *webhookNotifier {
+	return &webhookNotifier{
+		url:         url,
+		secret:      secret,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan webhookEvent, 256),
+		maxAttempts: 5,
+		backoff:     time.Second,
+	}
+}
+
+func (n *webhookNotifier) Start() {
+	go func() {
+		for ev := range n.queue {
+			n.deliver(ev)
+		}
+	}()
+}
+
+// Notify queues an event for delivery. It never blocks the caller and is a
+// no-op when webhooks are disabled.
+func (n *webhookNotifier) Notify(event string, data interface{}) {
+	if n == nil {
+		return
+	}
+	ev := webhookEvent{Event: event, OccurredAt: time.Now().UTC().Format(time.RFC3339), Data: data}
+	select {
+	case n.queue <- ev:
+	default:
+		log.Printf("Webhook queue full, dropping %s event", event)
+	}
+}
+
+func (n *webhookNotifier) deliver(ev webhookEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("Webhook encode failed for %s: %v", ev.Event, err)
+		return
+	}
+
+	delay := n.backoff
+	for attempt := 1; attempt <= n.maxAttempts; attempt++ {
+		err = n.post(ev.Event, body)
+		if err == nil {
+			return
+		}
+		if attempt < n.maxAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	log.Printf("Webhook delivery of %s failed after %d attempts: %v", ev.Event, n.maxAttempts, err)
+}
+
+func (n *webhookNotifier) post(event string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Adserver-Event", event)
+	req.Header.Set(webhookSignatureHeader, signPayload(n.secret, body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyAdCreated emits ad.created for a newly stored ad, read back so the
+// payload carries its defaults and timestamps.
+func notifyAdCreated(id int64) {
+	if webhooks == nil {
+		return
+	}
+	ad, err := scanAd(db.QueryRow(`SELECT `+adColumns+` FROM ads WHERE id = ?`, id))
+	if err != nil {
+		log.Printf("Webhook: loading ad %d failed: %v", id, err)
+		return
+	}
+	webhooks.Notify(eventAdCreated, ad)
+}
+
+// CapReached is the data of an ad.cap_reached event: an ad has been viewed
+// DailyCap times on Day (server time) and stops serving until the next day.
+// CampaignID is the campaign the ad belongs to, if any; caps are per ad.
+type CapReached struct {
+	AdID       int    `json:"ad_id"`
+	CampaignID int    `json:"campaign_id,omitempty"`
+	DailyCap   int    `json:"daily_cap"`
+	Views      int    `json:"views"`
+	Day        string `json:"day"`
+}
+
+// capAlerts remembers the ads whose cap has been reported today, so
+// ad.cap_reached fires once per ad per day.
+type capAlerts struct {
+	mu   sync.Mutex
+	day  string
+	sent map[int]bool
+}
+
+var reachedCaps = &capAlerts{}
+
+// First reports whether adID's cap hasn't been reported yet on day.
+func (c *capAlerts) First(adID int, day string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.day != day {
+		c.day, c.sent = day, map[int]bool{}
+	}
+	if c.sent[adID] {
+		return false
+	}
+	c.sent[adID] = true
+	return true
+}
+
+// notifyCapReached emits ad.cap_reached the first time ad is found
+// at its daily cap on day.
+func notifyCapReached(ad Ad, views int, day string) {
+	if webhooks == nil || !reachedCaps.First(ad.ID, day) {
+		return
+	}
+	webhooks.Notify(eventAdCapReached, CapReached{
+		AdID: ad.ID, CampaignID: ad.CampaignID, DailyCap: ad.DailyCap, Views: views, Day: day,
+	})
+}
+
+// watchExpiredAds emits ad.expired for every ad whose expires_at passes
+// while the server is running.
+func watchExpiredAds(interval time.Duration) {
+	since := time.Now().UTC()
+	for range time.Tick(interval) {
+		now := time.Now().UTC()
+		rows, err := db.Query(`SELECT `+adColumns+` FROM ads
+		          WHERE `+db.Time("expires_at")+` > `+db.Time("?")+` AND `+db.Time("expires_at")+` <= `+db.Time("?"),
+			since.Format(sqlTimeLayout), now.Format(sqlTimeLayout))
+		if err != nil {
+			log.Printf("Expiry check failed: %v", err)
+			continue
+		}
+		for rows.Next() {
+			if a, err := scanAd(rows); err == nil {
+				webhooks.Notify(eventAdExpired, a)
+			}
+		}
+		rows.Close()
+		since = now
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookAdCreated(t *testing.T) {
+	newTestDB(t)
+	type delivery struct {
+		header http.Header
+		body   []byte
+	}
+	got := make(chan delivery, 4)
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		// Fail the first attempt to exercise the retry.
+		if attempts++; attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		got <- delivery{r.Header, body}
+	}))
+	defer srv.Close()
+
+	n := newWebhookNotifier(srv.URL, "shh")
+	n.backoff = time.Millisecond
+	n.Start()
+	webhooks = n
+	defer func() { webhooks = nil }()
+
+	w := serve(handleAddAd, newRequest(http.MethodPost, "/api/ad/add",
+		`{"ad_type":"text","content":"hooked","redirect_url":"https://example.com","tags":["go"]}`))
+	var created Ad
+	decodeBody(t, w, http.StatusCreated, &created)
+
+	var d delivery
+	select {
+	case d = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook delivered")
+	}
+	if sig := d.header.Get(webhookSignatureHeader); sig != signPayload("shh", d.body) {
+		t.Errorf("signature %q doesn't match the body", sig)
+	}
+	if d.header.Get("X-Adserver-Event") != eventAdCreated {
+		t.Errorf("X-Adserver-Event = %q", d.header.Get("X-Adserver-Event"))
+	}
+
+	var ev struct {
+		Event      string `json:"event"`
+		OccurredAt string `json:"occurred_at"`
+		Data       Ad     `json:"data"`
+	}
+	if err := json.Unmarshal(d.body, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Event != eventAdCreated {
+		t.Errorf("event = %q", ev.Event)
+	}
+	if _, err := time.Parse(time.RFC3339, ev.OccurredAt); err != nil {
+		t.Errorf("occurred_at %q: %v", ev.OccurredAt, err)
+	}
+	if ev.Data.ID != created.ID || ev.Data.Content != "hooked" || ev.Data.CreatedAt == "" {
+		t.Errorf("data = %+v, want the stored ad %d", ev.Data, created.ID)
+	}
+}
+
+func TestWebhookAdCapReachedOncePerDay(t *testing.T) {
+	newTestDB(t)
+	got := make(chan []byte, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- body
+	}))
+	defer srv.Close()
+	n := newWebhookNotifier(srv.URL, "shh")
+	n.Start()
+	webhooks, reachedCaps = n, &capAlerts{}
+	defer func() { webhooks = nil }()
+
+	campaign, err := insertCampaign(Campaign{Name: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	capped, err := insertAd(Ad{AdType: "text", Content: "capped", RedirectURL: "https://example.com/c", DailyCap: 2, CampaignID: int(campaign)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 5, 4, 10, 0, 0, 0, time.Local)
+	mustLogImpressions(t, int(capped), "view", now.Add(-time.Hour), 2)
+
+	ad := mustGetAd(t, int(capped))
+	for range 2 {
+		if ads, err := withinDailyCaps([]Ad{ad}, now); err != nil || len(ads) != 0 {
+			t.Fatalf("withinDailyCaps = %v, %v; want the ad capped", ads, err)
+		}
+	}
+
+	var ev struct {
+		Event string     `json:"event"`
+		Data  CapReached `json:"data"`
+	}
+	select {
+	case body := <-got:
+		if err := json.Unmarshal(body, &ev); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook delivered")
+	}
+	want := CapReached{AdID: int(capped), CampaignID: int(campaign), DailyCap: 2, Views: 2, Day: "2026-05-04"}
+	if ev.Event != eventAdCapReached || ev.Data != want {
+		t.Errorf("got %s %+v, want %s %+v", ev.Event, ev.Data, eventAdCapReached, want)
+	}
+	select {
+	case body := <-got:
+		t.Errorf("second delivery for the same day: %s", body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}